@@ -4,18 +4,58 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"io"
+	"regexp"
 	"time"
 
 	"github.com/deis/k8s-claimer/k8s"
+	"github.com/deis/k8s-claimer/selection"
+	"github.com/deis/k8s-claimer/semver"
+	"k8s.io/client-go/pkg/labels"
+)
+
+const (
+	// VersionSourceNode indicates that cluster_version is matched against the version of a
+	// cluster's nodes. This is the default
+	VersionSourceNode = "node"
+	// VersionSourceMaster indicates that cluster_version is matched against the version of a
+	// cluster's master
+	VersionSourceMaster = "master"
 )
 
 // CreateLeaseReq is the encoding/json compatible struct that represents the POST /lease
-// request body
+// request body. If ExecCredential is set, the kubeconfig of the lease fetches its credentials
+// with the CLI each time they're needed, instead of carrying them. If Proxy is set, the kubeconfig
+// talks to the leased cluster through the API proxy of the server. ClusterRegexes are never
+// decoded. The server sets them, such as from its policy, and leased clusters' names must match them
+// as well as ClusterRegex
 type CreateLeaseReq struct {
-	MaxTimeSec     int    `json:"max_time"`
-	ClusterRegex   string `json:"cluster_regex"`
-	ClusterVersion string `json:"cluster_version"`
-	CloudProvider  string `json:"cloud_provider"`
+	MaxTimeSec           int                `json:"max_time"`
+	ClusterRegex         string             `json:"cluster_regex"`
+	ClusterVersion       string             `json:"cluster_version"`
+	ClusterVersionSource string             `json:"cluster_version_source"`
+	ClusterSelector      string             `json:"cluster_selector"`
+	SelectionStrategy    string             `json:"selection_strategy"`
+	Holder               string             `json:"holder"`
+	PreferredCluster     string             `json:"preferred_cluster"`
+	AffinityKey          string             `json:"affinity_key"`
+	AvoidClusters        []string           `json:"avoid_clusters"`
+	CloudProvider        string             `json:"cloud_provider"`
+	ExecCredential       *ExecCredentialReq `json:"exec_credential,omitempty"`
+	Proxy                *ProxyReq          `json:"proxy,omitempty"`
+	ClusterRegexes       []string           `json:"-"`
+}
+
+// ClusterNameRegexps are regular expressions that a cluster name must all match
+type ClusterNameRegexps []*regexp.Regexp
+
+// MatchString returns true if name matches all of r
+func (r ClusterNameRegexps) MatchString(name string) bool {
+	for _, regex := range r {
+		if !regex.MatchString(name) {
+			return false
+		}
+	}
+	return true
 }
 
 // MaxTimeDur returns the maximum time specified in c as a time.Duration
@@ -28,13 +68,81 @@ func (c CreateLeaseReq) ExpirationTime(start time.Time) time.Time {
 	return start.Add(c.MaxTimeDur())
 }
 
+// ClusterNameRegexps compiles c.ClusterRegex and c.ClusterRegexes, which the names of the clusters
+// leased for c must all match
+func (c CreateLeaseReq) ClusterNameRegexps() (ClusterNameRegexps, error) {
+	ret := make(ClusterNameRegexps, 0, len(c.ClusterRegexes)+1)
+	for _, str := range append([]string{c.ClusterRegex}, c.ClusterRegexes...) {
+		regex, err := regexp.Compile(str)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, regex)
+	}
+	return ret, nil
+}
+
+// VersionConstraint parses c.ClusterVersion as a semver constraint. Returns nil and no error if
+// no version was requested
+func (c CreateLeaseReq) VersionConstraint() (*semver.Constraint, error) {
+	if c.ClusterVersion == "" {
+		return nil, nil
+	}
+	return semver.ParseConstraint(c.ClusterVersion)
+}
+
+// VersionSource returns c.ClusterVersionSource, or VersionSourceNode if it's empty
+func (c CreateLeaseReq) VersionSource() string {
+	if c.ClusterVersionSource == "" {
+		return VersionSourceNode
+	}
+	return c.ClusterVersionSource
+}
+
+// LabelSelector parses c.ClusterSelector as a Kubernetes label selector (i.e.
+// gpu=false,region in (us-west,us-east)). Returns a selector that matches everything if no
+// selector was requested
+func (c CreateLeaseReq) LabelSelector() (labels.Selector, error) {
+	if c.ClusterSelector == "" {
+		return labels.Everything(), nil
+	}
+	return labels.Parse(c.ClusterSelector)
+}
+
+// StrategyName returns c.SelectionStrategy, or selection.Random if it's empty
+func (c CreateLeaseReq) StrategyName() string {
+	if c.SelectionStrategy == "" {
+		return selection.Random
+	}
+	return c.SelectionStrategy
+}
+
+// Strategy returns the selection strategy named by c.StrategyName(). Returns nil and
+// selection.ErrUnknownStrategy if there is no such strategy
+func (c CreateLeaseReq) Strategy() (selection.Strategy, error) {
+	return selection.ByName(c.StrategyName())
+}
+
+// Hints returns the soft cluster preferences in c
+func (c CreateLeaseReq) Hints() selection.Hints {
+	return selection.Hints{
+		PreferredCluster: c.PreferredCluster,
+		AffinityKey:      c.AffinityKey,
+		Avoid:            c.AvoidClusters,
+	}
+}
+
 // CreateLeaseResp is the encoding/json compatible struct that represents the POST /lease
-// response body
+// response body. ClusterName is the cluster's name within its provider, and ClusterID is
+// qualified by the provider, so it's unique across all of them. Token is the public ID of the
+// lease, and Secret is what the lease is released with. The secret isn't handed out again
 type CreateLeaseResp struct {
 	KubeConfigStr  string `json:"kubeconfig"`
 	IP             string `json:"ip"`
 	Token          string `json:"uuid"`
+	Secret         string `json:"secret"`
 	ClusterName    string `json:"cluster_name"`
+	ClusterID      string `json:"cluster_id"`
 	ClusterVersion string `json:"cluster_version"`
 	CloudProvider  string `json:"cloud_provider"`
 }
@@ -1,5 +1,10 @@
 package api
 
+const (
+	// LeaseSecretHeader is the header that requests which act on a lease carry its secret in
+	LeaseSecretHeader = "Lease-Secret"
+)
+
 // DeleteLeaseReq is the encoding/json compatible struct that represents the DELETE /lease request body
 type DeleteLeaseReq struct {
 	CloudProvider string `json:"cloud_provider"`
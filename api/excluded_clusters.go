@@ -0,0 +1,16 @@
+package api
+
+// ExcludedCluster is the encoding/json compatible struct that represents a cluster that a cloud
+// provider lists, but that isn't in the pool of clusters that can be leased
+type ExcludedCluster struct {
+	CloudProvider string `json:"cloud_provider"`
+	ClusterName   string `json:"cluster_name"`
+	ClusterID     string `json:"cluster_id"`
+	Reason        string `json:"reason"`
+}
+
+// ExcludedClustersResp is the encoding/json compatible struct that represents the GET /excluded
+// response body
+type ExcludedClustersResp struct {
+	Clusters []ExcludedCluster `json:"clusters"`
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/deis/k8s-claimer/k8s"
+)
+
+const (
+	// DefaultExecCredentialCommand is the command that exec credential kubeconfigs run if the
+	// request doesn't name one
+	DefaultExecCredentialCommand = "k8s-claimer-cli"
+	// LeaseSecretEnvVar is the environment variable that exec credential kubeconfigs pass the
+	// secret of the lease to their command in
+	LeaseSecretEnvVar = "K8S_CLAIMER_LEASE_SECRET"
+)
+
+// ExecCredentialReq is the encoding/json compatible struct that asks for a kubeconfig whose
+// users run Command as a Kubernetes exec credential plugin. The command fetches the credentials
+// of the lease from Server, the k8s-claimer server that the lease is created with, each time
+// kubectl needs them
+type ExecCredentialReq struct {
+	Command string `json:"command"`
+	Server  string `json:"server"`
+}
+
+// CommandName returns e.Command, or DefaultExecCredentialCommand if it's empty
+func (e ExecCredentialReq) CommandName() string {
+	if e.Command == "" {
+		return DefaultExecCredentialCommand
+	}
+	return e.Command
+}
+
+// Args returns the arguments that CommandName is run with to fetch the credentials of the lease
+// with the given token
+func (e ExecCredentialReq) Args(leaseToken string) []string {
+	return []string{"--server", e.Server, "credential", "--token", leaseToken}
+}
+
+// Env returns the environment variables that CommandName is run with to fetch the credentials of
+// the lease with the given secret
+func (e ExecCredentialReq) Env(leaseSecret string) []k8s.ExecEnvVar {
+	return []k8s.ExecEnvVar{{Name: LeaseSecretEnvVar, Value: leaseSecret}}
+}
+
+// LeaseCredentialResp is the encoding/json compatible struct that represents the
+// GET /credential/{token} response body. ExpirationTime, in the RFC 3339 format, is when kubectl
+// fetches the token again. It's only a cache hint: the token is the permanent token of the lease's
+// service account, which stays valid until the lease's credentials are revoked
+type LeaseCredentialResp struct {
+	Token          string `json:"token"`
+	ExpirationTime string `json:"expiration_time"`
+}
+
+// Expiration parses r.ExpirationTime. Returns the zero time and an error if it's malformed
+func (r LeaseCredentialResp) Expiration() (time.Time, error) {
+	return time.Parse(time.RFC3339, r.ExpirationTime)
+}
+
+// DecodeLeaseCredentialResp decodes rdr from its JSON representation into a LeaseCredentialResp.
+// If there was any error reading rdr or it had malformed JSON, returns nil and the error
+func DecodeLeaseCredentialResp(rdr io.Reader) (*LeaseCredentialResp, error) {
+	ret := new(LeaseCredentialResp)
+	if err := json.NewDecoder(rdr).Decode(ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
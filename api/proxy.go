@@ -0,0 +1,32 @@
+package api
+
+import "strings"
+
+// ProxyReq is the encoding/json compatible struct that asks for a kubeconfig that talks to the
+// leased cluster through the API proxy of Server, the k8s-claimer server that the lease is
+// created with, instead of talking to the cluster directly
+type ProxyReq struct {
+	Server string `json:"server"`
+}
+
+// URL returns the URL of the API proxy of the lease with the given token
+func (p ProxyReq) URL(leaseToken string) string {
+	return strings.TrimSuffix(p.Server, "/") + "/proxy/" + leaseToken
+}
+
+// ProxyLeaseActivity is the encoding/json compatible struct that represents how a lease used its
+// API proxy. LastRequest is the time of its last request in the RFC 3339 format, and IdleSeconds
+// the number of seconds since then, or since the lease was created if it made no requests yet
+type ProxyLeaseActivity struct {
+	Token       string `json:"token"`
+	ClusterID   string `json:"cluster_id"`
+	Requests    int64  `json:"requests"`
+	LastRequest string `json:"last_request,omitempty"`
+	IdleSeconds int64  `json:"idle_seconds"`
+}
+
+// ProxyActivityResp is the encoding/json compatible struct that represents the GET /activity
+// response body
+type ProxyActivityResp struct {
+	Leases []ProxyLeaseActivity `json:"leases"`
+}
@@ -0,0 +1,23 @@
+package api
+
+// QuotaWindow is the encoding/json compatible struct that represents how much of its budget for
+// a window an identity used. Reset is the time the window ends, when the usage starts over
+type QuotaWindow struct {
+	Window         string  `json:"window"`
+	BudgetHours    float64 `json:"budget_hours"`
+	UsedHours      float64 `json:"used_hours"`
+	RemainingHours float64 `json:"remaining_hours"`
+	Reset          string  `json:"reset"`
+}
+
+// Quota is the encoding/json compatible struct that represents the usage of one identity in each
+// window that its budget limits
+type Quota struct {
+	Identity string        `json:"identity"`
+	Windows  []QuotaWindow `json:"windows"`
+}
+
+// QuotaResp is the encoding/json compatible struct that represents the GET /quota response body
+type QuotaResp struct {
+	Quotas []Quota `json:"quotas"`
+}
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+var (
+	errNoAuthenticators = errors.New("no way to authenticate is configured")
+	errUnknownToken     = errors.New("unknown API token")
+)
+
+// Authenticator establishes the identity of whoever made a request from the value of its
+// Authorization header. Errors must not include the credential that the header carries
+type Authenticator interface {
+	Authenticate(ctx context.Context, header string) (Identity, error)
+}
+
+// Authenticate is the Authenticator interface implementation. The header must be one of the
+// tokens in t
+func (t *Tokens) Authenticate(ctx context.Context, header string) (Identity, error) {
+	id, ok := t.Lookup(header)
+	if !ok {
+		return Identity{}, errUnknownToken
+	}
+	return id, nil
+}
+
+type authenticators []Authenticator
+
+// Any returns an Authenticator that tries each of authns in order, and returns the identity that
+// the first one to succeed establishes. If all of them fail, their errors are returned together
+func Any(authns ...Authenticator) Authenticator {
+	return authenticators(authns)
+}
+
+func (a authenticators) Authenticate(ctx context.Context, header string) (Identity, error) {
+	if len(a) == 0 {
+		return Identity{}, errNoAuthenticators
+	}
+	errs := make([]string, 0, len(a))
+	for _, authn := range a {
+		id, err := authn.Authenticate(ctx, header)
+		if err == nil {
+			return id, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return Identity{}, errors.New(strings.Join(errs, "; "))
+}
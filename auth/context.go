@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"context"
+	"strings"
+)
+
+type identityKey struct{}
+
+// Source is how an identity was established
+type Source string
+
+const (
+	// SourceToken is the source of the identities of API tokens, whose names are the tokens' names
+	SourceToken Source = "token"
+	// SourceOIDC is the source of the identities of ID tokens, whose names come from their claims
+	SourceOIDC Source = "oidc"
+)
+
+// Identity is who made a request, as established by the API token or the ID token it carried
+type Identity struct {
+	Name   string
+	Source Source
+	Role   Role
+}
+
+// ID returns the name of id qualified with its source, such as token:ci or oidc:dev@example.com.
+// The holder of an ID token can have the same name as an API token, so identities are told apart
+// by their IDs wherever they're recorded or matched. Returns an empty string for an identity
+// without a name
+func (id Identity) ID() string {
+	if id.Name == "" {
+		return ""
+	}
+	return string(id.Source) + ":" + id.Name
+}
+
+// ValidID returns true if id is an identity ID, qualified with a known source
+func ValidID(id string) bool {
+	for _, source := range []Source{SourceToken, SourceOIDC} {
+		if strings.HasPrefix(id, string(source)+":") && len(id) > len(source)+1 {
+			return true
+		}
+	}
+	return false
+}
+
+// NewContext returns a copy of ctx that carries id
+func NewContext(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext returns the identity that ctx carries. Returns false if it carries none, such as for
+// requests that aren't authenticated
+func FromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+// ID returns the ID of the identity that ctx carries, or an empty string if it carries none
+func ID(ctx context.Context) string {
+	id, _ := FromContext(ctx)
+	return id.ID()
+}
@@ -0,0 +1,273 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deis/k8s-claimer/retry"
+)
+
+const (
+	// discoveryPath is where OIDC issuers publish their configuration, relative to their URL
+	discoveryPath = "/.well-known/openid-configuration"
+	// minKeysRefresh is how long a KeySet waits before it fetches the keys again to find a key that
+	// it doesn't have, so that tokens with made up key IDs can't make it hammer the issuer
+	minKeysRefresh = 1 * time.Minute
+	fetchTimeout   = 10 * time.Second
+	// refreshTimeout is how long a fetch of the keys may take, discovery and retries included
+	refreshTimeout = 30 * time.Second
+)
+
+var (
+	errNoJWKSURI = errors.New("the OIDC discovery document has no jwks_uri")
+)
+
+// ErrUnknownKey is the error returned when a KeySet has no key with a key ID
+type ErrUnknownKey struct {
+	kid string
+}
+
+// Error is the error interface implementation
+func (e ErrUnknownKey) Error() string {
+	return fmt.Sprintf("no signing key with ID %q", e.kid)
+}
+
+// errFetchStatus is returned when the issuer responds to a fetch with a non-200 status code
+type errFetchStatus struct {
+	url  string
+	code int
+}
+
+func (e errFetchStatus) Error() string {
+	return fmt.Sprintf("GET %s returned %d", e.url, e.code)
+}
+
+// jwk is a JSON Web Key, of which only RSA and EC P-256 keys are supported
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// keysFetch is a fetch of the keys of an issuer that callers of KeySet.Key wait for. err is set
+// before done is closed
+type keysFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// KeySet holds the signing keys of an OIDC issuer, which it fetches from its JWKS URL, or from the
+// URL that the issuer's discovery document names if there isn't one. The keys are fetched when
+// they're first needed, and again when a token is signed with a key that the KeySet doesn't have,
+// at most every minKeysRefresh. Only one fetch runs at a time, and it doesn't block the lookups of
+// keys that the KeySet already has
+type KeySet struct {
+	issuer string
+	client *http.Client
+	// jwksURL is only used by the running fetch
+	jwksURL string
+
+	mut      sync.Mutex
+	keys     map[string]crypto.PublicKey
+	fetched  time.Time
+	fetching *keysFetch
+}
+
+// NewKeySet creates a KeySet for the keys of issuer. jwksURL may be empty, in which case it's
+// discovered from issuer
+func NewKeySet(issuer, jwksURL string) *KeySet {
+	return &KeySet{
+		issuer:  strings.TrimSuffix(issuer, "/"),
+		jwksURL: jwksURL,
+		client:  &http.Client{Timeout: fetchTimeout},
+	}
+}
+
+// Key returns the key with ID kid. If kid is empty, the issuer must only have one key. If the keys
+// have to be fetched, Key waits for the fetch until ctx is done. The fetch itself isn't bound by
+// ctx, so that other callers waiting for it don't fail when ctx's request goes away
+func (k *KeySet) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	k.mut.Lock()
+	if key, ok := k.lookup(kid); ok {
+		k.mut.Unlock()
+		return key, nil
+	}
+	if !k.fetched.IsZero() && time.Since(k.fetched) < minKeysRefresh {
+		k.mut.Unlock()
+		return nil, ErrUnknownKey{kid: kid}
+	}
+	f := k.fetching
+	if f == nil {
+		f = &keysFetch{done: make(chan struct{})}
+		k.fetching = f
+		go k.refresh(f)
+	}
+	k.mut.Unlock()
+
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	k.mut.Lock()
+	defer k.mut.Unlock()
+	if key, ok := k.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey{kid: kid}
+}
+
+// refresh fetches the keys for f, and stores them if the fetch succeeds
+func (k *KeySet) refresh(f *keysFetch) {
+	ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+	defer cancel()
+	keys, err := k.fetch(ctx)
+	k.mut.Lock()
+	if err == nil {
+		k.keys = keys
+		k.fetched = time.Now()
+	}
+	k.fetching = nil
+	f.err = err
+	k.mut.Unlock()
+	close(f.done)
+}
+
+func (k *KeySet) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+	key, ok := k.keys[kid]
+	return key, ok
+}
+
+// fetch fetches the keys of the issuer, after discovering the JWKS URL if k has none. It must only
+// be called by refresh
+func (k *KeySet) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	if k.jwksURL == "" {
+		discovery := struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}{}
+		if err := k.getJSON(ctx, k.issuer+discoveryPath, &discovery); err != nil {
+			return nil, err
+		}
+		if strings.TrimSuffix(discovery.Issuer, "/") != k.issuer {
+			return nil, fmt.Errorf("the OIDC discovery document is for issuer %s instead of %s", discovery.Issuer, k.issuer)
+		}
+		if discovery.JWKSURI == "" {
+			return nil, errNoJWKSURI
+		}
+		k.jwksURL = discovery.JWKSURI
+	}
+	jwks := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err := k.getJSON(ctx, k.jwksURL, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, j := range jwks.Keys {
+		if j.Use != "" && j.Use != "sig" {
+			continue
+		}
+		key, err := j.publicKey()
+		if err != nil {
+			// keys of unsupported types are skipped, since tokens can't be signed with them anyway
+			continue
+		}
+		keys[j.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k *KeySet) getJSON(ctx context.Context, url string, v interface{}) error {
+	return retry.Do(ctx, retry.DefaultBackoff, isTransientFetchError, func() error {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return err
+		}
+		res, err := k.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return errFetchStatus{url: url, code: res.StatusCode}
+		}
+		return json.NewDecoder(res.Body).Decode(v)
+	})
+}
+
+func isTransientFetchError(err error) bool {
+	if statusErr, ok := err.(errFetchStatus); ok {
+		return retry.IsTransientStatus(statusErr.code)
+	}
+	return retry.IsTransientNetError(err)
+}
+
+func (j jwk) publicKey() (crypto.PublicKey, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := decodeBigInt(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(j.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("RSA key %q has an invalid exponent", j.Kid)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if j.Crv != "P-256" {
+			return nil, fmt.Errorf("EC key %q has unsupported curve %s", j.Kid, j.Crv)
+		}
+		x, err := decodeBigInt(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, fmt.Errorf("EC key %q isn't on its curve", j.Kid)
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("key %q has unsupported type %s", j.Kid, j.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
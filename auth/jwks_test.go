@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+)
+
+func TestKeySetFetch(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoErr(t, err)
+	var fetches int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&fetches, 1) > 1 {
+			<-release
+		}
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": {{
+			Kty: "RSA",
+			Kid: testKeyID,
+			N:   encodeBigInt(key.N),
+			E:   encodeBigInt(big.NewInt(int64(key.E))),
+		}}})
+	}))
+	defer server.Close()
+	keys := NewKeySet(server.URL, server.URL)
+	ctx := context.Background()
+	_, err = keys.Key(ctx, testKeyID)
+	assert.NoErr(t, err)
+
+	// let the keys be fetched again for an unknown key, and hold that fetch
+	keys.mut.Lock()
+	keys.fetched = time.Now().Add(-minKeysRefresh)
+	keys.mut.Unlock()
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := keys.Key(ctx, "key2")
+			errs <- err
+		}()
+	}
+	for start := time.Now(); atomic.LoadInt32(&fetches) < 2; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("the keys weren't fetched again")
+		}
+	}
+
+	// the fetch doesn't hold up known keys, nor callers that give up
+	_, err = keys.Key(ctx, testKeyID)
+	assert.NoErr(t, err)
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = keys.Key(canceled, "key2")
+	assert.Err(t, context.Canceled, err)
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		assert.Err(t, ErrUnknownKey{kid: "key2"}, <-errs)
+	}
+	assert.Equal(t, atomic.LoadInt32(&fetches), int32(2), "number of fetches")
+}
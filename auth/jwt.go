@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// clockSkew is how far the clocks of the issuer and the server may be apart
+	clockSkew = 1 * time.Minute
+)
+
+var (
+	errMalformedJWT = errors.New("malformed JWT")
+	errExpiredJWT   = errors.New("the JWT has expired")
+	errEarlyJWT     = errors.New("the JWT isn't valid yet")
+)
+
+// Claims are the claims of a verified JWT
+type Claims map[string]interface{}
+
+// Strings returns the values of the claim called name, which may be a string, a list of strings, a
+// bool or a number. Returns nil if there's no such claim, or if it's of another type
+func (c Claims) Strings(name string) []string {
+	switch val := c[name].(type) {
+	case string:
+		return []string{val}
+	case []interface{}:
+		ret := make([]string, 0, len(val))
+		for _, v := range val {
+			if s, ok := v.(string); ok {
+				ret = append(ret, s)
+			}
+		}
+		return ret
+	case bool:
+		return []string{strconv.FormatBool(val)}
+	case json.Number:
+		return []string{val.String()}
+	default:
+		return nil
+	}
+}
+
+// time returns the claim called name, which holds seconds since the epoch. Returns false if
+// there's no such claim
+func (c Claims) time(name string) (time.Time, bool, error) {
+	val, ok := c[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	num, ok := val.(json.Number)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("the %s claim isn't a number", name)
+	}
+	secs, err := num.Float64()
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("the %s claim isn't a number", name)
+	}
+	return time.Unix(int64(secs), 0), true, nil
+}
+
+// ErrInvalidClaim is the error returned when a JWT is for another issuer or audience
+type ErrInvalidClaim struct {
+	claim    string
+	expected string
+}
+
+// Error is the error interface implementation
+func (e ErrInvalidClaim) Error() string {
+	return fmt.Sprintf("the %s claim of the JWT isn't %s", e.claim, e.expected)
+}
+
+// Verifier verifies JWTs that an OIDC issuer signed for an audience. Only RS256 and ES256
+// signatures are accepted
+type Verifier struct {
+	issuer   string
+	audience string
+	keys     *KeySet
+}
+
+// NewVerifier creates a Verifier for the JWTs that issuer signs with keys for audience
+func NewVerifier(issuer, audience string, keys *KeySet) *Verifier {
+	return &Verifier{issuer: strings.TrimSuffix(issuer, "/"), audience: audience, keys: keys}
+}
+
+// Verify verifies the signature of the JWT raw, checks that it's for v's issuer and audience and
+// that it hasn't expired, and returns its claims
+func (v *Verifier) Verify(ctx context.Context, raw string) (Claims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errMalformedJWT
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" && header.Alg != "ES256" {
+		return nil, fmt.Errorf("unsupported JWT signing algorithm %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errMalformedJWT
+	}
+	key, err := v.keys.Key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := verifySignature(header.Alg, key, hash[:], sig); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != v.issuer {
+		return nil, ErrInvalidClaim{claim: "iss", expected: v.issuer}
+	}
+	if !contains(claims.Strings("aud"), v.audience) {
+		return nil, ErrInvalidClaim{claim: "aud", expected: v.audience}
+	}
+	now := time.Now()
+	exp, ok, err := claims.time("exp")
+	if err != nil {
+		return nil, err
+	}
+	if !ok || now.After(exp.Add(clockSkew)) {
+		return nil, errExpiredJWT
+	}
+	nbf, ok, err := claims.time("nbf")
+	if err != nil {
+		return nil, err
+	}
+	if ok && now.Add(clockSkew).Before(nbf) {
+		return nil, errEarlyJWT
+	}
+	return claims, nil
+}
+
+func verifySignature(alg string, key crypto.PublicKey, hash, sig []byte) error {
+	switch alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("the signing key isn't an RSA key, as %s needs", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, hash, sig); err != nil {
+			return fmt.Errorf("invalid JWT signature (%s)", err)
+		}
+		return nil
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("the signing key isn't an EC key, as %s needs", alg)
+		}
+		if len(sig) != 64 {
+			return errors.New("invalid JWT signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(ecKey, hash, r, s) {
+			return errors.New("invalid JWT signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported JWT signing algorithm %q", alg)
+	}
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return errMalformedJWT
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return errMalformedJWT
+	}
+	return nil
+}
+
+func contains(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	bearerPrefix = "Bearer "
+)
+
+const (
+	// emailClaim is the claim that holds the email address of an ID token's holder, which is only
+	// trusted if emailVerifiedClaim is true
+	emailClaim         = "email"
+	emailVerifiedClaim = "email_verified"
+)
+
+var (
+	errNotBearer       = errors.New("not a bearer token")
+	errUnverifiedEmail = errors.New("the email address of the JWT isn't verified")
+)
+
+// RoleRule grants Role to the holders of JWTs whose Claim holds Value, or has it among its values
+type RoleRule struct {
+	Claim string
+	Value string
+	Role  Role
+}
+
+// ErrInvalidRoleRule is the error returned when a role rule can't be parsed
+type ErrInvalidRoleRule struct {
+	rule string
+}
+
+// Error is the error interface implementation
+func (e ErrInvalidRoleRule) Error() string {
+	return fmt.Sprintf("invalid role rule %q. Role rules look like group=role or claim:value=role, and roles are %s", e.rule, strings.Join(Roles, ", "))
+}
+
+// ParseRoleRules parses rules, each of which is group=role or claim:value=role. Groups are values
+// of groupsClaim
+func ParseRoleRules(rules []string, groupsClaim string) ([]RoleRule, error) {
+	ret := make([]RoleRule, 0, len(rules))
+	for _, rule := range rules {
+		i := strings.LastIndex(rule, "=")
+		if i <= 0 {
+			return nil, ErrInvalidRoleRule{rule: rule}
+		}
+		match, role := rule[:i], Role(rule[i+1:])
+		if !role.Valid() {
+			return nil, ErrInvalidRoleRule{rule: rule}
+		}
+		claim, value := groupsClaim, match
+		if j := strings.Index(match, ":"); j >= 0 {
+			claim, value = match[:j], match[j+1:]
+		}
+		if claim == "" || value == "" {
+			return nil, ErrInvalidRoleRule{rule: rule}
+		}
+		ret = append(ret, RoleRule{Claim: claim, Value: value, Role: role})
+	}
+	return ret, nil
+}
+
+// ErrNoRole is the error returned when none of the role rules match a verified JWT, and there's no
+// default role
+type ErrNoRole struct {
+	name string
+}
+
+// Error is the error interface implementation
+func (e ErrNoRole) Error() string {
+	return fmt.Sprintf("%s has no role", e.name)
+}
+
+// OIDC authenticates requests that carry an OIDC ID token as a bearer token. The identity's name
+// is the value of the token's usernameClaim, and its role is the most allowed role that rules
+// grant it, or defaultRole if they grant none. Many issuers let their users set an email address
+// that they don't own, so the email claim is only used if the token's email_verified claim is true.
+// If it's the usernameClaim, tokens whose email isn't verified are refused, and otherwise the rules
+// that match it are skipped
+type OIDC struct {
+	verifier      *Verifier
+	usernameClaim string
+	rules         []RoleRule
+	defaultRole   Role
+}
+
+// NewOIDC creates an OIDC authenticator. defaultRole may be empty, in which case tokens that no
+// rule matches are refused
+func NewOIDC(verifier *Verifier, usernameClaim string, rules []RoleRule, defaultRole Role) *OIDC {
+	return &OIDC{
+		verifier:      verifier,
+		usernameClaim: usernameClaim,
+		rules:         rules,
+		defaultRole:   defaultRole,
+	}
+}
+
+// Authenticate is the Authenticator interface implementation. The header must be a bearer token
+// that o's verifier verifies
+func (o *OIDC) Authenticate(ctx context.Context, header string) (Identity, error) {
+	if len(header) <= len(bearerPrefix) || !strings.EqualFold(header[:len(bearerPrefix)], bearerPrefix) {
+		return Identity{}, errNotBearer
+	}
+	claims, err := o.verifier.Verify(ctx, strings.TrimSpace(header[len(bearerPrefix):]))
+	if err != nil {
+		return Identity{}, err
+	}
+	names := claims.Strings(o.usernameClaim)
+	if len(names) != 1 || names[0] == "" {
+		return Identity{}, fmt.Errorf("the JWT has no %s claim", o.usernameClaim)
+	}
+	emailVerified := contains(claims.Strings(emailVerifiedClaim), "true")
+	if o.usernameClaim == emailClaim && !emailVerified {
+		return Identity{}, errUnverifiedEmail
+	}
+	id := Identity{Name: names[0], Source: SourceOIDC, Role: o.defaultRole}
+	for _, rule := range o.rules {
+		if rule.Claim == emailClaim && !emailVerified {
+			continue
+		}
+		if contains(claims.Strings(rule.Claim), rule.Value) && !id.Role.Allows(rule.Role) {
+			id.Role = rule.Role
+		}
+	}
+	if !id.Role.Valid() {
+		return Identity{}, ErrNoRole{name: id.Name}
+	}
+	return id, nil
+}
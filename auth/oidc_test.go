@@ -0,0 +1,255 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+)
+
+const (
+	testAudience = "k8s-claimer"
+	testKeyID    = "key1"
+)
+
+// testIssuer is a stub OIDC issuer, which serves its discovery document and JWKS, and signs JWTs
+// with a local key
+type testIssuer struct {
+	server  *httptest.Server
+	key     *rsa.PrivateKey
+	ecKey   *ecdsa.PrivateKey
+	fetches int
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoErr(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoErr(t, err)
+	iss := &testIssuer{key: key, ecKey: ecKey}
+	mux := http.NewServeMux()
+	mux.HandleFunc(discoveryPath, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   iss.server.URL,
+			"jwks_uri": iss.server.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		iss.fetches++
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": {
+			{
+				Kty: "RSA",
+				Kid: testKeyID,
+				Use: "sig",
+				N:   encodeBigInt(key.N),
+				E:   encodeBigInt(big.NewInt(int64(key.E))),
+			},
+			{
+				Kty: "EC",
+				Kid: "ec1",
+				Crv: "P-256",
+				X:   encodeBigInt(ecKey.X),
+				Y:   encodeBigInt(ecKey.Y),
+			},
+		}})
+	})
+	iss.server = httptest.NewServer(mux)
+	return iss
+}
+
+func (iss *testIssuer) claims(email string, groups ...string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":            iss.server.URL,
+		"aud":            testAudience,
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"sub":            "subject-" + email,
+		"email":          email,
+		"email_verified": true,
+		"groups":         groups,
+	}
+}
+
+// sign returns a JWT with claims, signed by iss with the RS256 key if alg is RS256, and with the
+// ES256 key otherwise
+func (iss *testIssuer) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	assert.NoErr(t, err)
+	payload, err := json.Marshal(claims)
+	assert.NoErr(t, err)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(input))
+	var sig []byte
+	if alg == "RS256" {
+		sig, err = rsa.SignPKCS1v15(rand.Reader, iss.key, crypto.SHA256, hash[:])
+		assert.NoErr(t, err)
+	} else {
+		r, s, err := ecdsa.Sign(rand.Reader, iss.ecKey, hash[:])
+		assert.NoErr(t, err)
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func encodeBigInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func newTestOIDC(t *testing.T, iss *testIssuer, defaultRole Role) *OIDC {
+	rules, err := ParseRoleRules([]string{"developers=user", "email:ops@example.com=admin"}, "groups")
+	assert.NoErr(t, err)
+	verifier := NewVerifier(iss.server.URL, testAudience, NewKeySet(iss.server.URL, ""))
+	return NewOIDC(verifier, "email", rules, defaultRole)
+}
+
+func TestOIDCAuthenticate(t *testing.T) {
+	iss := newTestIssuer(t)
+	defer iss.server.Close()
+	oidc := newTestOIDC(t, iss, "")
+	ctx := context.Background()
+
+	id, err := oidc.Authenticate(ctx, "Bearer "+iss.sign(t, "RS256", testKeyID, iss.claims("dev@example.com", "developers")))
+	assert.NoErr(t, err)
+	assert.Equal(t, id, Identity{Name: "dev@example.com", Source: SourceOIDC, Role: RoleUser}, "identity")
+
+	id, err = oidc.Authenticate(ctx, "bearer "+iss.sign(t, "ES256", "ec1", iss.claims("ops@example.com", "developers")))
+	assert.NoErr(t, err)
+	assert.Equal(t, id, Identity{Name: "ops@example.com", Source: SourceOIDC, Role: RoleAdmin}, "identity")
+	assert.Equal(t, iss.fetches, 1, "number of JWKS fetches")
+
+	_, err = oidc.Authenticate(ctx, "Bearer "+iss.sign(t, "RS256", testKeyID, iss.claims("someone@example.com", "others")))
+	assert.Err(t, ErrNoRole{name: "someone@example.com"}, err)
+	id, err = newTestOIDC(t, iss, RoleReadOnly).Authenticate(ctx, "Bearer "+iss.sign(t, "RS256", testKeyID, iss.claims("someone@example.com")))
+	assert.NoErr(t, err)
+	assert.Equal(t, id.Role, RoleReadOnly, "default role")
+}
+
+func TestOIDCAuthenticateUnverifiedEmail(t *testing.T) {
+	iss := newTestIssuer(t)
+	defer iss.server.Close()
+	ctx := context.Background()
+	unverified := iss.claims("ops@example.com", "developers")
+	unverified["email_verified"] = false
+	noVerified := iss.claims("ops@example.com", "developers")
+	delete(noVerified, "email_verified")
+	verifiedString := iss.claims("ops@example.com")
+	verifiedString["email_verified"] = "true"
+
+	// unverified email addresses aren't names
+	oidc := newTestOIDC(t, iss, RoleReadOnly)
+	_, err := oidc.Authenticate(ctx, "Bearer "+iss.sign(t, "RS256", testKeyID, unverified))
+	assert.Err(t, errUnverifiedEmail, err)
+	_, err = oidc.Authenticate(ctx, "Bearer "+iss.sign(t, "RS256", testKeyID, noVerified))
+	assert.Err(t, errUnverifiedEmail, err)
+	id, err := oidc.Authenticate(ctx, "Bearer "+iss.sign(t, "RS256", testKeyID, verifiedString))
+	assert.NoErr(t, err)
+	assert.Equal(t, id, Identity{Name: "ops@example.com", Source: SourceOIDC, Role: RoleAdmin}, "identity")
+
+	// nor do they match role rules
+	rules, err := ParseRoleRules([]string{"developers=user", "email:ops@example.com=admin"}, "groups")
+	assert.NoErr(t, err)
+	bySubject := NewOIDC(NewVerifier(iss.server.URL, testAudience, NewKeySet(iss.server.URL, "")), "sub", rules, "")
+	id, err = bySubject.Authenticate(ctx, "Bearer "+iss.sign(t, "RS256", testKeyID, unverified))
+	assert.NoErr(t, err)
+	assert.Equal(t, id, Identity{Name: "subject-ops@example.com", Source: SourceOIDC, Role: RoleUser}, "identity")
+}
+
+func TestOIDCAuthenticateInvalid(t *testing.T) {
+	iss := newTestIssuer(t)
+	defer iss.server.Close()
+	other := newTestIssuer(t)
+	defer other.server.Close()
+	oidc := newTestOIDC(t, iss, RoleUser)
+	ctx := context.Background()
+
+	wrongAudience := iss.claims("dev@example.com")
+	wrongAudience["aud"] = []string{"someone-else"}
+	wrongIssuer := iss.claims("dev@example.com")
+	wrongIssuer["iss"] = other.server.URL
+	expired := iss.claims("dev@example.com")
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	early := iss.claims("dev@example.com")
+	early["nbf"] = time.Now().Add(time.Hour).Unix()
+	noExpiry := iss.claims("dev@example.com")
+	delete(noExpiry, "exp")
+	noName := iss.claims("")
+
+	testCases := map[string]string{
+		"not a bearer token":  iss.sign(t, "RS256", testKeyID, iss.claims("dev@example.com")),
+		"malformed":           "Bearer abc.def",
+		"wrong audience":      "Bearer " + iss.sign(t, "RS256", testKeyID, wrongAudience),
+		"wrong issuer":        "Bearer " + iss.sign(t, "RS256", testKeyID, wrongIssuer),
+		"expired":             "Bearer " + iss.sign(t, "RS256", testKeyID, expired),
+		"not valid yet":       "Bearer " + iss.sign(t, "RS256", testKeyID, early),
+		"no expiry":           "Bearer " + iss.sign(t, "RS256", testKeyID, noExpiry),
+		"no name":             "Bearer " + iss.sign(t, "RS256", testKeyID, noName),
+		"signed by another":   "Bearer " + other.sign(t, "RS256", testKeyID, iss.claims("dev@example.com")),
+		"unknown key":         "Bearer " + iss.sign(t, "RS256", "key2", iss.claims("dev@example.com")),
+		"mismatched key type": "Bearer " + iss.sign(t, "RS256", "ec1", iss.claims("dev@example.com")),
+		"unsigned":            "Bearer " + iss.sign(t, "none", testKeyID, iss.claims("dev@example.com")),
+	}
+	for name, header := range testCases {
+		_, err := oidc.Authenticate(ctx, header)
+		assert.True(t, err != nil, "%s token was accepted", name)
+	}
+	// unknown keys only make the keys be fetched again once in a while
+	assert.Equal(t, iss.fetches, 1, "number of JWKS fetches")
+}
+
+func TestParseRoleRules(t *testing.T) {
+	rules, err := ParseRoleRules([]string{"developers=user", "email:ops@example.com=admin", "org:team=a=read-only"}, "groups")
+	assert.NoErr(t, err)
+	assert.Equal(t, rules, []RoleRule{
+		{Claim: "groups", Value: "developers", Role: RoleUser},
+		{Claim: "email", Value: "ops@example.com", Role: RoleAdmin},
+		{Claim: "org", Value: "team=a", Role: RoleReadOnly},
+	}, "rules")
+
+	for _, rule := range []string{"developers", "=user", "developers=root", ":x=user", "email:=user"} {
+		_, err := ParseRoleRules([]string{rule}, "groups")
+		assert.Err(t, ErrInvalidRoleRule{rule: rule}, err)
+	}
+}
+
+func TestAny(t *testing.T) {
+	iss := newTestIssuer(t)
+	defer iss.server.Close()
+	tokens, err := NewTokens([]Token{{Name: "ci", Token: "ci-token", Role: RoleUser}})
+	assert.NoErr(t, err)
+	authn := Any(tokens, newTestOIDC(t, iss, ""))
+	ctx := context.Background()
+
+	id, err := authn.Authenticate(ctx, "ci-token")
+	assert.NoErr(t, err)
+	assert.Equal(t, id, Identity{Name: "ci", Source: SourceToken, Role: RoleUser}, "identity")
+	id, err = authn.Authenticate(ctx, "Bearer "+iss.sign(t, "RS256", testKeyID, iss.claims("dev@example.com", "developers")))
+	assert.NoErr(t, err)
+	assert.Equal(t, id, Identity{Name: "dev@example.com", Source: SourceOIDC, Role: RoleUser}, "identity")
+	_, err = authn.Authenticate(ctx, "other-token")
+	assert.True(t, err != nil, "an unknown token was accepted")
+
+	// an ID token holder with the name of an API token is a different identity
+	for _, name := range []string{"ci", DefaultTokenName} {
+		oidcID, err := authn.Authenticate(ctx, "Bearer "+iss.sign(t, "RS256", testKeyID, iss.claims(name, "developers")))
+		assert.NoErr(t, err)
+		tokenID := Token{Name: name, Role: RoleUser}.Identity()
+		assert.Equal(t, oidcID.Name, tokenID.Name, "name")
+		assert.Equal(t, oidcID.ID(), "oidc:"+name, "ID of the ID token holder")
+		assert.Equal(t, tokenID.ID(), "token:"+name, "ID of the API token")
+	}
+	_, err = Any().Authenticate(ctx, "ci-token")
+	assert.Err(t, errNoAuthenticators, err)
+}
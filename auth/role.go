@@ -0,0 +1,37 @@
+package auth
+
+// Role is what the holder of an API token is allowed to do. Each role is allowed everything that
+// the roles below it are
+type Role string
+
+const (
+	// RoleReadOnly is allowed to read the state of the server, such as GET /pool
+	RoleReadOnly Role = "read-only"
+	// RoleUser is allowed to acquire and release leases, and fetch their credentials
+	RoleUser Role = "user"
+	// RoleAdmin is allowed to release leases and fetch their credentials without their secrets
+	RoleAdmin Role = "admin"
+)
+
+// Roles are the names of all the roles, from the least to the most allowed
+var Roles = []string{string(RoleReadOnly), string(RoleUser), string(RoleAdmin)}
+
+// Valid returns true if r is one of the known roles
+func (r Role) Valid() bool {
+	return r.rank() > 0
+}
+
+// Allows returns true if r is allowed everything that required is. Unknown roles aren't allowed
+// anything
+func (r Role) Allows(required Role) bool {
+	return r.Valid() && r.rank() >= required.rank()
+}
+
+func (r Role) rank() int {
+	for i, name := range Roles {
+		if string(r) == name {
+			return i + 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+const (
+	// DefaultTokenName is the name of the token that's set with AUTH_TOKEN
+	DefaultTokenName = "default"
+)
+
+var (
+	errNoTokens = errors.New("no API tokens are configured")
+)
+
+// Token is a named API token, which is allowed what its role is. It's what each entry of a tokens
+// file decodes into
+type Token struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	Role  Role   `json:"role"`
+}
+
+// Identity returns the identity of the holder of t
+func (t Token) Identity() Identity {
+	return Identity{Name: t.Name, Source: SourceToken, Role: t.Role}
+}
+
+// ErrInvalidToken is the error returned when a token can't be added to a Tokens registry
+type ErrInvalidToken struct {
+	name   string
+	reason string
+}
+
+// Error is the error interface implementation
+func (e ErrInvalidToken) Error() string {
+	return fmt.Sprintf("invalid API token %q (%s)", e.name, e.reason)
+}
+
+// Tokens is a registry of API tokens. It only keeps the hashes of the tokens, which are compared
+// in constant time
+type Tokens struct {
+	names  []string
+	roles  []Role
+	hashes [][]byte
+}
+
+// NewTokens creates a registry of tokens. Returns an ErrInvalidToken if a token has no name, no
+// value or an unknown role, or if its name or value is used by another token
+func NewTokens(tokens []Token) (*Tokens, error) {
+	if len(tokens) == 0 {
+		return nil, errNoTokens
+	}
+	t := &Tokens{}
+	names := make(map[string]bool, len(tokens))
+	values := make(map[string]bool, len(tokens))
+	for _, tok := range tokens {
+		switch {
+		case tok.Name == "":
+			return nil, ErrInvalidToken{name: tok.Name, reason: "the name is empty"}
+		case tok.Token == "":
+			return nil, ErrInvalidToken{name: tok.Name, reason: "the token is empty"}
+		case !tok.Role.Valid():
+			return nil, ErrInvalidToken{name: tok.Name, reason: fmt.Sprintf("unknown role %q", tok.Role)}
+		case names[tok.Name]:
+			return nil, ErrInvalidToken{name: tok.Name, reason: "another token has the same name"}
+		case values[tok.Token]:
+			return nil, ErrInvalidToken{name: tok.Name, reason: "another token has the same value"}
+		}
+		names[tok.Name] = true
+		values[tok.Token] = true
+		t.names = append(t.names, tok.Name)
+		t.roles = append(t.roles, tok.Role)
+		t.hashes = append(t.hashes, hashToken(tok.Token))
+	}
+	return t, nil
+}
+
+// ReadTokensFile reads the tokens in the JSON file at path, which holds a list of Tokens
+func ReadTokensFile(path string) ([]Token, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []Token
+	if err := json.Unmarshal(b, &tokens); err != nil {
+		return nil, fmt.Errorf("error decoding API tokens file %s (%s)", path, err)
+	}
+	return tokens, nil
+}
+
+// Lookup returns the identity of the holder of token. Returns false if token isn't in t. Every
+// token in t is compared with token, in constant time, so that the time it takes doesn't tell
+// how much of token was right or which token it was
+func (t *Tokens) Lookup(token string) (Identity, bool) {
+	if t == nil || token == "" {
+		return Identity{}, false
+	}
+	hash := hashToken(token)
+	found := -1
+	for i, h := range t.hashes {
+		if subtle.ConstantTimeCompare(hash, h) == 1 {
+			found = i
+		}
+	}
+	if found < 0 {
+		return Identity{}, false
+	}
+	return Identity{Name: t.names[found], Source: SourceToken, Role: t.roles[found]}, true
+}
+
+// Names returns the names of the tokens in t, along with their roles, for logging
+func (t *Tokens) Names() []string {
+	if t == nil {
+		return nil
+	}
+	ret := make([]string, len(t.names))
+	for i, name := range t.names {
+		ret[i] = fmt.Sprintf("%s:%s", name, t.roles[i])
+	}
+	return ret
+}
+
+// hashToken hashes token, so that tokens of every length are compared in the same time
+func hashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
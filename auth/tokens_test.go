@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+func TestNewTokensInvalid(t *testing.T) {
+	testCases := [][]Token{
+		nil,
+		{{Name: "", Token: "a", Role: RoleUser}},
+		{{Name: "ci", Token: "", Role: RoleUser}},
+		{{Name: "ci", Token: "a", Role: "superuser"}},
+		{{Name: "ci", Token: "a", Role: RoleUser}, {Name: "ci", Token: "b", Role: RoleUser}},
+		{{Name: "ci", Token: "a", Role: RoleUser}, {Name: "dev", Token: "a", Role: RoleAdmin}},
+	}
+	for i, tokens := range testCases {
+		_, err := NewTokens(tokens)
+		assert.True(t, err != nil, "test case %d didn't return an error", i)
+	}
+}
+
+func TestTokensLookup(t *testing.T) {
+	tokens, err := NewTokens([]Token{
+		{Name: "ci", Token: "ci-token", Role: RoleUser},
+		{Name: "ops", Token: "ops-token", Role: RoleAdmin},
+		{Name: "dashboard", Token: "dashboard-token", Role: RoleReadOnly},
+	})
+	assert.NoErr(t, err)
+
+	id, ok := tokens.Lookup("ops-token")
+	assert.True(t, ok, "ops-token wasn't found")
+	assert.Equal(t, id, Identity{Name: "ops", Source: SourceToken, Role: RoleAdmin}, "identity")
+	id, ok = tokens.Lookup("dashboard-token")
+	assert.True(t, ok, "dashboard-token wasn't found")
+	assert.Equal(t, id, Identity{Name: "dashboard", Source: SourceToken, Role: RoleReadOnly}, "identity")
+
+	for _, token := range []string{"", "ci-toke", "ci-token ", "other"} {
+		_, ok := tokens.Lookup(token)
+		assert.False(t, ok, "token %q was found", token)
+	}
+	var nilTokens *Tokens
+	_, ok = nilTokens.Lookup("ci-token")
+	assert.False(t, ok, "a nil registry found a token")
+
+	assert.Equal(t, tokens.Names(), []string{"ci:user", "ops:admin", "dashboard:read-only"}, "names")
+}
+
+func TestReadTokensFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8s-claimer-tokens")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens.json")
+	assert.NoErr(t, ioutil.WriteFile(path, []byte(`[{"name":"ci","token":"ci-token","role":"user"}]`), 0600))
+
+	tokens, err := ReadTokensFile(path)
+	assert.NoErr(t, err)
+	assert.Equal(t, tokens, []Token{{Name: "ci", Token: "ci-token", Role: RoleUser}}, "tokens")
+
+	assert.NoErr(t, ioutil.WriteFile(path, []byte(`{"name":"ci"}`), 0600))
+	_, err = ReadTokensFile(path)
+	assert.True(t, err != nil, "a malformed file didn't return an error")
+	_, err = ReadTokensFile(filepath.Join(dir, "missing.json"))
+	assert.True(t, err != nil, "a missing file didn't return an error")
+}
+
+func TestRoleAllows(t *testing.T) {
+	assert.True(t, RoleAdmin.Allows(RoleUser), "admin doesn't allow user")
+	assert.True(t, RoleUser.Allows(RoleReadOnly), "user doesn't allow read-only")
+	assert.True(t, RoleUser.Allows(RoleUser), "user doesn't allow user")
+	assert.False(t, RoleReadOnly.Allows(RoleUser), "read-only allows user")
+	assert.False(t, RoleUser.Allows(RoleAdmin), "user allows admin")
+	assert.False(t, Role("").Allows(Role("")), "an empty role allows itself")
+}
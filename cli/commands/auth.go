@@ -0,0 +1,32 @@
+package commands
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/codegangsta/cli"
+)
+
+// authorization returns the value of the Authorization header that the server is called with.
+// It's the ID token in the id-token global flag, or in the file that the id-token-file global flag
+// names, as a bearer token. Otherwise it's the API token in the AUTH_TOKEN env var
+func authorization(c *cli.Context) string {
+	idToken := c.GlobalString("id-token")
+	if idTokenFile := c.GlobalString("id-token-file"); idToken == "" && idTokenFile != "" {
+		b, err := ioutil.ReadFile(idTokenFile)
+		if err != nil {
+			log.Fatalf("Error reading the ID token file %s: %s", idTokenFile, err)
+		}
+		idToken = strings.TrimSpace(string(b))
+	}
+	if idToken != "" {
+		return "Bearer " + idToken
+	}
+	authToken := os.Getenv("AUTH_TOKEN")
+	if authToken == "" {
+		log.Fatal("An authorization token is required in the form of an env var AUTH_TOKEN, or an ID token in the id-token or id-token-file flag")
+	}
+	return authToken
+}
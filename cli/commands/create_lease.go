@@ -9,22 +9,21 @@ import (
 	"strings"
 
 	"github.com/codegangsta/cli"
+	"github.com/deis/k8s-claimer/api"
 	"github.com/deis/k8s-claimer/client"
 )
 
 const (
 	ipEnvVarName          = "IP"
 	tokenEnvVarName       = "TOKEN"
+	secretEnvVarName      = "SECRET"
 	clusterNameEnvVarName = "CLUSTER_NAME"
+	clusterIDEnvVarName   = "CLUSTER_ID"
 )
 
 // CreateLease is a cli.Command action for creating a lease
 func CreateLease(c *cli.Context) {
-	// inspect env for auth env var
-	authToken := os.Getenv("AUTH_TOKEN")
-	if authToken == "" {
-		log.Fatal("An authorization token is required in the form of an env var AUTH_TOKEN")
-	}
+	authToken := authorization(c)
 	server := c.GlobalString("server")
 	if server == "" {
 		log.Fatal("Server missing")
@@ -36,13 +35,17 @@ func CreateLease(c *cli.Context) {
 	envPrefix := c.String("env-prefix")
 	clusterRegex := c.String("cluster-regex")
 	clusterVersion := c.String("cluster-version")
+	clusterVersionSource := c.String("cluster-version-source")
+	clusterSelector := c.String("cluster-selector")
+	selectionStrategy := c.String("strategy")
+	holder := c.String("holder")
+	preferredCluster := c.String("preferred-cluster")
+	affinityKey := c.String("affinity-key")
+	avoidClusters := c.StringSlice("avoid-cluster")
 	cloudProvider := c.String("provider")
 	if cloudProvider == "" {
 		log.Fatal("Cloud Provider not provided")
 	}
-	if cloudProvider == "azure" && clusterVersion != "" {
-		log.Fatal("Finding clusters by version is currently not supported with Azure!")
-	}
 
 	kcfgFile := c.String("kubeconfig-file")
 	if len(kcfgFile) < 1 {
@@ -55,7 +58,31 @@ func CreateLease(c *cli.Context) {
 	}
 	defer fd.Close()
 
-	resp, err := client.CreateLease(server, authToken, cloudProvider, clusterVersion, clusterRegex, durationSec)
+	var execCredential *api.ExecCredentialReq
+	if c.Bool("exec-credential") {
+		execCredential = &api.ExecCredentialReq{Command: c.String("exec-credential-command"), Server: server}
+	}
+	var proxy *api.ProxyReq
+	if c.Bool("proxy") {
+		proxy = &api.ProxyReq{Server: server}
+	}
+
+	req := api.CreateLeaseReq{
+		MaxTimeSec:           durationSec,
+		ClusterRegex:         clusterRegex,
+		ClusterVersion:       clusterVersion,
+		ClusterVersionSource: clusterVersionSource,
+		ClusterSelector:      clusterSelector,
+		SelectionStrategy:    selectionStrategy,
+		Holder:               holder,
+		PreferredCluster:     preferredCluster,
+		AffinityKey:          affinityKey,
+		AvoidClusters:        avoidClusters,
+		CloudProvider:        cloudProvider,
+		ExecCredential:       execCredential,
+		Proxy:                proxy,
+	}
+	resp, err := client.CreateLease(server, authToken, req)
 	if err != nil {
 		log.Fatalf("Error returned from server when creating lease: %s", err)
 	}
@@ -66,7 +93,9 @@ func CreateLease(c *cli.Context) {
 	}
 	fmt.Println(exportVar(envPrefix, ipEnvVarName, resp.IP))
 	fmt.Println(exportVar(envPrefix, tokenEnvVarName, resp.Token))
+	fmt.Println(exportVar(envPrefix, secretEnvVarName, resp.Secret))
 	fmt.Println(exportVar(envPrefix, clusterNameEnvVarName, resp.ClusterName))
+	fmt.Println(exportVar(envPrefix, clusterIDEnvVarName, resp.ClusterID))
 
 	if _, err := io.Copy(fd, bytes.NewBuffer(kcfg)); err != nil {
 		log.Fatalf("Error writing new Kubeconfig file to %s: %s", kcfgFile, err)
@@ -0,0 +1,43 @@
+package commands
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+
+	"github.com/codegangsta/cli"
+	"github.com/deis/k8s-claimer/api"
+	"github.com/deis/k8s-claimer/client"
+	"github.com/deis/k8s-claimer/k8s"
+)
+
+// Credential is a cli.Command action for fetching the credentials of a lease. It prints them as a
+// Kubernetes ExecCredential, so that kubectl can run it as an exec credential plugin
+func Credential(c *cli.Context) {
+	authToken := authorization(c)
+	server := c.GlobalString("server")
+	if server == "" {
+		log.Fatal("Server missing")
+	}
+	leaseToken := c.String("token")
+	if leaseToken == "" {
+		log.Fatal("Lease token missing")
+	}
+
+	leaseSecret := c.String("secret")
+	if leaseSecret == "" {
+		log.Fatalf("Lease secret missing. Pass it with the secret flag or the %s env var", api.LeaseSecretEnvVar)
+	}
+
+	resp, err := client.GetLeaseCredential(server, authToken, leaseToken, leaseSecret)
+	if err != nil {
+		log.Fatalf("Error returned from server when fetching the credentials of the lease: %s", err)
+	}
+	expiration, err := resp.Expiration()
+	if err != nil {
+		log.Fatalf("Error decoding the expiration time of the credentials: %s", err)
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(k8s.NewExecCredential(resp.Token, expiration)); err != nil {
+		log.Fatalf("Error encoding the credentials: %s", err)
+	}
+}
@@ -3,7 +3,6 @@ package commands
 import (
 	"fmt"
 	"log"
-	"os"
 
 	"github.com/codegangsta/cli"
 	"github.com/deis/k8s-claimer/client"
@@ -11,11 +10,7 @@ import (
 
 // DeleteLease is a cli.Command action for deleting a lease
 func DeleteLease(c *cli.Context) {
-	// inspect env for auth env var
-	authToken := os.Getenv("AUTH_TOKEN")
-	if authToken == "" {
-		log.Fatalf("An authorization token is required in the form of an env var AUTH_TOKEN")
-	}
+	authToken := authorization(c)
 	server := c.GlobalString("server")
 	if server == "" {
 		log.Fatalf("Server missing")
@@ -24,12 +19,12 @@ func DeleteLease(c *cli.Context) {
 		log.Fatalf("Lease token missing")
 	}
 	leaseToken := c.Args()[0]
-	cloudProvider := c.String("provider")
-	if cloudProvider == "" {
-		log.Fatal("Cloud Provider not provided")
+	leaseSecret := c.String("secret")
+	if leaseSecret == "" {
+		log.Fatalf("Lease secret missing. Pass it with the secret flag or the SECRET env var")
 	}
 
-	if err := client.DeleteLease(server, authToken, cloudProvider, leaseToken); err != nil {
+	if err := client.DeleteLease(server, authToken, leaseToken, leaseSecret); err != nil {
 		log.Fatalf("Error deleting lease: %s", err)
 	}
 
@@ -4,6 +4,7 @@ import (
 	"os"
 
 	"github.com/codegangsta/cli"
+	"github.com/deis/k8s-claimer/api"
 	"github.com/deis/k8s-claimer/cli/commands"
 )
 
@@ -21,6 +22,18 @@ func main() {
 			Value: "",
 			Usage: "The k8s-claimer server to talk to",
 		},
+		cli.StringFlag{
+			Name:   "id-token",
+			Value:  "",
+			EnvVar: "K8S_CLAIMER_ID_TOKEN",
+			Usage:  "An OIDC ID token, such as one from a device flow, to authenticate with instead of the AUTH_TOKEN env var",
+		},
+		cli.StringFlag{
+			Name:   "id-token-file",
+			Value:  "",
+			EnvVar: "K8S_CLAIMER_ID_TOKEN_FILE",
+			Usage:  "A file that holds an OIDC ID token to authenticate with. It's read each time the CLI runs, so it can be refreshed by other tools",
+		},
 	}
 	app.Commands = []cli.Command{
 		cli.Command{
@@ -31,10 +44,12 @@ func main() {
 					Usage: `Creates a new lease and returns 'export' statements to set the lease values as environment variables. Set the 'env-prefix' flag to prefix the environment variable names. If you pass that flag, a '_' character will separate the prefix with the rest of the environment variable name. Below are the basic environment variable names:
 
 - IP - the IP address of the Kubernetes master server
-- TOKEN - contains the lease token. Use this when you run 'k8s-claimer-cli lease delete'
+- TOKEN - contains the lease token, which is the public ID of the lease. Use this when you run 'k8s-claimer-cli lease delete'
+- SECRET - contains the lease secret, which 'k8s-claimer-cli lease delete' needs as well. It isn't handed out again, so keep it
 - CLUSTER_NAME - contains the name of the cluster. For informational purposes only
+- CLUSTER_ID - contains the ID of the cluster, qualified by its cloud provider (i.e. google/my-project/us-west1-a/my-cluster). For informational purposes only
 
-The Kubeconfig file will be written to kubeconfig-file
+The Kubeconfig file will be written to kubeconfig-file. If the exec-credential flag is set, its user runs 'k8s-claimer-cli credential' to fetch the credentials of the lease each time kubectl needs them, instead of carrying them. If the proxy flag is set, it talks to the cluster through the API proxy of the server instead
 `,
 					Action: commands.CreateLease,
 					Flags: []cli.Flag{
@@ -61,32 +76,101 @@ The Kubeconfig file will be written to kubeconfig-file
 						cli.StringFlag{
 							Name:  "cluster-version",
 							Value: "",
-							Usage: "A version string that will be used to find a cluster to lease",
+							Usage: "A version constraint that will be used to find a cluster to lease, such as 1.7, ~1.7.3 or '>=1.6 <1.8'. The cluster with the highest matching version is preferred",
+						},
+						cli.StringFlag{
+							Name:  "cluster-version-source",
+							Value: "node",
+							Usage: "Which version of a cluster cluster-version is matched against. Acceptable values are node and master",
+						},
+						cli.StringFlag{
+							Name:  "cluster-selector",
+							Value: "",
+							Usage: "A Kubernetes label selector, such as 'gpu=false,region=us-west', that will be matched against GKE resource labels or Azure resource tags to find a cluster to lease",
+						},
+						cli.StringFlag{
+							Name:  "strategy",
+							Value: "",
+							Usage: "How to pick among the free clusters that match. Acceptable values are random, least-recently-used, most-recently-cleaned and bin-pack. If a value is not provided, the server's default is used",
+						},
+						cli.StringFlag{
+							Name:  "holder",
+							Value: "",
+							Usage: "Who is holding the lease, such as a CI job name. The server remembers it as the cluster's last holder",
+						},
+						cli.StringFlag{
+							Name:  "preferred-cluster",
+							Value: "",
+							Usage: "The name of a cluster to lease if it's free and matches",
+						},
+						cli.StringFlag{
+							Name:  "affinity-key",
+							Value: "",
+							Usage: "Prefer free clusters whose last lease had this affinity key, such as a pipeline name. The new lease is recorded with it as well",
+						},
+						cli.StringSliceFlag{
+							Name:  "avoid-cluster",
+							Usage: "The name of a cluster to only lease if no other matching cluster is free. May be given more than once",
 						},
 						cli.StringFlag{
 							Name:  "provider",
 							Value: "",
 							Usage: "Which cloud provider to use when creating a cluster lease. Acceptable values are azure and google. If a value is not provided it will return an error.",
 						},
+						cli.BoolFlag{
+							Name:  "exec-credential",
+							Usage: "Write a Kubeconfig file whose user fetches the credentials of the lease with the credential command, instead of carrying them. The AUTH_TOKEN, K8S_CLAIMER_ID_TOKEN or K8S_CLAIMER_ID_TOKEN_FILE env var must be set wherever kubectl runs",
+						},
+						cli.StringFlag{
+							Name:  "exec-credential-command",
+							Value: "k8s-claimer-cli",
+							Usage: "The command that the Kubeconfig file runs to fetch the credentials of the lease if exec-credential is set",
+						},
+						cli.BoolFlag{
+							Name:  "proxy",
+							Usage: "Write a Kubeconfig file that talks to the cluster through the API proxy of the server, which cuts off access when the lease expires or is released",
+						},
 					},
 				},
 				cli.Command{
 					Name:   "delete",
 					Action: commands.DeleteLease,
-					Usage: `Releases a currently held lease. Pass the lease token as the first and only parameter to this command. For example:
+					Usage: `Releases a currently held lease. Pass the lease token as the first and only parameter to this command, and the lease secret in the secret flag or the SECRET env var. For example:
 
-k8s-claimer-cli lease delete $TOKEN
+k8s-claimer-cli lease delete --secret $SECRET $TOKEN
 `,
 					Flags: []cli.Flag{
 						cli.StringFlag{
-							Name:  "provider",
-							Value: "",
-							Usage: "Which cloud provider to use when deleting a cluster lease. Acceptable values are azure and google. If a value is not provided it will return an error.",
+							Name:   "secret",
+							Value:  "",
+							EnvVar: "SECRET",
+							Usage:  "The secret of the lease",
 						},
 					},
 				},
 			},
 		},
+		cli.Command{
+			Name:   "credential",
+			Action: commands.Credential,
+			Usage: `Fetches the credentials of a lease and prints them as a Kubernetes ExecCredential. Kubeconfig files written by 'k8s-claimer-cli lease create --exec-credential' run this command for kubectl. For example:
+
+k8s-claimer-cli --server $SERVER credential --token $TOKEN
+`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "token",
+					Value: "",
+					Usage: "The token of the lease",
+				},
+				cli.StringFlag{
+					Name:   "secret",
+					Value:  "",
+					EnvVar: api.LeaseSecretEnvVar,
+					Usage:  "The secret of the lease. Kubeconfig files written by 'k8s-claimer-cli lease create --exec-credential' pass it in the env var",
+				},
+			},
+		},
 	}
 	app.Run(os.Args)
 }
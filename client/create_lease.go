@@ -11,11 +11,10 @@ import (
 	"github.com/deis/k8s-claimer/htp"
 )
 
-// CreateLease creates a lease
-func CreateLease(server, authToken, cloudProvider, clusterVersion, clusterRegex string, durationSec int) (*api.CreateLeaseResp, error) {
+// CreateLease creates a lease that satisfies req
+func CreateLease(server, authToken string, req api.CreateLeaseReq) (*api.CreateLeaseResp, error) {
 	endpt := newEndpoint(htp.Post, server, "lease")
 	reqBuf := new(bytes.Buffer)
-	req := api.CreateLeaseReq{MaxTimeSec: durationSec, ClusterRegex: clusterRegex, ClusterVersion: clusterVersion, CloudProvider: cloudProvider}
 	if err := json.NewEncoder(reqBuf).Encode(req); err != nil {
 		return nil, errEncoding{err: err}
 	}
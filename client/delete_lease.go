@@ -3,6 +3,7 @@ package client
 import (
 	"net/http"
 
+	"github.com/deis/k8s-claimer/api"
 	"github.com/deis/k8s-claimer/htp"
 )
 
@@ -11,9 +12,10 @@ type DeleteLeaseReq struct {
 	CloudProvider string `json:"cloud_provider"`
 }
 
-// DeleteLease deletes a lease
-func DeleteLease(server, authToken, cloudProvider, leaseToken string) error {
-	endpt := newEndpoint(htp.Delete, server, "lease/"+cloudProvider+"/"+leaseToken)
+// DeleteLease deletes a lease with its secret. The server looks up the lease's cloud provider from
+// the token
+func DeleteLease(server, authToken, leaseToken, leaseSecret string) error {
+	endpt := newEndpoint(htp.Delete, server, "lease/"+leaseToken).withHeader(api.LeaseSecretHeader, leaseSecret)
 	resp, err := endpt.executeReq(getHTTPClient(), nil, authToken)
 	if err != nil {
 		return errHTTPRequest{endpoint: endpt.String(), err: err}
@@ -10,9 +10,10 @@ import (
 )
 
 type endpoint struct {
-	host   string
-	path   string
-	method htp.Method
+	host    string
+	path    string
+	method  htp.Method
+	headers map[string]string
 }
 
 func newEndpoint(method htp.Method, host, path string) endpoint {
@@ -25,6 +26,16 @@ func newEndpoint(method htp.Method, host, path string) endpoint {
 	return endpoint{host: host, path: path, method: method}
 }
 
+// withHeader returns a copy of e whose requests carry the given header
+func (e endpoint) withHeader(key, val string) endpoint {
+	headers := map[string]string{key: val}
+	for k, v := range e.headers {
+		headers[k] = v
+	}
+	e.headers = headers
+	return e
+}
+
 func (e endpoint) String() string {
 	return fmt.Sprintf("%s %s/%s", e.method, e.host, e.path)
 }
@@ -39,6 +50,9 @@ func (e endpoint) executeReq(cl *http.Client, body io.Reader, authToken string)
 		return nil, err
 	}
 	req.Header.Set("Authorization", authToken)
+	for key, val := range e.headers {
+		req.Header.Set(key, val)
+	}
 	return cl.Do(req)
 }
 
@@ -0,0 +1,34 @@
+package client
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/deis/k8s-claimer/api"
+	"github.com/deis/k8s-claimer/htp"
+)
+
+// GetLeaseCredential fetches the credentials of the lease with the given token and secret
+func GetLeaseCredential(server, authToken, leaseToken, leaseSecret string) (*api.LeaseCredentialResp, error) {
+	endpt := newEndpoint(htp.Get, server, "credential/"+leaseToken).withHeader(api.LeaseSecretHeader, leaseSecret)
+	res, err := endpt.executeReq(getHTTPClient(), nil, authToken)
+	if err != nil {
+		return nil, errHTTPRequest{endpoint: endpt.String(), err: err}
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		bodyBytes, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			log.Printf("Unable to read body of response:%s\n", err)
+			return nil, err
+		}
+		message := string(bodyBytes)
+		return nil, APIError{endpoint: endpt.String(), code: res.StatusCode, message: message}
+	}
+	decodedRes, err := api.DecodeLeaseCredentialResp(res.Body)
+	if err != nil {
+		return nil, errDecoding{err: err}
+	}
+	return decodedRes, nil
+}
@@ -1,14 +1,36 @@
 package config
 
-// Azure contains the necessary configuration to talk to the Azure Cloud API
+import (
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+// Azure contains the necessary configuration to talk to the Azure Cloud API. Environment is the
+// name of the Azure cloud that the subscription is in, such as AzureChinaCloud. If ResourceGroups
+// is set, only clusters in those resource groups are listed. Either way, only clusters that carry
+// ClaimableTag and aren't in Exclude can be leased
 type Azure struct {
-	ClientID       string `envconfig:"AZURE_CLIENT_ID"`
-	ClientSecret   string `envconfig:"AZURE_CLIENT_SECRET"`
-	TenantID       string `envconfig:"AZURE_TENANT_ID"`
-	SubscriptionID string `envconfig:"AZURE_SUBSCRIPTION_ID"`
+	ClientID       string   `envconfig:"AZURE_CLIENT_ID"`
+	ClientSecret   string   `envconfig:"AZURE_CLIENT_SECRET"`
+	TenantID       string   `envconfig:"AZURE_TENANT_ID"`
+	SubscriptionID string   `envconfig:"AZURE_SUBSCRIPTION_ID"`
+	Environment    string   `envconfig:"AZURE_ENVIRONMENT" default:"AzurePublicCloud"`
+	ResourceGroups []string `envconfig:"AZURE_RESOURCE_GROUPS"`
+	ClaimableTag   string   `envconfig:"AZURE_CLAIMABLE_TAG" default:"k8s-claimer=true"`
+	Exclude        []string `envconfig:"AZURE_EXCLUDE"`
 }
 
 //ValidConfig will return true if there are values set for each Property of the Azure config object
 func (a *Azure) ValidConfig() bool {
-	return a.SubscriptionID != "" && a.ClientID != "" && a.ClientSecret != "" && a.TenantID != ""
+	return a.SubscriptionID != "" && a.ClientID != "" && a.ClientSecret != "" && a.TenantID != "" && a.ClaimableTag != ""
+}
+
+// CloudEnvironment returns the endpoints of the Azure cloud named by a.Environment. Returns an
+// error if it's not the name of a known cloud
+func (a *Azure) CloudEnvironment() (azure.Environment, error) {
+	return azure.EnvironmentFromName(a.Environment)
+}
+
+// Membership returns the rules that decide which Azure clusters can be leased
+func (a *Azure) Membership() PoolMembership {
+	return PoolMembership{Label: a.ClaimableTag, Exclude: a.Exclude}
 }
@@ -0,0 +1,18 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+func TestAzureCloudEnvironment(t *testing.T) {
+	a := &Azure{Environment: "AzureChinaCloud"}
+	env, err := a.CloudEnvironment()
+	assert.NoErr(t, err)
+	assert.Equal(t, env.Name, "AzureChinaCloud", "environment name")
+
+	a.Environment = "AzureMoonCloud"
+	_, err = a.CloudEnvironment()
+	assert.True(t, err != nil, "no error for an unknown cloud")
+}
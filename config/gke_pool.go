@@ -0,0 +1,55 @@
+package config
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+var (
+	errInvalidMinFree     = errors.New("GKE_POOL_MIN_FREE must not be negative")
+	errInvalidIdleTimeout = errors.New("GKE_POOL_IDLE_TIMEOUT must be greater than 0")
+	errInvalidInterval    = errors.New("GKE_POOL_INTERVAL must be greater than 0")
+)
+
+// GKEPool is the envconfig-compatible configuration for the GKE pool manager, which scales the
+// node pools of idle clusters down to zero nodes and keeps MinFree free clusters of each version
+// running
+type GKEPool struct {
+	Enabled          bool          `envconfig:"GKE_POOL_MANAGER" default:"false"`
+	MinFree          int           `envconfig:"GKE_POOL_MIN_FREE" default:"1"`
+	IdleTimeout      time.Duration `envconfig:"GKE_POOL_IDLE_TIMEOUT" default:"2h"`
+	Interval         time.Duration `envconfig:"GKE_POOL_INTERVAL" default:"5m"`
+	OperationTimeout time.Duration `envconfig:"GKE_POOL_OPERATION_TIMEOUT" default:"10m"`
+	PollInterval     time.Duration `envconfig:"GKE_POOL_POLL_INTERVAL" default:"10s"`
+}
+
+// Validate returns an error if g is enabled but can't be used to manage the pool
+func (g GKEPool) Validate() error {
+	if !g.Enabled {
+		return nil
+	}
+	if g.MinFree < 0 {
+		return errInvalidMinFree
+	}
+	if g.IdleTimeout <= 0 {
+		return errInvalidIdleTimeout
+	}
+	if g.Interval <= 0 {
+		return errInvalidInterval
+	}
+	return nil
+}
+
+// Print will render the current pool manager configuration
+func (g GKEPool) Print() {
+	log.Println("GKE Pool Manager Configuration:")
+	log.Printf("\tEnabled?:%v\n", g.Enabled)
+	if !g.Enabled {
+		return
+	}
+	log.Printf("\tMin Free Clusters Per Version:%d\n", g.MinFree)
+	log.Printf("\tIdle Timeout:%s\n", g.IdleTimeout)
+	log.Printf("\tInterval:%s\n", g.Interval)
+	log.Printf("\tOperation Timeout:%s\n", g.OperationTimeout)
+}
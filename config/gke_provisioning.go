@@ -0,0 +1,78 @@
+package config
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+var (
+	errNoProvisioningZone      = errors.New("GKE_PROVISIONING_ZONE must be set when GOOGLE_CLOUD_ZONE is -")
+	errProvisioningZoneNotUsed = errors.New("GKE_PROVISIONING_ZONE must be GOOGLE_CLOUD_ZONE, or clusters it creates can't be leased")
+	errInvalidMaxClusters      = errors.New("GKE_MAX_CLUSTERS must be greater than 0")
+	errInvalidProvisionedNodes = errors.New("GKE_PROVISIONING_NODE_COUNT must be greater than 0")
+)
+
+// GKEProvisioning is the envconfig-compatible configuration for creating GKE clusters on demand,
+// when no free cluster matches a lease request. The cluster template is made of ClusterVersion,
+// MachineType, NodeCount and Labels
+type GKEProvisioning struct {
+	Enabled        bool              `envconfig:"GKE_PROVISIONING" default:"false"`
+	Zone           string            `envconfig:"GKE_PROVISIONING_ZONE"`
+	MaxClusters    int               `envconfig:"GKE_MAX_CLUSTERS" default:"10"`
+	NamePrefix     string            `envconfig:"GKE_PROVISIONING_NAME_PREFIX" default:"k8s-claimer-"`
+	ClusterVersion string            `envconfig:"GKE_PROVISIONING_CLUSTER_VERSION"`
+	MachineType    string            `envconfig:"GKE_PROVISIONING_MACHINE_TYPE" default:"n1-standard-2"`
+	NodeCount      int64             `envconfig:"GKE_PROVISIONING_NODE_COUNT" default:"3"`
+	Labels         map[string]string `envconfig:"GKE_PROVISIONING_LABELS"`
+	Timeout        time.Duration     `envconfig:"GKE_PROVISIONING_TIMEOUT" default:"15m"`
+	PollInterval   time.Duration     `envconfig:"GKE_PROVISIONING_POLL_INTERVAL" default:"10s"`
+}
+
+// ZoneFor returns the zone that clusters are created in, given the zone that clusters are
+// leased from. Returns g.Zone if it's set, and leaseZone otherwise
+func (g GKEProvisioning) ZoneFor(leaseZone string) string {
+	if g.Zone != "" {
+		return g.Zone
+	}
+	return leaseZone
+}
+
+// Validate returns an error if g is enabled but can't be used to create clusters. leaseZone is
+// the zone that clusters are leased from
+func (g GKEProvisioning) Validate(leaseZone string) error {
+	if !g.Enabled {
+		return nil
+	}
+	zone := g.ZoneFor(leaseZone)
+	if zone == "" || zone == "-" {
+		return errNoProvisioningZone
+	}
+	if leaseZone != "-" && zone != leaseZone {
+		return errProvisioningZoneNotUsed
+	}
+	if g.MaxClusters <= 0 {
+		return errInvalidMaxClusters
+	}
+	if g.NodeCount <= 0 {
+		return errInvalidProvisionedNodes
+	}
+	return nil
+}
+
+// Print will render the current provisioning configuration
+func (g GKEProvisioning) Print() {
+	log.Println("GKE Provisioning Configuration:")
+	log.Printf("\tEnabled?:%v\n", g.Enabled)
+	if !g.Enabled {
+		return
+	}
+	log.Printf("\tZone:%s\n", g.Zone)
+	log.Printf("\tMax Clusters:%d\n", g.MaxClusters)
+	log.Printf("\tName Prefix:%s\n", g.NamePrefix)
+	log.Printf("\tCluster Version:%s\n", g.ClusterVersion)
+	log.Printf("\tMachine Type:%s\n", g.MachineType)
+	log.Printf("\tNode Count:%d\n", g.NodeCount)
+	log.Printf("\tLabels:%v\n", g.Labels)
+	log.Printf("\tTimeout:%s\n", g.Timeout)
+}
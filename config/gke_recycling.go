@@ -0,0 +1,54 @@
+package config
+
+import (
+	"errors"
+	"log"
+	"regexp"
+	"time"
+)
+
+var (
+	errInvalidRecycleInterval = errors.New("GKE_RECYCLE_INTERVAL must be greater than 0")
+)
+
+// GKERecycling is the envconfig-compatible configuration for recycling GKE clusters by recreating
+// them after their leases are released, instead of deleting their namespaces. Only clusters whose
+// names match ClusterRegex are recycled, and none are if it's empty
+type GKERecycling struct {
+	ClusterRegex string        `envconfig:"GKE_RECYCLE_CLUSTER_REGEX"`
+	Timeout      time.Duration `envconfig:"GKE_RECYCLE_TIMEOUT" default:"30m"`
+	PollInterval time.Duration `envconfig:"GKE_RECYCLE_POLL_INTERVAL" default:"10s"`
+	// Interval is how often clusters whose leases expired, or whose recycle was interrupted, are
+	// looked for
+	Interval time.Duration `envconfig:"GKE_RECYCLE_INTERVAL" default:"1m"`
+}
+
+// Enabled returns true if any cluster is recycled
+func (g GKERecycling) Enabled() bool {
+	return g.ClusterRegex != ""
+}
+
+// Validate returns an error if g is enabled but g.ClusterRegex isn't a valid regular expression,
+// or g.Interval isn't positive
+func (g GKERecycling) Validate() error {
+	if !g.Enabled() {
+		return nil
+	}
+	if g.Interval <= 0 {
+		return errInvalidRecycleInterval
+	}
+	_, err := regexp.Compile(g.ClusterRegex)
+	return err
+}
+
+// Print will render the current recycling configuration
+func (g GKERecycling) Print() {
+	log.Println("GKE Recycling Configuration:")
+	log.Printf("\tEnabled?:%v\n", g.Enabled())
+	if !g.Enabled() {
+		return
+	}
+	log.Printf("\tCluster Regex:%s\n", g.ClusterRegex)
+	log.Printf("\tTimeout:%s\n", g.Timeout)
+	log.Printf("\tInterval:%s\n", g.Interval)
+}
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// allLocations is the GKE location that stands for every zone and region of a project
+const allLocations = "-"
+
+type errMalformedScope struct {
+	scope string
+}
+
+func (e errMalformedScope) Error() string {
+	return fmt.Sprintf("scope %q isn't in the project/location format", e.scope)
+}
+
+// GKEScope is a Google Cloud project and a location in it that GKE clusters are leased from. The
+// location is a zone, a region (for regional clusters) or - for every zone and region
+type GKEScope struct {
+	ProjectID string `json:"project"`
+	Location  string `json:"location"`
+}
+
+// ParseGKEScope parses a scope in the project/location format. If the location is omitted, every
+// zone and region of the project is in the scope
+func ParseGKEScope(str string) (GKEScope, error) {
+	parts := strings.Split(strings.TrimSpace(str), "/")
+	if len(parts) > 2 || parts[0] == "" {
+		return GKEScope{}, errMalformedScope{scope: str}
+	}
+	scope := GKEScope{ProjectID: parts[0], Location: allLocations}
+	if len(parts) == 2 {
+		if parts[1] == "" {
+			return GKEScope{}, errMalformedScope{scope: str}
+		}
+		scope.Location = parts[1]
+	}
+	return scope, nil
+}
+
+// String is the fmt.Stringer interface implementation. It returns the scope in the
+// project/location format
+func (s GKEScope) String() string {
+	return s.ProjectID + "/" + s.Location
+}
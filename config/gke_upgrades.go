@@ -0,0 +1,84 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	errInvalidUpgradeInterval = errors.New("GKE_UPGRADE_INTERVAL must be greater than 0")
+)
+
+type errMalformedUpgradeTarget struct {
+	target string
+}
+
+func (e errMalformedUpgradeTarget) Error() string {
+	return fmt.Sprintf("upgrade target %q isn't in the regex=version format", e.target)
+}
+
+// UpgradeTarget is the version that the GKE clusters whose names match ClusterRegex are upgraded to
+type UpgradeTarget struct {
+	ClusterRegex *regexp.Regexp
+	Version      string
+}
+
+// GKEUpgrades is the envconfig-compatible configuration for upgrading idle GKE clusters to target
+// versions. Each of Targets is a cluster name regex and a version in the regex=version format.
+// A cluster is upgraded to the version of the first target whose regex matches its name
+type GKEUpgrades struct {
+	Targets      []string      `envconfig:"GKE_UPGRADE_TARGETS"`
+	Interval     time.Duration `envconfig:"GKE_UPGRADE_INTERVAL" default:"10m"`
+	Timeout      time.Duration `envconfig:"GKE_UPGRADE_TIMEOUT" default:"1h"`
+	PollInterval time.Duration `envconfig:"GKE_UPGRADE_POLL_INTERVAL" default:"10s"`
+}
+
+// Enabled returns true if any upgrade target is configured
+func (g GKEUpgrades) Enabled() bool {
+	return len(g.Targets) > 0
+}
+
+// ParseTargets parses g.Targets, in order. Returns nil and an error if any of them is malformed
+func (g GKEUpgrades) ParseTargets() ([]UpgradeTarget, error) {
+	ret := make([]UpgradeTarget, len(g.Targets))
+	for i, target := range g.Targets {
+		sep := strings.LastIndex(target, "=")
+		if sep <= 0 || sep == len(target)-1 {
+			return nil, errMalformedUpgradeTarget{target: target}
+		}
+		regex, err := regexp.Compile(target[:sep])
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = UpgradeTarget{ClusterRegex: regex, Version: target[sep+1:]}
+	}
+	return ret, nil
+}
+
+// Validate returns an error if g is enabled but can't be used to upgrade clusters
+func (g GKEUpgrades) Validate() error {
+	if !g.Enabled() {
+		return nil
+	}
+	if g.Interval <= 0 {
+		return errInvalidUpgradeInterval
+	}
+	_, err := g.ParseTargets()
+	return err
+}
+
+// Print will render the current upgrade configuration
+func (g GKEUpgrades) Print() {
+	log.Println("GKE Upgrade Configuration:")
+	log.Printf("\tEnabled?:%v\n", g.Enabled())
+	if !g.Enabled() {
+		return
+	}
+	log.Printf("\tTargets:%v\n", g.Targets)
+	log.Printf("\tInterval:%s\n", g.Interval)
+	log.Printf("\tTimeout:%s\n", g.Timeout)
+}
@@ -0,0 +1,26 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+func TestParseUpgradeTargets(t *testing.T) {
+	conf := GKEUpgrades{Targets: []string{"^ci-=1.7.8-gke.0", "a=b=1.8.1-gke.1"}}
+	targets, err := conf.ParseTargets()
+	assert.NoErr(t, err)
+	assert.Equal(t, len(targets), 2, "number of targets")
+	assert.Equal(t, targets[0].ClusterRegex.String(), "^ci-", "first target regex")
+	assert.Equal(t, targets[0].Version, "1.7.8-gke.0", "first target version")
+	assert.Equal(t, targets[1].ClusterRegex.String(), "a=b", "second target regex")
+	assert.Equal(t, targets[1].Version, "1.8.1-gke.1", "second target version")
+
+	for _, target := range []string{"1.7.8", "=1.7.8", "^ci-=", "(=1.7.8"} {
+		conf := GKEUpgrades{Targets: []string{target}, Interval: 1}
+		_, err := conf.ParseTargets()
+		assert.True(t, err != nil, "no error for target %s", target)
+		assert.True(t, conf.Validate() != nil, "no validation error for target %s", target)
+	}
+	assert.NoErr(t, GKEUpgrades{}.Validate())
+}
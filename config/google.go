@@ -4,14 +4,54 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 )
 
+const (
+	// GoogleCredentialsAccountFile authenticates with the service account JSON in
+	// GOOGLE_CLOUD_ACCOUNT_FILE
+	GoogleCredentialsAccountFile = "account-file"
+	// GoogleCredentialsKeyFile authenticates with the service account key file at
+	// GOOGLE_CLOUD_ACCOUNT_FILE_PATH
+	GoogleCredentialsKeyFile = "key-file"
+	// GoogleCredentialsDefault authenticates with Application Default Credentials
+	GoogleCredentialsDefault = "default"
+	// GoogleCredentialsMetadata authenticates with the service account that the metadata server
+	// hands out, which is the workload identity's on GKE
+	GoogleCredentialsMetadata = "metadata"
+)
+
+type errUnknownGoogleCredentials struct {
+	source string
+}
+
+func (e errUnknownGoogleCredentials) Error() string {
+	return fmt.Sprintf("unknown GOOGLE_CLOUD_CREDENTIALS %q", e.source)
+}
+
+type errMissingGoogleCredentials struct {
+	source string
+	envVar string
+}
+
+func (e errMissingGoogleCredentials) Error() string {
+	return fmt.Sprintf("GOOGLE_CLOUD_CREDENTIALS is %q, but %s isn't set", e.source, e.envVar)
+}
+
 // Google contains the Google cloud related configuration, including credentials and
-// project info
+// project info. Clusters are leased from every one of Scopes, in the project/location format, or
+// from ProjectID and Zone if Scopes is empty. Only clusters that carry PoolLabel and aren't in
+// Exclude can be leased. Credentials picks where the GKE credentials come from, and is inferred
+// from the other fields if it's empty
 type Google struct {
-	AccountFileJSON string `envconfig:"GOOGLE_CLOUD_ACCOUNT_FILE"`
-	ProjectID       string `envconfig:"GOOGLE_CLOUD_PROJECT_ID"`
-	Zone            string `envconfig:"GOOGLE_CLOUD_ZONE" default:"-"`
+	Credentials     string   `envconfig:"GOOGLE_CLOUD_CREDENTIALS"`
+	AccountFileJSON string   `envconfig:"GOOGLE_CLOUD_ACCOUNT_FILE"`
+	AccountFilePath string   `envconfig:"GOOGLE_CLOUD_ACCOUNT_FILE_PATH"`
+	ProjectID       string   `envconfig:"GOOGLE_CLOUD_PROJECT_ID"`
+	Zone            string   `envconfig:"GOOGLE_CLOUD_ZONE" default:"-"`
+	Scopes          []string `envconfig:"GOOGLE_CLOUD_SCOPES"`
+	PoolLabel       string   `envconfig:"GOOGLE_CLOUD_POOL_LABEL" default:"k8s-claimer=true"`
+	Exclude         []string `envconfig:"GOOGLE_CLOUD_EXCLUDE"`
 	AccountFile     AccountFile
 }
 
@@ -43,7 +83,79 @@ func AccountInfo(fileBase64 string) (*AccountFile, error) {
 	return ret, nil
 }
 
-//ValidConfig will return true if there are values set for each Property of the Google config object
+// ClusterScopes returns the scopes that clusters are leased from, in order. Returns nil and an
+// error if any of g.Scopes is malformed
+func (g *Google) ClusterScopes() ([]GKEScope, error) {
+	if len(g.Scopes) == 0 {
+		return []GKEScope{{ProjectID: g.ProjectID, Location: g.Zone}}, nil
+	}
+	ret := make([]GKEScope, len(g.Scopes))
+	for i, str := range g.Scopes {
+		scope, err := ParseGKEScope(str)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = scope
+	}
+	return ret, nil
+}
+
+// CredentialsSource returns where the GKE credentials come from, which is one of the
+// GoogleCredentials constants. If g.Credentials is empty, it's GoogleCredentialsAccountFile if
+// g.AccountFileJSON is set, GoogleCredentialsKeyFile if g.AccountFilePath is set and
+// GoogleCredentialsDefault otherwise. Returns an error if g.Credentials is unknown, or if it
+// needs a field that isn't set
+func (g *Google) CredentialsSource() (string, error) {
+	switch g.Credentials {
+	case "":
+		if g.AccountFileJSON != "" {
+			return GoogleCredentialsAccountFile, nil
+		}
+		if g.AccountFilePath != "" {
+			return GoogleCredentialsKeyFile, nil
+		}
+		return GoogleCredentialsDefault, nil
+	case GoogleCredentialsAccountFile:
+		if g.AccountFileJSON == "" {
+			return "", errMissingGoogleCredentials{source: g.Credentials, envVar: "GOOGLE_CLOUD_ACCOUNT_FILE"}
+		}
+	case GoogleCredentialsKeyFile:
+		if g.AccountFilePath == "" {
+			return "", errMissingGoogleCredentials{source: g.Credentials, envVar: "GOOGLE_CLOUD_ACCOUNT_FILE_PATH"}
+		}
+	case GoogleCredentialsDefault, GoogleCredentialsMetadata:
+	default:
+		return "", errUnknownGoogleCredentials{source: g.Credentials}
+	}
+	return g.Credentials, nil
+}
+
+// Membership returns the rules that decide which GKE clusters can be leased
+func (g *Google) Membership() PoolMembership {
+	return PoolMembership{Label: g.PoolLabel, Exclude: g.Exclude}
+}
+
+// PrimaryScope returns the first scope that clusters are leased from. New clusters are created
+// in its project
+func (g *Google) PrimaryScope() GKEScope {
+	scopes, err := g.ClusterScopes()
+	if err != nil || len(scopes) == 0 {
+		return GKEScope{ProjectID: g.ProjectID, Location: g.Zone}
+	}
+	return scopes[0]
+}
+
+//ValidConfig will return true if there are values set for each Property of the Google config object.
+//The credentials aren't checked, since they may come from the environment GKE runs in
 func (g *Google) ValidConfig() bool {
-	return g.AccountFileJSON != "" && g.ProjectID != "" && g.Zone != ""
+	scopes, err := g.ClusterScopes()
+	if err != nil {
+		return false
+	}
+	for _, scope := range scopes {
+		if scope.ProjectID == "" || scope.Location == "" {
+			return false
+		}
+	}
+	return true
 }
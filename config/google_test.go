@@ -22,3 +22,67 @@ func TestGoogleAccountInfo(t *testing.T) {
 	assert.Equal(t, f.ClientEmail, "aaron@deis.com", "client email")
 	assert.Equal(t, f.ClientID, "aaronschlesinger", "client ID")
 }
+
+func TestGoogleClusterScopes(t *testing.T) {
+	g := &Google{AccountFileJSON: "{}", ProjectID: "proj1", Zone: "-"}
+	scopes, err := g.ClusterScopes()
+	assert.NoErr(t, err)
+	assert.Equal(t, scopes, []GKEScope{{ProjectID: "proj1", Location: "-"}}, "scopes")
+	assert.True(t, g.ValidConfig(), "config with a project isn't valid")
+
+	g.Scopes = []string{"proj2/us-west1-a", "proj3/us-central1", "proj4"}
+	scopes, err = g.ClusterScopes()
+	assert.NoErr(t, err)
+	assert.Equal(t, scopes, []GKEScope{
+		{ProjectID: "proj2", Location: "us-west1-a"},
+		{ProjectID: "proj3", Location: "us-central1"},
+		{ProjectID: "proj4", Location: "-"},
+	}, "scopes")
+	assert.Equal(t, g.PrimaryScope(), scopes[0], "primary scope")
+	assert.True(t, g.ValidConfig(), "config with scopes isn't valid")
+
+	g.Scopes = []string{"proj2/us-west1-a/extra"}
+	_, err = g.ClusterScopes()
+	assert.True(t, err != nil, "no error for a malformed scope")
+	assert.False(t, g.ValidConfig(), "config with a malformed scope is valid")
+
+	g = &Google{AccountFileJSON: "{}", Zone: "-"}
+	assert.False(t, g.ValidConfig(), "config without a project is valid")
+}
+
+func TestGoogleCredentialsSource(t *testing.T) {
+	g := &Google{}
+	src, err := g.CredentialsSource()
+	assert.NoErr(t, err)
+	assert.Equal(t, src, GoogleCredentialsDefault, "credentials source")
+
+	g.AccountFilePath = "/var/run/secrets/google/key.json"
+	src, err = g.CredentialsSource()
+	assert.NoErr(t, err)
+	assert.Equal(t, src, GoogleCredentialsKeyFile, "credentials source")
+
+	g.AccountFileJSON = "{}"
+	src, err = g.CredentialsSource()
+	assert.NoErr(t, err)
+	assert.Equal(t, src, GoogleCredentialsAccountFile, "credentials source")
+
+	g.Credentials = GoogleCredentialsMetadata
+	src, err = g.CredentialsSource()
+	assert.NoErr(t, err)
+	assert.Equal(t, src, GoogleCredentialsMetadata, "credentials source")
+
+	g = &Google{Credentials: GoogleCredentialsKeyFile}
+	_, err = g.CredentialsSource()
+	assert.Equal(t, err, errMissingGoogleCredentials{source: GoogleCredentialsKeyFile, envVar: "GOOGLE_CLOUD_ACCOUNT_FILE_PATH"}, "error")
+
+	g = &Google{Credentials: "gcloud"}
+	_, err = g.CredentialsSource()
+	assert.Equal(t, err, errUnknownGoogleCredentials{source: "gcloud"}, "error")
+}
+
+func TestGoogleValidConfigWithoutAccountFile(t *testing.T) {
+	g := &Google{ProjectID: "proj1", Zone: "-"}
+	assert.True(t, g.ValidConfig(), "config with a project but no account file isn't valid")
+	g = &Google{Zone: "-"}
+	assert.False(t, g.ValidConfig(), "unconfigured config is valid")
+}
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+var (
+	errInvalidInventoryInterval     = errors.New("INVENTORY_REFRESH_INTERVAL must be greater than 0")
+	errInvalidInventoryMaxStaleness = errors.New("INVENTORY_MAX_STALENESS must not be negative")
+)
+
+// Inventory is the envconfig-compatible configuration for the inventory cache, which keeps the
+// clusters that each provider lists in memory and relists them every RefreshInterval. If a
+// provider's API fails, clusters that were listed less than MaxStaleness ago are still served
+type Inventory struct {
+	Enabled         bool          `envconfig:"INVENTORY_CACHE" default:"true"`
+	RefreshInterval time.Duration `envconfig:"INVENTORY_REFRESH_INTERVAL" default:"1m"`
+	MaxStaleness    time.Duration `envconfig:"INVENTORY_MAX_STALENESS" default:"10m"`
+}
+
+// Validate returns an error if i is enabled but can't be used to cache the inventory
+func (i Inventory) Validate() error {
+	if !i.Enabled {
+		return nil
+	}
+	if i.RefreshInterval <= 0 {
+		return errInvalidInventoryInterval
+	}
+	if i.MaxStaleness < 0 {
+		return errInvalidInventoryMaxStaleness
+	}
+	return nil
+}
+
+// Print will render the current inventory cache configuration
+func (i Inventory) Print() {
+	log.Println("Inventory Cache Configuration:")
+	log.Printf("\tEnabled?:%v\n", i.Enabled)
+	if !i.Enabled {
+		return
+	}
+	log.Printf("\tRefresh Interval:%s\n", i.RefreshInterval)
+	log.Printf("\tMax Staleness:%s\n", i.MaxStaleness)
+}
@@ -0,0 +1,106 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+var (
+	errNoLeaseCredentialsNamespace    = errors.New("LEASE_CREDENTIALS_NAMESPACE must not be empty")
+	errInvalidLeaseCredentialsTimeout = errors.New("LEASE_CREDENTIALS_TIMEOUT must be greater than 0")
+	errInvalidLeaseCredentialsExecTTL = errors.New("LEASE_CREDENTIALS_EXEC_TTL must be greater than 0")
+	errInvalidLeaseCredentialsRevoke  = errors.New("LEASE_CREDENTIALS_REVOKE_INTERVAL must be greater than 0")
+
+	// systemNamespaces hold the service accounts of the cluster's own components, which lessees
+	// mustn't be able to run pods as, or see the tokens of
+	systemNamespaces = map[string]struct{}{
+		"kube-system": struct{}{},
+		"kube-public": struct{}{},
+	}
+)
+
+type errLeaseCredentialsNamespace struct {
+	namespace string
+}
+
+func (e errLeaseCredentialsNamespace) Error() string {
+	return fmt.Sprintf("LEASE_CREDENTIALS_NAMESPACE must be a namespace of its own, not %s", e.namespace)
+}
+
+type errLeaseCredentialsWorkNamespace struct {
+	namespace string
+}
+
+func (e errLeaseCredentialsWorkNamespace) Error() string {
+	return fmt.Sprintf("LEASE_CREDENTIALS_WORK_NAMESPACES must not hold %s, since lessees could run pods as its service accounts", e.namespace)
+}
+
+// LeaseCredentials is the envconfig-compatible configuration for per-lease credentials. Each
+// lease gets a service account in Namespace of the leased cluster, instead of the cluster's admin
+// credentials. The service account can look at the cluster, but not at its secrets, and can only
+// deploy to WorkNamespaces, so it can't run pods as the service accounts of the cluster's own
+// components. Namespace must not hold any other service accounts, since lessees could otherwise
+// find out their tokens. Calls to the leased cluster give up after Timeout. kubectl caches the
+// credentials that the exec credential plugin of the CLI fetches for ExecTTL, and then fetches
+// them again, but the token itself doesn't expire. The credentials of ended leases that weren't
+// revoked are revoked again every RevokeInterval
+type LeaseCredentials struct {
+	Enabled        bool          `envconfig:"LEASE_CREDENTIALS" default:"true"`
+	Namespace      string        `envconfig:"LEASE_CREDENTIALS_NAMESPACE" default:"k8s-claimer-leases"`
+	WorkNamespaces []string      `envconfig:"LEASE_CREDENTIALS_WORK_NAMESPACES" default:"default"`
+	Timeout        time.Duration `envconfig:"LEASE_CREDENTIALS_TIMEOUT" default:"30s"`
+	ExecTTL        time.Duration `envconfig:"LEASE_CREDENTIALS_EXEC_TTL" default:"5m"`
+	RevokeInterval time.Duration `envconfig:"LEASE_CREDENTIALS_REVOKE_INTERVAL" default:"1m"`
+}
+
+// WorkNamespaceNames returns the non-empty WorkNamespaces, since envconfig parses an empty list
+// as one empty string
+func (l LeaseCredentials) WorkNamespaceNames() []string {
+	var ret []string
+	for _, namespace := range l.WorkNamespaces {
+		if namespace = strings.TrimSpace(namespace); namespace != "" {
+			ret = append(ret, namespace)
+		}
+	}
+	return ret
+}
+
+// Validate returns an error if the credentials of leases can't be managed with l. The credentials
+// of existing leases are still revoked when l isn't enabled, so it's always validated
+func (l LeaseCredentials) Validate() error {
+	if l.Namespace == "" {
+		return errNoLeaseCredentialsNamespace
+	}
+	if _, ok := systemNamespaces[l.Namespace]; ok || l.Namespace == "default" {
+		return errLeaseCredentialsNamespace{namespace: l.Namespace}
+	}
+	for _, namespace := range l.WorkNamespaceNames() {
+		if _, ok := systemNamespaces[namespace]; ok || namespace == l.Namespace {
+			return errLeaseCredentialsWorkNamespace{namespace: namespace}
+		}
+	}
+	if l.Timeout <= 0 {
+		return errInvalidLeaseCredentialsTimeout
+	}
+	if l.ExecTTL <= 0 {
+		return errInvalidLeaseCredentialsExecTTL
+	}
+	if l.RevokeInterval <= 0 {
+		return errInvalidLeaseCredentialsRevoke
+	}
+	return nil
+}
+
+// Print will render the current lease credentials configuration
+func (l LeaseCredentials) Print() {
+	log.Println("Lease Credentials Configuration:")
+	log.Printf("\tEnabled?:%v\n", l.Enabled)
+	log.Printf("\tNamespace:%s\n", l.Namespace)
+	log.Printf("\tWork Namespaces:%s\n", strings.Join(l.WorkNamespaceNames(), ","))
+	log.Printf("\tTimeout:%s\n", l.Timeout)
+	log.Printf("\tExec TTL:%s\n", l.ExecTTL)
+	log.Printf("\tRevoke Interval:%s\n", l.RevokeInterval)
+}
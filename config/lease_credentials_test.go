@@ -0,0 +1,35 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+)
+
+func TestLeaseCredentialsValidate(t *testing.T) {
+	conf := LeaseCredentials{
+		Namespace:      "k8s-claimer-leases",
+		WorkNamespaces: []string{"default", " ci "},
+		Timeout:        time.Second,
+		ExecTTL:        time.Second,
+		RevokeInterval: time.Second,
+	}
+	assert.NoErr(t, conf.Validate())
+	assert.Equal(t, conf.WorkNamespaceNames(), []string{"default", "ci"}, "work namespaces")
+
+	conf.WorkNamespaces = []string{""}
+	assert.NoErr(t, conf.Validate())
+	assert.Equal(t, len(conf.WorkNamespaceNames()), 0, "number of work namespaces")
+
+	for _, namespace := range []string{"kube-system", "kube-public", "default"} {
+		conf.Namespace = namespace
+		assert.Err(t, errLeaseCredentialsNamespace{namespace: namespace}, conf.Validate())
+	}
+
+	conf.Namespace = "k8s-claimer-leases"
+	for _, namespace := range []string{"kube-system", "kube-public", "k8s-claimer-leases"} {
+		conf.WorkNamespaces = []string{"default", namespace}
+		assert.Err(t, errLeaseCredentialsWorkNamespace{namespace: namespace}, conf.Validate())
+	}
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"errors"
+	"log"
+)
+
+var (
+	errNoOIDCAudience      = errors.New("OIDC_AUDIENCE must be set if OIDC_ISSUER_URL is")
+	errNoOIDCUsernameClaim = errors.New("OIDC_USERNAME_CLAIM must not be empty")
+)
+
+// OIDC is the envconfig-compatible configuration for authenticating with the ID tokens of an OIDC
+// issuer, which are verified with the issuer's keys from JWKSURL, or from the URL in the issuer's
+// discovery document if that's empty. The tokens must be for Audience. The name of their holder
+// is in UsernameClaim, and Roles grant them roles by the values of their GroupsClaim or other
+// claims. The email claim is only used if the email_verified claim is true. Holders that no role
+// rule matches get DefaultRole, or are refused if that's empty
+type OIDC struct {
+	IssuerURL     string   `envconfig:"OIDC_ISSUER_URL"`
+	Audience      string   `envconfig:"OIDC_AUDIENCE"`
+	JWKSURL       string   `envconfig:"OIDC_JWKS_URL"`
+	UsernameClaim string   `envconfig:"OIDC_USERNAME_CLAIM" default:"email"`
+	GroupsClaim   string   `envconfig:"OIDC_GROUPS_CLAIM" default:"groups"`
+	Roles         []string `envconfig:"OIDC_ROLES"`
+	DefaultRole   string   `envconfig:"OIDC_DEFAULT_ROLE"`
+}
+
+// Enabled returns true if ID tokens are accepted
+func (o OIDC) Enabled() bool {
+	return o.IssuerURL != ""
+}
+
+// Validate returns an error if o is enabled but can't be used to verify ID tokens. The role rules
+// are validated when they're parsed
+func (o OIDC) Validate() error {
+	if !o.Enabled() {
+		return nil
+	}
+	if o.Audience == "" {
+		return errNoOIDCAudience
+	}
+	if o.UsernameClaim == "" {
+		return errNoOIDCUsernameClaim
+	}
+	return nil
+}
+
+// Print will render the current OIDC configuration
+func (o OIDC) Print() {
+	log.Println("OIDC Configuration:")
+	log.Printf("\tEnabled?:%v\n", o.Enabled())
+	if !o.Enabled() {
+		return
+	}
+	log.Printf("\tIssuer URL:%s\n", o.IssuerURL)
+	log.Printf("\tAudience:%s\n", o.Audience)
+	log.Printf("\tJWKS URL:%s\n", o.JWKSURL)
+	log.Printf("\tUsername Claim:%s\n", o.UsernameClaim)
+	log.Printf("\tGroups Claim:%s\n", o.GroupsClaim)
+	log.Printf("\tRoles:%v\n", o.Roles)
+	log.Printf("\tDefault Role:%s\n", o.DefaultRole)
+}
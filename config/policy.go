@@ -0,0 +1,46 @@
+package config
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+var (
+	errInvalidPolicyReloadInterval = errors.New("POLICY_RELOAD_INTERVAL must be greater than 0")
+)
+
+// Policy is the envconfig-compatible configuration for the policy that lease requests and releases
+// are checked against. It's loaded from the JSON file at File, which is checked for changes every
+// ReloadInterval. There's no policy if File is empty
+type Policy struct {
+	File           string        `envconfig:"POLICY_FILE"`
+	ReloadInterval time.Duration `envconfig:"POLICY_RELOAD_INTERVAL" default:"30s"`
+}
+
+// Enabled returns true if there's a policy
+func (p Policy) Enabled() bool {
+	return p.File != ""
+}
+
+// Validate returns an error if p is enabled but its policy can't be reloaded
+func (p Policy) Validate() error {
+	if !p.Enabled() {
+		return nil
+	}
+	if p.ReloadInterval <= 0 {
+		return errInvalidPolicyReloadInterval
+	}
+	return nil
+}
+
+// Print will render the current policy configuration
+func (p Policy) Print() {
+	log.Println("Policy Configuration:")
+	log.Printf("\tEnabled?:%v\n", p.Enabled())
+	if !p.Enabled() {
+		return
+	}
+	log.Printf("\tFile:%s\n", p.File)
+	log.Printf("\tReload Interval:%s\n", p.ReloadInterval)
+}
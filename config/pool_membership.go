@@ -0,0 +1,58 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PoolMembership decides which of the clusters that a provider lists are in the pool of clusters
+// that can be leased. A cluster is a member if it carries Label, which is in the key=value format,
+// and neither its name nor any of its IDs is in Exclude. If Label has no value, the label may have
+// any value. The zero value makes every cluster a member
+type PoolMembership struct {
+	Label   string
+	Exclude []string
+}
+
+// LabelKeyValue returns the key and value of p.Label. Both are empty if p.Label is
+func (p PoolMembership) LabelKeyValue() (string, string) {
+	kv := strings.SplitN(p.Label, "=", 2)
+	if len(kv) < 2 {
+		return strings.TrimSpace(kv[0]), ""
+	}
+	return strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+}
+
+// Labels returns p.Label as a map, for labeling clusters that should be members. Returns nil if
+// p.Label is empty
+func (p PoolMembership) Labels() map[string]string {
+	key, val := p.LabelKeyValue()
+	if key == "" {
+		return nil
+	}
+	return map[string]string{key: val}
+}
+
+// ExclusionReason returns why the cluster with the given labels isn't a member of the pool, or an
+// empty string if it is. names holds the cluster's name and the IDs it's known by
+func (p PoolMembership) ExclusionReason(labels map[string]string, names ...string) string {
+	for _, excluded := range p.Exclude {
+		for _, name := range names {
+			if excluded == name {
+				return fmt.Sprintf("%s is in the exclude list", excluded)
+			}
+		}
+	}
+	key, val := p.LabelKeyValue()
+	if key == "" {
+		return ""
+	}
+	actual, found := labels[key]
+	if !found {
+		return fmt.Sprintf("missing the %s label", key)
+	}
+	if val != "" && actual != val {
+		return fmt.Sprintf("the %s label is %q, not %q", key, actual, val)
+	}
+	return ""
+}
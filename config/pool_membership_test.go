@@ -0,0 +1,30 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+func TestPoolMembershipLabelKeyValue(t *testing.T) {
+	key, val := PoolMembership{Label: "k8s-claimer=true"}.LabelKeyValue()
+	assert.Equal(t, key, "k8s-claimer", "label key")
+	assert.Equal(t, val, "true", "label value")
+	key, val = PoolMembership{Label: "ci"}.LabelKeyValue()
+	assert.Equal(t, key, "ci", "label key")
+	assert.Equal(t, val, "", "label value")
+	assert.Equal(t, PoolMembership{}.Labels(), map[string]string(nil), "labels of the zero value")
+}
+
+func TestPoolMembershipExclusionReason(t *testing.T) {
+	membership := PoolMembership{Label: "k8s-claimer=true", Exclude: []string{"claimer", "proj1/zone1/staging"}}
+	member := map[string]string{"k8s-claimer": "true"}
+	assert.Equal(t, membership.ExclusionReason(member, "ci-a"), "", "reason for a member")
+	assert.Equal(t, membership.ExclusionReason(member, "claimer"), "claimer is in the exclude list", "reason for an excluded name")
+	assert.Equal(t, membership.ExclusionReason(member, "staging", "proj1/zone1/staging"), "proj1/zone1/staging is in the exclude list", "reason for an excluded ID")
+	assert.Equal(t, membership.ExclusionReason(nil, "ci-b"), "missing the k8s-claimer label", "reason for an unlabeled cluster")
+	assert.Equal(t, membership.ExclusionReason(map[string]string{"k8s-claimer": "false"}, "ci-c"), `the k8s-claimer label is "false", not "true"`, "reason for a mislabeled cluster")
+
+	// the zero value makes every cluster a member
+	assert.Equal(t, PoolMembership{}.ExclusionReason(nil, "claimer"), "", "reason without rules")
+}
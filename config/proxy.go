@@ -0,0 +1,40 @@
+package config
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+var (
+	errInvalidProxyFlushInterval = errors.New("PROXY_FLUSH_INTERVAL must be greater than 0")
+)
+
+// Proxy is the envconfig-compatible configuration for the API proxy, which forwards the requests
+// made with the kubeconfigs of leases that ask for it to the leased clusters. Responses are
+// flushed to the client every FlushInterval, so that watches are streamed
+type Proxy struct {
+	Enabled       bool          `envconfig:"PROXY" default:"false"`
+	FlushInterval time.Duration `envconfig:"PROXY_FLUSH_INTERVAL" default:"100ms"`
+}
+
+// Validate returns an error if p is enabled but can't be used to proxy requests
+func (p Proxy) Validate() error {
+	if !p.Enabled {
+		return nil
+	}
+	if p.FlushInterval <= 0 {
+		return errInvalidProxyFlushInterval
+	}
+	return nil
+}
+
+// Print will render the current API proxy configuration
+func (p Proxy) Print() {
+	log.Println("API Proxy Configuration:")
+	log.Printf("\tEnabled?:%v\n", p.Enabled)
+	if !p.Enabled {
+		return
+	}
+	log.Printf("\tFlush Interval:%s\n", p.FlushInterval)
+}
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+var (
+	errNegativeQuotaBudget = errors.New("QUOTA_DAILY_BUDGET and QUOTA_WEEKLY_BUDGET can't be negative")
+)
+
+// Quota is the envconfig-compatible configuration for how much cluster time each identity may
+// lease per day and per week, such as 8h and 40h. A budget of 0 is unlimited
+type Quota struct {
+	DailyBudget  time.Duration `envconfig:"QUOTA_DAILY_BUDGET"`
+	WeeklyBudget time.Duration `envconfig:"QUOTA_WEEKLY_BUDGET"`
+}
+
+// Enabled returns true if either budget is limited
+func (q Quota) Enabled() bool {
+	return q.DailyBudget > 0 || q.WeeklyBudget > 0
+}
+
+// Validate returns an error if a budget is negative
+func (q Quota) Validate() error {
+	if q.DailyBudget < 0 || q.WeeklyBudget < 0 {
+		return errNegativeQuotaBudget
+	}
+	return nil
+}
+
+// Print will render the current quota configuration
+func (q Quota) Print() {
+	log.Println("Quota Configuration:")
+	log.Printf("\tEnabled?:%v\n", q.Enabled())
+	if !q.Enabled() {
+		return
+	}
+	log.Printf("\tDaily Budget:%s\n", q.DailyBudget)
+	log.Printf("\tWeekly Budget:%s\n", q.WeeklyBudget)
+}
@@ -3,16 +3,23 @@ package config
 import (
 	"fmt"
 	"log"
+	"time"
 )
 
-// Server represents the envconfig-compatible server configuration
+// Server represents the envconfig-compatible server configuration. Clients authenticate with
+// AuthToken, or with the named tokens in the AuthTokensFile JSON file
 type Server struct {
-	BindHost        string `envconfig:"BIND_HOST" default:"0.0.0.0"`
-	BindPort        int    `envconfig:"BIND_PORT" default:"8080"`
-	Namespace       string `envconfig:"NAMESPACE" default:"k8s-claimer"`
-	ServiceName     string `envconfig:"SERVICE_NAME" default:"k8s-claimer"`
-	AuthToken       string `envconfig:"AUTH_TOKEN" required:"true"`
-	ClearNamespaces bool   `envconfig:"CLEAR_NAMESPACES" default:"false"`
+	BindHost          string        `envconfig:"BIND_HOST" default:"0.0.0.0"`
+	BindPort          int           `envconfig:"BIND_PORT" default:"8080"`
+	Namespace         string        `envconfig:"NAMESPACE" default:"k8s-claimer"`
+	ServiceName       string        `envconfig:"SERVICE_NAME" default:"k8s-claimer"`
+	AuthToken         string        `envconfig:"AUTH_TOKEN"`
+	AuthTokensFile    string        `envconfig:"AUTH_TOKENS_FILE"`
+	ClearNamespaces   bool          `envconfig:"CLEAR_NAMESPACES" default:"false"`
+	SelectionStrategy string        `envconfig:"SELECTION_STRATEGY" default:"random"`
+	HealthCheck       bool          `envconfig:"HEALTH_CHECK" default:"true"`
+	HealthCheckBudget time.Duration `envconfig:"HEALTH_CHECK_BUDGET" default:"30s"`
+	RequiredPods      []string      `envconfig:"HEALTH_CHECK_REQUIRED_PODS"`
 }
 
 // HostStr returns the full host string for the server, based on s.BindHost and s.BindPort
@@ -26,6 +33,19 @@ func (s Server) Print() {
 	log.Printf("\tListening:%s:%v\n", s.BindHost, s.BindPort)
 	log.Printf("\tNamespace:%s\n", s.Namespace)
 	log.Printf("\tService Name:%s\n", s.ServiceName)
-	log.Printf("\tAuth Token:%s\n", s.AuthToken)
+	log.Printf("\tAuth Token:%s\n", redact(s.AuthToken))
+	log.Printf("\tAuth Tokens File:%s\n", s.AuthTokensFile)
 	log.Printf("\tClear Namespaces?:%v\n", s.ClearNamespaces)
+	log.Printf("\tSelection Strategy:%s\n", s.SelectionStrategy)
+	log.Printf("\tHealth Check?:%v\n", s.HealthCheck)
+	log.Printf("\tHealth Check Budget:%s\n", s.HealthCheckBudget)
+	log.Printf("\tHealth Check Required Pods:%v\n", s.RequiredPods)
+}
+
+// redact hides secret, so that it can be logged
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "<redacted>"
 }
@@ -3,7 +3,9 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"log"
 
+	"github.com/deis/k8s-claimer/auth"
 	"github.com/deis/k8s-claimer/config"
 	"github.com/kelseyhightower/envconfig"
 )
@@ -22,6 +24,9 @@ func parseGoogleConfig(appName string) (*config.Google, error) {
 		return nil, err
 	}
 
+	if conf.AccountFileJSON == "" {
+		return conf, nil
+	}
 	gCloudConfFile := new(config.AccountFile)
 	if err := json.NewDecoder(bytes.NewBuffer([]byte(conf.AccountFileJSON))).Decode(gCloudConfFile); err != nil {
 		return nil, err
@@ -37,3 +42,125 @@ func parseServerConfig(appName string) (*config.Server, error) {
 	}
 	return conf, nil
 }
+
+func parsePolicyConfig(appName string) (*config.Policy, error) {
+	conf := new(config.Policy)
+	if err := envconfig.Process(appName, conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func parseQuotaConfig(appName string) (*config.Quota, error) {
+	conf := new(config.Quota)
+	if err := envconfig.Process(appName, conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func parseOIDCConfig(appName string) (*config.OIDC, error) {
+	conf := new(config.OIDC)
+	if err := envconfig.Process(appName, conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// parseAuthenticator creates the Authenticator that requests are authenticated with. It accepts
+// the API tokens in the tokens file of serverConf and the token in AUTH_TOKEN, if there is one,
+// which has the user role. If oidcConf is enabled, it accepts the ID tokens of its issuer as well
+func parseAuthenticator(serverConf *config.Server, oidcConf *config.OIDC) (auth.Authenticator, error) {
+	var tokens []auth.Token
+	if serverConf.AuthTokensFile != "" {
+		fileTokens, err := auth.ReadTokensFile(serverConf.AuthTokensFile)
+		if err != nil {
+			return nil, err
+		}
+		tokens = fileTokens
+	}
+	if serverConf.AuthToken != "" {
+		tokens = append(tokens, auth.Token{Name: auth.DefaultTokenName, Token: serverConf.AuthToken, Role: auth.RoleUser})
+	}
+	var authns []auth.Authenticator
+	if len(tokens) > 0 {
+		registry, err := auth.NewTokens(tokens)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("API tokens: %v", registry.Names())
+		authns = append(authns, registry)
+	}
+	if oidcConf.Enabled() {
+		rules, err := auth.ParseRoleRules(oidcConf.Roles, oidcConf.GroupsClaim)
+		if err != nil {
+			return nil, err
+		}
+		defaultRole := auth.Role(oidcConf.DefaultRole)
+		if defaultRole != "" && !defaultRole.Valid() {
+			return nil, errInvalidDefaultRole
+		}
+		verifier := auth.NewVerifier(oidcConf.IssuerURL, oidcConf.Audience, auth.NewKeySet(oidcConf.IssuerURL, oidcConf.JWKSURL))
+		authns = append(authns, auth.NewOIDC(verifier, oidcConf.UsernameClaim, rules, defaultRole))
+	}
+	if len(authns) == 0 {
+		return nil, errNoAuthenticators
+	}
+	return auth.Any(authns...), nil
+}
+
+func parseGKEProvisioningConfig(appName string) (*config.GKEProvisioning, error) {
+	conf := new(config.GKEProvisioning)
+	if err := envconfig.Process(appName, conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func parseGKEPoolConfig(appName string) (*config.GKEPool, error) {
+	conf := new(config.GKEPool)
+	if err := envconfig.Process(appName, conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func parseGKERecyclingConfig(appName string) (*config.GKERecycling, error) {
+	conf := new(config.GKERecycling)
+	if err := envconfig.Process(appName, conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func parseGKEUpgradesConfig(appName string) (*config.GKEUpgrades, error) {
+	conf := new(config.GKEUpgrades)
+	if err := envconfig.Process(appName, conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func parseInventoryConfig(appName string) (*config.Inventory, error) {
+	conf := new(config.Inventory)
+	if err := envconfig.Process(appName, conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func parseLeaseCredentialsConfig(appName string) (*config.LeaseCredentials, error) {
+	conf := new(config.LeaseCredentials)
+	if err := envconfig.Process(appName, conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func parseProxyConfig(appName string) (*config.Proxy, error) {
+	conf := new(config.Proxy)
+	if err := envconfig.Process(appName, conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
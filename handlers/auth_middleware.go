@@ -1,14 +1,29 @@
 package handlers
 
-import "net/http"
+import (
+	"log"
+	"net/http"
 
-// WithAuth provides handling of endpoints requiring authentication
-func WithAuth(tokenToCheck, tokenHeaderName string, next http.Handler) http.Handler {
+	"github.com/deis/k8s-claimer/auth"
+	"github.com/deis/k8s-claimer/htp"
+)
+
+// WithAuth provides handling of endpoints requiring authentication. authn must establish the
+// identity of whoever made the request from its tokenHeaderName header, and its role must allow
+// role. The identity is passed to next in the context of the request
+func WithAuth(authn auth.Authenticator, role auth.Role, tokenHeaderName string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Header.Get(tokenHeaderName) != tokenToCheck {
+		id, err := authn.Authenticate(r.Context(), r.Header.Get(tokenHeaderName))
+		if err != nil {
+			log.Printf("Refused %s %s -- %s", r.Method, r.URL.Path, err)
 			http.Error(w, "not authorized", http.StatusUnauthorized)
 			return
 		}
-		next.ServeHTTP(w, r)
+		if !id.Role.Allows(role) {
+			log.Printf("%s has the %s role, which isn't allowed %s %s", id.ID(), id.Role, r.Method, r.URL.Path)
+			htp.Error(w, http.StatusForbidden, "%s has the %s role, but %s %s needs the %s role", id.ID(), id.Role, r.Method, r.URL.Path, role)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), id)))
 	})
 }
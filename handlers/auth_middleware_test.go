@@ -12,12 +12,23 @@ import (
 	"k8s.io/client-go/pkg/api/v1"
 
 	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/auth"
 	"github.com/deis/k8s-claimer/config"
 	"github.com/deis/k8s-claimer/htp"
 	"github.com/deis/k8s-claimer/k8s"
 	"github.com/deis/k8s-claimer/providers/gke"
+	"github.com/deis/k8s-claimer/quota"
 )
 
+func testTokens(t *testing.T) *auth.Tokens {
+	tokens, err := auth.NewTokens([]auth.Token{
+		{Name: "ci", Token: "auth token", Role: auth.RoleUser},
+		{Name: "dashboard", Token: "read-only token", Role: auth.RoleReadOnly},
+	})
+	assert.NoErr(t, err)
+	return tokens
+}
+
 func TestWithAuthValidToken(t *testing.T) {
 	cluster := &container.Cluster{
 		Name:       "cluster1",
@@ -31,11 +42,11 @@ func TestWithAuthValidToken(t *testing.T) {
 		ObjectMeta: v1.ObjectMeta{Name: "service1"},
 	}, nil, nil, nil)
 	googleConfig := &config.Google{AccountFileJSON: "test", ProjectID: "proj1", Zone: "zone1"}
-	hdl := CreateLease(services, "", gkeClusterLister, nil, nil, googleConfig)
+	hdl := CreateLease(services, "", gkeClusterLister, nil, nil, nil, googleConfig, "", nil, 0, nil, false, nil, quota.Budget{}, nil, nil, nil)
 	createLeaseHandler := htp.MethodMux(map[htp.Method]http.Handler{htp.Post: hdl})
 
 	mux := http.NewServeMux()
-	mux.Handle("/lease", WithAuth("auth token", "Authorization", createLeaseHandler))
+	mux.Handle("/lease", WithAuth(testTokens(t), auth.RoleUser, "Authorization", createLeaseHandler))
 	reqBody := `{"max_time":30, "cloud_provider":"google"}`
 	req, err := http.NewRequest("POST", "/lease", strings.NewReader(reqBody))
 	req.Header.Set("Authorization", "auth token")
@@ -47,11 +58,11 @@ func TestWithAuthValidToken(t *testing.T) {
 
 func TestWithAuthInvalidToken(t *testing.T) {
 	googleConfig := &config.Google{AccountFileJSON: "test", ProjectID: "proj1", Zone: "zone1"}
-	hdl := CreateLease(nil, "", nil, nil, nil, googleConfig)
+	hdl := CreateLease(nil, "", nil, nil, nil, nil, googleConfig, "", nil, 0, nil, false, nil, quota.Budget{}, nil, nil, nil)
 	createLeaseHandler := htp.MethodMux(map[htp.Method]http.Handler{htp.Post: hdl})
 
 	mux := http.NewServeMux()
-	mux.Handle("/lease", WithAuth("auth token", "Authorization", createLeaseHandler))
+	mux.Handle("/lease", WithAuth(testTokens(t), auth.RoleUser, "Authorization", createLeaseHandler))
 	req, err := http.NewRequest("POST", "/lease", bytes.NewReader(nil))
 	req.Header.Set("Authorization", "invalid auth token")
 	assert.NoErr(t, err)
@@ -59,3 +70,29 @@ func TestWithAuthInvalidToken(t *testing.T) {
 	mux.ServeHTTP(res, req)
 	assert.Equal(t, res.Code, http.StatusUnauthorized, "response code")
 }
+
+func TestWithAuthRole(t *testing.T) {
+	var seen auth.Identity
+	hdl := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = auth.FromContext(r.Context())
+		w.WriteHeader(http.StatusOK)
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/lease", WithAuth(testTokens(t), auth.RoleUser, "Authorization", hdl))
+	mux.Handle("/pool", WithAuth(testTokens(t), auth.RoleReadOnly, "Authorization", hdl))
+
+	req, err := http.NewRequest("POST", "/lease", nil)
+	assert.NoErr(t, err)
+	req.Header.Set("Authorization", "read-only token")
+	res := httptest.NewRecorder()
+	mux.ServeHTTP(res, req)
+	assert.Equal(t, res.Code, http.StatusForbidden, "response code")
+
+	req, err = http.NewRequest("GET", "/pool", nil)
+	assert.NoErr(t, err)
+	req.Header.Set("Authorization", "auth token")
+	res = httptest.NewRecorder()
+	mux.ServeHTTP(res, req)
+	assert.Equal(t, res.Code, http.StatusOK, "response code")
+	assert.Equal(t, seen, auth.Identity{Name: "ci", Source: auth.SourceToken, Role: auth.RoleUser}, "identity")
+}
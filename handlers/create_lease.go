@@ -1,26 +1,63 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/deis/k8s-claimer/api"
+	"github.com/deis/k8s-claimer/auth"
 	"github.com/deis/k8s-claimer/config"
 	"github.com/deis/k8s-claimer/htp"
 	"github.com/deis/k8s-claimer/k8s"
+	"github.com/deis/k8s-claimer/leases"
+	"github.com/deis/k8s-claimer/policy"
 	"github.com/deis/k8s-claimer/providers/azure"
 	"github.com/deis/k8s-claimer/providers/gke"
+	"github.com/deis/k8s-claimer/quota"
+	"github.com/deis/k8s-claimer/selection"
 )
 
-// CreateLease creates the handler that responds to the POST /lease endpoint
+const (
+	// policyAPITimeout is how long a POST /lease request waits for the k8s API to count the leases
+	// that a policy limits, or to get the usage that a budget limits, and how long a GET /quota
+	// request waits for it to get the usage
+	policyAPITimeout = 10 * time.Second
+)
+
+// CreateLease creates the handler that responds to the POST /lease endpoint. If leaseCredentials
+// is enabled, each lease is handed out its own credentials instead of the cluster's admin
+// credentials, and requests may ask for a kubeconfig that fetches them with the CLI. If
+// proxyEnabled is true, requests may ask for a kubeconfig that talks to the leased cluster through
+// the API proxy. Requests are checked against the policy in policies before a cluster is picked,
+// and only clusters that it allows are picked. Requests that would take their identity over
+// budget are refused with a 429, and a Retry-After header with the time until the budget resets.
+// Both are checked again against the leases that the new lease is saved with, so that concurrent
+// requests can't get past them together. The GKE clusters of expired leases that gkeRecycler
+// recycles are recycled instead of being leased again
 func CreateLease(
 	services k8s.ServiceGetterUpdater,
 	k8sServiceName string,
 	gkeClusterLister gke.ClusterLister,
 	azureClusterLister azure.ClusterLister,
+	azureVersions *azure.VersionCache,
 	azureConfig *config.Azure,
 	googleConfig *config.Google,
+	defaultStrategy string,
+	healthChecker k8s.HealthChecker,
+	healthBudget time.Duration,
+	leaseCredentials *k8s.LeaseCredentials,
+	proxyEnabled bool,
+	policies *policy.File,
+	budget quota.Budget,
+	gkeProvisioner *gke.Provisioner,
+	gkePoolManager *gke.PoolManager,
+	gkeRecycler *gke.Recycler,
 ) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		req := new(api.CreateLeaseReq)
@@ -29,18 +66,98 @@ func CreateLease(
 			htp.Error(w, http.StatusBadRequest, "Error decoding JSON -- %s", err)
 			return
 		}
+		if _, err := req.VersionConstraint(); err != nil {
+			log.Printf("Invalid cluster version -- %s", err)
+			htp.Error(w, http.StatusBadRequest, "Invalid cluster version -- %s", err)
+			return
+		}
+		if _, err := req.LabelSelector(); err != nil {
+			log.Printf("Invalid cluster selector -- %s", err)
+			htp.Error(w, http.StatusBadRequest, "Invalid cluster selector -- %s", err)
+			return
+		}
+		if req.SelectionStrategy == "" {
+			req.SelectionStrategy = defaultStrategy
+		}
+		if _, err := req.Strategy(); err != nil {
+			log.Printf("Invalid selection strategy -- %s", err)
+			htp.Error(w, http.StatusBadRequest, "Invalid selection strategy -- %s. Acceptable values are %s", err, strings.Join(selection.Names, ", "))
+			return
+		}
+		if src := req.VersionSource(); src != api.VersionSourceNode && src != api.VersionSourceMaster {
+			log.Printf("Invalid cluster version source %s", src)
+			htp.Error(w, http.StatusBadRequest, "Invalid cluster version source %s. Acceptable values are %s and %s", src, api.VersionSourceNode, api.VersionSourceMaster)
+			return
+		}
+		if req.ExecCredential != nil {
+			if leaseCredentials == nil || !leaseCredentials.Enabled {
+				log.Println("Exec credentials were requested, but leases aren't handed out their own credentials")
+				htp.Error(w, http.StatusBadRequest, "Exec credentials need per-lease credentials, which are disabled")
+				return
+			}
+			if req.ExecCredential.Server == "" {
+				log.Println("Exec credentials were requested without a server")
+				htp.Error(w, http.StatusBadRequest, "The server of the exec credential is missing")
+				return
+			}
+		}
+		if req.Proxy != nil {
+			if !proxyEnabled {
+				log.Println("The API proxy was requested, but it's disabled")
+				htp.Error(w, http.StatusBadRequest, "The API proxy is disabled")
+				return
+			}
+			if req.Proxy.Server == "" {
+				log.Println("The API proxy was requested without a server")
+				htp.Error(w, http.StatusBadRequest, "The server of the API proxy is missing")
+				return
+			}
+			if req.ExecCredential != nil {
+				log.Println("Both the API proxy and exec credentials were requested")
+				htp.Error(w, http.StatusBadRequest, "The API proxy and exec credentials can't be used together")
+				return
+			}
+		}
+
+		// the saved leases are only fetched if the policy or the budget needs them, and only once
+		var saved *leases.Map
+		clusterRegexes, ok := admitLease(w, r, req, policies, budget, func() (*leases.Map, error) {
+			if saved != nil {
+				return saved, nil
+			}
+			leaseMap, err := getLeaseMap(r.Context(), services, k8sServiceName)
+			if err != nil {
+				return nil, err
+			}
+			saved = leaseMap
+			return saved, nil
+		})
+		if !ok {
+			return
+		}
+		req.ClusterRegexes = clusterRegexes
+		// the leases above may be outdated by the time the new lease is saved, so the provider checks
+		// the request again against the leases that it saves the new lease with
+		admit := func(w http.ResponseWriter, leaseMap *leases.Map) bool {
+			_, ok := admitLease(w, r, req, policies, budget, func() (*leases.Map, error) {
+				return leaseMap, nil
+			})
+			return ok
+		}
 
 		switch req.CloudProvider {
-		case "google":
+		case leases.ProviderGoogle:
 			if googleConfig.ValidConfig() {
-				gke.Lease(w, req, gkeClusterLister, services, k8sServiceName, googleConfig.ProjectID, googleConfig.Zone)
+				// ValidConfig only passes if the scopes parse
+				scopes, _ := googleConfig.ClusterScopes()
+				gke.Lease(r.Context(), w, req, gkeClusterLister, services, gkeProvisioner, gkePoolManager, gkeRecycler, healthChecker, healthBudget, leaseCredentials, admit, k8sServiceName, scopes, googleConfig.Membership())
 			} else {
 				log.Println("Unable to satisfy this request because the Google provider is not properly configured.")
 				htp.Error(w, http.StatusInternalServerError, "Unable to satisfy this request because the Google provider is not properly configured.")
 			}
-		case "azure":
+		case leases.ProviderAzure:
 			if azureConfig.ValidConfig() {
-				azure.Lease(w, req, azureClusterLister, services, azureConfig, k8sServiceName)
+				azure.Lease(r.Context(), w, req, azureClusterLister, services, azureConfig, azureVersions, healthChecker, healthBudget, leaseCredentials, admit, k8sServiceName)
 			} else {
 				log.Println("Unable to satisfy this request because the Azure provider is not properly configured.")
 				htp.Error(w, http.StatusInternalServerError, "Unable to satisfy this request because the Azure provider is not properly configured.")
@@ -51,3 +168,79 @@ func CreateLease(
 		}
 	})
 }
+
+// admitLease checks req, which the identity in r's context made, against the policy in policies
+// and against budget. savedLeases returns the leases to check it with, and is only called if the
+// policy or the budget needs them. Returns the regular expressions that the names of the clusters
+// leased for req must match, and true if req is admitted. Otherwise, responds to w and returns
+// false
+func admitLease(
+	w http.ResponseWriter,
+	r *http.Request,
+	req *api.CreateLeaseReq,
+	policies *policy.File,
+	budget quota.Budget,
+	savedLeases func() (*leases.Map, error),
+) ([]string, bool) {
+	id, _ := auth.FromContext(r.Context())
+	clusterRegexes, err := policies.Policy().CheckCreate(policy.CreateReq{
+		Identity: id,
+		Provider: req.CloudProvider,
+		MaxTime:  req.MaxTimeDur(),
+	}, func() (int, error) {
+		leaseMap, err := savedLeases()
+		if err != nil {
+			return 0, err
+		}
+		return leaseMap.CountCreatedBy(id.ID(), time.Now()), nil
+	})
+	if err != nil {
+		if denied, ok := err.(policy.ErrDenied); ok {
+			log.Printf("The lease request of %s was %s", id.ID(), denied)
+			htp.Error(w, http.StatusForbidden, "The lease request was %s", denied)
+			return nil, false
+		}
+		if r.Context().Err() == context.Canceled {
+			log.Printf("The client went away while its active leases were counted")
+			return nil, false
+		}
+		log.Printf("Error counting the active leases of %s -- %s", id.ID(), err)
+		htp.Error(w, htp.UpstreamStatus(err), "Error counting the active leases of %s -- %s", id.ID(), err)
+		return nil, false
+	}
+
+	if budget.Enabled() && id.ID() != "" {
+		leaseMap, err := savedLeases()
+		if err != nil {
+			if r.Context().Err() == context.Canceled {
+				log.Printf("The client went away while its usage was fetched")
+				return nil, false
+			}
+			log.Printf("Error getting the usage of %s -- %s", id.ID(), err)
+			htp.Error(w, htp.UpstreamStatus(err), "Error getting the usage of %s -- %s", id.ID(), err)
+			return nil, false
+		}
+		now := time.Now()
+		if err := budget.Check(leaseMap.Usage(id.ID()), req.MaxTimeDur(), now); err != nil {
+			if exceeded, ok := err.(quota.ErrExceeded); ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(exceeded.Reset.Sub(now).Seconds()))))
+			}
+			log.Printf("The lease request of %s is over budget -- %s", id.ID(), err)
+			htp.Error(w, http.StatusTooManyRequests, "The lease request is over budget -- %s", err)
+			return nil, false
+		}
+	}
+	return clusterRegexes, true
+}
+
+// getLeaseMap returns the leases, cluster statuses and usage ledgers in the annotations of the
+// k8sServiceName service
+func getLeaseMap(ctx context.Context, services k8s.ServiceGetter, k8sServiceName string) (*leases.Map, error) {
+	ctx, cancel := context.WithTimeout(ctx, policyAPITimeout)
+	defer cancel()
+	svc, err := k8s.GetService(ctx, services, k8sServiceName)
+	if err != nil {
+		return nil, err
+	}
+	return leases.ParseMapFromAnnotations(svc.Annotations)
+}
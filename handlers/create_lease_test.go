@@ -3,18 +3,26 @@ package handlers
 import (
 	"bytes"
 	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"k8s.io/client-go/pkg/api/v1"
 
 	"github.com/arschles/assert"
 	"github.com/deis/k8s-claimer/api"
+	"github.com/deis/k8s-claimer/auth"
 	"github.com/deis/k8s-claimer/config"
 	"github.com/deis/k8s-claimer/k8s"
+	"github.com/deis/k8s-claimer/leases"
+	"github.com/deis/k8s-claimer/policy"
 	"github.com/deis/k8s-claimer/providers/gke"
+	"github.com/deis/k8s-claimer/quota"
 	"github.com/deis/k8s-claimer/testutil"
 	"github.com/pborman/uuid"
 	container "google.golang.org/api/container/v1"
@@ -40,10 +48,23 @@ func newListClusterResp(clusters []*container.Cluster) *container.ListClustersRe
 	return resp
 }
 
+// testPolicies loads policyJSON like the server loads its policy file
+func testPolicies(t *testing.T, policyJSON string) *policy.File {
+	f, err := ioutil.TempFile("", "k8s-claimer-policy")
+	assert.NoErr(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(policyJSON)
+	assert.NoErr(t, err)
+	assert.NoErr(t, f.Close())
+	policies, err := policy.NewFile(f.Name(), time.Minute)
+	assert.NoErr(t, err)
+	return policies
+}
+
 func TestCreateLeaseInvalidReq(t *testing.T) {
 	gkeClusterLister := gke.NewFakeClusterLister(nil, nil)
 	slu := k8s.NewFakeServiceGetterUpdater(nil, nil, nil, nil)
-	hdl := CreateLease(slu, "", gkeClusterLister, nil, nil, nil)
+	hdl := CreateLease(slu, "", gkeClusterLister, nil, nil, nil, nil, "", nil, 0, nil, false, nil, quota.Budget{}, nil, nil, nil)
 	req, err := http.NewRequest("POST", "/lease", bytes.NewReader(nil))
 	assert.NoErr(t, err)
 	res := httptest.NewRecorder()
@@ -51,6 +72,45 @@ func TestCreateLeaseInvalidReq(t *testing.T) {
 	assert.Equal(t, res.Code, http.StatusBadRequest, "response code")
 }
 
+func TestCreateLeaseInvalidCriteria(t *testing.T) {
+	gkeClusterLister := gke.NewFakeClusterLister(nil, nil)
+	slu := k8s.NewFakeServiceGetterUpdater(nil, nil, nil, nil)
+	hdl := CreateLease(slu, "", gkeClusterLister, nil, nil, nil, nil, "", nil, 0, nil, false, nil, quota.Budget{}, nil, nil, nil)
+	for _, reqBody := range []string{
+		`{"max_time":30, "cloud_provider":"google", "cluster_version":">=1.a"}`,
+		`{"max_time":30, "cloud_provider":"google", "cluster_version":"1.7", "cluster_version_source":"kubelet"}`,
+		`{"max_time":30, "cloud_provider":"google", "cluster_selector":"region in (us-west"}`,
+		`{"max_time":30, "cloud_provider":"google", "selection_strategy":"first-fit"}`,
+	} {
+		req, err := http.NewRequest("POST", "/lease", strings.NewReader(reqBody))
+		assert.NoErr(t, err)
+		res := httptest.NewRecorder()
+		hdl.ServeHTTP(res, req)
+		assert.Equal(t, res.Code, http.StatusBadRequest, "response code for "+reqBody)
+	}
+}
+
+func TestCreateLeaseInvalidProxy(t *testing.T) {
+	gkeClusterLister := gke.NewFakeClusterLister(nil, nil)
+	slu := k8s.NewFakeServiceGetterUpdater(nil, nil, nil, nil)
+	creds := &k8s.LeaseCredentials{Enabled: true}
+	for _, tc := range []struct {
+		proxyEnabled bool
+		reqBody      string
+	}{
+		{false, `{"max_time":30, "cloud_provider":"google", "proxy":{"server":"https://claimer"}}`},
+		{true, `{"max_time":30, "cloud_provider":"google", "proxy":{"server":""}}`},
+		{true, `{"max_time":30, "cloud_provider":"google", "proxy":{"server":"https://claimer"}, "exec_credential":{"server":"https://claimer"}}`},
+	} {
+		hdl := CreateLease(slu, "", gkeClusterLister, nil, nil, nil, nil, "", nil, 0, creds, tc.proxyEnabled, nil, quota.Budget{}, nil, nil, nil)
+		req, err := http.NewRequest("POST", "/lease", strings.NewReader(tc.reqBody))
+		assert.NoErr(t, err)
+		res := httptest.NewRecorder()
+		hdl.ServeHTTP(res, req)
+		assert.Equal(t, res.Code, http.StatusBadRequest, "response code for "+tc.reqBody)
+	}
+}
+
 func TestCreateLeaseValidResp(t *testing.T) {
 	cluster := testutil.GetGKEClusters()[0]
 	gkeClusterLister := gke.NewFakeClusterLister(newListClusterResp([]*container.Cluster{cluster}), nil)
@@ -58,11 +118,12 @@ func TestCreateLeaseValidResp(t *testing.T) {
 		ObjectMeta: v1.ObjectMeta{Name: "service1"},
 	}, nil, nil, nil)
 	googleConfig := &config.Google{AccountFileJSON: "test", ProjectID: "proj1", Zone: "zone1"}
-	hdl := CreateLease(services, "", gkeClusterLister, nil, nil, googleConfig)
+	hdl := CreateLease(services, "", gkeClusterLister, nil, nil, nil, googleConfig, "", nil, 0, nil, false, nil, quota.Budget{}, nil, nil, nil)
 	reqBody := `{"max_time":30, "cloud_provider": "google"}`
 	req, err := http.NewRequest("POST", "/lease", strings.NewReader(reqBody))
 	req.Header.Set("Authorization", "some awesome token")
 	assert.NoErr(t, err)
+	req = req.WithContext(auth.NewContext(req.Context(), auth.Identity{Name: "ci", Source: auth.SourceToken, Role: auth.RoleUser}))
 
 	res := httptest.NewRecorder()
 	hdl.ServeHTTP(res, req)
@@ -83,4 +144,125 @@ func TestCreateLeaseValidResp(t *testing.T) {
 
 	parsedUUID := uuid.Parse(leaseResp.Token)
 	assert.True(t, parsedUUID != nil, "returned token is not a valid uuid")
+
+	// the lease records where the cluster is, so that it can be found again
+	leaseMap, err := leases.ParseMapFromAnnotations(services.Svc.Annotations)
+	assert.NoErr(t, err)
+	lease, found := leaseMap.LeaseForUUID(parsedUUID)
+	assert.True(t, found, "lease wasn't saved")
+	assert.Equal(t, lease.Project, "proj1", "lease project")
+	assert.Equal(t, lease.Location, "zone1", "lease location")
+	assert.Equal(t, lease.Provider, leases.ProviderGoogle, "lease provider")
+	assert.Equal(t, lease.CreatedBy, "token:ci", "lease creator")
+	usage := leaseMap.Usage("token:ci")
+	assert.Equal(t, len(usage.Leases), 1, "number of usage ledger entries")
+	assert.Equal(t, usage.Leases[0].Token, leaseResp.Token, "usage ledger token")
+	assert.Equal(t, usage.Leases[0].Duration(), 30*time.Second, "usage ledger duration")
+	assert.Equal(t, leaseResp.ClusterID, "google/proj1/zone1/"+cluster.Name, "returned cluster ID")
+	assert.Equal(t, leaseResp.ClusterName, cluster.Name, "returned cluster name")
+	// the secret is handed out, but only its hash is saved
+	version, _ := parsedUUID.Version()
+	assert.Equal(t, version, uuid.Version(4), "token version")
+	assert.True(t, leaseResp.Secret != "", "no secret was returned")
+	assert.True(t, lease.SecretMatches(leaseResp.Secret), "the returned secret doesn't match the lease")
+	for _, anno := range services.Svc.Annotations {
+		assert.False(t, strings.Contains(anno, leaseResp.Secret), "the secret was saved")
+	}
+}
+
+func TestCreateLeaseDeniedByPolicy(t *testing.T) {
+	gkeClusterLister := gke.NewFakeClusterLister(newListClusterResp(testutil.GetGKEClusters()), nil)
+	services := k8s.NewFakeServiceGetterUpdater(&v1.Service{
+		ObjectMeta: v1.ObjectMeta{Name: "service1"},
+	}, nil, nil, nil)
+	googleConfig := &config.Google{AccountFileJSON: "test", ProjectID: "proj1", Zone: "zone1"}
+	policies := testPolicies(t, `{"rules": [{"name": "ci-1h", "identities": ["token:ci"], "max_time": "1h"}]}`)
+	hdl := CreateLease(services, "", gkeClusterLister, nil, nil, nil, googleConfig, "", nil, 0, nil, false, policies, quota.Budget{}, nil, nil, nil)
+	req, err := http.NewRequest("POST", "/lease", strings.NewReader(`{"max_time":7200, "cloud_provider": "google"}`))
+	assert.NoErr(t, err)
+	req = req.WithContext(auth.NewContext(req.Context(), auth.Identity{Name: "ci", Source: auth.SourceToken, Role: auth.RoleUser}))
+	res := httptest.NewRecorder()
+	hdl.ServeHTTP(res, req)
+	assert.Equal(t, res.Code, http.StatusForbidden, "response code")
+	assert.True(t, strings.Contains(res.Body.String(), `"ci-1h"`), "the response doesn't name the rule: %s", res.Body.String())
+	assert.Equal(t, len(services.Svc.Annotations), 0, "number of leases")
+
+	req, err = http.NewRequest("POST", "/lease", strings.NewReader(`{"max_time":1800, "cloud_provider": "google"}`))
+	assert.NoErr(t, err)
+	req = req.WithContext(auth.NewContext(req.Context(), auth.Identity{Name: "ci", Source: auth.SourceToken, Role: auth.RoleUser}))
+	res = httptest.NewRecorder()
+	hdl.ServeHTTP(res, req)
+	assert.Equal(t, res.Code, http.StatusOK, "response code")
+}
+
+func TestCreateLeaseOverBudget(t *testing.T) {
+	gkeClusterLister := gke.NewFakeClusterLister(newListClusterResp(testutil.GetGKEClusters()), nil)
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	now := time.Now()
+	leaseMap.RecordUsage("token:ci", uuid.NewRandom(), now, now.Add(7*time.Hour))
+	annos, err := leaseMap.ToAnnotations()
+	assert.NoErr(t, err)
+	services := k8s.NewFakeServiceGetterUpdater(&v1.Service{
+		ObjectMeta: v1.ObjectMeta{Name: "service1", Annotations: annos},
+	}, nil, nil, nil)
+	googleConfig := &config.Google{AccountFileJSON: "test", ProjectID: "proj1", Zone: "zone1"}
+	budget := quota.Budget{Daily: 8 * time.Hour}
+	hdl := CreateLease(services, "", gkeClusterLister, nil, nil, nil, googleConfig, "", nil, 0, nil, false, nil, budget, nil, nil, nil)
+	req, err := http.NewRequest("POST", "/lease", strings.NewReader(`{"max_time":7200, "cloud_provider": "google"}`))
+	assert.NoErr(t, err)
+	req = req.WithContext(auth.NewContext(req.Context(), auth.Identity{Name: "ci", Source: auth.SourceToken, Role: auth.RoleUser}))
+	res := httptest.NewRecorder()
+	hdl.ServeHTTP(res, req)
+	assert.Equal(t, res.Code, http.StatusTooManyRequests, "response code")
+	retryAfter, err := strconv.Atoi(res.Header().Get("Retry-After"))
+	assert.NoErr(t, err)
+	assert.True(t, retryAfter > 0 && retryAfter <= 24*60*60, "Retry-After %d isn't within a day", retryAfter)
+	saved, err := leases.ParseMapFromAnnotations(services.Svc.Annotations)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(saved.Usage("token:ci").Leases), 1, "number of usage ledger entries")
+
+	// other identities have their own budgets
+	req, err = http.NewRequest("POST", "/lease", strings.NewReader(`{"max_time":7200, "cloud_provider": "google"}`))
+	assert.NoErr(t, err)
+	req = req.WithContext(auth.NewContext(req.Context(), auth.Identity{Name: "dev", Source: auth.SourceOIDC, Role: auth.RoleUser}))
+	res = httptest.NewRecorder()
+	hdl.ServeHTTP(res, req)
+	assert.Equal(t, res.Code, http.StatusOK, "response code for another identity")
+}
+
+func TestCreateLeaseProvisionsCluster(t *testing.T) {
+	gkeClusterLister := gke.NewFakeClusterLister(newListClusterResp(nil), nil)
+	services := k8s.NewFakeServiceGetterUpdater(&v1.Service{
+		ObjectMeta: v1.ObjectMeta{Name: "service1"},
+	}, nil, nil, nil)
+	googleConfig := &config.Google{AccountFileJSON: "test", ProjectID: "proj1", Zone: "zone1"}
+	provisioningConfig := config.GKEProvisioning{
+		Enabled:     true,
+		MaxClusters: 1,
+		NamePrefix:  "ci-",
+		NodeCount:   1,
+		Timeout:     time.Minute,
+	}
+	creator := gke.NewFakeClusterCreator(2, nil)
+	provisioner := gke.NewProvisioner(creator, provisioningConfig, googleConfig.ProjectID, googleConfig.Zone)
+	hdl := CreateLease(services, "", gkeClusterLister, nil, nil, nil, googleConfig, "", nil, 0, nil, false, nil, quota.Budget{}, provisioner, nil, nil)
+
+	req, err := http.NewRequest("POST", "/lease", strings.NewReader(`{"max_time":30, "cloud_provider": "google"}`))
+	assert.NoErr(t, err)
+	res := httptest.NewRecorder()
+	hdl.ServeHTTP(res, req)
+	assert.Equal(t, res.Code, http.StatusOK, "response code")
+	leaseResp := new(api.CreateLeaseResp)
+	assert.NoErr(t, json.NewDecoder(res.Body).Decode(leaseResp))
+	assert.Equal(t, len(creator.Created), 1, "number of created clusters")
+	assert.Equal(t, leaseResp.ClusterName, creator.Created[0].Cluster.Name, "leased cluster name")
+
+	// a request that the template can't satisfy isn't provisioned
+	req, err = http.NewRequest("POST", "/lease", strings.NewReader(`{"max_time":30, "cloud_provider": "google", "cluster_regex": "^staging-"}`))
+	assert.NoErr(t, err)
+	res = httptest.NewRecorder()
+	hdl.ServeHTTP(res, req)
+	assert.Equal(t, res.Code, http.StatusConflict, "response code")
+	assert.Equal(t, len(creator.Created), 1, "number of created clusters")
 }
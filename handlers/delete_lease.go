@@ -1,18 +1,31 @@
 package handlers
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"time"
 
+	"github.com/deis/k8s-claimer/api"
+	"github.com/deis/k8s-claimer/auth"
 	"github.com/deis/k8s-claimer/config"
 	"github.com/deis/k8s-claimer/htp"
+	"github.com/deis/k8s-claimer/inventory"
 	"github.com/deis/k8s-claimer/k8s"
 	"github.com/deis/k8s-claimer/leases"
+	"github.com/deis/k8s-claimer/policy"
 	"github.com/deis/k8s-claimer/providers/azure"
 	"github.com/deis/k8s-claimer/providers/gke"
+	"github.com/deis/k8s-claimer/proxy"
 	"github.com/pborman/uuid"
 )
 
+const (
+	// deleteAPITimeout is how long a DELETE /lease or GET /credential request waits for the
+	// provider and k8s APIs
+	deleteAPITimeout = 10 * time.Second
+)
+
 var (
 	skipDeleteNamespaces = map[string]struct{}{
 		"default":     struct{}{},
@@ -20,7 +33,17 @@ var (
 	}
 )
 
-// DeleteLease returns the http handler for the DELETE /lease/{token} endpoint
+// DeleteLease returns the http handler for the DELETE /lease/{token} endpoint. The legacy
+// DELETE /lease/{provider}/{token} path is accepted too, and its provider is used for leases that
+// were created before leases recorded their provider. If the provider or k8s APIs time out, the
+// response status is 504, and if they fail, it's 502. The credentials that the lease was handed
+// out are revoked with leaseCredentials. If that fails, the lease is deleted anyway, and its
+// credentials are recorded as unrevoked, for k8s.CredentialRevoker to revoke later. If
+// clearNamespaces is set, the namespaces of the cluster are deleted, except for the ones that
+// leaseCredentials manages. The requests that the API proxy is forwarding for the lease are cut
+// off with proxyActivity, and its cached target is dropped from proxyTransports. Requests must
+// carry the secret of the lease, unless it was created before leases had secrets or they were made
+// with an admin token. The policy in policies must allow the release
 func DeleteLease(services k8s.ServiceGetterUpdater,
 	k8sServiceName string,
 	gkeClusterLister gke.ClusterLister,
@@ -28,27 +51,43 @@ func DeleteLease(services k8s.ServiceGetterUpdater,
 	azureConfig *config.Azure,
 	googleConfig *config.Google,
 	clearNamespaces bool,
-	nsFunc func(*k8s.KubeConfig) (k8s.NamespaceListerDeleter, error)) http.Handler {
+	nsFunc func(*k8s.KubeConfig) (k8s.NamespaceListerDeleter, error),
+	leaseCredentials *k8s.LeaseCredentials,
+	proxyActivity *proxy.Activity,
+	proxyTransports *proxy.Transports,
+	policies *policy.File,
+	gkeRecycler *gke.Recycler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		pathElts := htp.SplitPath(r)
-		if len(pathElts) != 3 {
-			log.Println("Path must be in the format /lease/{provider}/{token}")
+		var pathProvider, tokenStr string
+		switch len(pathElts) {
+		case 2:
+			tokenStr = pathElts[1]
+		case 3:
+			pathProvider, tokenStr = pathElts[1], pathElts[2]
+		default:
+			log.Println("Path must be in the format /lease/{token}")
 			htp.Error(w, http.StatusBadRequest, "Path must be in the format /lease/{token}")
 			return
 		}
 
-		provider := pathElts[1]
-		leaseToken := uuid.Parse(pathElts[2])
+		leaseToken := uuid.Parse(tokenStr)
 		if leaseToken == nil {
-			log.Printf("Lease token %s is invalid", pathElts[1])
-			htp.Error(w, http.StatusBadRequest, "Lease token %s is invalid", pathElts[1])
+			log.Printf("Lease token %s is invalid", tokenStr)
+			htp.Error(w, http.StatusBadRequest, "Lease token %s is invalid", tokenStr)
 			return
 		}
 
-		svc, err := services.Get(k8sServiceName)
+		ctx, cancel := context.WithTimeout(r.Context(), deleteAPITimeout)
+		defer cancel()
+		svc, err := k8s.GetService(ctx, services, k8sServiceName)
 		if err != nil {
+			if r.Context().Err() == context.Canceled {
+				log.Printf("The client went away while the %s service was fetched", k8sServiceName)
+				return
+			}
 			log.Printf("Error getting the %s service -- %s", k8sServiceName, err)
-			htp.Error(w, http.StatusInternalServerError, "Error getting the %s service -- %s", k8sServiceName, err)
+			htp.Error(w, htp.UpstreamStatus(err), "Error getting the %s service -- %s", k8sServiceName, err)
 			return
 		}
 		leaseMap, err := leases.ParseMapFromAnnotations(svc.Annotations)
@@ -63,52 +102,47 @@ func DeleteLease(services k8s.ServiceGetterUpdater,
 			htp.Error(w, http.StatusConflict, "Lease %s doesn't exist", leaseToken)
 			return
 		}
+		if !secretAllowed(lease, r) {
+			log.Printf("The request to release lease %s doesn't carry its secret", leaseToken)
+			htp.Error(w, http.StatusForbidden, "The request doesn't carry the secret of lease %s in the %s header", leaseToken, api.LeaseSecretHeader)
+			return
+		}
 
-		var cfg *k8s.KubeConfig
-		switch provider {
-		case "google":
-			if googleConfig.ValidConfig() {
-				cluster, err := gke.GetClusterFromLease(lease, gkeClusterLister, googleConfig.ProjectID, googleConfig.Zone)
-				if err != nil {
-					log.Printf("Couldn't get cluster from lease -- %s for google provider", err)
-					htp.Error(w, http.StatusInternalServerError, "Couldn't get cluster from lease -- %s", err)
-					return
-				}
-				cfg, err = k8s.CreateKubeConfigFromCluster(cluster)
-				if err != nil {
-					log.Printf("Couldn't create kube config from cluster -- %s", err)
-					htp.Error(w, http.StatusInternalServerError, "Couldn't create kube config from cluster -- %s", err)
-					return
-				}
-			} else {
-				log.Println("Unable to satisfy this request because the Google provider is not properly configured.")
-				htp.Error(w, http.StatusInternalServerError, "Unable to satisfy this request because the Google provider is not properly configured.")
-			}
-		case "azure":
-			if azureConfig.ValidConfig() {
-				cluster, err := azure.GetClusterFromLease(lease, azureClusterLister)
-				if err != nil {
-					log.Printf("Couldn't get cluster from lease -- %s for azure provider", err)
-					htp.Error(w, http.StatusInternalServerError, "Couldn't get cluster from lease -- %s", err)
-					return
-				}
-				log.Printf("Cluster when deleting:%+v\n", cluster)
-				cfg, err = azure.FetchKubeConfig(*cluster.MasterProfile.Fqdn)
-				if err != nil {
-					log.Printf("Couldn't create kube config from cluster -- %s", err)
-					htp.Error(w, http.StatusInternalServerError, "Couldn't create kube config from cluster -- %s", err)
-					return
-				}
-			} else {
-				log.Println("Unable to satisfy this request because the Azure provider is not properly configured.")
-				htp.Error(w, http.StatusInternalServerError, "Unable to satisfy this request because the Azure provider is not properly configured.")
-			}
-		default:
-			log.Printf("Unable to find suitable provider for this request -- Provider:%s", provider)
-			htp.Error(w, http.StatusBadRequest, "Unable to find suitable provider for this request -- Provider:%s", provider)
+		provider := lease.Provider
+		switch {
+		case provider == "" && pathProvider == "":
+			log.Printf("Lease %s doesn't record its provider, and none was given", leaseToken)
+			htp.Error(w, http.StatusBadRequest, "Lease %s doesn't record its provider, use /lease/{provider}/{token}", leaseToken)
+			return
+		case provider == "":
+			provider = pathProvider
+		case pathProvider != "" && pathProvider != provider:
+			log.Printf("Lease %s is for a %s cluster, not %s", leaseToken, provider, pathProvider)
+			htp.Error(w, http.StatusBadRequest, "Lease %s is for a %s cluster, not %s", leaseToken, provider, pathProvider)
+			return
+		}
+		clusterID := leases.ClusterID(provider, lease.ClusterName)
+		id, _ := auth.FromContext(r.Context())
+		if err := policies.Policy().CheckRelease(id, lease, provider); err != nil {
+			log.Printf("The request of %s to release lease %s was %s", id.ID(), leaseToken, err)
+			htp.Error(w, http.StatusForbidden, "The request to release lease %s was %s", leaseToken, err)
 			return
 		}
 
+		cluster, ok := lookupLeasedCluster(ctx, w, r, lease, provider, gkeClusterLister, googleConfig, azureClusterLister, azureConfig)
+		if !ok {
+			return
+		}
+		cfg, gkeCluster, gkeScope := cluster.kubeConfig, cluster.gkeCluster, cluster.gkeScope
+
+		// recycled clusters are recreated instead of having their namespaces deleted, and can't be
+		// leased again until they're running. Recreating them revokes every credential too
+		recycle := gkeCluster != nil && gkeRecycler != nil && gkeRecycler.Matches(gkeCluster.Name)
+		revokeErr := error(nil)
+		if lease.ServiceAccount != "" && !recycle && leaseCredentials != nil {
+			revokeErr = leaseCredentials.Revoke(cfg, lease.ServiceAccount)
+		}
+
 		// blow away the lease, regardless of whether it's expired or not. the create endpoint deletes
 		// the lease from annotations, replacing the lease for a cluster with a new UUID anyway
 		deleted := leaseMap.DeleteLease(leaseToken)
@@ -117,27 +151,72 @@ func DeleteLease(services k8s.ServiceGetterUpdater,
 			htp.Error(w, http.StatusConflict, "Lease %s doesn't exist", leaseToken)
 			return
 		}
+		leaseMap.MarkReleased(clusterID, time.Now())
+		// the lease is released even if its credentials couldn't be revoked. The credential revoker
+		// tries again later
+		if revokeErr != nil {
+			log.Printf("Error revoking the credentials of lease %s, they'll be revoked later -- %s", leaseToken, revokeErr)
+			leaseMap.MarkUnrevoked(clusterID, lease.ServiceAccount)
+		}
+		// leases that are released early only count against their creator's budget until now
+		leaseMap.EndUsage(lease.CreatedBy, leaseToken, time.Now())
+		// the lease's API proxy requests are cut off before its namespaces are deleted
+		proxyActivity.Cut(leaseToken.String())
+		proxyTransports.Drop(leaseToken.String())
 
-		if clearNamespaces {
+		if recycle {
+			leaseMap.MarkRecycling(clusterID, leases.RecycleDeleting, time.Now())
+		} else if clearNamespaces {
 			namespaces, err := nsFunc(cfg)
 			if err != nil {
 				log.Printf("Couldn't create namespaces lister/deleter implementation  -- %s", err)
 				htp.Error(w, http.StatusInternalServerError, "Couldn't create namespaces lister/deleter implementation  -- %s", err)
 				return
 			}
-			if err := deleteNamespaces(namespaces, skipDeleteNamespaces); err != nil {
+			// the namespaces that the credentials of leases are created in are kept
+			skip := make(map[string]struct{})
+			for _, namespace := range leaseCredentials.ManagedNamespaces() {
+				skip[namespace] = struct{}{}
+			}
+			if err := deleteNamespaces(namespaces, skip); err != nil {
 				log.Printf("Error deleting namespaces -- %s", err)
 				htp.Error(w, http.StatusInternalServerError, "Error deleting namespaces -- %s", err)
 				return
 			}
+			leaseMap.MarkCleaned(clusterID, time.Now())
 		}
 
-		if err := k8s.SaveAnnotations(services, svc, leaseMap); err != nil {
+		// the release is saved even if the client goes away or the namespaces took a while to
+		// delete, since the cluster is already being cleaned up
+		saveCtx, cancelSave := context.WithTimeout(context.Background(), deleteAPITimeout)
+		defer cancelSave()
+		if err := k8s.SaveAnnotations(saveCtx, services, svc, leaseMap); err != nil {
 			log.Printf("Error saving new annotations -- %s", err)
 			htp.Error(w, http.StatusInternalServerError, "Error saving new annotations -- %s", err)
 			return
 		}
+		if recycle {
+			// if the server stops before the recycle is done, the recycler resumes it after the
+			// server starts again
+			go func() {
+				gkeRecycler.Recycle(lease.ClusterName, gkeScope, gkeCluster)
+				// the recreated cluster has a new endpoint and credentials
+				inventory.Invalidate(gkeClusterLister)
+			}()
+		}
 
 		w.WriteHeader(http.StatusOK)
 	})
 }
+
+// secretAllowed returns true if r carries the secret of lease, if lease was created before
+// leases had secrets, or if r was made with an admin token
+func secretAllowed(lease *leases.Lease, r *http.Request) bool {
+	if lease.SecretHash == "" {
+		return true
+	}
+	if id, ok := auth.FromContext(r.Context()); ok && id.Role.Allows(auth.RoleAdmin) {
+		return true
+	}
+	return lease.SecretMatches(r.Header.Get(api.LeaseSecretHeader))
+}
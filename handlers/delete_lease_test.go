@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -9,6 +10,8 @@ import (
 	"k8s.io/client-go/pkg/api/v1"
 
 	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/api"
+	"github.com/deis/k8s-claimer/auth"
 	"github.com/deis/k8s-claimer/config"
 	"github.com/deis/k8s-claimer/k8s"
 	"github.com/deis/k8s-claimer/leases"
@@ -22,7 +25,7 @@ func TestDeleteLeaseNoToken(t *testing.T) {
 	clusterLister := gke.NewFakeClusterLister(newListClusterResp(testutil.GetGKEClusters()), nil)
 	nsListerDeleter := k8s.NewFakeNamespaceListerDeleter(&v1.NamespaceList{}, nil, nil)
 	googleConfig := &config.Google{AccountFileJSON: "test", ProjectID: "proj1", Zone: "zone1"}
-	hdl := DeleteLease(getterUpdater, "claimer", clusterLister, nil, nil, googleConfig, true, k8s.GetNSFunc(nsListerDeleter, nil))
+	hdl := DeleteLease(getterUpdater, "claimer", clusterLister, nil, nil, googleConfig, true, k8s.GetNSFunc(nsListerDeleter, nil), nil, nil, nil, nil, nil)
 	req, err := http.NewRequest("DELETE", "/lease", nil)
 	req.Header.Set("Authorization", "some awesome token")
 	assert.NoErr(t, err)
@@ -36,7 +39,7 @@ func TestDeleteLeaseInvalidLeaseToken(t *testing.T) {
 	clusterLister := gke.NewFakeClusterLister(newListClusterResp(testutil.GetGKEClusters()), nil)
 	nsListerDeleter := k8s.NewFakeNamespaceListerDeleter(&v1.NamespaceList{}, nil, nil)
 	googleConfig := config.Google{ProjectID: "proj1", Zone: "zone1"}
-	hdl := DeleteLease(getterUpdater, "claimer", clusterLister, nil, nil, &googleConfig, true, k8s.GetNSFunc(nsListerDeleter, nil))
+	hdl := DeleteLease(getterUpdater, "claimer", clusterLister, nil, nil, &googleConfig, true, k8s.GetNSFunc(nsListerDeleter, nil), nil, nil, nil, nil, nil)
 	req, err := http.NewRequest("DELETE", "/lease/google/abcd", nil)
 	req.Header.Set("Authorization", "some awesome token")
 	assert.NoErr(t, err)
@@ -57,7 +60,7 @@ func TestDeleteLeaseInvalidAnnotations(t *testing.T) {
 	clusterLister := gke.NewFakeClusterLister(newListClusterResp(testutil.GetGKEClusters()), nil)
 	nsListerDeleter := k8s.NewFakeNamespaceListerDeleter(&v1.NamespaceList{}, nil, nil)
 	googleConfig := &config.Google{AccountFileJSON: "test", ProjectID: "proj1", Zone: "zone1"}
-	hdl := DeleteLease(getterUpdater, "claimer", clusterLister, nil, nil, googleConfig, true, k8s.GetNSFunc(nsListerDeleter, nil))
+	hdl := DeleteLease(getterUpdater, "claimer", clusterLister, nil, nil, googleConfig, true, k8s.GetNSFunc(nsListerDeleter, nil), nil, nil, nil, nil, nil)
 	req, err := http.NewRequest("DELETE", "/lease/google/"+uuid.New(), nil)
 	req.Header.Set("Authorization", "some awesome token")
 	assert.NoErr(t, err)
@@ -76,7 +79,7 @@ func TestDeleteLeaseNoSuchLease(t *testing.T) {
 	clusterLister := gke.NewFakeClusterLister(newListClusterResp(testutil.GetGKEClusters()), nil)
 	nsListerDeleter := k8s.NewFakeNamespaceListerDeleter(&v1.NamespaceList{}, nil, nil)
 	googleConfig := &config.Google{AccountFileJSON: "test", ProjectID: "proj1", Zone: "zone1"}
-	hdl := DeleteLease(getterUpdater, "claimer", clusterLister, nil, nil, googleConfig, true, k8s.GetNSFunc(nsListerDeleter, nil))
+	hdl := DeleteLease(getterUpdater, "claimer", clusterLister, nil, nil, googleConfig, true, k8s.GetNSFunc(nsListerDeleter, nil), nil, nil, nil, nil, nil)
 	req, err := http.NewRequest("DELETE", "/lease/google/"+uuid.New(), nil)
 	req.Header.Set("Authorization", "some awesome token")
 	assert.NoErr(t, err)
@@ -120,7 +123,7 @@ func TestDeleteLeaseExists(t *testing.T) {
 		clusterLister := gke.NewFakeClusterLister(listClusterResp, nil)
 		nsListerDeleter := k8s.NewFakeNamespaceListerDeleter(&nsList, nil, nil)
 		googleConfig := &config.Google{AccountFileJSON: "test", ProjectID: "proj1", Zone: "zone1"}
-		hdl := DeleteLease(getterUpdater, "claimer", clusterLister, nil, nil, googleConfig, true, k8s.GetNSFunc(nsListerDeleter, nil))
+		hdl := DeleteLease(getterUpdater, "claimer", clusterLister, nil, nil, googleConfig, true, k8s.GetNSFunc(nsListerDeleter, nil), nil, nil, nil, nil, nil)
 		req, err := http.NewRequest("DELETE", path, nil)
 		req.Header.Set("Authorization", "some awesome token")
 		if err != nil {
@@ -182,7 +185,7 @@ func TestDeleteLeaseExistsNoClearNamespaces(t *testing.T) {
 		clusterLister := gke.NewFakeClusterLister(listClusterResp, nil)
 		nsListerDeleter := k8s.NewFakeNamespaceListerDeleter(&nsList, nil, nil)
 		googleConfig := &config.Google{AccountFileJSON: "test", ProjectID: "proj1", Zone: "zone1"}
-		hdl := DeleteLease(getterUpdater, "claimer", clusterLister, nil, nil, googleConfig, false, k8s.GetNSFunc(nsListerDeleter, nil))
+		hdl := DeleteLease(getterUpdater, "claimer", clusterLister, nil, nil, googleConfig, false, k8s.GetNSFunc(nsListerDeleter, nil), nil, nil, nil, nil, nil)
 		req, err := http.NewRequest("DELETE", path, nil)
 		req.Header.Set("Authorization", "some awesome token")
 		if err != nil {
@@ -199,3 +202,252 @@ func TestDeleteLeaseExistsNoClearNamespaces(t *testing.T) {
 		assert.Equal(t, len(nsListerDeleter.NsDeleted), 0, "number of deleted namespaces")
 	}
 }
+
+func TestDeleteLeaseTokenOnly(t *testing.T) {
+	cluster := testutil.GetGKEClusters()[0]
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	token := uuid.NewUUID()
+	lease := leases.NewLease(cluster.Name, time.Now().Add(1*time.Hour))
+	lease.Provider = leases.ProviderGoogle
+	assert.True(t, leaseMap.CreateLease(token, lease), "failed to create the lease")
+	legacyToken := uuid.NewUUID()
+	legacyCluster := testutil.GetGKEClusters()[1]
+	assert.True(t, leaseMap.CreateLease(legacyToken, leases.NewLease(legacyCluster.Name, time.Now().Add(1*time.Hour))), "failed to create the legacy lease")
+	annos, err := leaseMap.ToAnnotations()
+	assert.NoErr(t, err)
+	getterUpdater := k8s.NewFakeServiceGetterUpdater(&v1.Service{ObjectMeta: v1.ObjectMeta{Annotations: annos}}, nil, nil, nil)
+	clusterLister := gke.NewFakeClusterLister(newListClusterResp(testutil.GetGKEClusters()), nil)
+	nsListerDeleter := k8s.NewFakeNamespaceListerDeleter(&v1.NamespaceList{}, nil, nil)
+	googleConfig := &config.Google{AccountFileJSON: "test", ProjectID: "proj1", Zone: "zone1"}
+	hdl := DeleteLease(getterUpdater, "claimer", clusterLister, nil, nil, googleConfig, false, k8s.GetNSFunc(nsListerDeleter, nil), nil, nil, nil, nil, nil)
+
+	for path, code := range map[string]int{
+		// the legacy lease doesn't record its provider, so it has to be given
+		"/lease/" + legacyToken.String(): http.StatusBadRequest,
+		// the path's provider must match the lease's
+		"/lease/azure/" + token.String(): http.StatusBadRequest,
+	} {
+		req, err := http.NewRequest("DELETE", path, nil)
+		assert.NoErr(t, err)
+		res := httptest.NewRecorder()
+		hdl.ServeHTTP(res, req)
+		assert.Equal(t, res.Code, code, "response code for "+path)
+	}
+
+	req, err := http.NewRequest("DELETE", "/lease/"+token.String(), nil)
+	assert.NoErr(t, err)
+	res := httptest.NewRecorder()
+	hdl.ServeHTTP(res, req)
+	assert.Equal(t, res.Code, http.StatusOK, "response code")
+	saved, err := leases.ParseMapFromAnnotations(getterUpdater.Svc.Annotations)
+	assert.NoErr(t, err)
+	_, found := saved.LeaseForUUID(token)
+	assert.False(t, found, "lease still exists")
+	assert.False(t, saved.ClusterStatus("google/"+cluster.Name).LastReleasedTime().IsZero(), "cluster wasn't marked released")
+}
+
+func TestDeleteLeaseRevokesCredentials(t *testing.T) {
+	cluster := testutil.GetGKEClusters()[0]
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	token := uuid.NewUUID()
+	lease := leases.NewLease(cluster.Name, time.Now().Add(1*time.Hour))
+	lease.Provider = leases.ProviderGoogle
+	lease.ServiceAccount = "k8s-claimer-leases/k8s-claimer-lease-" + token.String()
+	assert.True(t, leaseMap.CreateLease(token, lease), "failed to create the lease")
+	annos, err := leaseMap.ToAnnotations()
+	assert.NoErr(t, err)
+	getterUpdater := k8s.NewFakeServiceGetterUpdater(&v1.Service{ObjectMeta: v1.ObjectMeta{Annotations: annos}}, nil, nil, nil)
+	clusterLister := gke.NewFakeClusterLister(newListClusterResp(testutil.GetGKEClusters()), nil)
+	nsListerDeleter := k8s.NewFakeNamespaceListerDeleter(&v1.NamespaceList{}, nil, nil)
+	googleConfig := &config.Google{ProjectID: "proj1", Zone: "zone1"}
+	bindings := &k8s.FakeRBACClient{Bindings: []k8s.RoleBinding{{Name: "k8s-claimer-lease-" + token.String(), ClusterRole: k8s.LeaseClusterRole}}}
+	clients := &k8s.LeaseCredentialClients{
+		Namespaces:      &k8s.FakeNamespaceCreator{},
+		ServiceAccounts: &k8s.FakeServiceAccountClient{Err: errors.New("the cluster is unreachable")},
+		Secrets:         &k8s.FakeSecretClient{},
+		RBAC:            bindings,
+	}
+	creds := &k8s.LeaseCredentials{Clients: func(*k8s.KubeConfig, string) (*k8s.LeaseCredentialClients, error) {
+		return clients, nil
+	}}
+	hdl := DeleteLease(getterUpdater, "claimer", clusterLister, nil, nil, googleConfig, false, k8s.GetNSFunc(nsListerDeleter, nil), creds, nil, nil, nil, nil)
+
+	// the lease is released even if its credentials can't be revoked, and they're recorded as
+	// unrevoked
+	req, err := http.NewRequest("DELETE", "/lease/"+token.String(), nil)
+	assert.NoErr(t, err)
+	res := httptest.NewRecorder()
+	hdl.ServeHTTP(res, req)
+	assert.Equal(t, res.Code, http.StatusOK, "response code")
+	saved, err := leases.ParseMapFromAnnotations(getterUpdater.Svc.Annotations)
+	assert.NoErr(t, err)
+	_, found := saved.LeaseForUUID(token)
+	assert.False(t, found, "lease still exists")
+	unrevoked := saved.ClusterStatus("google/" + cluster.Name).UnrevokedServiceAccounts
+	assert.Equal(t, unrevoked, []string{lease.ServiceAccount}, "unrevoked service accounts")
+
+	token = uuid.NewUUID()
+	lease = leases.NewLease(cluster.Name, time.Now().Add(1*time.Hour))
+	lease.Provider = leases.ProviderGoogle
+	lease.ServiceAccount = "k8s-claimer-leases/k8s-claimer-lease-" + token.String()
+	assert.True(t, saved.CreateLease(token, lease), "failed to create the second lease")
+	getterUpdater.Svc.Annotations, err = saved.ToAnnotations()
+	assert.NoErr(t, err)
+	bindings.Bindings = []k8s.RoleBinding{{Name: "k8s-claimer-lease-" + token.String(), ClusterRole: k8s.LeaseClusterRole}}
+	sas := &k8s.FakeServiceAccountClient{Items: []v1.ServiceAccount{{ObjectMeta: v1.ObjectMeta{Name: "k8s-claimer-lease-" + token.String()}}}}
+	clients.ServiceAccounts = sas
+	req, err = http.NewRequest("DELETE", "/lease/"+token.String(), nil)
+	assert.NoErr(t, err)
+	res = httptest.NewRecorder()
+	hdl.ServeHTTP(res, req)
+	assert.Equal(t, res.Code, http.StatusOK, "response code")
+	assert.Equal(t, len(sas.Items), 0, "number of service accounts")
+	assert.Equal(t, len(bindings.Bindings), 0, "number of bindings")
+	saved, err = leases.ParseMapFromAnnotations(getterUpdater.Svc.Annotations)
+	assert.NoErr(t, err)
+	_, found = saved.LeaseForUUID(token)
+	assert.False(t, found, "lease still exists")
+	assert.Equal(t, len(saved.ClusterStatus("google/"+cluster.Name).UnrevokedServiceAccounts), 1, "number of unrevoked service accounts")
+}
+
+func TestDeleteLeaseRequiresSecret(t *testing.T) {
+	cluster := testutil.GetGKEClusters()[0]
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	secret, secretHash, err := leases.NewSecret()
+	assert.NoErr(t, err)
+	token := uuid.NewRandom()
+	lease := leases.NewLease(cluster.Name, time.Now().Add(1*time.Hour))
+	lease.Provider = leases.ProviderGoogle
+	lease.SecretHash = secretHash
+	assert.True(t, leaseMap.CreateLease(token, lease), "failed to create the lease")
+	annos, err := leaseMap.ToAnnotations()
+	assert.NoErr(t, err)
+	getterUpdater := k8s.NewFakeServiceGetterUpdater(&v1.Service{ObjectMeta: v1.ObjectMeta{Annotations: annos}}, nil, nil, nil)
+	clusterLister := gke.NewFakeClusterLister(newListClusterResp(testutil.GetGKEClusters()), nil)
+	nsListerDeleter := k8s.NewFakeNamespaceListerDeleter(&v1.NamespaceList{}, nil, nil)
+	googleConfig := &config.Google{ProjectID: "proj1", Zone: "zone1"}
+	hdl := DeleteLease(getterUpdater, "claimer", clusterLister, nil, nil, googleConfig, false, k8s.GetNSFunc(nsListerDeleter, nil), nil, nil, nil, nil, nil)
+
+	for _, wrongSecret := range []string{"", "wrong", secretHash} {
+		req, err := http.NewRequest("DELETE", "/lease/"+token.String(), nil)
+		assert.NoErr(t, err)
+		req.Header.Set(api.LeaseSecretHeader, wrongSecret)
+		res := httptest.NewRecorder()
+		hdl.ServeHTTP(res, req)
+		assert.Equal(t, res.Code, http.StatusForbidden, "response code for secret "+wrongSecret)
+	}
+	saved, err := leases.ParseMapFromAnnotations(getterUpdater.Svc.Annotations)
+	assert.NoErr(t, err)
+	_, found := saved.LeaseForUUID(token)
+	assert.True(t, found, "lease was deleted without its secret")
+
+	req, err := http.NewRequest("DELETE", "/lease/"+token.String(), nil)
+	assert.NoErr(t, err)
+	req.Header.Set(api.LeaseSecretHeader, secret)
+	res := httptest.NewRecorder()
+	hdl.ServeHTTP(res, req)
+	assert.Equal(t, res.Code, http.StatusOK, "response code")
+	saved, err = leases.ParseMapFromAnnotations(getterUpdater.Svc.Annotations)
+	assert.NoErr(t, err)
+	_, found = saved.LeaseForUUID(token)
+	assert.False(t, found, "lease still exists")
+}
+
+func TestDeleteLeaseAdminWithoutSecret(t *testing.T) {
+	cluster := testutil.GetGKEClusters()[0]
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	_, secretHash, err := leases.NewSecret()
+	assert.NoErr(t, err)
+	token := uuid.NewRandom()
+	lease := leases.NewLease(cluster.Name, time.Now().Add(1*time.Hour))
+	lease.Provider = leases.ProviderGoogle
+	lease.SecretHash = secretHash
+	assert.True(t, leaseMap.CreateLease(token, lease), "failed to create the lease")
+	annos, err := leaseMap.ToAnnotations()
+	assert.NoErr(t, err)
+	getterUpdater := k8s.NewFakeServiceGetterUpdater(&v1.Service{ObjectMeta: v1.ObjectMeta{Annotations: annos}}, nil, nil, nil)
+	clusterLister := gke.NewFakeClusterLister(newListClusterResp(testutil.GetGKEClusters()), nil)
+	nsListerDeleter := k8s.NewFakeNamespaceListerDeleter(&v1.NamespaceList{}, nil, nil)
+	googleConfig := &config.Google{ProjectID: "proj1", Zone: "zone1"}
+	hdl := DeleteLease(getterUpdater, "claimer", clusterLister, nil, nil, googleConfig, false, k8s.GetNSFunc(nsListerDeleter, nil), nil, nil, nil, nil, nil)
+
+	req, err := http.NewRequest("DELETE", "/lease/"+token.String(), nil)
+	assert.NoErr(t, err)
+	req = req.WithContext(auth.NewContext(req.Context(), auth.Identity{Name: "ci", Source: auth.SourceToken, Role: auth.RoleUser}))
+	res := httptest.NewRecorder()
+	hdl.ServeHTTP(res, req)
+	assert.Equal(t, res.Code, http.StatusForbidden, "response code for a user token")
+
+	req, err = http.NewRequest("DELETE", "/lease/"+token.String(), nil)
+	assert.NoErr(t, err)
+	req = req.WithContext(auth.NewContext(req.Context(), auth.Identity{Name: "ops", Source: auth.SourceToken, Role: auth.RoleAdmin}))
+	res = httptest.NewRecorder()
+	hdl.ServeHTTP(res, req)
+	assert.Equal(t, res.Code, http.StatusOK, "response code for an admin token")
+	saved, err := leases.ParseMapFromAnnotations(getterUpdater.Svc.Annotations)
+	assert.NoErr(t, err)
+	_, found := saved.LeaseForUUID(token)
+	assert.False(t, found, "lease still exists")
+}
+
+func TestDeleteLeaseDeniedByPolicy(t *testing.T) {
+	cluster := testutil.GetGKEClusters()[0]
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	secret, secretHash, err := leases.NewSecret()
+	assert.NoErr(t, err)
+	token := uuid.NewRandom()
+	lease := leases.NewLease(cluster.Name, time.Now().Add(1*time.Hour))
+	lease.Provider = leases.ProviderGoogle
+	lease.SecretHash = secretHash
+	lease.CreatedBy = "token:ci"
+	assert.True(t, leaseMap.CreateLease(token, lease), "failed to create the lease")
+	leaseMap.RecordUsage("token:ci", token, time.Now().Add(-time.Hour), time.Now().Add(1*time.Hour))
+	annos, err := leaseMap.ToAnnotations()
+	assert.NoErr(t, err)
+	getterUpdater := k8s.NewFakeServiceGetterUpdater(&v1.Service{ObjectMeta: v1.ObjectMeta{Annotations: annos}}, nil, nil, nil)
+	clusterLister := gke.NewFakeClusterLister(newListClusterResp(testutil.GetGKEClusters()), nil)
+	nsListerDeleter := k8s.NewFakeNamespaceListerDeleter(&v1.NamespaceList{}, nil, nil)
+	googleConfig := &config.Google{ProjectID: "proj1", Zone: "zone1"}
+	policies := testPolicies(t, `{"rules": [{"name": "own-leases", "roles": ["user"], "own_leases_only": true}]}`)
+	hdl := DeleteLease(getterUpdater, "claimer", clusterLister, nil, nil, googleConfig, false, k8s.GetNSFunc(nsListerDeleter, nil), nil, nil, nil, policies, nil)
+
+	req, err := http.NewRequest("DELETE", "/lease/"+token.String(), nil)
+	assert.NoErr(t, err)
+	req.Header.Set(api.LeaseSecretHeader, secret)
+	req = req.WithContext(auth.NewContext(req.Context(), auth.Identity{Name: "dev", Source: auth.SourceOIDC, Role: auth.RoleUser}))
+	res := httptest.NewRecorder()
+	hdl.ServeHTTP(res, req)
+	assert.Equal(t, res.Code, http.StatusForbidden, "response code for another identity")
+	saved, err := leases.ParseMapFromAnnotations(getterUpdater.Svc.Annotations)
+	assert.NoErr(t, err)
+	_, found := saved.LeaseForUUID(token)
+	assert.True(t, found, "lease was deleted by another identity")
+
+	// a user whose ID token names them like the API token didn't create the lease either
+	req, err = http.NewRequest("DELETE", "/lease/"+token.String(), nil)
+	assert.NoErr(t, err)
+	req.Header.Set(api.LeaseSecretHeader, secret)
+	req = req.WithContext(auth.NewContext(req.Context(), auth.Identity{Name: "ci", Source: auth.SourceOIDC, Role: auth.RoleUser}))
+	res = httptest.NewRecorder()
+	hdl.ServeHTTP(res, req)
+	assert.Equal(t, res.Code, http.StatusForbidden, "response code for an ID token named like the API token")
+
+	req, err = http.NewRequest("DELETE", "/lease/"+token.String(), nil)
+	assert.NoErr(t, err)
+	req.Header.Set(api.LeaseSecretHeader, secret)
+	req = req.WithContext(auth.NewContext(req.Context(), auth.Identity{Name: "ci", Source: auth.SourceToken, Role: auth.RoleUser}))
+	res = httptest.NewRecorder()
+	hdl.ServeHTTP(res, req)
+	assert.Equal(t, res.Code, http.StatusOK, "response code for the lease's creator")
+	// the lease only counts against the budget of its creator until it was released
+	saved, err = leases.ParseMapFromAnnotations(getterUpdater.Svc.Annotations)
+	assert.NoErr(t, err)
+	usage := saved.Usage("token:ci")
+	assert.Equal(t, len(usage.Leases), 1, "number of usage ledger entries")
+	assert.True(t, usage.Leases[0].Duration() < 90*time.Minute, "the lease counts for %s after it was released", usage.Leases[0].Duration())
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/deis/k8s-claimer/api"
+	"github.com/deis/k8s-claimer/config"
+	"github.com/deis/k8s-claimer/htp"
+	"github.com/deis/k8s-claimer/providers/azure"
+	"github.com/deis/k8s-claimer/providers/gke"
+)
+
+// ExcludedClusters returns the http handler for the GET /excluded endpoint, which reports the
+// clusters of each configured provider that aren't in the pool, and why
+func ExcludedClusters(
+	gkeClusterLister gke.ClusterLister,
+	googleConfig *config.Google,
+	azureClusterLister azure.ClusterLister,
+	azureConfig *config.Azure,
+) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp := api.ExcludedClustersResp{Clusters: []api.ExcludedCluster{}}
+		if googleConfig.ValidConfig() {
+			// ValidConfig only passes if the scopes parse
+			scopes, _ := googleConfig.ClusterScopes()
+			clusterMap, err := gke.ParseMapFromGKE(r.Context(), gkeClusterLister, scopes, googleConfig.Membership())
+			if err != nil {
+				log.Printf("Error listing GKE clusters -- %s", err)
+				htp.Error(w, htp.UpstreamStatus(err), "Error listing GKE clusters -- %s", err)
+				return
+			}
+			resp.Clusters = append(resp.Clusters, clusterMap.Excluded()...)
+		}
+		if azureConfig.ValidConfig() {
+			clusterMap, err := azure.ParseMapFromAzure(r.Context(), azureClusterLister, nil, azureConfig.Membership())
+			if err != nil {
+				log.Printf("Error listing Azure clusters -- %s", err)
+				htp.Error(w, htp.UpstreamStatus(err), "Error listing Azure clusters -- %s", err)
+				return
+			}
+			resp.Clusters = append(resp.Clusters, clusterMap.Excluded()...)
+		}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding json -- %s", err)
+			htp.Error(w, http.StatusInternalServerError, "Error encoding json -- %s", err)
+			return
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/api"
+	"github.com/deis/k8s-claimer/config"
+	"github.com/deis/k8s-claimer/providers/azure"
+	"github.com/deis/k8s-claimer/providers/gke"
+)
+
+func TestExcludedClusters(t *testing.T) {
+	googleConfig := &config.Google{
+		AccountFileJSON: "test",
+		ProjectID:       "proj1",
+		Zone:            "zone1",
+		PoolLabel:       "k8s-claimer=true",
+	}
+	req, err := http.NewRequest("GET", "/excluded", nil)
+	assert.NoErr(t, err)
+	res := httptest.NewRecorder()
+	ExcludedClusters(
+		gke.NewFakeClusterLister(expectedListClusterResp, nil),
+		googleConfig,
+		azure.NewFakeClusterLister(nil, nil),
+		&config.Azure{},
+	).ServeHTTP(res, req)
+	assert.Equal(t, res.Code, http.StatusOK, "response code")
+	resp := new(api.ExcludedClustersResp)
+	assert.NoErr(t, json.NewDecoder(res.Body).Decode(resp))
+	assert.Equal(t, resp.Clusters, []api.ExcludedCluster{{
+		CloudProvider: "google",
+		ClusterName:   expectedCluster.Name,
+		ClusterID:     "google/proj1/zone1/" + expectedCluster.Name,
+		Reason:        "missing the k8s-claimer label",
+	}}, "excluded clusters")
+}
+
+func TestExcludedClustersListError(t *testing.T) {
+	googleConfig := &config.Google{AccountFileJSON: "test", ProjectID: "proj1", Zone: "zone1"}
+	req, err := http.NewRequest("GET", "/excluded", nil)
+	assert.NoErr(t, err)
+	res := httptest.NewRecorder()
+	ExcludedClusters(
+		gke.NewFakeClusterLister(nil, errors.New("test error")),
+		googleConfig,
+		azure.NewFakeClusterLister(nil, nil),
+		&config.Azure{},
+	).ServeHTTP(res, req)
+	assert.Equal(t, res.Code, http.StatusBadGateway, "response code")
+}
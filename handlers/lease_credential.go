@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/deis/k8s-claimer/api"
+	"github.com/deis/k8s-claimer/config"
+	"github.com/deis/k8s-claimer/htp"
+	"github.com/deis/k8s-claimer/k8s"
+	"github.com/deis/k8s-claimer/leases"
+	"github.com/deis/k8s-claimer/providers/azure"
+	"github.com/deis/k8s-claimer/providers/gke"
+	"github.com/pborman/uuid"
+)
+
+// LeaseCredential returns the http handler for the GET /credential/{token} endpoint, which the
+// exec credential plugin of the CLI calls each time kubectl needs the credentials of a lease. The
+// credentials are fetched from the leased cluster with leaseCredentials, and kubectl caches them
+// for ttl or until the lease expires, whichever comes first. That's only a cache hint, since the
+// token is the permanent token of the lease's service account: it only stops working when the
+// lease's credentials are revoked. Leases that were released or that expired are
+// refused, and so are requests that don't carry the secret of the lease and weren't made with an
+// admin token
+func LeaseCredential(services k8s.ServiceGetter,
+	k8sServiceName string,
+	gkeClusterLister gke.ClusterLister,
+	azureClusterLister azure.ClusterLister,
+	azureConfig *config.Azure,
+	googleConfig *config.Google,
+	leaseCredentials *k8s.LeaseCredentials,
+	ttl time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pathElts := htp.SplitPath(r)
+		if len(pathElts) != 2 {
+			log.Println("Path must be in the format /credential/{token}")
+			htp.Error(w, http.StatusBadRequest, "Path must be in the format /credential/{token}")
+			return
+		}
+		leaseToken := uuid.Parse(pathElts[1])
+		if leaseToken == nil {
+			log.Printf("Lease token %s is invalid", pathElts[1])
+			htp.Error(w, http.StatusBadRequest, "Lease token %s is invalid", pathElts[1])
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), deleteAPITimeout)
+		defer cancel()
+		svc, err := k8s.GetService(ctx, services, k8sServiceName)
+		if err != nil {
+			if r.Context().Err() == context.Canceled {
+				log.Printf("The client went away while the %s service was fetched", k8sServiceName)
+				return
+			}
+			log.Printf("Error getting the %s service -- %s", k8sServiceName, err)
+			htp.Error(w, htp.UpstreamStatus(err), "Error getting the %s service -- %s", k8sServiceName, err)
+			return
+		}
+		leaseMap, err := leases.ParseMapFromAnnotations(svc.Annotations)
+		if err != nil {
+			log.Printf("Error getting annotations for the %s service -- %s", k8sServiceName, err)
+			htp.Error(w, http.StatusInternalServerError, "Error getting annotations for the %s service -- %s", k8sServiceName, err)
+			return
+		}
+		lease, existed := leaseMap.LeaseForUUID(leaseToken)
+		if !existed {
+			log.Printf("Lease %s doesn't exist", leaseToken)
+			htp.Error(w, http.StatusConflict, "Lease %s doesn't exist", leaseToken)
+			return
+		}
+		if !secretAllowed(lease, r) {
+			log.Printf("The request for the credentials of lease %s doesn't carry its secret", leaseToken)
+			htp.Error(w, http.StatusForbidden, "The request doesn't carry the secret of lease %s in the %s header", leaseToken, api.LeaseSecretHeader)
+			return
+		}
+		exprTime, err := lease.ExpirationTime()
+		if err != nil {
+			log.Printf("Lease %s has a malformed expiration time -- %s", leaseToken, err)
+			htp.Error(w, http.StatusInternalServerError, "Lease %s has a malformed expiration time -- %s", leaseToken, err)
+			return
+		}
+		now := time.Now()
+		if !now.Before(exprTime) {
+			log.Printf("Lease %s expired at %s", leaseToken, exprTime)
+			htp.Error(w, http.StatusGone, "Lease %s expired at %s", leaseToken, exprTime.Format(time.RFC3339))
+			return
+		}
+		if lease.ServiceAccount == "" {
+			log.Printf("Lease %s wasn't handed out its own credentials", leaseToken)
+			htp.Error(w, http.StatusConflict, "Lease %s wasn't handed out its own credentials", leaseToken)
+			return
+		}
+
+		cluster, ok := lookupLeasedCluster(ctx, w, r, lease, lease.Provider, gkeClusterLister, googleConfig, azureClusterLister, azureConfig)
+		if !ok {
+			return
+		}
+		token, err := leaseCredentials.Token(cluster.kubeConfig, lease.ServiceAccount)
+		if err != nil {
+			log.Printf("Error getting the credentials of lease %s -- %s", leaseToken, err)
+			htp.Error(w, htp.UpstreamStatus(err), "Error getting the credentials of lease %s -- %s", leaseToken, err)
+			return
+		}
+
+		expiration := now.Add(ttl)
+		if exprTime.Before(expiration) {
+			expiration = exprTime
+		}
+		resp := api.LeaseCredentialResp{Token: token, ExpirationTime: expiration.UTC().Format(time.RFC3339)}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding json -- %s", err)
+			htp.Error(w, http.StatusInternalServerError, "Error encoding json -- %s", err)
+			return
+		}
+	})
+}
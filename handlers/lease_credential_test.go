@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/api"
+	"github.com/deis/k8s-claimer/config"
+	"github.com/deis/k8s-claimer/k8s"
+	"github.com/deis/k8s-claimer/leases"
+	"github.com/deis/k8s-claimer/providers/gke"
+	"github.com/deis/k8s-claimer/testutil"
+	"github.com/pborman/uuid"
+)
+
+func TestLeaseCredential(t *testing.T) {
+	clusters := testutil.GetGKEClusters()
+	cluster := clusters[0]
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	lease := leases.NewLease(cluster.Name, time.Now().Add(1*time.Hour))
+	lease.Provider = leases.ProviderGoogle
+	lease.ServiceAccount = "k8s-claimer-leases/k8s-claimer-lease-abc"
+	secret, secretHash, err := leases.NewSecret()
+	assert.NoErr(t, err)
+	lease.SecretHash = secretHash
+	token := uuid.NewUUID()
+	assert.True(t, leaseMap.CreateLease(token, lease), "failed to create the lease")
+	expired := leases.NewLease(clusters[1].Name, time.Now().Add(-1*time.Minute))
+	expired.Provider = leases.ProviderGoogle
+	expired.ServiceAccount = "k8s-claimer-leases/k8s-claimer-lease-def"
+	expiredToken := uuid.NewUUID()
+	assert.True(t, leaseMap.CreateLease(expiredToken, expired), "failed to create the expired lease")
+	adminOnly := leases.NewLease(clusters[2].Name, time.Now().Add(1*time.Hour))
+	adminOnly.Provider = leases.ProviderGoogle
+	adminOnlyToken := uuid.NewUUID()
+	assert.True(t, leaseMap.CreateLease(adminOnlyToken, adminOnly), "failed to create the admin lease")
+	annos, err := leaseMap.ToAnnotations()
+	assert.NoErr(t, err)
+
+	getter := k8s.NewFakeServiceGetterUpdater(&v1.Service{ObjectMeta: v1.ObjectMeta{Annotations: annos}}, nil, nil, nil)
+	clusterLister := gke.NewFakeClusterLister(newListClusterResp(clusters), nil)
+	googleConfig := &config.Google{ProjectID: "proj1", Zone: "zone1"}
+	secrets := &k8s.FakeSecretClient{
+		Items: []v1.Secret{{ObjectMeta: v1.ObjectMeta{Name: "k8s-claimer-lease-abc"}, Type: v1.SecretTypeServiceAccountToken}},
+		Token: "token1",
+	}
+	creds := &k8s.LeaseCredentials{Clients: func(*k8s.KubeConfig, string) (*k8s.LeaseCredentialClients, error) {
+		return &k8s.LeaseCredentialClients{Secrets: secrets}, nil
+	}}
+	hdl := LeaseCredential(getter, "claimer", clusterLister, nil, nil, googleConfig, creds, 5*time.Minute)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", path, nil)
+		assert.NoErr(t, err)
+		req.Header.Set(api.LeaseSecretHeader, secret)
+		res := httptest.NewRecorder()
+		hdl.ServeHTTP(res, req)
+		return res
+	}
+	assert.Equal(t, get("/credential/abcd").Code, http.StatusBadRequest, "response code for a malformed token")
+	assert.Equal(t, get("/credential/"+uuid.New()).Code, http.StatusConflict, "response code for a missing lease")
+	assert.Equal(t, get("/credential/"+expiredToken.String()).Code, http.StatusGone, "response code for an expired lease")
+	assert.Equal(t, get("/credential/"+adminOnlyToken.String()).Code, http.StatusConflict, "response code for a lease without credentials")
+
+	req, err := http.NewRequest("GET", "/credential/"+token.String(), nil)
+	assert.NoErr(t, err)
+	res := httptest.NewRecorder()
+	hdl.ServeHTTP(res, req)
+	assert.Equal(t, res.Code, http.StatusForbidden, "response code without the secret")
+
+	res = get("/credential/" + token.String())
+	assert.Equal(t, res.Code, http.StatusOK, "response code")
+	resp, err := api.DecodeLeaseCredentialResp(res.Body)
+	assert.NoErr(t, err)
+	assert.Equal(t, resp.Token, "token1", "token")
+	expiration, err := resp.Expiration()
+	assert.NoErr(t, err)
+	assert.True(t, expiration.Before(time.Now().Add(6*time.Minute)), "credentials outlive the TTL")
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/deis/k8s-claimer/config"
+	"github.com/deis/k8s-claimer/htp"
+	"github.com/deis/k8s-claimer/k8s"
+	"github.com/deis/k8s-claimer/leases"
+	"github.com/deis/k8s-claimer/providers/azure"
+	"github.com/deis/k8s-claimer/providers/gke"
+	container "google.golang.org/api/container/v1"
+)
+
+// leasedCluster is the cluster of a lease, along with its admin kubeconfig. gkeCluster and
+// gkeScope are only set for GKE clusters
+type leasedCluster struct {
+	kubeConfig *k8s.KubeConfig
+	gkeCluster *container.Cluster
+	gkeScope   config.GKEScope
+}
+
+// lookupLeasedCluster finds the cluster of lease, which is from provider, and creates its admin
+// kubeconfig. The provider APIs are called with ctx, which is derived from the context of r. If
+// that fails, the error response is written to w, unless the client went away, and false is
+// returned
+func lookupLeasedCluster(
+	ctx context.Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	lease *leases.Lease,
+	provider string,
+	gkeClusterLister gke.ClusterLister,
+	googleConfig *config.Google,
+	azureClusterLister azure.ClusterLister,
+	azureConfig *config.Azure,
+) (*leasedCluster, bool) {
+	switch provider {
+	case leases.ProviderGoogle:
+		if !googleConfig.ValidConfig() {
+			log.Println("Unable to satisfy this request because the Google provider is not properly configured.")
+			htp.Error(w, http.StatusInternalServerError, "Unable to satisfy this request because the Google provider is not properly configured.")
+			return nil, false
+		}
+		// ValidConfig only passes if the scopes parse
+		scopes, _ := googleConfig.ClusterScopes()
+		cluster, scope, err := gke.GetClusterFromLease(ctx, lease, gkeClusterLister, scopes)
+		if err != nil {
+			if r.Context().Err() == context.Canceled {
+				log.Printf("The client went away while GKE clusters were listed")
+				return nil, false
+			}
+			log.Printf("Couldn't get cluster from lease -- %s for google provider", err)
+			htp.Error(w, lookupStatus(err, gke.IsNoSuchCluster(err)), "Couldn't get cluster from lease -- %s", err)
+			return nil, false
+		}
+		cfg, err := k8s.CreateKubeConfigFromCluster(cluster)
+		if err != nil {
+			log.Printf("Couldn't create kube config from cluster -- %s", err)
+			htp.Error(w, http.StatusInternalServerError, "Couldn't create kube config from cluster -- %s", err)
+			return nil, false
+		}
+		return &leasedCluster{kubeConfig: cfg, gkeCluster: cluster, gkeScope: scope}, true
+	case leases.ProviderAzure:
+		if !azureConfig.ValidConfig() {
+			log.Println("Unable to satisfy this request because the Azure provider is not properly configured.")
+			htp.Error(w, http.StatusInternalServerError, "Unable to satisfy this request because the Azure provider is not properly configured.")
+			return nil, false
+		}
+		cluster, err := azure.GetClusterFromLease(ctx, lease, azureClusterLister)
+		if err != nil {
+			if r.Context().Err() == context.Canceled {
+				log.Printf("The client went away while Azure clusters were listed")
+				return nil, false
+			}
+			log.Printf("Couldn't get cluster from lease -- %s for azure provider", err)
+			htp.Error(w, lookupStatus(err, azure.IsNoSuchCluster(err)), "Couldn't get cluster from lease -- %s", err)
+			return nil, false
+		}
+		cfg, err := azure.FetchKubeConfig(*cluster.MasterProfile.Fqdn)
+		if err != nil {
+			log.Printf("Couldn't create kube config from cluster -- %s", err)
+			htp.Error(w, http.StatusInternalServerError, "Couldn't create kube config from cluster -- %s", err)
+			return nil, false
+		}
+		return &leasedCluster{kubeConfig: cfg}, true
+	default:
+		log.Printf("Unable to find suitable provider for this request -- Provider:%s", provider)
+		htp.Error(w, http.StatusBadRequest, "Unable to find suitable provider for this request -- Provider:%s", provider)
+		return nil, false
+	}
+}
+
+// lookupStatus returns the status code to respond with when the cluster of a lease couldn't be
+// looked up because of err. A cluster that doesn't exist anymore is a server error, and other
+// errors come from the provider's API
+func lookupStatus(err error, noSuchCluster bool) int {
+	if noSuchCluster {
+		return http.StatusInternalServerError
+	}
+	return htp.UpstreamStatus(err)
+}
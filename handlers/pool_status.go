@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/deis/k8s-claimer/htp"
+	"github.com/deis/k8s-claimer/providers/gke"
+)
+
+// PoolStatus returns the http handler for the GET /pool endpoint, which reports what the GKE pool
+// manager decided to do with each free cluster on its last run
+func PoolStatus(poolManager *gke.PoolManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if poolManager == nil {
+			log.Println("The GKE pool manager is not enabled")
+			htp.Error(w, http.StatusNotFound, "The GKE pool manager is not enabled")
+			return
+		}
+		if err := json.NewEncoder(w).Encode(poolManager.Status()); err != nil {
+			log.Printf("Error encoding json -- %s", err)
+			htp.Error(w, http.StatusInternalServerError, "Error encoding json -- %s", err)
+			return
+		}
+	})
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/config"
+	"github.com/deis/k8s-claimer/k8s"
+	"github.com/deis/k8s-claimer/providers/gke"
+)
+
+func TestPoolStatusNotEnabled(t *testing.T) {
+	req, err := http.NewRequest("GET", "/pool", nil)
+	assert.NoErr(t, err)
+	res := httptest.NewRecorder()
+	PoolStatus(nil).ServeHTTP(res, req)
+	assert.Equal(t, res.Code, http.StatusNotFound, "response code")
+}
+
+func TestPoolStatus(t *testing.T) {
+	services := k8s.NewFakeServiceGetterUpdater(&v1.Service{
+		ObjectMeta: v1.ObjectMeta{Name: "service1"},
+	}, nil, nil, nil)
+	poolConfig := config.GKEPool{Enabled: true, MinFree: 1, IdleTimeout: time.Hour, Interval: time.Minute}
+	poolManager := gke.NewPoolManager(
+		gke.NewFakeClusterLister(expectedListClusterResp, nil),
+		gke.NewFakeNodePoolScaler(nil),
+		services,
+		"service1",
+		[]config.GKEScope{{ProjectID: "proj1", Location: "zone1"}},
+		config.PoolMembership{},
+		poolConfig,
+	)
+	poolManager.Reconcile(time.Now())
+
+	req, err := http.NewRequest("GET", "/pool", nil)
+	assert.NoErr(t, err)
+	res := httptest.NewRecorder()
+	PoolStatus(poolManager).ServeHTTP(res, req)
+	assert.Equal(t, res.Code, http.StatusOK, "response code")
+	status := new(gke.PoolStatus)
+	assert.NoErr(t, json.NewDecoder(res.Body).Decode(status))
+	assert.Equal(t, status.Error, "", "pool manager error")
+	assert.Equal(t, len(status.Decisions), 1, "number of decisions")
+	assert.Equal(t, status.Decisions[0].ClusterName, "proj1/zone1/"+expectedCluster.Name, "cluster ID")
+	assert.Equal(t, status.Decisions[0].Action, gke.PoolActionKeep, "action")
+}
@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/deis/k8s-claimer/api"
+	"github.com/deis/k8s-claimer/config"
+	"github.com/deis/k8s-claimer/htp"
+	"github.com/deis/k8s-claimer/k8s"
+	"github.com/deis/k8s-claimer/leases"
+	"github.com/deis/k8s-claimer/providers/azure"
+	"github.com/deis/k8s-claimer/providers/gke"
+	"github.com/deis/k8s-claimer/proxy"
+	"github.com/pborman/uuid"
+)
+
+const (
+	bearerPrefix = "Bearer "
+)
+
+// Proxy returns the http handler for the /proxy/{token}/{path} endpoint, the API proxy that the
+// kubeconfigs of leases that ask for it talk to. Requests that carry the bearer token of the
+// lease are forwarded to {path} on the master of the leased cluster, with the cluster's
+// credentials. The lease and its cluster are looked up once, and then cached in transports, so
+// the requests of a lease reuse its connections to the master. If the lease was handed out its
+// own credentials, the master impersonates its service account. Requests are cut off when the
+// lease expires, and activity cuts them off when the lease is released. Responses are flushed
+// every flushInterval. Requests that upgrade their connection, like exec, attach and
+// port-forward, can't be forwarded, and are refused with 501
+func Proxy(services k8s.ServiceGetter,
+	k8sServiceName string,
+	gkeClusterLister gke.ClusterLister,
+	azureClusterLister azure.ClusterLister,
+	azureConfig *config.Azure,
+	googleConfig *config.Google,
+	transports *proxy.Transports,
+	activity *proxy.Activity,
+	flushInterval time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pathElts := htp.SplitPath(r)
+		if len(pathElts) < 2 {
+			log.Println("Path must be in the format /proxy/{token}/{path}")
+			htp.Error(w, http.StatusBadRequest, "Path must be in the format /proxy/{token}/{path}")
+			return
+		}
+		leaseToken := uuid.Parse(pathElts[1])
+		if leaseToken == nil {
+			log.Printf("Lease token %s is invalid", pathElts[1])
+			htp.Error(w, http.StatusBadRequest, "Lease token %s is invalid", pathElts[1])
+			return
+		}
+
+		if proxy.Upgrade(r) {
+			log.Printf("The API proxy can't forward the connection upgrade requested for lease %s", leaseToken)
+			htp.Error(w, http.StatusNotImplemented, "The API proxy can't forward exec, attach or port-forward requests, or other connection upgrades")
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), deleteAPITimeout)
+		defer cancel()
+		target, cached := transports.Get(leaseToken.String())
+		var lease *leases.Lease
+		if cached {
+			lease = &target.Lease
+		} else {
+			svc, err := k8s.GetService(ctx, services, k8sServiceName)
+			if err != nil {
+				if r.Context().Err() == context.Canceled {
+					log.Printf("The client went away while the %s service was fetched", k8sServiceName)
+					return
+				}
+				log.Printf("Error getting the %s service -- %s", k8sServiceName, err)
+				htp.Error(w, htp.UpstreamStatus(err), "Error getting the %s service -- %s", k8sServiceName, err)
+				return
+			}
+			leaseMap, err := leases.ParseMapFromAnnotations(svc.Annotations)
+			if err != nil {
+				log.Printf("Error getting annotations for the %s service -- %s", k8sServiceName, err)
+				htp.Error(w, http.StatusInternalServerError, "Error getting annotations for the %s service -- %s", k8sServiceName, err)
+				return
+			}
+			lease, _ = leaseMap.LeaseForUUID(leaseToken)
+		}
+		// Kubernetes clients take 410 Gone to mean that a watch is too old, so every refusal is a 401
+		if lease == nil || !lease.ProxyTokenMatches(bearerToken(r)) {
+			log.Printf("Lease %s doesn't exist, or the request doesn't carry its API proxy token", leaseToken)
+			htp.Error(w, http.StatusUnauthorized, "Lease %s doesn't exist, or the request doesn't carry its API proxy token", leaseToken)
+			return
+		}
+		exprTime, err := lease.ExpirationTime()
+		if err != nil {
+			log.Printf("Lease %s has a malformed expiration time -- %s", leaseToken, err)
+			htp.Error(w, http.StatusInternalServerError, "Lease %s has a malformed expiration time -- %s", leaseToken, err)
+			return
+		}
+		if !time.Now().Before(exprTime) {
+			transports.Drop(leaseToken.String())
+			log.Printf("Lease %s expired at %s", leaseToken, exprTime)
+			htp.Error(w, http.StatusUnauthorized, "Lease %s expired at %s", leaseToken, exprTime.Format(time.RFC3339))
+			return
+		}
+
+		if !cached {
+			cluster, ok := lookupLeasedCluster(ctx, w, r, lease, lease.Provider, gkeClusterLister, googleConfig, azureClusterLister, azureConfig)
+			if !ok {
+				return
+			}
+			target, err = transports.Put(leaseToken.String(), lease, cluster.kubeConfig)
+			if err != nil {
+				log.Printf("Error creating the transport to cluster %s -- %s", lease.ClusterID(), err)
+				htp.Error(w, http.StatusInternalServerError, "Error creating the transport to cluster %s -- %s", lease.ClusterID(), err)
+				return
+			}
+		}
+		var user string
+		if lease.ServiceAccount != "" {
+			user, err = k8s.ServiceAccountUsername(lease.ServiceAccount)
+			if err != nil {
+				log.Printf("Lease %s has a malformed service account -- %s", leaseToken, err)
+				htp.Error(w, http.StatusInternalServerError, "Lease %s has a malformed service account -- %s", leaseToken, err)
+				return
+			}
+		}
+
+		fwdCtx, fwdCancel := context.WithDeadline(r.Context(), exprTime)
+		defer fwdCancel()
+		done := activity.Begin(leaseToken.String(), lease.ClusterID(), fwdCancel)
+		defer done()
+		path := "/" + strings.Join(pathElts[2:], "/")
+		proxy.Forward(w, r.WithContext(fwdCtx), target.Server, target.Transport, path, user, flushInterval)
+	})
+}
+
+// ProxyActivity returns the http handler for the GET /activity endpoint, which reports how many
+// requests the API proxy forwarded for each lease that uses it, and how long each lease has been
+// idle. Leases that were released or expired are forgotten
+func ProxyActivity(services k8s.ServiceGetter, k8sServiceName string, activity *proxy.Activity) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if activity == nil {
+			log.Println("The API proxy is not enabled")
+			htp.Error(w, http.StatusNotFound, "The API proxy is not enabled")
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), deleteAPITimeout)
+		defer cancel()
+		svc, err := k8s.GetService(ctx, services, k8sServiceName)
+		if err != nil {
+			log.Printf("Error getting the %s service -- %s", k8sServiceName, err)
+			htp.Error(w, htp.UpstreamStatus(err), "Error getting the %s service -- %s", k8sServiceName, err)
+			return
+		}
+		leaseMap, err := leases.ParseMapFromAnnotations(svc.Annotations)
+		if err != nil {
+			log.Printf("Error getting annotations for the %s service -- %s", k8sServiceName, err)
+			htp.Error(w, http.StatusInternalServerError, "Error getting annotations for the %s service -- %s", k8sServiceName, err)
+			return
+		}
+		uuids, err := leaseMap.UUIDs()
+		if err != nil {
+			log.Printf("Error getting the lease tokens -- %s", err)
+			htp.Error(w, http.StatusInternalServerError, "Error getting the lease tokens -- %s", err)
+			return
+		}
+
+		now := time.Now()
+		proxied := make(map[string]*leases.Lease)
+		var tokens []string
+		for _, u := range uuids {
+			lease, _ := leaseMap.LeaseForUUID(u)
+			exprTime, err := lease.ExpirationTime()
+			if lease.ProxyTokenHash == "" || err != nil || !now.Before(exprTime) {
+				continue
+			}
+			proxied[u.String()] = lease
+			tokens = append(tokens, u.String())
+		}
+		sort.Strings(tokens)
+		activity.Retain(func(leaseToken string) bool {
+			_, ok := proxied[leaseToken]
+			return ok
+		})
+		recorded := make(map[string]proxy.LeaseActivity)
+		for _, leaseActivity := range activity.Leases() {
+			recorded[leaseActivity.Token] = leaseActivity
+		}
+
+		resp := api.ProxyActivityResp{Leases: []api.ProxyLeaseActivity{}}
+		for _, token := range tokens {
+			lease := proxied[token]
+			leaseActivity := api.ProxyLeaseActivity{Token: token, ClusterID: lease.ClusterID()}
+			idleSince := leaseMap.ClusterStatus(lease.ClusterID()).LastLeasedTime()
+			if rec, ok := recorded[token]; ok {
+				leaseActivity.Requests = rec.Requests
+				leaseActivity.LastRequest = rec.LastRequest.UTC().Format(time.RFC3339)
+				idleSince = rec.LastRequest
+			}
+			if !idleSince.IsZero() {
+				leaseActivity.IdleSeconds = int64(now.Sub(idleSince) / time.Second)
+			}
+			resp.Leases = append(resp.Leases, leaseActivity)
+		}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding json -- %s", err)
+			htp.Error(w, http.StatusInternalServerError, "Error encoding json -- %s", err)
+			return
+		}
+	})
+}
+
+// bearerToken returns the bearer token in the Authorization header of r, or the empty string if
+// it has none
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, bearerPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(header, bearerPrefix)
+}
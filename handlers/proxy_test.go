@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	container "google.golang.org/api/container/v1"
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/api"
+	"github.com/deis/k8s-claimer/config"
+	"github.com/deis/k8s-claimer/k8s"
+	"github.com/deis/k8s-claimer/leases"
+	"github.com/deis/k8s-claimer/providers/gke"
+	"github.com/deis/k8s-claimer/proxy"
+	"github.com/pborman/uuid"
+)
+
+func TestProxy(t *testing.T) {
+	var masterReq *http.Request
+	master := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		masterReq = r
+		w.Write([]byte("pods"))
+	}))
+	defer master.Close()
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: master.Certificate().Raw})
+	cluster := &container.Cluster{
+		Name:               "cluster1",
+		CurrentNodeVersion: "9.9.9",
+		Endpoint:           strings.TrimPrefix(master.URL, "https://"),
+		MasterAuth: &container.MasterAuth{
+			ClusterCaCertificate: base64.StdEncoding.EncodeToString(caPEM),
+			Username:             "admin",
+			Password:             "pass",
+		},
+	}
+	expiredCluster := &container.Cluster{Name: "cluster2", CurrentNodeVersion: "9.9.9", Endpoint: "192.168.1.1", MasterAuth: &container.MasterAuth{}}
+
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	proxyToken, proxyTokenHash, err := leases.NewSecret()
+	assert.NoErr(t, err)
+	token := uuid.NewUUID()
+	lease := leases.NewLease(cluster.Name, time.Now().Add(1*time.Hour))
+	lease.Provider = leases.ProviderGoogle
+	lease.ServiceAccount = "k8s-claimer-leases/k8s-claimer-lease-" + token.String()
+	lease.ProxyTokenHash = proxyTokenHash
+	assert.True(t, leaseMap.CreateLease(token, lease), "failed to create the lease")
+	expiredToken := uuid.NewUUID()
+	expired := leases.NewLease(expiredCluster.Name, time.Now().Add(-1*time.Minute))
+	expired.Provider = leases.ProviderGoogle
+	expired.ProxyTokenHash = proxyTokenHash
+	assert.True(t, leaseMap.CreateLease(expiredToken, expired), "failed to create the expired lease")
+	annos, err := leaseMap.ToAnnotations()
+	assert.NoErr(t, err)
+
+	getter := k8s.NewFakeServiceGetterUpdater(&v1.Service{ObjectMeta: v1.ObjectMeta{Annotations: annos}}, nil, nil, nil)
+	clusterLister := gke.NewFakeClusterLister(newListClusterResp([]*container.Cluster{cluster, expiredCluster}), nil)
+	googleConfig := &config.Google{ProjectID: "proj1", Zone: "zone1"}
+	activity := proxy.NewActivity()
+	transports := proxy.NewTransports()
+	hdl := Proxy(getter, "claimer", clusterLister, nil, nil, googleConfig, transports, activity, 10*time.Millisecond)
+
+	upgrade := false
+	get := func(path, bearer string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", path, nil)
+		assert.NoErr(t, err)
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		if upgrade {
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "SPDY/3.1")
+		}
+		res := httptest.NewRecorder()
+		hdl.ServeHTTP(res, req)
+		return res
+	}
+	assert.Equal(t, get("/proxy/abcd/api", proxyToken).Code, http.StatusBadRequest, "response code for a malformed token")
+	assert.Equal(t, get("/proxy/"+uuid.New()+"/api", proxyToken).Code, http.StatusUnauthorized, "response code for a missing lease")
+	assert.Equal(t, get("/proxy/"+token.String()+"/api", "").Code, http.StatusUnauthorized, "response code without a bearer token")
+	assert.Equal(t, get("/proxy/"+token.String()+"/api", "wrong").Code, http.StatusUnauthorized, "response code for a wrong bearer token")
+	assert.Equal(t, get("/proxy/"+expiredToken.String()+"/api", proxyToken).Code, http.StatusUnauthorized, "response code for an expired lease")
+	assert.Nil(t, masterReq, "a refused request was forwarded")
+
+	res := get("/proxy/"+token.String()+"/api/v1/namespaces/default/pods", proxyToken)
+	assert.Equal(t, res.Code, http.StatusOK, "response code")
+	body, err := ioutil.ReadAll(res.Body)
+	assert.NoErr(t, err)
+	assert.Equal(t, string(body), "pods", "response body")
+	assert.Equal(t, masterReq.URL.Path, "/api/v1/namespaces/default/pods", "forwarded path")
+	user, pass, _ := masterReq.BasicAuth()
+	assert.Equal(t, user+":"+pass, "admin:pass", "forwarded credentials")
+	assert.Equal(t, masterReq.Header.Get("Impersonate-User"), "system:serviceaccount:k8s-claimer-leases:k8s-claimer-lease-"+token.String(), "impersonated user")
+
+	// the lease and its cluster are cached, so they aren't looked up again
+	getter.FakeServiceGetter.Err = errors.New("service unavailable")
+	clusterLister.Err = errors.New("clusters unavailable")
+	assert.Equal(t, get("/proxy/"+token.String()+"/api", proxyToken).Code, http.StatusOK, "response code for a cached lease")
+	assert.Equal(t, get("/proxy/"+token.String()+"/api", "wrong").Code, http.StatusUnauthorized, "response code for a cached lease with a wrong bearer token")
+	upgrade = true
+	assert.Equal(t, get("/proxy/"+token.String()+"/api/v1/namespaces/default/pods/pod1/exec", proxyToken).Code, http.StatusNotImplemented, "response code for an exec request")
+	upgrade = false
+	transports.Drop(token.String())
+	assert.Equal(t, get("/proxy/"+token.String()+"/api", proxyToken).Code, http.StatusBadGateway, "response code for a dropped lease")
+	getter.FakeServiceGetter.Err = nil
+	clusterLister.Err = nil
+
+	recorded := activity.Leases()
+	assert.Equal(t, len(recorded), 1, "number of leases with activity")
+	assert.Equal(t, recorded[0].Token, token.String(), "token")
+	assert.Equal(t, recorded[0].Requests, int64(2), "number of requests")
+
+	activityHdl := ProxyActivity(getter, "claimer", activity)
+	req, err := http.NewRequest("GET", "/activity", nil)
+	assert.NoErr(t, err)
+	res = httptest.NewRecorder()
+	activityHdl.ServeHTTP(res, req)
+	assert.Equal(t, res.Code, http.StatusOK, "response code")
+	resp := new(api.ProxyActivityResp)
+	assert.NoErr(t, json.NewDecoder(res.Body).Decode(resp))
+	assert.Equal(t, len(resp.Leases), 1, "number of leases")
+	assert.Equal(t, resp.Leases[0].Token, token.String(), "token")
+	assert.Equal(t, resp.Leases[0].Requests, int64(2), "number of requests")
+}
+
+func TestProxyActivityDisabled(t *testing.T) {
+	hdl := ProxyActivity(nil, "claimer", nil)
+	req, err := http.NewRequest("GET", "/activity", nil)
+	assert.NoErr(t, err)
+	res := httptest.NewRecorder()
+	hdl.ServeHTTP(res, req)
+	assert.Equal(t, res.Code, http.StatusNotFound, "response code")
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/deis/k8s-claimer/api"
+	"github.com/deis/k8s-claimer/auth"
+	"github.com/deis/k8s-claimer/htp"
+	"github.com/deis/k8s-claimer/k8s"
+	"github.com/deis/k8s-claimer/leases"
+	"github.com/deis/k8s-claimer/quota"
+)
+
+// Quota returns the http handler for the GET /quota endpoint, which reports how much of budget
+// each identity that created a lease in the last week used, and when its usage starts over. The
+// identity that made the request is always reported, even if it didn't create any lease
+func Quota(services k8s.ServiceGetter, k8sServiceName string, budget quota.Budget) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !budget.Enabled() {
+			log.Println("Quotas are not enabled")
+			htp.Error(w, http.StatusNotFound, "Quotas are not enabled")
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), policyAPITimeout)
+		defer cancel()
+		svc, err := k8s.GetService(ctx, services, k8sServiceName)
+		if err != nil {
+			log.Printf("Error getting the %s service -- %s", k8sServiceName, err)
+			htp.Error(w, htp.UpstreamStatus(err), "Error getting the %s service -- %s", k8sServiceName, err)
+			return
+		}
+		leaseMap, err := leases.ParseMapFromAnnotations(svc.Annotations)
+		if err != nil {
+			log.Printf("Error getting annotations for the %s service -- %s", k8sServiceName, err)
+			htp.Error(w, http.StatusInternalServerError, "Error getting annotations for the %s service -- %s", k8sServiceName, err)
+			return
+		}
+
+		now := time.Now()
+		usages := leaseMap.Usages(now)
+		id, _ := auth.FromContext(r.Context())
+		if id.ID() != "" && !hasUsage(usages, id.ID()) {
+			usages = append(usages, leaseMap.Usage(id.ID()))
+		}
+		resp := api.QuotaResp{Quotas: make([]api.Quota, len(usages))}
+		for i, usage := range usages {
+			resp.Quotas[i] = budget.Report(usage, now)
+		}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding json -- %s", err)
+			htp.Error(w, http.StatusInternalServerError, "Error encoding json -- %s", err)
+			return
+		}
+	})
+}
+
+func hasUsage(usages []leases.Usage, name string) bool {
+	for _, usage := range usages {
+		if usage.Identity == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/api"
+	"github.com/deis/k8s-claimer/auth"
+	"github.com/deis/k8s-claimer/k8s"
+	"github.com/deis/k8s-claimer/leases"
+	"github.com/deis/k8s-claimer/quota"
+	"github.com/pborman/uuid"
+)
+
+func TestQuotaDisabled(t *testing.T) {
+	hdl := Quota(nil, "claimer", quota.Budget{})
+	req, err := http.NewRequest("GET", "/quota", nil)
+	assert.NoErr(t, err)
+	res := httptest.NewRecorder()
+	hdl.ServeHTTP(res, req)
+	assert.Equal(t, res.Code, http.StatusNotFound, "response code")
+}
+
+func TestQuota(t *testing.T) {
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	now := time.Now()
+	leaseMap.RecordUsage("oidc:dev@example.com", uuid.NewRandom(), now, now.Add(2*time.Hour))
+	annos, err := leaseMap.ToAnnotations()
+	assert.NoErr(t, err)
+	services := k8s.NewFakeServiceGetterUpdater(&v1.Service{ObjectMeta: v1.ObjectMeta{Annotations: annos}}, nil, nil, nil)
+	hdl := Quota(services, "claimer", quota.Budget{Daily: 8 * time.Hour, Weekly: 20 * time.Hour})
+
+	req, err := http.NewRequest("GET", "/quota", nil)
+	assert.NoErr(t, err)
+	req = req.WithContext(auth.NewContext(req.Context(), auth.Identity{Name: "ci", Source: auth.SourceToken, Role: auth.RoleReadOnly}))
+	res := httptest.NewRecorder()
+	hdl.ServeHTTP(res, req)
+	assert.Equal(t, res.Code, http.StatusOK, "response code")
+
+	resp := new(api.QuotaResp)
+	assert.NoErr(t, json.NewDecoder(res.Body).Decode(resp))
+	// the caller is reported even though it didn't lease anything
+	assert.Equal(t, len(resp.Quotas), 2, "number of quotas")
+	assert.Equal(t, resp.Quotas[0].Identity, "oidc:dev@example.com", "identity")
+	assert.Equal(t, len(resp.Quotas[0].Windows), 2, "number of windows")
+	assert.Equal(t, resp.Quotas[0].Windows[0].Window, quota.WindowDay, "window")
+	assert.Equal(t, resp.Quotas[0].Windows[0].UsedHours, 2.0, "used hours")
+	assert.Equal(t, resp.Quotas[0].Windows[0].RemainingHours, 6.0, "remaining hours")
+	assert.Equal(t, resp.Quotas[1].Identity, "token:ci", "identity")
+	assert.Equal(t, resp.Quotas[1].Windows[1].UsedHours, 0.0, "used hours")
+	assert.Equal(t, resp.Quotas[1].Windows[1].RemainingHours, 20.0, "remaining hours")
+}
@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/deis/k8s-claimer/htp"
+	"github.com/deis/k8s-claimer/providers/gke"
+)
+
+// UpgradeStatus returns the http handler for the GET /upgrades endpoint, which reports the target
+// version and upgrade state of each GKE cluster that has one, and the progress of the running
+// upgrade
+func UpgradeStatus(upgrader *gke.Upgrader) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if upgrader == nil {
+			log.Println("GKE cluster upgrades are not enabled")
+			htp.Error(w, http.StatusNotFound, "GKE cluster upgrades are not enabled")
+			return
+		}
+		if err := json.NewEncoder(w).Encode(upgrader.Status()); err != nil {
+			log.Printf("Error encoding json -- %s", err)
+			htp.Error(w, http.StatusInternalServerError, "Error encoding json -- %s", err)
+			return
+		}
+	})
+}
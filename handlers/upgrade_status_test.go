@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/config"
+	"github.com/deis/k8s-claimer/k8s"
+	"github.com/deis/k8s-claimer/providers/gke"
+)
+
+func TestUpgradeStatusNotEnabled(t *testing.T) {
+	req, err := http.NewRequest("GET", "/upgrades", nil)
+	assert.NoErr(t, err)
+	res := httptest.NewRecorder()
+	UpgradeStatus(nil).ServeHTTP(res, req)
+	assert.Equal(t, res.Code, http.StatusNotFound, "response code")
+}
+
+func TestUpgradeStatus(t *testing.T) {
+	services := k8s.NewFakeServiceGetterUpdater(&v1.Service{
+		ObjectMeta: v1.ObjectMeta{Name: "service1"},
+	}, nil, nil, nil)
+	upgradeConfig := config.GKEUpgrades{Targets: []string{"^cluster=9.9.9"}, Interval: time.Minute, Timeout: time.Minute}
+	upgrader, err := gke.NewUpgrader(
+		gke.NewFakeClusterLister(expectedListClusterResp, nil),
+		gke.NewFakeClusterUpdater(nil, nil),
+		services,
+		"service1",
+		[]config.GKEScope{{ProjectID: "proj1", Location: "zone1"}},
+		config.PoolMembership{},
+		upgradeConfig,
+	)
+	assert.NoErr(t, err)
+	upgrader.Reconcile(time.Now())
+
+	req, err := http.NewRequest("GET", "/upgrades", nil)
+	assert.NoErr(t, err)
+	res := httptest.NewRecorder()
+	UpgradeStatus(upgrader).ServeHTTP(res, req)
+	assert.Equal(t, res.Code, http.StatusOK, "response code")
+	status := new(gke.UpgradeStatus)
+	assert.NoErr(t, json.NewDecoder(res.Body).Decode(status))
+	assert.Equal(t, status.Error, "", "upgrader error")
+	assert.Equal(t, len(status.Clusters), 1, "number of clusters")
+	assert.Equal(t, status.Clusters[0].ClusterName, "proj1/zone1/"+expectedCluster.Name, "cluster ID")
+	assert.Equal(t, status.Clusters[0].TargetVersion, "9.9.9", "target version")
+	assert.Equal(t, status.Clusters[0].State, gke.UpgradeStateUpToDate, "state")
+}
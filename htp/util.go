@@ -10,3 +10,17 @@ import (
 func Error(w http.ResponseWriter, code int, fmtStr string, vars ...interface{}) {
 	http.Error(w, fmt.Sprintf(fmtStr, vars...), code)
 }
+
+type timeout interface {
+	Timeout() bool
+}
+
+// UpstreamStatus returns the status code to respond with when a call to an upstream API, such as
+// a cloud provider's or the k8s API server's, failed with err. Returns http.StatusGatewayTimeout
+// if the call timed out, and http.StatusBadGateway otherwise
+func UpstreamStatus(err error) int {
+	if t, ok := err.(timeout); ok && t.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
@@ -0,0 +1,15 @@
+package htp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+func TestUpstreamStatus(t *testing.T) {
+	assert.Equal(t, UpstreamStatus(context.DeadlineExceeded), http.StatusGatewayTimeout, "status of a timeout")
+	assert.Equal(t, UpstreamStatus(errors.New("test error")), http.StatusBadGateway, "status of an error")
+}
@@ -0,0 +1,156 @@
+// Package inventory keeps the clusters that the providers list in memory, so that lease requests
+// don't wait for the providers' APIs, and serves them for a while when those APIs fail
+package inventory
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/deis/k8s-claimer/config"
+)
+
+// Invalidator is implemented by cluster listers that keep the clusters they list in memory. Code
+// that changes clusters, or finds them out of date, calls Invalidate, so that they're listed right
+// away instead of after the next refresh
+type Invalidator interface {
+	Invalidate()
+}
+
+// Invalidate invalidates the clusters that lister keeps in memory, if it keeps any
+func Invalidate(lister interface{}) {
+	if inv, ok := lister.(Invalidator); ok {
+		inv.Invalidate()
+	}
+}
+
+// ListFunc lists the clusters of a cache entry
+type ListFunc func(ctx context.Context) (interface{}, error)
+
+type entry struct {
+	list   ListFunc
+	result interface{}
+	listed time.Time
+	valid  bool
+}
+
+type listed struct {
+	result interface{}
+	err    error
+}
+
+// Cache keeps the clusters that ListFuncs list in memory, keyed by a description of what they
+// list, and relists them in the background with Run. Entries are invalidated when relisting them
+// fails and when Invalidate is called, and are listed again the next time they're asked for. It's
+// safe for concurrent use
+type Cache struct {
+	conf config.Inventory
+	now  func() time.Time
+
+	mut     sync.Mutex
+	entries map[string]*entry
+}
+
+// NewCache creates a new, empty Cache
+func NewCache(conf config.Inventory) *Cache {
+	return &Cache{conf: conf, now: time.Now, entries: make(map[string]*entry)}
+}
+
+// Get returns the clusters of the entry with the given key. Valid entries are served from memory,
+// and others are listed with list. That isn't tied to ctx, so that a request that gives up
+// doesn't fail the list for every other request waiting on it; it gives up after the configured
+// refresh interval instead. If listing fails, the clusters that were last listed are served
+// anyway if they were listed less than the configured max staleness ago
+func (c *Cache) Get(ctx context.Context, key string, list ListFunc) (interface{}, error) {
+	c.mut.Lock()
+	e, found := c.entries[key]
+	var cached entry
+	if found {
+		cached = *e
+	}
+	c.mut.Unlock()
+	if found && cached.valid {
+		return cached.result, nil
+	}
+	ch := make(chan listed, 1)
+	go func() {
+		refreshCtx, cancel := context.WithTimeout(context.Background(), c.conf.RefreshInterval)
+		defer cancel()
+		result, err := c.refresh(refreshCtx, key, list)
+		ch <- listed{result: result, err: err}
+	}()
+	var err error
+	select {
+	case l := <-ch:
+		if l.err == nil {
+			return l.result, nil
+		}
+		err = l.err
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if found && c.now().Sub(cached.listed) <= c.conf.MaxStaleness {
+		log.Printf("Error listing %s, serving the clusters listed at %s -- %s", key, cached.listed, err)
+		return cached.result, nil
+	}
+	return nil, err
+}
+
+// Refresh relists every entry that has been listed before. It gives up after the configured
+// refresh interval
+func (c *Cache) Refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), c.conf.RefreshInterval)
+	defer cancel()
+	c.mut.Lock()
+	lists := make(map[string]ListFunc, len(c.entries))
+	for key, e := range c.entries {
+		lists[key] = e.list
+	}
+	c.mut.Unlock()
+	for key, list := range lists {
+		if _, err := c.refresh(ctx, key, list); err != nil {
+			log.Printf("Error refreshing %s -- %s", key, err)
+		}
+	}
+}
+
+// Run calls Refresh once every configured interval, until stop is closed
+func (c *Cache) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(c.conf.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.Refresh()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Invalidate is the Invalidator interface implementation. Every entry is listed again the next
+// time it's asked for
+func (c *Cache) Invalidate() {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	for _, e := range c.entries {
+		e.valid = false
+	}
+}
+
+// refresh lists the clusters of the entry with the given key and stores them. The stored entry
+// is invalidated if listing fails
+func (c *Cache) refresh(ctx context.Context, key string, list ListFunc) (interface{}, error) {
+	result, err := list(ctx)
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if err != nil {
+		if e, found := c.entries[key]; found {
+			e.valid = false
+		}
+		return nil, err
+	}
+	c.entries[key] = &entry{list: list, result: result, listed: c.now(), valid: true}
+	return result, nil
+}
@@ -0,0 +1,111 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/config"
+)
+
+// countingList returns a ListFunc that counts its calls and returns *result and *err
+func countingList(calls *int, result *string, err *error) ListFunc {
+	return func(ctx context.Context) (interface{}, error) {
+		*calls++
+		if *err != nil {
+			return nil, *err
+		}
+		return *result, nil
+	}
+}
+
+func TestCache(t *testing.T) {
+	calls, result, listErr := 0, "clusters", error(nil)
+	list := countingList(&calls, &result, &listErr)
+	now := time.Now()
+	cache := NewCache(config.Inventory{Enabled: true, RefreshInterval: time.Minute, MaxStaleness: time.Hour})
+	cache.now = func() time.Time { return now }
+
+	// nothing is refreshed before the first list
+	cache.Refresh()
+	assert.Equal(t, calls, 0, "number of calls before the first list")
+	got, err := cache.Get(context.Background(), "key1", list)
+	assert.NoErr(t, err)
+	assert.Equal(t, got, "clusters", "listed clusters")
+	_, err = cache.Get(context.Background(), "key1", list)
+	assert.NoErr(t, err)
+	assert.Equal(t, calls, 1, "number of calls after a cached list")
+
+	// a failed refresh invalidates the entry, but the clusters are still served
+	result, listErr = "", errors.New("test error")
+	cache.Refresh()
+	assert.Equal(t, calls, 2, "number of calls after a refresh")
+	got, err = cache.Get(context.Background(), "key1", list)
+	assert.NoErr(t, err)
+	assert.Equal(t, got, "clusters", "stale clusters")
+	assert.Equal(t, calls, 3, "number of calls after an invalid list")
+
+	// until they're too stale
+	now = now.Add(2 * time.Hour)
+	_, err = cache.Get(context.Background(), "key1", list)
+	assert.Equal(t, err, listErr, "error")
+
+	// other keys are listed separately
+	_, err = cache.Get(context.Background(), "key2", list)
+	assert.Equal(t, err, listErr, "error")
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	calls, result, listErr := 0, "clusters", error(nil)
+	list := countingList(&calls, &result, &listErr)
+	cache := NewCache(config.Inventory{Enabled: true, RefreshInterval: time.Minute})
+	_, err := cache.Get(context.Background(), "key1", list)
+	assert.NoErr(t, err)
+	Invalidate(cache)
+	_, err = cache.Get(context.Background(), "key1", list)
+	assert.NoErr(t, err)
+	assert.Equal(t, calls, 2, "number of calls")
+	// values that don't keep clusters in memory are left alone
+	Invalidate(list)
+}
+
+func TestCacheGetOutlivesRequest(t *testing.T) {
+	release := make(chan struct{})
+	listed := make(chan context.Context, 1)
+	list := func(ctx context.Context) (interface{}, error) {
+		listed <- ctx
+		<-release
+		return "clusters", ctx.Err()
+	}
+	cache := NewCache(config.Inventory{Enabled: true, RefreshInterval: time.Minute})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := cache.Get(ctx, "key1", list)
+		done <- err
+	}()
+	listCtx := <-listed
+	cancel()
+	assert.Equal(t, <-done, context.Canceled, "error of the canceled request")
+	_, hasDeadline := listCtx.Deadline()
+	assert.True(t, hasDeadline, "the list has no deadline")
+	assert.NoErr(t, listCtx.Err())
+
+	// the list that the canceled request started still fills the cache
+	close(release)
+	for i := 0; ; i++ {
+		cache.mut.Lock()
+		e, found := cache.entries["key1"]
+		cache.mut.Unlock()
+		if found {
+			assert.Equal(t, e.result, "clusters", "cached clusters")
+			break
+		}
+		if i == 100 {
+			t.Fatal("the cache wasn't filled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
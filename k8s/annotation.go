@@ -1,19 +1,84 @@
 package k8s
 
 import (
+	"context"
+
 	"github.com/deis/k8s-claimer/leases"
+	apierrors "k8s.io/client-go/pkg/api/errors"
 	"k8s.io/client-go/pkg/api/v1"
 )
 
-// SaveAnnotations will publish the current lease map back to the k8s annotation
-func SaveAnnotations(services ServiceUpdater, svc *v1.Service, leaseMap *leases.Map) error {
+const (
+	// LeaseUpdateAttempts is the number of times UpdateLeaseMap, or a lease request, tries to save
+	// an update to the k8s annotations before giving up, since other requests may update them at
+	// the same time
+	LeaseUpdateAttempts = 3
+)
+
+// SaveAnnotations will publish the current lease map back to the k8s annotation, retrying
+// transient API server errors. Returns ctx.Err() if ctx is done first. The update in flight then
+// finishes in the background, as described in callContext, so it may still be saved. Retries and
+// abandoned updates are safe, since svc carries the resource version it was fetched at: an
+// update that was already applied makes the ones after it fail with a conflict. Since an update
+// that timed out or failed transiently may have been applied anyway, a conflict on the retry
+// after it re-reads the service, and the update counts as saved if the service already holds
+// leaseMap
+func SaveAnnotations(ctx context.Context, services ServiceGetterUpdater, svc *v1.Service, leaseMap *leases.Map) error {
 	annos, err := leaseMap.ToAnnotations()
 	if err != nil {
 		return err
 	}
 	svc.Annotations = annos
-	if _, err := services.Update(svc); err != nil {
+	mayBeSaved := false
+	return callContext(ctx, func() error {
+		_, err := services.Update(svc)
+		if mayBeSaved && apierrors.IsConflict(err) {
+			if saved, getErr := services.Get(svc.Name); getErr == nil && annotationsEqual(saved.Annotations, annos) {
+				return nil
+			}
+		}
+		if err != nil && IsTransientError(err) {
+			mayBeSaved = true
+		}
+		return err
+	})
+}
+
+// annotationsEqual returns true if a and b hold the same annotations
+func annotationsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, val := range a {
+		if bVal, ok := b[key]; !ok || bVal != val {
+			return false
+		}
+	}
+	return true
+}
+
+// UpdateLeaseMap fetches the leases from the annotations of the k8s service with the given name,
+// calls fn with them and saves them again. It tries LeaseUpdateAttempts times if that fails, since
+// other requests may update the annotations at the same time
+func UpdateLeaseMap(ctx context.Context, services ServiceGetterUpdater, k8sServiceName string, fn func(*leases.Map)) error {
+	var err error
+	for i := 0; i < LeaseUpdateAttempts; i++ {
+		if err = tryUpdateLeaseMap(ctx, services, k8sServiceName, fn); err == nil || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func tryUpdateLeaseMap(ctx context.Context, services ServiceGetterUpdater, k8sServiceName string, fn func(*leases.Map)) error {
+	svc, err := GetService(ctx, services, k8sServiceName)
+	if err != nil {
+		return err
+	}
+	leaseMap, err := leases.ParseMapFromAnnotations(svc.Annotations)
+	if err != nil {
 		return err
 	}
-	return nil
+	fn(leaseMap)
+	return SaveAnnotations(ctx, services, svc, leaseMap)
 }
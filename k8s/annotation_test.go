@@ -0,0 +1,92 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/leases"
+	apierrors "k8s.io/client-go/pkg/api/errors"
+	"k8s.io/client-go/pkg/api/unversioned"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// flakyServices is a ServiceGetterUpdater whose first Update fails with err. If applied is true,
+// that Update is saved anyway, like one that timed out after the API server applied it, and the
+// ones after it fail with a conflict. If overwrite is set, it's saved after that Update, like an
+// update of another request
+type flakyServices struct {
+	err       error
+	applied   bool
+	overwrite *v1.Service
+	saved     *v1.Service
+	calls     int
+}
+
+func (f *flakyServices) Get(name string) (*v1.Service, error) {
+	return f.saved, nil
+}
+
+func (f *flakyServices) Update(svc *v1.Service) (*v1.Service, error) {
+	f.calls++
+	if f.calls == 1 {
+		if f.applied {
+			f.saved = &v1.Service{ObjectMeta: v1.ObjectMeta{Name: svc.Name, Annotations: svc.Annotations}}
+		}
+		if f.overwrite != nil {
+			f.saved = f.overwrite
+		}
+		return nil, f.err
+	}
+	if f.applied {
+		return nil, apierrors.NewConflict(unversioned.GroupResource{Resource: "services"}, svc.Name, errors.New("the object has been modified"))
+	}
+	f.saved = svc
+	return svc, nil
+}
+
+func TestSaveAnnotations(t *testing.T) {
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	svc := &v1.Service{ObjectMeta: v1.ObjectMeta{Name: "k8s-claimer"}}
+
+	updater := &flakyServices{err: apierrors.NewInternalError(errors.New("etcd is down"))}
+	assert.NoErr(t, SaveAnnotations(context.Background(), updater, svc, leaseMap))
+	assert.Equal(t, updater.calls, 2, "number of calls after a transient error")
+
+	updater = &flakyServices{err: errors.New("conflict")}
+	assert.Err(t, updater.err, SaveAnnotations(context.Background(), updater, svc, leaseMap))
+	assert.Equal(t, updater.calls, 1, "number of calls after a permanent error")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = SaveAnnotations(ctx, NewFakeServiceGetterUpdater(nil, nil, nil, apierrors.NewInternalError(errors.New("etcd is down"))), svc, leaseMap)
+	assert.Equal(t, err, context.Canceled, "error")
+}
+
+func TestSaveAnnotationsAlreadySaved(t *testing.T) {
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	svc := &v1.Service{ObjectMeta: v1.ObjectMeta{Name: "k8s-claimer"}}
+
+	// the update timed out, but was applied, so the conflict on the retry is a success
+	updater := &flakyServices{err: apierrors.NewInternalError(errors.New("timed out")), applied: true}
+	assert.NoErr(t, SaveAnnotations(context.Background(), updater, svc, leaseMap))
+	assert.Equal(t, updater.calls, 2, "number of calls")
+
+	// another request saved the service after it, so the conflict stands
+	updater = &flakyServices{
+		err:       apierrors.NewInternalError(errors.New("timed out")),
+		applied:   true,
+		overwrite: &v1.Service{ObjectMeta: v1.ObjectMeta{Name: "k8s-claimer", Annotations: map[string]string{"other": "lease"}}},
+	}
+	err = SaveAnnotations(context.Background(), updater, svc, leaseMap)
+	assert.True(t, apierrors.IsConflict(err), "the error wasn't a conflict: %s", err)
+
+	// conflicts without an earlier failed update aren't looked into
+	updater = &flakyServices{err: apierrors.NewConflict(unversioned.GroupResource{Resource: "services"}, "k8s-claimer", errors.New("the object has been modified"))}
+	err = SaveAnnotations(context.Background(), updater, svc, leaseMap)
+	assert.True(t, apierrors.IsConflict(err), "the error wasn't a conflict: %s", err)
+	assert.Equal(t, updater.calls, 1, "number of calls")
+}
@@ -0,0 +1,145 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// ErrMalformedRequiredPod is returned from NewAPIServerHealthChecker when a required pod isn't in
+// the namespace/name-prefix format
+type ErrMalformedRequiredPod struct {
+	Pod string
+}
+
+// Error is the error interface implementation
+func (e ErrMalformedRequiredPod) Error() string {
+	return fmt.Sprintf("required pod %s is not in the namespace/name-prefix format", e.Pod)
+}
+
+// ErrUnhealthy is returned from APIServerHealthChecker.CheckHealth when the cluster could be
+// reached, but isn't healthy
+type ErrUnhealthy struct {
+	Reason string
+}
+
+// Error is the error interface implementation
+func (e ErrUnhealthy) Error() string {
+	return fmt.Sprintf("cluster is unhealthy (%s)", e.Reason)
+}
+
+type requiredPod struct {
+	namespace  string
+	namePrefix string
+}
+
+// APIServerHealthChecker is a HealthChecker that talks to a cluster's API server. A cluster is
+// healthy if its /healthz endpoint returns ok, it has at least one node and all of its nodes are
+// ready, and each of the required pods has at least one running and ready replica
+type APIServerHealthChecker struct {
+	requiredPods []requiredPod
+}
+
+// NewAPIServerHealthChecker returns a new APIServerHealthChecker. Each of requiredPods is a
+// namespace and a pod name prefix separated by a slash, such as kube-system/kube-dns. Empty ones
+// are ignored, since envconfig parses an empty list as one empty string. Returns nil and
+// ErrMalformedRequiredPod if any other isn't in that format
+func NewAPIServerHealthChecker(requiredPods []string) (*APIServerHealthChecker, error) {
+	ret := &APIServerHealthChecker{}
+	for _, pod := range requiredPods {
+		if strings.TrimSpace(pod) == "" {
+			continue
+		}
+		parts := strings.SplitN(pod, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, ErrMalformedRequiredPod{Pod: pod}
+		}
+		ret.requiredPods = append(ret.requiredPods, requiredPod{namespace: parts[0], namePrefix: parts[1]})
+	}
+	return ret, nil
+}
+
+// CheckHealth is the HealthChecker interface implementation
+func (a *APIServerHealthChecker) CheckHealth(ctx context.Context, conf *KubeConfig, timeout time.Duration) error {
+	cl, err := CreateKubeClientWithContext(ctx, conf, timeout)
+	if err != nil {
+		return err
+	}
+	if err := checkHealthz(cl); err != nil {
+		return err
+	}
+	if err := checkNodes(cl); err != nil {
+		return err
+	}
+	for _, pod := range a.requiredPods {
+		if err := checkPods(cl, pod); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkHealthz(cl *kubernetes.Clientset) error {
+	body, err := cl.Core().RESTClient().Get().AbsPath("/healthz").Do().Raw()
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(body)) != "ok" {
+		return ErrUnhealthy{Reason: fmt.Sprintf("/healthz returned %q", string(body))}
+	}
+	return nil
+}
+
+func checkNodes(cl *kubernetes.Clientset) error {
+	nodes, err := cl.Core().Nodes().List(v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	if len(nodes.Items) == 0 {
+		return ErrUnhealthy{Reason: "the cluster has no nodes"}
+	}
+	for _, node := range nodes.Items {
+		if !nodeReady(node) {
+			return ErrUnhealthy{Reason: fmt.Sprintf("node %s is not ready", node.Name)}
+		}
+	}
+	return nil
+}
+
+func checkPods(cl *kubernetes.Clientset, required requiredPod) error {
+	pods, err := cl.Core().Pods(required.namespace).List(v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods.Items {
+		if strings.HasPrefix(pod.Name, required.namePrefix) && podReady(pod) {
+			return nil
+		}
+	}
+	return ErrUnhealthy{Reason: fmt.Sprintf("no ready pod %s/%s* is running", required.namespace, required.namePrefix)}
+}
+
+func nodeReady(node v1.Node) bool {
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == v1.NodeReady {
+			return cond.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func podReady(pod v1.Pod) bool {
+	if pod.Status.Phase != v1.PodRunning {
+		return false
+	}
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == v1.PodReady {
+			return cond.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
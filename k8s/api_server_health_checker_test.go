@@ -0,0 +1,85 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+)
+
+const (
+	readyNodeJSON    = `{"metadata":{"name":"node1"},"status":{"conditions":[{"type":"Ready","status":"True"}]}}`
+	notReadyNodeJSON = `{"metadata":{"name":"node2"},"status":{"conditions":[{"type":"Ready","status":"False"}]}}`
+	readyPodJSON     = `{"metadata":{"name":"kube-dns-1234"},"status":{"phase":"Running","conditions":[{"type":"Ready","status":"True"}]}}`
+)
+
+// newFakeAPIServer returns a server that serves /healthz, the node list and the kube-system pod
+// list from the given bodies
+func newFakeAPIServer(healthz, nodes, pods string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, healthz)
+	})
+	mux.HandleFunc("/api/v1/nodes", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"kind":"NodeList","apiVersion":"v1","items":[%s]}`, nodes)
+	})
+	mux.HandleFunc("/api/v1/namespaces/kube-system/pods", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"kind":"PodList","apiVersion":"v1","items":[%s]}`, pods)
+	})
+	return httptest.NewServer(mux)
+}
+
+func kubeConfigForServer(server string) *KubeConfig {
+	return &KubeConfig{
+		Clusters:  []NamedCluster{NamedCluster{Name: "test", Cluster: Cluster{Server: server}}},
+		AuthInfos: []NamedAuthInfo{NamedAuthInfo{Name: "test", AuthInfo: AuthInfo{Token: "token"}}},
+	}
+}
+
+func TestNewAPIServerHealthChecker(t *testing.T) {
+	_, err := NewAPIServerHealthChecker([]string{"kube-system/kube-dns", "kube-system/heapster"})
+	assert.NoErr(t, err)
+	checker, err := NewAPIServerHealthChecker([]string{"kube-dns"})
+	assert.Nil(t, checker, "health checker")
+	assert.Err(t, ErrMalformedRequiredPod{Pod: "kube-dns"}, err)
+
+	// an empty HEALTH_CHECK_REQUIRED_PODS is parsed as one empty pod
+	checker, err = NewAPIServerHealthChecker([]string{""})
+	assert.NoErr(t, err)
+	assert.Equal(t, len(checker.requiredPods), 0, "number of required pods")
+}
+
+func TestAPIServerHealthCheckerCheckHealth(t *testing.T) {
+	checker, err := NewAPIServerHealthChecker([]string{"kube-system/kube-dns"})
+	assert.NoErr(t, err)
+
+	tests := []struct {
+		healthz string
+		nodes   string
+		pods    string
+		healthy bool
+	}{
+		{healthz: "ok", nodes: readyNodeJSON, pods: readyPodJSON, healthy: true},
+		{healthz: "not ok", nodes: readyNodeJSON, pods: readyPodJSON, healthy: false},
+		{healthz: "ok", nodes: "", pods: readyPodJSON, healthy: false},
+		{healthz: "ok", nodes: readyNodeJSON + "," + notReadyNodeJSON, pods: readyPodJSON, healthy: false},
+		{healthz: "ok", nodes: readyNodeJSON, pods: "", healthy: false},
+	}
+	for i, test := range tests {
+		srv := newFakeAPIServer(test.healthz, test.nodes, test.pods)
+		err := checker.CheckHealth(context.Background(), kubeConfigForServer(srv.URL), 5*time.Second)
+		srv.Close()
+		if test.healthy && err != nil {
+			t.Errorf("test %d: expected a healthy cluster, got %s", i, err)
+		}
+		if !test.healthy && err == nil {
+			t.Errorf("test %d: expected an unhealthy cluster", i)
+		}
+	}
+}
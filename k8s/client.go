@@ -1,7 +1,10 @@
 package k8s
 
 import (
+	"context"
 	"errors"
+	"net/http"
+	"time"
 
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -15,6 +18,45 @@ var (
 // CreateKubeClientFromConfig creates a new Kubernetes client from the given configuration.
 // returns nil and the appropriate error if the client couldn't be created for any reason
 func CreateKubeClientFromConfig(conf *KubeConfig) (*kubernetes.Clientset, error) {
+	return CreateKubeClientWithTimeout(conf, 0)
+}
+
+// CreateKubeClientWithTimeout is CreateKubeClientFromConfig, except that every request the
+// client makes fails after timeout. A timeout of 0 means no timeout
+func CreateKubeClientWithTimeout(conf *KubeConfig, timeout time.Duration) (*kubernetes.Clientset, error) {
+	rcConf, err := restConfig(conf, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(rcConf)
+}
+
+// CreateKubeClientWithContext is CreateKubeClientWithTimeout, except that every request the
+// client makes is also cancelled when ctx is done
+func CreateKubeClientWithContext(ctx context.Context, conf *KubeConfig, timeout time.Duration) (*kubernetes.Clientset, error) {
+	rcConf, err := restConfig(conf, timeout)
+	if err != nil {
+		return nil, err
+	}
+	rcConf.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		return &contextRoundTripper{ctx: ctx, next: rt}
+	}
+	return kubernetes.NewForConfig(rcConf)
+}
+
+// contextRoundTripper makes each request with ctx, so that it's cancelled when ctx is done
+type contextRoundTripper struct {
+	ctx  context.Context
+	next http.RoundTripper
+}
+
+func (c *contextRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return c.next.RoundTrip(req.WithContext(c.ctx))
+}
+
+// restConfig creates the client configuration for the cluster in conf, with the credentials of
+// its first user
+func restConfig(conf *KubeConfig, timeout time.Duration) (*rest.Config, error) {
 	rcConf := new(rest.Config)
 	if len(conf.Clusters) < 1 {
 		return nil, errNoClustersInConfig
@@ -34,6 +76,6 @@ func CreateKubeClientFromConfig(conf *KubeConfig) (*kubernetes.Clientset, error)
 	rcConf.BearerToken = authInfo.Token
 	rcConf.UserAgent = "k8s-claimer"
 	rcConf.Insecure = cluster.InsecureSkipTLSVerify
-
-	return kubernetes.NewForConfig(rcConf)
+	rcConf.Timeout = timeout
+	return rcConf, nil
 }
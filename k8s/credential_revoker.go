@@ -0,0 +1,143 @@
+package k8s
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/deis/k8s-claimer/leases"
+	"github.com/pborman/uuid"
+)
+
+// AdminKubeConfigFunc returns the admin kubeconfig of the cluster of lease. Returns nil and no
+// error if the cluster doesn't exist anymore, since its credentials went away with it
+type AdminKubeConfigFunc func(ctx context.Context, lease *leases.Lease) (*KubeConfig, error)
+
+// revocation is a service account whose credentials are revoked by a CredentialRevoker. token is
+// the token of its lease if the lease hasn't ended yet, and nil otherwise
+type revocation struct {
+	lease          *leases.Lease
+	token          uuid.UUID
+	serviceAccount string
+}
+
+// CredentialRevoker revokes the credentials of leases out of band, so that lease requests and
+// releases don't wait for the leased clusters. It revokes the credentials of expired leases
+// that haven't been reclaimed yet, and those that couldn't be revoked when their lease ended.
+// Each revocation is recorded in the k8s annotations, so it's only retried until it succeeds
+type CredentialRevoker struct {
+	credentials     *LeaseCredentials
+	services        ServiceGetterUpdater
+	k8sServiceName  string
+	adminKubeConfig AdminKubeConfigFunc
+	interval        time.Duration
+	now             func() time.Time
+}
+
+// NewCredentialRevoker creates a new CredentialRevoker that revokes credentials with credentials,
+// in the clusters whose admin kubeconfigs adminKubeConfig returns, once every interval
+func NewCredentialRevoker(
+	credentials *LeaseCredentials,
+	services ServiceGetterUpdater,
+	k8sServiceName string,
+	adminKubeConfig AdminKubeConfigFunc,
+	interval time.Duration,
+) *CredentialRevoker {
+	return &CredentialRevoker{
+		credentials:     credentials,
+		services:        services,
+		k8sServiceName:  k8sServiceName,
+		adminKubeConfig: adminKubeConfig,
+		interval:        interval,
+		now:             time.Now,
+	}
+}
+
+// Run calls Reconcile once every configured interval, until stop is closed
+func (r *CredentialRevoker) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.Reconcile(); err != nil {
+				log.Printf("Error revoking the credentials of ended leases -- %s", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Reconcile revokes the credentials of every expired lease, and every service account that the
+// lease map records as unrevoked, and records the revocations that succeeded. The others are only
+// logged, and tried again by the next call. It gives up after the configured interval
+func (r *CredentialRevoker) Reconcile() error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.interval)
+	defer cancel()
+	svc, err := GetService(ctx, r.services, r.k8sServiceName)
+	if err != nil {
+		return err
+	}
+	leaseMap, err := leases.ParseMapFromAnnotations(svc.Annotations)
+	if err != nil {
+		return err
+	}
+	pending, err := r.pending(leaseMap)
+	if err != nil {
+		return err
+	}
+	var revoked []revocation
+	for _, rev := range pending {
+		admin, err := r.adminKubeConfig(ctx, rev.lease)
+		if err == nil && admin != nil {
+			err = r.credentials.Revoke(admin, rev.serviceAccount)
+		}
+		if err != nil {
+			log.Printf("Error revoking the credentials of service account %s on cluster %s -- %s", rev.serviceAccount, rev.lease.ClusterID(), err)
+			continue
+		}
+		log.Printf("Revoked the credentials of service account %s on cluster %s", rev.serviceAccount, rev.lease.ClusterID())
+		revoked = append(revoked, rev)
+	}
+	if len(revoked) == 0 {
+		return nil
+	}
+	return UpdateLeaseMap(ctx, r.services, r.k8sServiceName, func(leaseMap *leases.Map) {
+		for _, rev := range revoked {
+			if rev.token != nil {
+				leaseMap.MarkLeaseRevoked(rev.token, rev.serviceAccount)
+			} else {
+				leaseMap.MarkRevoked(rev.lease.ClusterID(), rev.serviceAccount)
+			}
+		}
+	})
+}
+
+// pending returns the service accounts in leaseMap whose credentials need to be revoked
+func (r *CredentialRevoker) pending(leaseMap *leases.Map) ([]revocation, error) {
+	var ret []revocation
+	now := r.now()
+	tokens, err := leaseMap.UUIDs()
+	if err != nil {
+		return nil, err
+	}
+	for _, token := range tokens {
+		lease, _ := leaseMap.LeaseForUUID(token)
+		if lease.ServiceAccount == "" {
+			continue
+		}
+		if exp, err := lease.ExpirationTime(); err == nil && now.Before(exp) {
+			continue
+		}
+		ret = append(ret, revocation{lease: lease, token: token, serviceAccount: lease.ServiceAccount})
+	}
+	for _, clusterID := range leaseMap.UnrevokedClusterIDs() {
+		provider, clusterName := leases.SplitClusterID(clusterID)
+		lease := &leases.Lease{ClusterName: clusterName, Provider: provider}
+		for _, serviceAccount := range leaseMap.ClusterStatus(clusterID).UnrevokedServiceAccounts {
+			ret = append(ret, revocation{lease: lease, serviceAccount: serviceAccount})
+		}
+	}
+	return ret, nil
+}
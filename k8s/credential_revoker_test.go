@@ -0,0 +1,60 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/leases"
+	"github.com/pborman/uuid"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestCredentialRevoker(t *testing.T) {
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	expiredToken := uuid.NewRandom()
+	expired := leases.NewLease("cluster1", time.Now().Add(-time.Hour))
+	expired.Provider = leases.ProviderGoogle
+	expired.ServiceAccount = "k8s-claimer-leases/k8s-claimer-lease-expired"
+	assert.True(t, leaseMap.CreateLease(expiredToken, expired), "failed to create the expired lease")
+	active := leases.NewLease("cluster2", time.Now().Add(time.Hour))
+	active.Provider = leases.ProviderGoogle
+	active.ServiceAccount = "k8s-claimer-leases/k8s-claimer-lease-active"
+	assert.True(t, leaseMap.CreateLease(uuid.NewRandom(), active), "failed to create the active lease")
+	leaseMap.MarkUnrevoked("azure/cluster3", "k8s-claimer-leases/k8s-claimer-lease-released")
+	leaseMap.MarkUnrevoked("google/gone", "k8s-claimer-leases/k8s-claimer-lease-gone")
+	leaseMap.MarkUnrevoked("azure/unreachable", "k8s-claimer-leases/k8s-claimer-lease-unreachable")
+	annos, err := leaseMap.ToAnnotations()
+	assert.NoErr(t, err)
+	services := NewFakeServiceGetterUpdater(&v1.Service{ObjectMeta: v1.ObjectMeta{Name: "k8s-claimer", Annotations: annos}}, nil, nil, nil)
+
+	sas := &FakeServiceAccountClient{}
+	creds := &LeaseCredentials{Clients: func(*KubeConfig, string) (*LeaseCredentialClients, error) {
+		return fakeLeaseCredentialClients(sas, &FakeSecretClient{}, &FakeRBACClient{}), nil
+	}}
+	errUnreachable := errors.New("unreachable")
+	adminKubeConfig := func(ctx context.Context, lease *leases.Lease) (*KubeConfig, error) {
+		switch lease.ClusterID() {
+		case "google/gone":
+			return nil, nil
+		case "azure/unreachable":
+			return nil, errUnreachable
+		}
+		return &KubeConfig{}, nil
+	}
+	revoker := NewCredentialRevoker(creds, services, "k8s-claimer", adminKubeConfig, time.Minute)
+
+	assert.NoErr(t, revoker.Reconcile())
+	assert.Equal(t, len(sas.Deleted), 2, "number of deleted service accounts")
+	saved, err := leases.ParseMapFromAnnotations(services.Svc.Annotations)
+	assert.NoErr(t, err)
+	lease, _ := saved.LeaseForUUID(expiredToken)
+	assert.Equal(t, lease.ServiceAccount, "", "service account of the expired lease")
+	// revocations that failed are tried again, and the others aren't
+	assert.Equal(t, saved.UnrevokedClusterIDs(), []string{"azure/unreachable"}, "unrevoked cluster IDs")
+	assert.NoErr(t, revoker.Reconcile())
+	assert.Equal(t, len(sas.Deleted), 2, "number of deleted service accounts after a retry")
+}
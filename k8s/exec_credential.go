@@ -0,0 +1,68 @@
+package k8s
+
+import "time"
+
+const (
+	// ExecCredentialAPIVersion is the version of the client.authentication.k8s.io API that exec
+	// credential plugins are run with and answer in
+	ExecCredentialAPIVersion = "client.authentication.k8s.io/v1beta1"
+	// ExecCredentialKind is the kind of the object that exec credential plugins print
+	ExecCredentialKind = "ExecCredential"
+)
+
+// ExecConfig is the configuration of an exec credential plugin, which is a command that kubectl
+// runs to fetch credentials each time it needs them
+type ExecConfig struct {
+	APIVersion string       `yaml:"apiVersion"`
+	Command    string       `yaml:"command"`
+	Args       []string     `yaml:"args,omitempty"`
+	Env        []ExecEnvVar `yaml:"env,omitempty"`
+}
+
+// ExecEnvVar is an environment variable that an exec credential plugin is run with
+type ExecEnvVar struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+
+// ExecCredential is what an exec credential plugin prints for kubectl to read
+type ExecCredential struct {
+	APIVersion string               `json:"apiVersion"`
+	Kind       string               `json:"kind"`
+	Status     ExecCredentialStatus `json:"status"`
+}
+
+// ExecCredentialStatus holds the credentials that an exec credential plugin fetched. kubectl
+// runs the plugin again once ExpirationTimestamp has passed
+type ExecCredentialStatus struct {
+	Token               string `json:"token"`
+	ExpirationTimestamp string `json:"expirationTimestamp,omitempty"`
+}
+
+// NewExecCredential creates a new ExecCredential that carries token until expiration
+func NewExecCredential(token string, expiration time.Time) *ExecCredential {
+	return &ExecCredential{
+		APIVersion: ExecCredentialAPIVersion,
+		Kind:       ExecCredentialKind,
+		Status: ExecCredentialStatus{
+			Token:               token,
+			ExpirationTimestamp: expiration.UTC().Format(time.RFC3339),
+		},
+	}
+}
+
+// ExecKubeConfig returns a copy of kubeConfig whose users fetch their credentials by running
+// command with args and the environment variables in env, instead of carrying them
+func ExecKubeConfig(kubeConfig *KubeConfig, command string, args []string, env []ExecEnvVar) *KubeConfig {
+	ret := *kubeConfig
+	ret.AuthInfos = make([]NamedAuthInfo, len(kubeConfig.AuthInfos))
+	for i, authInfo := range kubeConfig.AuthInfos {
+		ret.AuthInfos[i] = NamedAuthInfo{Name: authInfo.Name, AuthInfo: AuthInfo{Exec: &ExecConfig{
+			APIVersion: ExecCredentialAPIVersion,
+			Command:    command,
+			Args:       args,
+			Env:        env,
+		}}}
+	}
+	return &ret
+}
@@ -0,0 +1,31 @@
+package k8s
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+)
+
+func TestExecKubeConfig(t *testing.T) {
+	admin := adminKubeConfig()
+	args := []string{"--server", "https://claimer.example.com", "credential", "--token", "abc"}
+	env := []ExecEnvVar{{Name: "K8S_CLAIMER_LEASE_SECRET", Value: "secret1"}}
+	kubeConfig := ExecKubeConfig(admin, "k8s-claimer-cli", args, env)
+	assert.Equal(t, kubeConfig.Clusters, admin.Clusters, "clusters")
+	assert.Equal(t, kubeConfig.AuthInfos, []NamedAuthInfo{{Name: "cluster1", AuthInfo: AuthInfo{Exec: &ExecConfig{
+		APIVersion: ExecCredentialAPIVersion,
+		Command:    "k8s-claimer-cli",
+		Args:       args,
+		Env:        env,
+	}}}}, "users")
+	assert.Equal(t, admin.AuthInfos[0].AuthInfo.Username, "admin", "admin user")
+}
+
+func TestNewExecCredential(t *testing.T) {
+	expiration := time.Date(2017, 10, 1, 12, 0, 0, 0, time.FixedZone("PDT", -7*60*60))
+	cred := NewExecCredential("token1", expiration)
+	assert.Equal(t, cred.Kind, ExecCredentialKind, "kind")
+	assert.Equal(t, cred.Status.Token, "token1", "token")
+	assert.Equal(t, cred.Status.ExpirationTimestamp, "2017-10-01T19:00:00Z", "expiration timestamp")
+}
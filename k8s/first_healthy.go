@@ -0,0 +1,93 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/deis/k8s-claimer/leases"
+)
+
+// ErrNoHealthyClusters is returned from FirstHealthyCluster when none of the clusters that were
+// probed before the budget ran out was healthy
+type ErrNoHealthyClusters struct {
+	Tried int
+}
+
+// Error is the error interface implementation
+func (e ErrNoHealthyClusters) Error() string {
+	return fmt.Sprintf("none of the %d free clusters that were probed were healthy", e.Tried)
+}
+
+// ErrCreatingKubeConfig is returned from FirstHealthyCluster when no health checker is used and
+// the kubeconfig of the first cluster couldn't be created
+type ErrCreatingKubeConfig struct {
+	ClusterID string
+	Err       error
+}
+
+// Error is the error interface implementation
+func (e ErrCreatingKubeConfig) Error() string {
+	return fmt.Sprintf("error creating kubeconfig file for cluster %s -- %s", e.ClusterID, e.Err)
+}
+
+// HealthCandidate is a cluster that FirstHealthyCluster may probe. ClusterID is the ID that its
+// status is recorded under, and KubeConfig creates or fetches its kubeconfig
+type HealthCandidate struct {
+	ClusterID  string
+	KubeConfig func() (*KubeConfig, error)
+}
+
+// FirstHealthyCluster returns the index of the first of candidates that passes a probe by
+// healthChecker, along with its kubeconfig. Candidates that fail the probe, or whose kubeconfig
+// can't be created, are marked unhealthy in leaseMap and skipped, and candidates that pass are
+// marked healthy. No new probe is started after budget has passed, and the probes are given up
+// when ctx is done. If healthChecker is nil, the first candidate is returned without probing.
+//
+// Returns ErrNoHealthyClusters if no candidate passed before the budget ran out
+// Returns ctx.Err() if ctx was done before a candidate passed
+// Returns ErrCreatingKubeConfig if healthChecker is nil and the kubeconfig of the first candidate
+// couldn't be created
+func FirstHealthyCluster(
+	ctx context.Context,
+	candidates []HealthCandidate,
+	leaseMap *leases.Map,
+	healthChecker HealthChecker,
+	budget time.Duration,
+) (int, *KubeConfig, error) {
+	deadline := time.Now().Add(budget)
+	tried := 0
+	for i, candidate := range candidates {
+		if healthChecker != nil && !time.Now().Before(deadline) {
+			log.Printf("Health check budget of %s ran out after probing %d clusters", budget, tried)
+			break
+		}
+		kubeConfig, err := candidate.KubeConfig()
+		if healthChecker == nil {
+			if err != nil {
+				return -1, nil, ErrCreatingKubeConfig{ClusterID: candidate.ClusterID, Err: err}
+			}
+			return i, kubeConfig, nil
+		}
+		if ctx.Err() != nil {
+			return -1, nil, ctx.Err()
+		}
+		tried++
+		if err == nil {
+			err = healthChecker.CheckHealth(ctx, kubeConfig, deadline.Sub(time.Now()))
+		}
+		if ctx.Err() != nil {
+			// the cluster may be fine, the probe was cut off
+			return -1, nil, ctx.Err()
+		}
+		if err != nil {
+			log.Printf("Skipping cluster %s, it failed its health check -- %s", candidate.ClusterID, err)
+			leaseMap.MarkUnhealthy(candidate.ClusterID, time.Now(), err.Error())
+			continue
+		}
+		leaseMap.MarkHealthy(candidate.ClusterID)
+		return i, kubeConfig, nil
+	}
+	return -1, nil, ErrNoHealthyClusters{Tried: tried}
+}
@@ -0,0 +1,59 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/leases"
+)
+
+func healthCandidate(clusterID string, err error) HealthCandidate {
+	return HealthCandidate{
+		ClusterID: clusterID,
+		KubeConfig: func() (*KubeConfig, error) {
+			if err != nil {
+				return nil, err
+			}
+			return &KubeConfig{Clusters: []NamedCluster{{Cluster: Cluster{Server: "https://" + clusterID}}}}, nil
+		},
+	}
+}
+
+func TestFirstHealthyCluster(t *testing.T) {
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	candidates := []HealthCandidate{
+		healthCandidate("down", errors.New("connection refused")),
+		healthCandidate("unhealthy", nil),
+		healthCandidate("healthy", nil),
+	}
+	checker := NewFakeHealthChecker(map[string]error{"https://unhealthy": errors.New("node is not ready")})
+	i, kubeConfig, err := FirstHealthyCluster(context.Background(), candidates, leaseMap, checker, 10*time.Second)
+	assert.NoErr(t, err)
+	assert.Equal(t, i, 2, "index of the healthy cluster")
+	assert.Equal(t, kubeConfig.Clusters[0].Cluster.Server, "https://healthy", "kubeconfig server")
+	assert.Equal(t, leaseMap.ClusterStatus("down").UnhealthyReason, "connection refused", "unhealthy reason")
+	assert.Equal(t, leaseMap.ClusterStatus("unhealthy").UnhealthyReason, "node is not ready", "unhealthy reason")
+
+	_, _, err = FirstHealthyCluster(context.Background(), candidates[:2], leaseMap, checker, 10*time.Second)
+	assert.Err(t, ErrNoHealthyClusters{Tried: 2}, err)
+
+	// without a health checker, the first cluster is returned without probing
+	_, _, err = FirstHealthyCluster(context.Background(), candidates, leaseMap, nil, 0)
+	assert.Err(t, ErrCreatingKubeConfig{ClusterID: "down", Err: errors.New("connection refused")}, err)
+}
+
+func TestFirstHealthyClusterContextDone(t *testing.T) {
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	checker := NewFakeHealthChecker(nil)
+	_, _, err = FirstHealthyCluster(ctx, []HealthCandidate{healthCandidate("healthy", nil)}, leaseMap, checker, 10*time.Second)
+	assert.Equal(t, err, context.Canceled, "error")
+	assert.Equal(t, len(checker.Checked), 0, "number of probes")
+	assert.True(t, leaseMap.ClusterStatus("healthy").LastUnhealthyTime().IsZero(), "the cluster was marked unhealthy")
+}
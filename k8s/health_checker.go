@@ -0,0 +1,41 @@
+package k8s
+
+import (
+	"context"
+	"time"
+)
+
+// HealthChecker checks whether the cluster described by a KubeConfig is healthy enough to be
+// leased. It should be used as a parameter to functions so that they can be more easily unit
+// tested
+type HealthChecker interface {
+	// CheckHealth returns nil if the cluster described by conf is healthy, and an error that
+	// describes the problem otherwise. It must give up and return an error after timeout, or
+	// when ctx is done
+	CheckHealth(ctx context.Context, conf *KubeConfig, timeout time.Duration) error
+}
+
+// FakeHealthChecker is a HealthChecker implementation to be used in unit tests
+type FakeHealthChecker struct {
+	// Errs maps API server addresses (as in the server field of a kubeconfig) to the error that
+	// CheckHealth returns for them. Servers not in Errs are healthy
+	Errs map[string]error
+	// Checked holds the API server addresses that CheckHealth was called with, in order
+	Checked []string
+}
+
+// CheckHealth is the HealthChecker interface implementation. It records the API server address
+// in conf and returns its error from f.Errs
+func (f *FakeHealthChecker) CheckHealth(ctx context.Context, conf *KubeConfig, timeout time.Duration) error {
+	server := ""
+	if len(conf.Clusters) > 0 {
+		server = conf.Clusters[0].Cluster.Server
+	}
+	f.Checked = append(f.Checked, server)
+	return f.Errs[server]
+}
+
+// NewFakeHealthChecker returns a new FakeHealthChecker that fails the servers in errs
+func NewFakeHealthChecker(errs map[string]error) *FakeHealthChecker {
+	return &FakeHealthChecker{Errs: errs}
+}
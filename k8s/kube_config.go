@@ -54,6 +54,7 @@ type AuthInfo struct {
 	Username              string              `yaml:"username,omitempty"`
 	Password              string              `yaml:"password,omitempty"`
 	AuthProvider          *AuthProviderConfig `yaml:"auth-provider,omitempty"`
+	Exec                  *ExecConfig         `yaml:"exec,omitempty"`
 	Extensions            []NamedExtension    `yaml:"extensions,omitempty"`
 }
 
@@ -0,0 +1,384 @@
+package k8s
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/client-go/pkg/api/errors"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// LeaseLabel is the label that marks the objects that make up the credentials of a lease in a
+	// leased cluster. Its value is the lease token
+	LeaseLabel = "k8s-claimer-lease"
+	// LeaseClusterRole is the cluster role that the service accounts of leases are bound to
+	// cluster-wide. See leaseClusterRoleRules
+	LeaseClusterRole = "k8s-claimer-lease"
+	// LeaseEditClusterRole is the cluster role that the service accounts of leases are bound to in
+	// the namespaces they may deploy to. See leaseEditClusterRoleRules
+	LeaseEditClusterRole = "k8s-claimer-lease-edit"
+
+	leaseObjectPrefix = "k8s-claimer-lease-"
+	rbacAPIGroup      = "rbac.authorization.k8s.io"
+	tokenPollInterval = 500 * time.Millisecond
+)
+
+var (
+	readVerbs = []string{"get", "list", "watch"}
+	editVerbs = []string{"get", "list", "watch", "create", "update", "patch", "delete", "deletecollection"}
+
+	// leaseClusterRoleRules let the service accounts of leases look at the workloads, nodes and
+	// volumes of the cluster. Secrets, config maps, service accounts and RBAC objects are left out,
+	// since those may hold the credentials of other service accounts, or of the cluster itself
+	leaseClusterRoleRules = []PolicyRule{
+		{APIGroups: []string{""}, Resources: []string{
+			"pods", "pods/log", "services", "endpoints", "events", "namespaces", "nodes",
+			"persistentvolumeclaims", "persistentvolumes", "replicationcontrollers", "resourcequotas",
+			"limitranges",
+		}, Verbs: readVerbs},
+		{APIGroups: []string{"apps", "extensions"}, Resources: []string{
+			"deployments", "replicasets", "daemonsets", "statefulsets", "ingresses",
+		}, Verbs: readVerbs},
+		{APIGroups: []string{"batch"}, Resources: []string{"jobs", "cronjobs"}, Verbs: readVerbs},
+		{APIGroups: []string{"autoscaling"}, Resources: []string{"horizontalpodautoscalers"}, Verbs: readVerbs},
+		{APIGroups: []string{"storage.k8s.io"}, Resources: []string{"storageclasses"}, Verbs: readVerbs},
+	}
+	// leaseEditClusterRoleRules let the service accounts of leases deploy workloads in the
+	// namespaces they're bound in. Secrets can be created and deleted, but not read. Service
+	// accounts, RBAC objects and impersonation are left out, so pods run as the default service
+	// account of their namespace, which has no permissions unless an admin granted them
+	leaseEditClusterRoleRules = []PolicyRule{
+		{APIGroups: []string{""}, Resources: []string{
+			"pods", "pods/attach", "pods/exec", "pods/portforward", "pods/proxy", "services",
+			"services/proxy", "endpoints", "configmaps", "persistentvolumeclaims",
+			"replicationcontrollers", "replicationcontrollers/scale",
+		}, Verbs: editVerbs},
+		{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"create", "delete"}},
+		{APIGroups: []string{"apps", "extensions"}, Resources: []string{
+			"deployments", "deployments/scale", "deployments/rollback", "replicasets",
+			"replicasets/scale", "daemonsets", "statefulsets", "ingresses",
+		}, Verbs: editVerbs},
+		{APIGroups: []string{"batch"}, Resources: []string{"jobs", "cronjobs"}, Verbs: editVerbs},
+		{APIGroups: []string{"autoscaling"}, Resources: []string{"horizontalpodautoscalers"}, Verbs: editVerbs},
+		{APIGroups: []string{"policy"}, Resources: []string{"poddisruptionbudgets"}, Verbs: editVerbs},
+	}
+)
+
+type errTokenNotIssued struct {
+	secretName string
+	timeout    time.Duration
+}
+
+func (e errTokenNotIssued) Error() string {
+	return fmt.Sprintf("no token was issued in secret %s within %s", e.secretName, e.timeout)
+}
+
+type errNoToken struct {
+	secretName string
+}
+
+func (e errNoToken) Error() string {
+	return fmt.Sprintf("secret %s doesn't hold a token", e.secretName)
+}
+
+type errMalformedServiceAccount struct {
+	serviceAccount string
+}
+
+func (e errMalformedServiceAccount) Error() string {
+	return fmt.Sprintf("service account %q isn't in the namespace/name format", e.serviceAccount)
+}
+
+// LeaseCredentialClients are the APIs of a leased cluster that the credentials of leases are
+// managed with. ServiceAccounts and Secrets are scoped to the namespace the service accounts of
+// leases are created in
+type LeaseCredentialClients struct {
+	Namespaces      NamespaceCreator
+	ServiceAccounts ServiceAccountClient
+	Secrets         SecretClient
+	RBAC            RBACClient
+}
+
+// LeaseCredentials gives each lease its own credentials in the leased cluster, instead of the
+// cluster's admin credentials. They belong to a service account in Namespace, which is bound to
+// LeaseClusterRole cluster-wide and to LeaseEditClusterRole in each of WorkNamespaces for the
+// duration of the lease, and are revoked by deleting the service account and its bindings. Both
+// cluster roles are kept up to date by Issue. Neither can read secrets or act as another service
+// account, so the service account's token is the only way into the cluster that a lease gets,
+// and revoking it cuts the lease off. Credentials are only issued if Enabled, but they're revoked
+// either way, so that leases that got them before they were disabled still lose them
+type LeaseCredentials struct {
+	Enabled        bool
+	Namespace      string
+	WorkNamespaces []string
+	TokenTimeout   time.Duration
+	// Clients returns the APIs of the cluster that admin is the admin kubeconfig of
+	Clients func(admin *KubeConfig, namespace string) (*LeaseCredentialClients, error)
+}
+
+// NewLeaseCredentials creates a new LeaseCredentials that talks to leased clusters with their
+// admin kubeconfig. Every request gives up after tokenTimeout, which is also how long the token
+// of a new service account is waited for
+func NewLeaseCredentials(enabled bool, namespace string, workNamespaces []string, tokenTimeout time.Duration) *LeaseCredentials {
+	return &LeaseCredentials{
+		Enabled:        enabled,
+		Namespace:      namespace,
+		WorkNamespaces: workNamespaces,
+		TokenTimeout:   tokenTimeout,
+		Clients: func(admin *KubeConfig, namespace string) (*LeaseCredentialClients, error) {
+			cl, err := CreateKubeClientWithTimeout(admin, tokenTimeout)
+			if err != nil {
+				return nil, err
+			}
+			rbacClient, err := NewRBACClient(admin, tokenTimeout)
+			if err != nil {
+				return nil, err
+			}
+			return &LeaseCredentialClients{
+				Namespaces:      cl.Core().Namespaces(),
+				ServiceAccounts: cl.Core().ServiceAccounts(namespace),
+				Secrets:         cl.Core().Secrets(namespace),
+				RBAC:            rbacClient,
+			}, nil
+		},
+	}
+}
+
+// Issue creates the credentials of the lease with the given token in the cluster that admin is
+// the admin kubeconfig of. The credentials of earlier leases that are still in the cluster are
+// revoked first, since a cluster has one lease at a time, and l.Namespace, l.WorkNamespaces and
+// the cluster roles are created if they're missing. Returns a kubeconfig for the cluster that
+// carries the credentials, along with their service account in the namespace/name format. If the
+// credentials can't be created, whatever was created for the lease is removed again and an error
+// is returned
+func (l *LeaseCredentials) Issue(admin *KubeConfig, leaseToken string) (*KubeConfig, string, error) {
+	clients, err := l.Clients(admin, l.Namespace)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := revokeStale(clients, l.Namespace, l.WorkNamespaces); err != nil {
+		return nil, "", err
+	}
+	if err := l.prepareCluster(clients); err != nil {
+		return nil, "", err
+	}
+
+	name := leaseObjectPrefix + leaseToken
+	labels := map[string]string{LeaseLabel: leaseToken}
+	sa := &v1.ServiceAccount{ObjectMeta: v1.ObjectMeta{Name: name, Namespace: l.Namespace, Labels: labels}}
+	if _, err := clients.ServiceAccounts.Create(sa); err != nil {
+		return nil, "", err
+	}
+	token, err := l.createBindingsAndToken(clients, name, labels)
+	if err != nil {
+		if revokeErr := revoke(clients, name, l.WorkNamespaces); revokeErr != nil {
+			log.Printf("Error removing service account %s/%s -- %s", l.Namespace, name, revokeErr)
+		}
+		return nil, "", err
+	}
+	return tokenKubeConfig(admin, token), l.Namespace + "/" + name, nil
+}
+
+// ManagedNamespaces returns l.Namespace and l.WorkNamespaces, which are kept when a leased
+// cluster is cleaned up, since the credentials of the next lease are created in them. Returns nil
+// if l is nil
+func (l *LeaseCredentials) ManagedNamespaces() []string {
+	if l == nil {
+		return nil
+	}
+	return append([]string{l.Namespace}, l.WorkNamespaces...)
+}
+
+// Revoke revokes the credentials of a lease, whose service account is serviceAccount in the
+// namespace/name format, in the cluster that admin is the admin kubeconfig of. Credentials that
+// don't exist anymore are already revoked
+func (l *LeaseCredentials) Revoke(admin *KubeConfig, serviceAccount string) error {
+	namespace, name, err := splitServiceAccount(serviceAccount)
+	if err != nil {
+		return err
+	}
+	clients, err := l.Clients(admin, namespace)
+	if err != nil {
+		return err
+	}
+	return revoke(clients, name, l.WorkNamespaces)
+}
+
+// RevokeUnsaved revokes the credentials of a lease that couldn't be saved, if it was issued any,
+// in the cluster that admin is the admin kubeconfig of. Failures are only logged, since the
+// credentials of earlier leases are revoked when their cluster is leased next
+func (l *LeaseCredentials) RevokeUnsaved(admin *KubeConfig, serviceAccount string) {
+	if serviceAccount == "" {
+		return
+	}
+	if err := l.Revoke(admin, serviceAccount); err != nil {
+		log.Printf("Error revoking the credentials of unsaved lease, service account %s -- %s", serviceAccount, err)
+	}
+}
+
+// Token returns the token of a lease's service account, which is serviceAccount in the
+// namespace/name format, in the cluster that admin is the admin kubeconfig of. The token doesn't
+// expire, and stays valid until the credentials are revoked
+func (l *LeaseCredentials) Token(admin *KubeConfig, serviceAccount string) (string, error) {
+	namespace, name, err := splitServiceAccount(serviceAccount)
+	if err != nil {
+		return "", err
+	}
+	clients, err := l.Clients(admin, namespace)
+	if err != nil {
+		return "", err
+	}
+	secret, err := clients.Secrets.Get(name)
+	if err != nil {
+		return "", err
+	}
+	token := secret.Data[v1.ServiceAccountTokenKey]
+	if len(token) == 0 {
+		return "", errNoToken{secretName: name}
+	}
+	return string(token), nil
+}
+
+// prepareCluster creates l.Namespace and l.WorkNamespaces if they don't exist, and creates or
+// updates LeaseClusterRole and LeaseEditClusterRole
+func (l *LeaseCredentials) prepareCluster(clients *LeaseCredentialClients) error {
+	for _, namespace := range l.ManagedNamespaces() {
+		ns := &v1.Namespace{ObjectMeta: v1.ObjectMeta{Name: namespace}}
+		if _, err := clients.Namespaces.Create(ns); err != nil && !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+	}
+	roles := []ClusterRole{
+		{Name: LeaseClusterRole, Rules: leaseClusterRoleRules},
+		{Name: LeaseEditClusterRole, Rules: leaseEditClusterRoleRules},
+	}
+	for _, role := range roles {
+		if err := clients.RBAC.ApplyClusterRole(role); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createBindingsAndToken binds the service account named name to LeaseClusterRole cluster-wide
+// and to LeaseEditClusterRole in each of l.WorkNamespaces, and creates a token for it. The token
+// is polled for until l.TokenTimeout has passed
+func (l *LeaseCredentials) createBindingsAndToken(clients *LeaseCredentialClients, name string, labels map[string]string) (string, error) {
+	bindings := []RoleBinding{{Name: name, ClusterRole: LeaseClusterRole}}
+	for _, namespace := range l.WorkNamespaces {
+		bindings = append(bindings, RoleBinding{Name: name, Namespace: namespace, ClusterRole: LeaseEditClusterRole})
+	}
+	for _, binding := range bindings {
+		binding.Labels = labels
+		binding.ServiceAccountNamespace = l.Namespace
+		binding.ServiceAccountName = name
+		if err := clients.RBAC.CreateBinding(binding); err != nil {
+			return "", err
+		}
+	}
+	secret := &v1.Secret{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        name,
+			Namespace:   l.Namespace,
+			Labels:      labels,
+			Annotations: map[string]string{v1.ServiceAccountNameKey: name},
+		},
+		Type: v1.SecretTypeServiceAccountToken,
+	}
+	if _, err := clients.Secrets.Create(secret); err != nil {
+		return "", err
+	}
+	// the token controller fills in the token of the secret asynchronously
+	deadline := time.Now().Add(l.TokenTimeout)
+	for {
+		secret, err := clients.Secrets.Get(name)
+		if err != nil {
+			return "", err
+		}
+		if token := secret.Data[v1.ServiceAccountTokenKey]; len(token) > 0 {
+			return string(token), nil
+		}
+		if time.Now().After(deadline) {
+			return "", errTokenNotIssued{secretName: name, timeout: l.TokenTimeout}
+		}
+		time.Sleep(tokenPollInterval)
+	}
+}
+
+// revokeStale revokes the credentials of every lease in the cluster that clients talk to, whose
+// service accounts are in namespace and whose bindings are cluster-wide or in workNamespaces
+func revokeStale(clients *LeaseCredentialClients, namespace string, workNamespaces []string) error {
+	sas, err := clients.ServiceAccounts.List(v1.ListOptions{LabelSelector: LeaseLabel})
+	if err != nil {
+		return err
+	}
+	names := make(map[string]struct{})
+	for _, sa := range sas.Items {
+		names[sa.Name] = struct{}{}
+	}
+	for _, bindingNamespace := range append([]string{""}, workNamespaces...) {
+		bindings, err := clients.RBAC.ListBindings(bindingNamespace, LeaseLabel)
+		if err != nil {
+			return err
+		}
+		for _, binding := range bindings {
+			names[binding] = struct{}{}
+		}
+	}
+	for name := range names {
+		log.Printf("Revoking the credentials of an earlier lease, service account %s/%s", namespace, name)
+		if err := revoke(clients, name, workNamespaces); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revoke deletes the bindings in workNamespaces and the cluster-wide binding named name, and the
+// service account named name. The token controller deletes the token secrets of the service
+// account along with it
+func revoke(clients *LeaseCredentialClients, name string, workNamespaces []string) error {
+	for _, namespace := range append([]string{""}, workNamespaces...) {
+		if err := clients.RBAC.DeleteBinding(namespace, name); err != nil {
+			return err
+		}
+	}
+	if err := clients.ServiceAccounts.Delete(name, nil); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// ServiceAccountUsername returns the username that the Kubernetes API authenticates
+// serviceAccount, in the namespace/name format, as
+func ServiceAccountUsername(serviceAccount string) (string, error) {
+	namespace, name, err := splitServiceAccount(serviceAccount)
+	if err != nil {
+		return "", err
+	}
+	return "system:serviceaccount:" + namespace + ":" + name, nil
+}
+
+// splitServiceAccount splits serviceAccount in the namespace/name format into its namespace and
+// name
+func splitServiceAccount(serviceAccount string) (string, string, error) {
+	parts := strings.Split(serviceAccount, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errMalformedServiceAccount{serviceAccount: serviceAccount}
+	}
+	return parts[0], parts[1], nil
+}
+
+// tokenKubeConfig returns a copy of admin whose users authenticate with token instead of the
+// admin credentials
+func tokenKubeConfig(admin *KubeConfig, token string) *KubeConfig {
+	ret := *admin
+	ret.AuthInfos = make([]NamedAuthInfo, len(admin.AuthInfos))
+	for i, authInfo := range admin.AuthInfos {
+		ret.AuthInfos[i] = NamedAuthInfo{Name: authInfo.Name, AuthInfo: AuthInfo{Token: token}}
+	}
+	return &ret
+}
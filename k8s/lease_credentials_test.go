@@ -0,0 +1,141 @@
+package k8s
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func fakeLeaseCredentials(clients *LeaseCredentialClients) *LeaseCredentials {
+	return &LeaseCredentials{
+		Enabled:        true,
+		Namespace:      "k8s-claimer-leases",
+		WorkNamespaces: []string{"default", "ci"},
+		TokenTimeout:   time.Second,
+		Clients: func(*KubeConfig, string) (*LeaseCredentialClients, error) {
+			return clients, nil
+		},
+	}
+}
+
+func fakeLeaseCredentialClients(sas *FakeServiceAccountClient, secrets *FakeSecretClient, rbacClient *FakeRBACClient) *LeaseCredentialClients {
+	return &LeaseCredentialClients{
+		Namespaces:      &FakeNamespaceCreator{},
+		ServiceAccounts: sas,
+		Secrets:         secrets,
+		RBAC:            rbacClient,
+	}
+}
+
+func adminKubeConfig() *KubeConfig {
+	return &KubeConfig{
+		Clusters:  []NamedCluster{{Name: "cluster1", Cluster: Cluster{Server: "https://1.2.3.4", CertificateAuthorityData: "ca"}}},
+		AuthInfos: []NamedAuthInfo{{Name: "cluster1", AuthInfo: AuthInfo{ClientCertificateData: "cert", ClientKeyData: "key", Username: "admin", Password: "pass"}}},
+		Contexts:  []NamedContext{{Name: "cluster1", Context: Context{Cluster: "cluster1", AuthInfo: "cluster1"}}},
+	}
+}
+
+func TestLeaseCredentialsIssue(t *testing.T) {
+	sas := &FakeServiceAccountClient{Items: []v1.ServiceAccount{{ObjectMeta: v1.ObjectMeta{Name: "k8s-claimer-lease-old"}}}}
+	rbacClient := &FakeRBACClient{Bindings: []RoleBinding{
+		{Name: "k8s-claimer-lease-old", ClusterRole: LeaseClusterRole},
+		{Name: "k8s-claimer-lease-old", Namespace: "ci", ClusterRole: LeaseEditClusterRole},
+	}}
+	clients := fakeLeaseCredentialClients(sas, &FakeSecretClient{Token: "token1"}, rbacClient)
+	admin := adminKubeConfig()
+	kubeConfig, serviceAccount, err := fakeLeaseCredentials(clients).Issue(admin, "abc")
+	assert.NoErr(t, err)
+	assert.Equal(t, serviceAccount, "k8s-claimer-leases/k8s-claimer-lease-abc", "service account")
+	assert.Equal(t, sas.Deleted, []string{"k8s-claimer-lease-old"}, "deleted service accounts")
+	assert.Equal(t, rbacClient.Deleted, []string{"k8s-claimer-lease-old", "default/k8s-claimer-lease-old", "ci/k8s-claimer-lease-old"}, "deleted bindings")
+	assert.Equal(t, clients.Namespaces.(*FakeNamespaceCreator).NsCreated, []string{"k8s-claimer-leases", "default", "ci"}, "created namespaces")
+	assert.Equal(t, rbacClient.Roles[LeaseClusterRole].Rules, leaseClusterRoleRules, "cluster role rules")
+	assert.Equal(t, rbacClient.Roles[LeaseEditClusterRole].Rules, leaseEditClusterRoleRules, "edit cluster role rules")
+	assert.Equal(t, len(sas.Items), 1, "number of service accounts")
+	assert.Equal(t, sas.Items[0].Labels[LeaseLabel], "abc", "lease label")
+	labels := map[string]string{LeaseLabel: "abc"}
+	assert.Equal(t, rbacClient.Bindings, []RoleBinding{
+		{Name: "k8s-claimer-lease-abc", Labels: labels, ClusterRole: LeaseClusterRole, ServiceAccountNamespace: "k8s-claimer-leases", ServiceAccountName: "k8s-claimer-lease-abc"},
+		{Name: "k8s-claimer-lease-abc", Namespace: "default", Labels: labels, ClusterRole: LeaseEditClusterRole, ServiceAccountNamespace: "k8s-claimer-leases", ServiceAccountName: "k8s-claimer-lease-abc"},
+		{Name: "k8s-claimer-lease-abc", Namespace: "ci", Labels: labels, ClusterRole: LeaseEditClusterRole, ServiceAccountNamespace: "k8s-claimer-leases", ServiceAccountName: "k8s-claimer-lease-abc"},
+	}, "bindings")
+
+	assert.Equal(t, kubeConfig.Clusters, admin.Clusters, "clusters")
+	assert.Equal(t, kubeConfig.Contexts, admin.Contexts, "contexts")
+	assert.Equal(t, kubeConfig.AuthInfos, []NamedAuthInfo{{Name: "cluster1", AuthInfo: AuthInfo{Token: "token1"}}}, "users")
+	assert.Equal(t, admin.AuthInfos[0].AuthInfo.Username, "admin", "admin user")
+}
+
+func TestLeaseCredentialRoles(t *testing.T) {
+	// the credentials of leases must not be able to read secrets, or to act as other service
+	// accounts, or they could outlive the lease
+	for name, rules := range map[string][]PolicyRule{LeaseClusterRole: leaseClusterRoleRules, LeaseEditClusterRole: leaseEditClusterRoleRules} {
+		for _, rule := range rules {
+			for _, resource := range rule.Resources {
+				assert.False(t, resource == "serviceaccounts" || resource == "*", "%s grants access to %s", name, resource)
+				for _, group := range rule.APIGroups {
+					assert.False(t, group == rbacAPIGroup || group == "*", "%s grants access to the %s API group", name, group)
+				}
+				for _, verb := range rule.Verbs {
+					assert.False(t, verb == "impersonate" || verb == "bind" || verb == "escalate" || verb == "*", "%s grants %s", name, verb)
+					assert.False(t, resource == "secrets" && (verb == "get" || verb == "list" || verb == "watch"), "%s lets secrets be read", name)
+				}
+			}
+		}
+	}
+}
+
+func TestLeaseCredentialsIssueNoToken(t *testing.T) {
+	sas := &FakeServiceAccountClient{}
+	rbacClient := &FakeRBACClient{}
+	creds := fakeLeaseCredentials(fakeLeaseCredentialClients(sas, &FakeSecretClient{}, rbacClient))
+	creds.TokenTimeout = 0
+	_, _, err := creds.Issue(adminKubeConfig(), "abc")
+	assert.Equal(t, err, errTokenNotIssued{secretName: "k8s-claimer-lease-abc", timeout: 0}, "error")
+	assert.Equal(t, len(sas.Items), 0, "number of service accounts")
+	assert.Equal(t, len(rbacClient.Bindings), 0, "number of bindings")
+}
+
+func TestLeaseCredentialsRevoke(t *testing.T) {
+	sas := &FakeServiceAccountClient{Items: []v1.ServiceAccount{{ObjectMeta: v1.ObjectMeta{Name: "k8s-claimer-lease-abc"}}}}
+	rbacClient := &FakeRBACClient{Bindings: []RoleBinding{
+		{Name: "k8s-claimer-lease-abc", ClusterRole: LeaseClusterRole},
+		{Name: "k8s-claimer-lease-abc", Namespace: "default", ClusterRole: LeaseEditClusterRole},
+	}}
+	clients := fakeLeaseCredentialClients(sas, &FakeSecretClient{}, rbacClient)
+	creds := fakeLeaseCredentials(clients)
+	assert.NoErr(t, creds.Revoke(adminKubeConfig(), "k8s-claimer-leases/k8s-claimer-lease-abc"))
+	assert.Equal(t, len(sas.Items), 0, "number of service accounts")
+	assert.Equal(t, len(rbacClient.Bindings), 0, "number of bindings")
+
+	err := creds.Revoke(adminKubeConfig(), "k8s-claimer-lease-abc")
+	assert.Equal(t, err, errMalformedServiceAccount{serviceAccount: "k8s-claimer-lease-abc"}, "error")
+
+	clients.ServiceAccounts = &FakeServiceAccountClient{Err: errors.New("forbidden")}
+	assert.True(t, creds.Revoke(adminKubeConfig(), "k8s-claimer-leases/k8s-claimer-lease-abc") != nil, "no error when deleting fails")
+}
+
+func TestLeaseCredentialsToken(t *testing.T) {
+	secrets := &FakeSecretClient{Token: "token1"}
+	creds := fakeLeaseCredentials(fakeLeaseCredentialClients(&FakeServiceAccountClient{}, secrets, &FakeRBACClient{}))
+	_, serviceAccount, err := creds.Issue(adminKubeConfig(), "abc")
+	assert.NoErr(t, err)
+	token, err := creds.Token(adminKubeConfig(), serviceAccount)
+	assert.NoErr(t, err)
+	assert.Equal(t, token, "token1", "token")
+
+	secrets.Token = ""
+	_, err = creds.Token(adminKubeConfig(), serviceAccount)
+	assert.Equal(t, err, errNoToken{secretName: "k8s-claimer-lease-abc"}, "error")
+}
+
+func TestServiceAccountUsername(t *testing.T) {
+	username, err := ServiceAccountUsername("k8s-claimer-leases/k8s-claimer-lease-abc")
+	assert.NoErr(t, err)
+	assert.Equal(t, username, "system:serviceaccount:k8s-claimer-leases:k8s-claimer-lease-abc", "username")
+	_, err = ServiceAccountUsername("k8s-claimer-lease-abc")
+	assert.Equal(t, err, errMalformedServiceAccount{serviceAccount: "k8s-claimer-lease-abc"}, "error")
+}
@@ -0,0 +1,28 @@
+package k8s
+
+import (
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// NamespaceCreator is a (k8s.io/client-go/kubernetes/typed/core/v1).NamespaceInterface
+// compatible interface designed only for creating namespaces. It should be used as a parameter to
+// functions so that they can be more easily unit tested
+type NamespaceCreator interface {
+	Create(ns *v1.Namespace) (*v1.Namespace, error)
+}
+
+// FakeNamespaceCreator is a NamespaceCreator implementation to be used in unit tests
+type FakeNamespaceCreator struct {
+	NsCreated []string
+	Err       error
+}
+
+// Create is the NamespaceCreator interface implementation. It records the name of ns in
+// f.NsCreated and returns f.Err
+func (f *FakeNamespaceCreator) Create(ns *v1.Namespace) (*v1.Namespace, error) {
+	f.NsCreated = append(f.NsCreated, ns.Name)
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	return ns, nil
+}
@@ -0,0 +1,17 @@
+package k8s
+
+// ProxyKubeConfig returns a copy of kubeConfig whose clusters are reached through the API proxy
+// at server, and whose users authenticate to it with token instead of carrying the cluster's
+// credentials
+func ProxyKubeConfig(kubeConfig *KubeConfig, server, token string) *KubeConfig {
+	ret := *kubeConfig
+	ret.Clusters = make([]NamedCluster, len(kubeConfig.Clusters))
+	for i, cluster := range kubeConfig.Clusters {
+		ret.Clusters[i] = NamedCluster{Name: cluster.Name, Cluster: Cluster{Server: server}}
+	}
+	ret.AuthInfos = make([]NamedAuthInfo, len(kubeConfig.AuthInfos))
+	for i, authInfo := range kubeConfig.AuthInfos {
+		ret.AuthInfos[i] = NamedAuthInfo{Name: authInfo.Name, AuthInfo: AuthInfo{Token: token}}
+	}
+	return &ret
+}
@@ -0,0 +1,16 @@
+package k8s
+
+import (
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+func TestProxyKubeConfig(t *testing.T) {
+	admin := adminKubeConfig()
+	kubeConfig := ProxyKubeConfig(admin, "https://claimer.example.com/proxy/abc", "token1")
+	assert.Equal(t, kubeConfig.Clusters, []NamedCluster{{Name: "cluster1", Cluster: Cluster{Server: "https://claimer.example.com/proxy/abc"}}}, "clusters")
+	assert.Equal(t, kubeConfig.AuthInfos, []NamedAuthInfo{{Name: "cluster1", AuthInfo: AuthInfo{Token: "token1"}}}, "users")
+	assert.Equal(t, kubeConfig.Contexts, admin.Contexts, "contexts")
+	assert.Equal(t, admin.Clusters[0].Cluster.Server, "https://1.2.3.4", "admin server")
+}
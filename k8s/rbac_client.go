@@ -0,0 +1,304 @@
+package k8s
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	rbacAPIPath = "/apis/rbac.authorization.k8s.io/v1beta1"
+	// maxRBACErrorBody is how much of an error response is read for its message
+	maxRBACErrorBody = 64 * 1024
+)
+
+type errRBACStatus struct {
+	method  string
+	path    string
+	code    int
+	message string
+}
+
+func (e errRBACStatus) Error() string {
+	return fmt.Sprintf("%s %s returned %d (%s)", e.method, e.path, e.code, e.message)
+}
+
+// isRBACNotFound returns true if err is an RBACClient error for an object that doesn't exist
+func isRBACNotFound(err error) bool {
+	e, ok := err.(errRBACStatus)
+	return ok && e.code == http.StatusNotFound
+}
+
+// PolicyRule is a rule of a ClusterRole, which allows Verbs on Resources in APIGroups
+type PolicyRule struct {
+	APIGroups []string `json:"apiGroups"`
+	Resources []string `json:"resources"`
+	Verbs     []string `json:"verbs"`
+}
+
+// ClusterRole is an RBAC cluster role
+type ClusterRole struct {
+	Name   string
+	Labels map[string]string
+	Rules  []PolicyRule
+}
+
+// RoleBinding binds the service account ServiceAccountNamespace/ServiceAccountName to the
+// cluster role ClusterRole. It's a cluster role binding if Namespace is empty, and a role binding
+// in Namespace otherwise
+type RoleBinding struct {
+	Name                    string
+	Namespace               string
+	Labels                  map[string]string
+	ClusterRole             string
+	ServiceAccountNamespace string
+	ServiceAccountName      string
+}
+
+// RBACClient is the part of the rbac.authorization.k8s.io/v1beta1 API that the credentials of
+// leases are managed with. It should be used as a parameter to functions so that they can be more
+// easily unit tested
+type RBACClient interface {
+	// ApplyClusterRole creates role, or replaces the cluster role with its name
+	ApplyClusterRole(role ClusterRole) error
+	// CreateBinding creates binding
+	CreateBinding(binding RoleBinding) error
+	// ListBindings returns the names of the bindings in namespace, or of the cluster role bindings
+	// if namespace is empty, that labelSelector selects
+	ListBindings(namespace, labelSelector string) ([]string, error)
+	// DeleteBinding deletes the binding named name in namespace, or the cluster role binding if
+	// namespace is empty. Bindings that don't exist are already deleted
+	DeleteBinding(namespace, name string) error
+}
+
+// httpRBACClient is an RBACClient that calls the API server over HTTP. The Kubernetes client
+// that the server is built with only has the v1alpha1 version of the RBAC API, which masters of
+// Kubernetes 1.6 and later don't serve
+type httpRBACClient struct {
+	server *url.URL
+	client *http.Client
+}
+
+// NewRBACClient creates an RBACClient that talks to the cluster in conf with the credentials of
+// its first user. Every request gives up after timeout
+func NewRBACClient(conf *KubeConfig, timeout time.Duration) (RBACClient, error) {
+	server, transport, err := NewTransport(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &httpRBACClient{server: server, client: &http.Client{Transport: transport, Timeout: timeout}}, nil
+}
+
+// rbacObjectMeta, rbacSubject, rbacRoleRef and rbacObject are the v1beta1 JSON representations
+// of the objects of the RBAC API
+type rbacObjectMeta struct {
+	Name      string            `json:"name"`
+	Namespace string            `json:"namespace,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+type rbacSubject struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+type rbacRoleRef struct {
+	APIGroup string `json:"apiGroup"`
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+}
+
+type rbacObject struct {
+	APIVersion string         `json:"apiVersion"`
+	Kind       string         `json:"kind"`
+	Metadata   rbacObjectMeta `json:"metadata"`
+	Rules      []PolicyRule   `json:"rules,omitempty"`
+	Subjects   []rbacSubject  `json:"subjects,omitempty"`
+	RoleRef    *rbacRoleRef   `json:"roleRef,omitempty"`
+}
+
+type rbacList struct {
+	Items []rbacObject `json:"items"`
+}
+
+// ApplyClusterRole is the RBACClient interface implementation
+func (h *httpRBACClient) ApplyClusterRole(role ClusterRole) error {
+	obj := rbacObject{
+		APIVersion: "rbac.authorization.k8s.io/v1beta1",
+		Kind:       "ClusterRole",
+		Metadata:   rbacObjectMeta{Name: role.Name, Labels: role.Labels},
+		Rules:      role.Rules,
+	}
+	err := h.do("PUT", rbacAPIPath+"/clusterroles/"+role.Name, nil, obj, nil)
+	if !isRBACNotFound(err) {
+		return err
+	}
+	return h.do("POST", rbacAPIPath+"/clusterroles", nil, obj, nil)
+}
+
+// CreateBinding is the RBACClient interface implementation
+func (h *httpRBACClient) CreateBinding(binding RoleBinding) error {
+	kind := "RoleBinding"
+	if binding.Namespace == "" {
+		kind = "ClusterRoleBinding"
+	}
+	obj := rbacObject{
+		APIVersion: "rbac.authorization.k8s.io/v1beta1",
+		Kind:       kind,
+		Metadata:   rbacObjectMeta{Name: binding.Name, Namespace: binding.Namespace, Labels: binding.Labels},
+		Subjects: []rbacSubject{{
+			Kind:      "ServiceAccount",
+			Name:      binding.ServiceAccountName,
+			Namespace: binding.ServiceAccountNamespace,
+		}},
+		RoleRef: &rbacRoleRef{APIGroup: rbacAPIGroup, Kind: "ClusterRole", Name: binding.ClusterRole},
+	}
+	return h.do("POST", bindingsPath(binding.Namespace), nil, obj, nil)
+}
+
+// ListBindings is the RBACClient interface implementation
+func (h *httpRBACClient) ListBindings(namespace, labelSelector string) ([]string, error) {
+	list := new(rbacList)
+	if err := h.do("GET", bindingsPath(namespace), url.Values{"labelSelector": {labelSelector}}, nil, list); err != nil {
+		return nil, err
+	}
+	names := make([]string, len(list.Items))
+	for i, item := range list.Items {
+		names[i] = item.Metadata.Name
+	}
+	return names, nil
+}
+
+// DeleteBinding is the RBACClient interface implementation
+func (h *httpRBACClient) DeleteBinding(namespace, name string) error {
+	if err := h.do("DELETE", bindingsPath(namespace)+"/"+name, nil, nil, nil); err != nil && !isRBACNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// do makes a request with method to path on the API server, with query and with body encoded as
+// JSON if it isn't nil, and decodes the response into out if it isn't nil. Returns errRBACStatus
+// if the response status isn't 2xx
+func (h *httpRBACClient) do(method, path string, query url.Values, body interface{}, out interface{}) error {
+	reqURL := *h.server
+	reqURL.Path = strings.TrimSuffix(reqURL.Path, "/") + path
+	reqURL.RawQuery = query.Encode()
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, reqURL.String(), &reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		status := struct {
+			Message string `json:"message"`
+		}{}
+		resBody, _ := ioutil.ReadAll(io.LimitReader(res.Body, maxRBACErrorBody))
+		if json.Unmarshal(resBody, &status) != nil || status.Message == "" {
+			status.Message = strings.TrimSpace(string(resBody))
+		}
+		return errRBACStatus{method: method, path: path, code: res.StatusCode, message: status.Message}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// bindingsPath returns the API path of the role bindings in namespace, or of the cluster role
+// bindings if namespace is empty
+func bindingsPath(namespace string) string {
+	if namespace == "" {
+		return rbacAPIPath + "/clusterrolebindings"
+	}
+	return rbacAPIPath + "/namespaces/" + namespace + "/rolebindings"
+}
+
+// FakeRBACClient is an RBACClient implementation to be used in unit tests. It keeps the cluster
+// roles it applies in Roles and the bindings it creates in Bindings, and fails every call with
+// Err if it's set
+type FakeRBACClient struct {
+	Roles    map[string]ClusterRole
+	Bindings []RoleBinding
+	// Deleted holds the bindings that were deleted, as namespace/name, or as name for cluster role
+	// bindings
+	Deleted []string
+	Err     error
+}
+
+// ApplyClusterRole is the RBACClient interface implementation. It stores role in f.Roles
+func (f *FakeRBACClient) ApplyClusterRole(role ClusterRole) error {
+	if f.Err != nil {
+		return f.Err
+	}
+	if f.Roles == nil {
+		f.Roles = make(map[string]ClusterRole)
+	}
+	f.Roles[role.Name] = role
+	return nil
+}
+
+// CreateBinding is the RBACClient interface implementation. It appends binding to f.Bindings
+func (f *FakeRBACClient) CreateBinding(binding RoleBinding) error {
+	if f.Err != nil {
+		return f.Err
+	}
+	f.Bindings = append(f.Bindings, binding)
+	return nil
+}
+
+// ListBindings is the RBACClient interface implementation. It returns the names of the
+// f.Bindings in namespace, regardless of labelSelector
+func (f *FakeRBACClient) ListBindings(namespace, labelSelector string) ([]string, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	var names []string
+	for _, binding := range f.Bindings {
+		if binding.Namespace == namespace {
+			names = append(names, binding.Name)
+		}
+	}
+	return names, nil
+}
+
+// DeleteBinding is the RBACClient interface implementation. It removes the binding from
+// f.Bindings if it's there, and records it in f.Deleted
+func (f *FakeRBACClient) DeleteBinding(namespace, name string) error {
+	if f.Err != nil {
+		return f.Err
+	}
+	if namespace == "" {
+		f.Deleted = append(f.Deleted, name)
+	} else {
+		f.Deleted = append(f.Deleted, namespace+"/"+name)
+	}
+	for i, binding := range f.Bindings {
+		if binding.Namespace == namespace && binding.Name == name {
+			f.Bindings = append(f.Bindings[:i], f.Bindings[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
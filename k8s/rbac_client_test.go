@@ -0,0 +1,86 @@
+package k8s
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+)
+
+func TestRBACClient(t *testing.T) {
+	var requests []string
+	var bodies []rbacObject
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.RequestURI())
+		if body, _ := ioutil.ReadAll(r.Body); len(body) > 0 {
+			obj := rbacObject{}
+			assert.NoErr(t, json.Unmarshal(body, &obj))
+			bodies = append(bodies, obj)
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "PUT " + rbacAPIPath + "/clusterroles/k8s-claimer-lease":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"kind":"Status","message":"clusterroles \"k8s-claimer-lease\" not found"}`))
+		case "GET " + rbacAPIPath + "/namespaces/ci/rolebindings":
+			w.Write([]byte(`{"items":[{"metadata":{"name":"k8s-claimer-lease-old"}}]}`))
+		case "DELETE " + rbacAPIPath + "/clusterrolebindings/k8s-claimer-lease-gone":
+			w.WriteHeader(http.StatusNotFound)
+		case "DELETE " + rbacAPIPath + "/clusterrolebindings/k8s-claimer-lease-forbidden":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"kind":"Status","message":"forbidden"}`))
+		default:
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer srv.Close()
+	client, err := NewRBACClient(kubeConfigForServer(srv.URL), time.Second)
+	assert.NoErr(t, err)
+
+	// missing cluster roles are created
+	role := ClusterRole{Name: "k8s-claimer-lease", Rules: leaseClusterRoleRules}
+	assert.NoErr(t, client.ApplyClusterRole(role))
+	assert.Equal(t, requests, []string{
+		"PUT " + rbacAPIPath + "/clusterroles/k8s-claimer-lease",
+		"POST " + rbacAPIPath + "/clusterroles",
+	}, "requests")
+	assert.Equal(t, bodies[1].Kind, "ClusterRole", "kind")
+	assert.Equal(t, bodies[1].Rules, leaseClusterRoleRules, "rules")
+
+	requests, bodies = nil, nil
+	binding := RoleBinding{
+		Name:                    "k8s-claimer-lease-abc",
+		Namespace:               "ci",
+		Labels:                  map[string]string{LeaseLabel: "abc"},
+		ClusterRole:             LeaseEditClusterRole,
+		ServiceAccountNamespace: "k8s-claimer-leases",
+		ServiceAccountName:      "k8s-claimer-lease-abc",
+	}
+	assert.NoErr(t, client.CreateBinding(binding))
+	assert.Equal(t, requests, []string{"POST " + rbacAPIPath + "/namespaces/ci/rolebindings"}, "requests")
+	assert.Equal(t, bodies[0].APIVersion, "rbac.authorization.k8s.io/v1beta1", "API version")
+	assert.Equal(t, bodies[0].Kind, "RoleBinding", "kind")
+	assert.Equal(t, bodies[0].Metadata, rbacObjectMeta{Name: "k8s-claimer-lease-abc", Namespace: "ci", Labels: binding.Labels}, "metadata")
+	assert.Equal(t, bodies[0].Subjects, []rbacSubject{{Kind: "ServiceAccount", Name: "k8s-claimer-lease-abc", Namespace: "k8s-claimer-leases"}}, "subjects")
+	assert.Equal(t, *bodies[0].RoleRef, rbacRoleRef{APIGroup: rbacAPIGroup, Kind: "ClusterRole", Name: LeaseEditClusterRole}, "role ref")
+
+	requests = nil
+	names, err := client.ListBindings("ci", LeaseLabel)
+	assert.NoErr(t, err)
+	assert.Equal(t, names, []string{"k8s-claimer-lease-old"}, "binding names")
+	assert.Equal(t, requests, []string{"GET " + rbacAPIPath + "/namespaces/ci/rolebindings?labelSelector=k8s-claimer-lease"}, "requests")
+
+	// bindings that are already gone are deleted
+	assert.NoErr(t, client.DeleteBinding("", "k8s-claimer-lease-gone"))
+	err = client.DeleteBinding("", "k8s-claimer-lease-forbidden")
+	assert.Equal(t, err, errRBACStatus{
+		method:  "DELETE",
+		path:    rbacAPIPath + "/clusterrolebindings/k8s-claimer-lease-forbidden",
+		code:    http.StatusForbidden,
+		message: "forbidden",
+	}, "error")
+}
@@ -0,0 +1,63 @@
+package k8s
+
+import (
+	"fmt"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// SecretClient is a (k8s.io/client-go/kubernetes/typed/core/v1).SecretInterface compatible
+// interface designed only for creating and getting secrets. It should be used as a parameter to
+// functions so that they can be more easily unit tested
+type SecretClient interface {
+	Create(secret *v1.Secret) (*v1.Secret, error)
+	Get(name string) (*v1.Secret, error)
+}
+
+// FakeSecretClient is a SecretClient implementation to be used in unit tests. It keeps the
+// secrets it creates in Items, and fails every call with Err if it's set. Service account token
+// secrets that it returns carry Token and CACert, like the token controller would fill in
+type FakeSecretClient struct {
+	Items  []v1.Secret
+	Token  string
+	CACert string
+	Err    error
+}
+
+// Create is the SecretClient interface implementation. It appends secret to f.Items
+func (f *FakeSecretClient) Create(secret *v1.Secret) (*v1.Secret, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	f.Items = append(f.Items, *secret)
+	return secret, nil
+}
+
+// Get is the SecretClient interface implementation. It returns the secret named name in f.Items,
+// and an error if there's none
+func (f *FakeSecretClient) Get(name string) (*v1.Secret, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	for _, secret := range f.Items {
+		if secret.Name != name {
+			continue
+		}
+		if secret.Type == v1.SecretTypeServiceAccountToken && f.Token != "" {
+			secret.Data = map[string][]byte{
+				v1.ServiceAccountTokenKey:  []byte(f.Token),
+				v1.ServiceAccountRootCAKey: []byte(f.CACert),
+			}
+		}
+		return &secret, nil
+	}
+	return nil, errSecretNotFound{name: name}
+}
+
+type errSecretNotFound struct {
+	name string
+}
+
+func (e errSecretNotFound) Error() string {
+	return fmt.Sprintf("secret %s not found", e.name)
+}
@@ -0,0 +1,16 @@
+package k8s
+
+// ServerVersion queries the /version endpoint of the API server described in conf and returns
+// its git version (i.e. v1.6.2). Returns an empty string and an appropriate error if the
+// client couldn't be created or the API server couldn't be reached
+func ServerVersion(conf *KubeConfig) (string, error) {
+	cl, err := CreateKubeClientFromConfig(conf)
+	if err != nil {
+		return "", err
+	}
+	info, err := cl.Discovery().ServerVersion()
+	if err != nil {
+		return "", err
+	}
+	return info.GitVersion, nil
+}
@@ -0,0 +1,54 @@
+package k8s
+
+import "k8s.io/client-go/pkg/api/v1"
+
+// ServiceAccountClient is a (k8s.io/client-go/kubernetes/typed/core/v1).ServiceAccountInterface
+// compatible interface designed only for creating, listing and deleting service accounts. It
+// should be used as a parameter to functions so that they can be more easily unit tested
+type ServiceAccountClient interface {
+	Create(sa *v1.ServiceAccount) (*v1.ServiceAccount, error)
+	List(opts v1.ListOptions) (*v1.ServiceAccountList, error)
+	Delete(name string, opts *v1.DeleteOptions) error
+}
+
+// FakeServiceAccountClient is a ServiceAccountClient implementation to be used in unit tests. It
+// keeps the service accounts it creates in Items, and fails every call with Err if it's set
+type FakeServiceAccountClient struct {
+	Items   []v1.ServiceAccount
+	Deleted []string
+	Err     error
+}
+
+// Create is the ServiceAccountClient interface implementation. It appends sa to f.Items
+func (f *FakeServiceAccountClient) Create(sa *v1.ServiceAccount) (*v1.ServiceAccount, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	f.Items = append(f.Items, *sa)
+	return sa, nil
+}
+
+// List is the ServiceAccountClient interface implementation. It returns every one of f.Items,
+// regardless of opts
+func (f *FakeServiceAccountClient) List(opts v1.ListOptions) (*v1.ServiceAccountList, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	return &v1.ServiceAccountList{Items: f.Items}, nil
+}
+
+// Delete is the ServiceAccountClient interface implementation. It removes the service account
+// named name from f.Items if it's there, and records name in f.Deleted
+func (f *FakeServiceAccountClient) Delete(name string, opts *v1.DeleteOptions) error {
+	if f.Err != nil {
+		return f.Err
+	}
+	f.Deleted = append(f.Deleted, name)
+	for i, sa := range f.Items {
+		if sa.Name == name {
+			f.Items = append(f.Items[:i], f.Items[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
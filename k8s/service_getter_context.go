@@ -0,0 +1,56 @@
+package k8s
+
+import (
+	"context"
+
+	"k8s.io/client-go/pkg/api/errors"
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/deis/k8s-claimer/retry"
+)
+
+// GetService gets the service with the given name with services, retrying transient API server
+// errors. Returns ctx.Err() if ctx is done first, abandoning the request in flight as described
+// in callContext
+func GetService(ctx context.Context, services ServiceGetter, name string) (*v1.Service, error) {
+	var svc *v1.Service
+	err := callContext(ctx, func() error {
+		var err error
+		svc, err = services.Get(name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return svc, nil
+}
+
+// callContext calls fn, retrying transient API server errors, and returns its error, or
+// ctx.Err() if ctx is done first. The k8s client doesn't take a context, so a call that's in
+// flight when ctx is done is abandoned: it finishes in the background and its result is dropped.
+// No retries are started after ctx is done, so at most one call is abandoned per callContext
+func callContext(ctx context.Context, fn func() error) error {
+	// buffered, so that the call never blocks after callContext has returned
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- retry.Do(ctx, retry.DefaultBackoff, IsTransientError, fn)
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// IsTransientError returns true if err is a k8s API server error that may go away if the call
+// that returned it is made again
+func IsTransientError(err error) bool {
+	if errors.IsServerTimeout(err) || errors.IsInternalError(err) {
+		return true
+	}
+	if _, delay := errors.SuggestsClientDelay(err); delay {
+		return true
+	}
+	return retry.IsTransientNetError(err)
+}
@@ -0,0 +1,34 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/arschles/assert"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// blockingServiceGetter is a ServiceGetter whose Get blocks until unblock is closed
+type blockingServiceGetter struct {
+	unblock chan struct{}
+}
+
+func (b blockingServiceGetter) Get(name string) (*v1.Service, error) {
+	<-b.unblock
+	return nil, errors.New("unblocked")
+}
+
+func TestGetService(t *testing.T) {
+	svc := &v1.Service{ObjectMeta: v1.ObjectMeta{Name: "k8s-claimer"}}
+	ret, err := GetService(context.Background(), NewFakeServiceGetter(svc, nil), "k8s-claimer")
+	assert.NoErr(t, err)
+	assert.Equal(t, ret, svc, "service")
+
+	getter := blockingServiceGetter{unblock: make(chan struct{})}
+	defer close(getter.unblock)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = GetService(ctx, getter, "k8s-claimer")
+	assert.Equal(t, err, context.Canceled, "error")
+}
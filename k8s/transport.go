@@ -0,0 +1,94 @@
+package k8s
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	errInvalidCAData = errors.New("the certificate authority data in config holds no certificates")
+)
+
+// NewTransport creates an http.RoundTripper that authenticates to the cluster in conf with the
+// credentials of its first user. Returns the URL of the cluster's master along with it, or nil,
+// nil and the appropriate error if the transport couldn't be created for any reason
+func NewTransport(conf *KubeConfig) (*url.URL, http.RoundTripper, error) {
+	if len(conf.Clusters) < 1 {
+		return nil, nil, errNoClustersInConfig
+	}
+	cluster := conf.Clusters[0].Cluster
+	if len(conf.AuthInfos) < 1 {
+		return nil, nil, errNoAuthInfosInConfig
+	}
+	authInfo := conf.AuthInfos[0].AuthInfo
+
+	server, err := url.Parse(cluster.Server)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: cluster.InsecureSkipTLSVerify}
+	if cluster.CertificateAuthorityData != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(kubeConfigData(cluster.CertificateAuthorityData)) {
+			return nil, nil, errInvalidCAData
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if authInfo.ClientCertificateData != "" && authInfo.ClientKeyData != "" {
+		cert, err := tls.X509KeyPair(kubeConfigData(authInfo.ClientCertificateData), kubeConfigData(authInfo.ClientKeyData))
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		Dial:                (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).Dial,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost: 25,
+	}
+	return server, &authRoundTripper{authInfo: authInfo, next: transport}, nil
+}
+
+// authRoundTripper adds the bearer token or the basic auth credentials of authInfo to each
+// request, if it has any
+type authRoundTripper struct {
+	authInfo AuthInfo
+	next     http.RoundTripper
+}
+
+func (a *authRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if a.authInfo.Token == "" && a.authInfo.Username == "" {
+		return a.next.RoundTrip(req)
+	}
+	// RoundTrippers must not modify the request they're given
+	authReq := new(http.Request)
+	*authReq = *req
+	authReq.Header = make(http.Header, len(req.Header))
+	for key, vals := range req.Header {
+		authReq.Header[key] = vals
+	}
+	if a.authInfo.Token != "" {
+		authReq.Header.Set("Authorization", "Bearer "+a.authInfo.Token)
+	} else {
+		authReq.SetBasicAuth(a.authInfo.Username, a.authInfo.Password)
+	}
+	return a.next.RoundTrip(authReq)
+}
+
+// kubeConfigData returns the PEM data in a *-data field of a kubeconfig. Those fields are base64
+// encoded, but PEM data that isn't is accepted as well
+func kubeConfigData(data string) []byte {
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return []byte(data)
+	}
+	return decoded
+}
@@ -0,0 +1,51 @@
+package k8s
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+func TestNewTransport(t *testing.T) {
+	var authHeader string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	conf := &KubeConfig{
+		Clusters:  []NamedCluster{{Name: "cluster1", Cluster: Cluster{Server: srv.URL, CertificateAuthorityData: base64.StdEncoding.EncodeToString(caPEM)}}},
+		AuthInfos: []NamedAuthInfo{{Name: "cluster1", AuthInfo: AuthInfo{Token: "token1"}}},
+	}
+	server, transport, err := NewTransport(conf)
+	assert.NoErr(t, err)
+	assert.Equal(t, server.String(), srv.URL, "server")
+
+	req, err := http.NewRequest("GET", srv.URL+"/api", nil)
+	assert.NoErr(t, err)
+	res, err := transport.RoundTrip(req)
+	assert.NoErr(t, err)
+	res.Body.Close()
+	assert.Equal(t, res.StatusCode, http.StatusOK, "response code")
+	assert.Equal(t, authHeader, "Bearer token1", "authorization header")
+	assert.Equal(t, req.Header.Get("Authorization"), "", "the request was modified")
+
+	conf.AuthInfos[0].AuthInfo = AuthInfo{Username: "admin", Password: "pass"}
+	_, transport, err = NewTransport(conf)
+	assert.NoErr(t, err)
+	res, err = transport.RoundTrip(req)
+	assert.NoErr(t, err)
+	res.Body.Close()
+	assert.Equal(t, authHeader, "Basic "+base64.StdEncoding.EncodeToString([]byte("admin:pass")), "authorization header")
+
+	conf.Clusters[0].Cluster.CertificateAuthorityData = "not a certificate"
+	_, _, err = NewTransport(conf)
+	assert.Equal(t, err, errInvalidCAData, "error")
+	_, _, err = NewTransport(&KubeConfig{})
+	assert.Equal(t, err, errNoClustersInConfig, "error")
+}
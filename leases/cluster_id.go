@@ -0,0 +1,56 @@
+package leases
+
+import (
+	"strings"
+)
+
+const (
+	// ProviderGoogle is the provider of clusters leased from GKE
+	ProviderGoogle = "google"
+	// ProviderAzure is the provider of clusters leased from Azure
+	ProviderAzure = "azure"
+)
+
+// ClusterID returns the provider-qualified ID of the cluster with the given name, in the
+// provider/name format. Cluster names are only unique within a provider, so leases and cluster
+// statuses are recorded under this ID. Returns clusterName if provider is empty
+func ClusterID(provider, clusterName string) string {
+	if provider == "" {
+		return clusterName
+	}
+	return provider + "/" + clusterName
+}
+
+// SplitClusterID splits id into its provider and cluster name. Leases and statuses recorded
+// before IDs were qualified by provider are recorded under the bare cluster name, so the provider
+// is empty if id doesn't start with a known one
+func SplitClusterID(id string) (provider, clusterName string) {
+	i := strings.Index(id, "/")
+	if i < 0 {
+		return "", id
+	}
+	switch id[:i] {
+	case ProviderGoogle, ProviderAzure:
+		return id[:i], id[i+1:]
+	default:
+		return "", id
+	}
+}
+
+// legacyClusterIDs returns the IDs that the cluster with the given ID may have been recorded
+// under by older versions, most recent first. Before IDs were qualified by provider, clusters were
+// recorded under the rest of their ID. Before GKE cluster IDs were always qualified by project and
+// location, GKE clusters were recorded under their bare name too. Returns nil if id isn't
+// qualified by provider
+func legacyClusterIDs(id string) []string {
+	provider, clusterName := SplitClusterID(id)
+	if provider == "" {
+		return nil
+	}
+	ids := []string{clusterName}
+	if i := strings.LastIndex(clusterName, "/"); provider == ProviderGoogle && i >= 0 {
+		bareName := clusterName[i+1:]
+		ids = append(ids, ClusterID(provider, bareName), bareName)
+	}
+	return ids
+}
@@ -0,0 +1,22 @@
+package leases
+
+import (
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+func TestClusterID(t *testing.T) {
+	assert.Equal(t, ClusterID(ProviderGoogle, "cluster1"), "google/cluster1", "GKE cluster ID")
+	assert.Equal(t, ClusterID("", "cluster1"), "cluster1", "cluster ID without a provider")
+
+	provider, name := SplitClusterID("google/proj1/zone1/cluster1")
+	assert.Equal(t, provider, ProviderGoogle, "provider")
+	assert.Equal(t, name, "proj1/zone1/cluster1", "cluster name")
+	provider, name = SplitClusterID("cluster1")
+	assert.Equal(t, provider, "", "provider of a legacy ID")
+	assert.Equal(t, name, "cluster1", "cluster name of a legacy ID")
+	provider, name = SplitClusterID("proj1/zone1/cluster1")
+	assert.Equal(t, provider, "", "provider of an ID without a known provider")
+	assert.Equal(t, name, "proj1/zone1/cluster1", "cluster name of an ID without a known provider")
+}
@@ -0,0 +1,162 @@
+package leases
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+const (
+	// RecycleDeleting is the recycle phase of a cluster that is being deleted to be recreated
+	RecycleDeleting = "deleting"
+	// RecycleCreating is the recycle phase of a cluster that is being recreated
+	RecycleCreating = "creating"
+	// RecycleFailed is the recycle phase of a cluster that couldn't be deleted or recreated
+	RecycleFailed = "failed"
+
+	// ClusterStatusAnnotationPrefix is the prefix of the k8s annotation keys that hold cluster
+	// statuses. The rest of the key is derived from the cluster ID, which is stored in the status
+	ClusterStatusAnnotationPrefix = "cluster.k8s-claimer.deis.io/"
+)
+
+// ClusterStatus is the json-encodable struct that holds what the server remembers about a
+// cluster between leases. It's stored in one annotation per cluster, next to the lease
+// annotations
+type ClusterStatus struct {
+	// ClusterID is the ID of the cluster, since the annotation key only holds a hash of it. It's
+	// only set in annotations
+	ClusterID    string `json:"cluster_id,omitempty"`
+	LastLeased   string `json:"last_leased,omitempty"`
+	LastReleased string `json:"last_released,omitempty"`
+	LastCleaned  string `json:"last_cleaned,omitempty"`
+	// LastHolder and AffinityKey are the holder and affinity key of the cluster's last lease, as
+	// given in its lease request
+	LastHolder  string `json:"last_holder,omitempty"`
+	AffinityKey string `json:"affinity_key,omitempty"`
+	// LastUnhealthy and UnhealthyReason are set when a health probe fails, and cleared when one
+	// succeeds
+	LastUnhealthy   string `json:"last_unhealthy,omitempty"`
+	UnhealthyReason string `json:"unhealthy_reason,omitempty"`
+	// ScaledDown is set when the cluster's node pools are scaled down to zero nodes while it's
+	// idle, and NodePoolSizes holds the number of nodes to restore each node pool to. Both are
+	// cleared when the node pools are restored
+	ScaledDown    string           `json:"scaled_down,omitempty"`
+	NodePoolSizes map[string]int64 `json:"node_pool_sizes,omitempty"`
+	// Recycling is the phase of the cluster's recreation after its last release, if it's being
+	// recreated. RecycleUpdated is the time the phase was entered, and RecycleError the reason a
+	// failed recreation failed. All three are cleared once the cluster is running again
+	Recycling      string `json:"recycling,omitempty"`
+	RecycleUpdated string `json:"recycle_updated,omitempty"`
+	RecycleError   string `json:"recycle_error,omitempty"`
+	// Upgrading is the version the cluster is being upgraded to, if it's being upgraded, and
+	// UpgradeStarted the time the upgrade started. UpgradeFailed is the version of the last
+	// upgrade, if it failed, and UpgradeError the reason it failed
+	Upgrading      string `json:"upgrading,omitempty"`
+	UpgradeStarted string `json:"upgrade_started,omitempty"`
+	UpgradeFailed  string `json:"upgrade_failed,omitempty"`
+	UpgradeError   string `json:"upgrade_error,omitempty"`
+	// UnrevokedServiceAccounts are the service accounts, in the namespace/name format, of leases
+	// of the cluster that ended before their credentials were revoked. Each is removed once its
+	// credentials are
+	UnrevokedServiceAccounts []string `json:"unrevoked_service_accounts,omitempty"`
+}
+
+// ParseClusterStatus decodes statusStr from json into a ClusterStatus structure. Returns nil and
+// any decoding error if there was one, and a valid status and nil otherwise
+func ParseClusterStatus(statusStr string) (*ClusterStatus, error) {
+	s := new(ClusterStatus)
+	if err := json.Unmarshal([]byte(statusStr), s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// LastLeasedTime returns the time the cluster was last leased, or the zero time if it never was
+func (s ClusterStatus) LastLeasedTime() time.Time {
+	return parseStatusTime(s.LastLeased)
+}
+
+// LastReleasedTime returns the time the cluster's last lease was released or reclaimed, or the
+// zero time if that never happened
+func (s ClusterStatus) LastReleasedTime() time.Time {
+	return parseStatusTime(s.LastReleased)
+}
+
+// LastCleanedTime returns the time the cluster's namespaces were last deleted, or the zero time
+// if they never were
+func (s ClusterStatus) LastCleanedTime() time.Time {
+	return parseStatusTime(s.LastCleaned)
+}
+
+// LastUnhealthyTime returns the time the cluster last failed a health probe, or the zero time if
+// it passed the last one or was never probed
+func (s ClusterStatus) LastUnhealthyTime() time.Time {
+	return parseStatusTime(s.LastUnhealthy)
+}
+
+// ScaledDownTime returns the time the cluster's node pools were scaled down to zero nodes, or
+// the zero time if they weren't, or were restored since
+func (s ClusterStatus) ScaledDownTime() time.Time {
+	return parseStatusTime(s.ScaledDown)
+}
+
+// IsScaledDown returns true if the cluster's node pools are scaled down to zero nodes
+func (s ClusterStatus) IsScaledDown() bool {
+	return s.ScaledDown != ""
+}
+
+// IsRecycling returns true if the cluster is being recreated, or its recreation failed
+func (s ClusterStatus) IsRecycling() bool {
+	return s.Recycling != ""
+}
+
+// IsUpgrading returns true if the cluster is being upgraded
+func (s ClusterStatus) IsUpgrading() bool {
+	return s.Upgrading != ""
+}
+
+// UpgradeStartedTime returns the time the cluster's current upgrade started, or the zero time if
+// it isn't being upgraded
+func (s ClusterStatus) UpgradeStartedTime() time.Time {
+	return parseStatusTime(s.UpgradeStarted)
+}
+
+// LastUsedTime returns the later of s.LastLeasedTime() and s.LastReleasedTime()
+func (s ClusterStatus) LastUsedTime() time.Time {
+	leased, released := s.LastLeasedTime(), s.LastReleasedTime()
+	if released.After(leased) {
+		return released
+	}
+	return leased
+}
+
+// parseStatusTime parses a time in TimeFormat, returning the zero time if it's empty or malformed
+func parseStatusTime(str string) time.Time {
+	t, err := time.Parse(TimeFormat, str)
+	if err != nil {
+		return zeroTime
+	}
+	return t
+}
+
+// clusterStatusAnnotationKey returns the annotation key that holds the status of clusterID.
+// Annotation key names can't contain slashes and are limited to 63 characters, so the cluster ID
+// is hashed
+func clusterStatusAnnotationKey(clusterID string) string {
+	sum := sha256.Sum256([]byte(clusterID))
+	return ClusterStatusAnnotationPrefix + hex.EncodeToString(sum[:16])
+}
+
+// isClusterStatusAnnotationKey returns true if key is a cluster status annotation key
+func isClusterStatusAnnotationKey(key string) bool {
+	return strings.HasPrefix(key, ClusterStatusAnnotationPrefix)
+}
+
+// legacyClusterIDFromAnnotationKey returns the cluster ID that key was derived from by older
+// versions, which didn't store the cluster ID in the status. They used the cluster ID with slashes
+// encoded as dots, which cluster names can't contain
+func legacyClusterIDFromAnnotationKey(key string) string {
+	return strings.Replace(strings.TrimPrefix(key, ClusterStatusAnnotationPrefix), ".", "/", -1)
+}
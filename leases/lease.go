@@ -16,10 +16,27 @@ var (
 )
 
 // Lease is the json-encodable struct that represents what's in the value of one lease annotation
-// in k8s
+// in k8s. Provider is the provider of the leased cluster, which is empty for leases created before
+// leases recorded it. Project and Location are the project and zone or region of the leased
+// cluster, for providers that have them. ServiceAccount is the service account, in the
+// namespace/name format, that the credentials handed out with the lease belong to. It's empty if
+// the lease was handed out the cluster's admin credentials. SecretHash is the salted hash of the
+// secret that the lease is released with, which is only handed out when the lease is created.
+// It's empty for leases created before leases had secrets. ProxyTokenHash is the salted hash of
+// the bearer token of the lease's API proxy. It's empty if the lease doesn't use the API proxy.
+// CreatedBy is the ID of the identity that created the lease, such as token:ci or
+// oidc:dev@example.com. Leases created before IDs were qualified with their source hold a bare
+// name, which no identity has
 type Lease struct {
 	ClusterName         string `json:"cluster_name"`
 	LeaseExpirationTime string `json:"lease_expiration_time"`
+	Provider            string `json:"provider,omitempty"`
+	Project             string `json:"project,omitempty"`
+	Location            string `json:"location,omitempty"`
+	ServiceAccount      string `json:"service_account,omitempty"`
+	SecretHash          string `json:"secret_hash,omitempty"`
+	ProxyTokenHash      string `json:"proxy_token_hash,omitempty"`
+	CreatedBy           string `json:"created_by,omitempty"`
 }
 
 // NewLease creates a new lease with the given cluster name and expiration time
@@ -40,6 +57,12 @@ func ParseLease(leaseStr string) (*Lease, error) {
 	return l, nil
 }
 
+// ClusterID returns the provider-qualified ID of the leased cluster. Returns the bare cluster name
+// if the lease doesn't record its provider
+func (l Lease) ClusterID() string {
+	return ClusterID(l.Provider, l.ClusterName)
+}
+
 // ExpirationTime returns the expiration time of this lease, if l.LeaseExpirationTime was a well
 // formed time string, returns the time and nil. Otherwise returns the zero value of time
 // (i.e. t.IsZero() will return true) and a non-nil error
@@ -2,17 +2,34 @@ package leases
 
 import (
 	"encoding/json"
+	"sort"
+	"time"
 
+	"github.com/deis/k8s-claimer/auth"
 	"github.com/pborman/uuid"
 )
 
 // Map holds an in-memory representation of the set of leases written to k8s annotations.
-// It can look up leases by lease token (which is a UUID) or cluster name
+// It can look up leases by lease token (which is a UUID) or cluster ID. It also holds the
+// status of each cluster and the usage ledger of each identity, which are written to k8s
+// annotations alongside the leases.
+//
+// Clusters are identified by their provider-qualified ID (see ClusterID). Leases and statuses
+// recorded under the IDs that older versions used (see legacyClusterIDs) are still found by the
+// qualified ID, and statuses move to the qualified ID the next time they're updated.
+//
+// Usage ledgers are kept by identity ID (see auth.Identity.ID). Ledgers recorded under the bare
+// names that older versions used can't be told apart between API tokens and ID token holders, so
+// they're ignored, and dropped the next time the map is saved
 type Map struct {
 	// mapping from uuid to lease. this map is what's stored in the k8s annotation
 	uuidMap map[string]*Lease
-	// mapping from cluster name to uuid. this map is the secondary index into uuidMap
+	// mapping from cluster ID to uuid. this map is the secondary index into uuidMap
 	nameMap map[string]uuid.UUID
+	// mapping from cluster ID to cluster status. each entry is stored in its own k8s annotation
+	statusMap map[string]*ClusterStatus
+	// mapping from identity ID to usage ledger. each entry is stored in its own k8s annotation
+	usageMap map[string]*Usage
 }
 
 // ParseMapFromAnnotations parses a map of Kubernetes annotations into a lease map. Returns nil
@@ -20,7 +37,30 @@ type Map struct {
 func ParseMapFromAnnotations(annotations map[string]string) (*Map, error) {
 	uuidMap := make(map[string]*Lease)
 	nameMap := make(map[string]uuid.UUID)
+	statusMap := make(map[string]*ClusterStatus)
+	usageMap := make(map[string]*Usage)
 	for uuidStr, leaseStr := range annotations {
+		if isClusterStatusAnnotationKey(uuidStr) {
+			status, err := ParseClusterStatus(leaseStr)
+			if err != nil {
+				continue
+			}
+			clusterID := status.ClusterID
+			if clusterID == "" {
+				clusterID = legacyClusterIDFromAnnotationKey(uuidStr)
+			}
+			status.ClusterID = ""
+			statusMap[clusterID] = status
+			continue
+		}
+		if isUsageAnnotationKey(uuidStr) {
+			usage, err := ParseUsage(leaseStr)
+			if err != nil || !auth.ValidID(usage.Identity) {
+				continue
+			}
+			usageMap[usage.Identity] = usage
+			continue
+		}
 		// try to parse the UUID and the lease, but skip if the annotation has a malformed UUID or
 		// lease. This is to work in clusters that have other annotations
 		u := uuid.Parse(uuidStr)
@@ -32,15 +72,21 @@ func ParseMapFromAnnotations(annotations map[string]string) (*Map, error) {
 			continue
 		}
 		uuidMap[u.String()] = lease
-		nameMap[lease.ClusterName] = u
+		nameMap[lease.ClusterID()] = u
 	}
-	return &Map{uuidMap: uuidMap, nameMap: nameMap}, nil
+	return &Map{uuidMap: uuidMap, nameMap: nameMap, statusMap: statusMap, usageMap: usageMap}, nil
 }
 
-// LeaseByClusterName finds a lease in m by the given cluster name. returns nil and false if no
-// lease exists for the given cluster name, non-nil and true otherwise
-func (m Map) LeaseByClusterName(clusterName string) (*Lease, bool) {
-	u, ok := m.nameMap[clusterName]
+// LeaseByClusterName finds a lease in m by the given cluster ID. returns nil and false if no
+// lease exists for the given cluster ID, non-nil and true otherwise
+func (m Map) LeaseByClusterName(clusterID string) (*Lease, bool) {
+	u, ok := m.nameMap[clusterID]
+	for _, legacyID := range legacyClusterIDs(clusterID) {
+		if ok {
+			break
+		}
+		u, ok = m.nameMap[legacyID]
+	}
 	if !ok {
 		return nil, false
 	}
@@ -73,21 +119,45 @@ func (m Map) LeaseForUUID(u uuid.UUID) (*Lease, bool) {
 	return l, ok
 }
 
+// CountCreatedBy returns how many of the leases in m were created by the identity whose ID is
+// name, and haven't expired at now
+func (m Map) CountCreatedBy(name string, now time.Time) int {
+	count := 0
+	for _, l := range m.uuidMap {
+		if l.CreatedBy != name {
+			continue
+		}
+		if exp, err := l.ExpirationTime(); err == nil && exp.After(now) {
+			count++
+		}
+	}
+	return count
+}
+
 // CreateLease attempts to set the given lease under the given uuid. If u already existed or
-// l.ClusterName otherwise already has a lease associated with it, does nothing and returns false.
+// l's cluster otherwise already has a lease associated with it, does nothing and returns false.
 // Otherwise adds the lease to the map and returns true
 func (m *Map) CreateLease(u uuid.UUID, l *Lease) bool {
 	if _, found := m.uuidMap[u.String()]; found {
 		return false
 	}
-	if _, found := m.nameMap[l.ClusterName]; found {
+	if _, found := m.LeaseByClusterName(l.ClusterID()); found {
 		return false
 	}
 	m.uuidMap[u.String()] = l
-	m.nameMap[l.ClusterName] = u
+	m.nameMap[l.ClusterID()] = u
 	return true
 }
 
+// MarkLeaseRevoked records that the credentials of serviceAccount, the service account of the lease
+// under the given uuid, were revoked before the lease ended, by removing the service account from
+// the lease. Does nothing if the lease doesn't exist or has another service account
+func (m *Map) MarkLeaseRevoked(u uuid.UUID, serviceAccount string) {
+	if lease, found := m.uuidMap[u.String()]; found && lease.ServiceAccount == serviceAccount {
+		lease.ServiceAccount = ""
+	}
+}
+
 // DeleteLease attempts to delete the lease under the given uuid. If there is no such lease,
 // does nothing and returns false. Otherwise, completes the delete operation and returns true
 func (m *Map) DeleteLease(u uuid.UUID) bool {
@@ -96,12 +166,319 @@ func (m *Map) DeleteLease(u uuid.UUID) bool {
 		return false
 	}
 	delete(m.uuidMap, u.String())
-	delete(m.nameMap, lease.ClusterName)
+	delete(m.nameMap, lease.ClusterID())
 	return true
 }
 
-// ToAnnotations returns a raw map[string]string of lease tokens and json-encoded leases. This map is
-// suitable for use in Kubernetes annotations, and will be parseable by ParseMapFromAnnotations
+// ClusterStatus returns the status of the given cluster. Returns the zero value if nothing has
+// been recorded for the cluster yet
+func (m Map) ClusterStatus(clusterID string) ClusterStatus {
+	status, ok := m.status(clusterID)
+	if !ok {
+		return ClusterStatus{}
+	}
+	return *status
+}
+
+// status returns the status recorded for the given cluster, falling back to the one recorded
+// under one of its legacy IDs. Returns nil and false if none exists
+func (m Map) status(clusterID string) (*ClusterStatus, bool) {
+	if status, ok := m.statusMap[clusterID]; ok {
+		return status, true
+	}
+	for _, legacyID := range legacyClusterIDs(clusterID) {
+		if status, ok := m.statusMap[legacyID]; ok {
+			return status, true
+		}
+	}
+	return nil, false
+}
+
+// RecyclingClusterIDs returns the IDs of the clusters that are being deleted or recreated to be
+// recycled, sorted
+func (m Map) RecyclingClusterIDs() []string {
+	var ids []string
+	for clusterID, status := range m.statusMap {
+		if status.Recycling == RecycleDeleting || status.Recycling == RecycleCreating {
+			ids = append(ids, clusterID)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// UnrevokedClusterIDs returns the IDs of the clusters that have service accounts whose
+// credentials weren't revoked, sorted
+func (m Map) UnrevokedClusterIDs() []string {
+	var ids []string
+	for clusterID, status := range m.statusMap {
+		if len(status.UnrevokedServiceAccounts) > 0 {
+			ids = append(ids, clusterID)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// UpdateClusterStatus calls fn with the status of the given cluster, creating an empty one if
+// none was recorded yet. fn may modify the status, and the result is stored in m under clusterID
+func (m *Map) UpdateClusterStatus(clusterID string, fn func(*ClusterStatus)) {
+	if m.statusMap == nil {
+		m.statusMap = make(map[string]*ClusterStatus)
+	}
+	status, ok := m.status(clusterID)
+	if !ok {
+		status = new(ClusterStatus)
+	}
+	for _, legacyID := range legacyClusterIDs(clusterID) {
+		delete(m.statusMap, legacyID)
+	}
+	m.statusMap[clusterID] = status
+	fn(status)
+}
+
+// MarkLeased records t as the time the given cluster was last leased
+func (m *Map) MarkLeased(clusterID string, t time.Time) {
+	m.UpdateClusterStatus(clusterID, func(s *ClusterStatus) {
+		s.LastLeased = t.Format(TimeFormat)
+	})
+}
+
+// MarkHeld records holder and affinityKey as the holder and affinity key of the given cluster's
+// last lease. Either may be empty
+func (m *Map) MarkHeld(clusterID, holder, affinityKey string) {
+	m.UpdateClusterStatus(clusterID, func(s *ClusterStatus) {
+		s.LastHolder = holder
+		s.AffinityKey = affinityKey
+	})
+}
+
+// MarkReleased records t as the time the given cluster's last lease was released or reclaimed
+func (m *Map) MarkReleased(clusterID string, t time.Time) {
+	m.UpdateClusterStatus(clusterID, func(s *ClusterStatus) {
+		s.LastReleased = t.Format(TimeFormat)
+	})
+}
+
+// MarkCleaned records t as the time the given cluster's namespaces were last deleted
+func (m *Map) MarkCleaned(clusterID string, t time.Time) {
+	m.UpdateClusterStatus(clusterID, func(s *ClusterStatus) {
+		s.LastCleaned = t.Format(TimeFormat)
+	})
+}
+
+// MarkUnhealthy records that the given cluster failed a health probe at t, for the given reason
+func (m *Map) MarkUnhealthy(clusterID string, t time.Time, reason string) {
+	m.UpdateClusterStatus(clusterID, func(s *ClusterStatus) {
+		s.LastUnhealthy = t.Format(TimeFormat)
+		s.UnhealthyReason = reason
+	})
+}
+
+// MarkHealthy clears the record of the given cluster's last failed health probe, if there is one
+func (m *Map) MarkHealthy(clusterID string) {
+	if _, ok := m.status(clusterID); !ok {
+		return
+	}
+	m.UpdateClusterStatus(clusterID, func(s *ClusterStatus) {
+		s.LastUnhealthy = ""
+		s.UnhealthyReason = ""
+	})
+}
+
+// MarkScaledDown records that the given cluster's node pools were scaled down to zero nodes at t.
+// nodePoolSizes holds the number of nodes to restore each node pool to, by node pool name
+func (m *Map) MarkScaledDown(clusterID string, t time.Time, nodePoolSizes map[string]int64) {
+	m.UpdateClusterStatus(clusterID, func(s *ClusterStatus) {
+		s.ScaledDown = t.Format(TimeFormat)
+		s.NodePoolSizes = nodePoolSizes
+	})
+}
+
+// MarkRestored clears the record of the given cluster's node pools being scaled down, if there
+// is one
+func (m *Map) MarkRestored(clusterID string) {
+	if _, ok := m.status(clusterID); !ok {
+		return
+	}
+	m.UpdateClusterStatus(clusterID, func(s *ClusterStatus) {
+		s.ScaledDown = ""
+		s.NodePoolSizes = nil
+	})
+}
+
+// MarkUnrevoked records that the credentials of serviceAccount, the service account of a lease of
+// the given cluster that ended, weren't revoked
+func (m *Map) MarkUnrevoked(clusterID, serviceAccount string) {
+	m.UpdateClusterStatus(clusterID, func(s *ClusterStatus) {
+		for _, unrevoked := range s.UnrevokedServiceAccounts {
+			if unrevoked == serviceAccount {
+				return
+			}
+		}
+		s.UnrevokedServiceAccounts = append(s.UnrevokedServiceAccounts, serviceAccount)
+	})
+}
+
+// MarkRevoked records that the credentials of serviceAccount, an unrevoked service account of the
+// given cluster, were revoked
+func (m *Map) MarkRevoked(clusterID, serviceAccount string) {
+	if _, ok := m.status(clusterID); !ok {
+		return
+	}
+	m.UpdateClusterStatus(clusterID, func(s *ClusterStatus) {
+		for i, unrevoked := range s.UnrevokedServiceAccounts {
+			if unrevoked == serviceAccount {
+				s.UnrevokedServiceAccounts = append(s.UnrevokedServiceAccounts[:i], s.UnrevokedServiceAccounts[i+1:]...)
+				return
+			}
+		}
+	})
+}
+
+// MarkRecycling records that the given cluster entered the given recycle phase at t
+func (m *Map) MarkRecycling(clusterID, phase string, t time.Time) {
+	m.UpdateClusterStatus(clusterID, func(s *ClusterStatus) {
+		s.Recycling = phase
+		s.RecycleUpdated = t.Format(TimeFormat)
+		s.RecycleError = ""
+	})
+}
+
+// MarkRecycleFailed records that recreating the given cluster failed at t, for the given reason
+func (m *Map) MarkRecycleFailed(clusterID string, t time.Time, reason string) {
+	m.UpdateClusterStatus(clusterID, func(s *ClusterStatus) {
+		s.Recycling = RecycleFailed
+		s.RecycleUpdated = t.Format(TimeFormat)
+		s.RecycleError = reason
+	})
+}
+
+// MarkRecycled clears the record of the given cluster being recreated, if there is one
+func (m *Map) MarkRecycled(clusterID string) {
+	if _, ok := m.status(clusterID); !ok {
+		return
+	}
+	m.UpdateClusterStatus(clusterID, func(s *ClusterStatus) {
+		s.Recycling = ""
+		s.RecycleUpdated = ""
+		s.RecycleError = ""
+	})
+}
+
+// MarkUpgrading records that the given cluster started being upgraded to version at t
+func (m *Map) MarkUpgrading(clusterID, version string, t time.Time) {
+	m.UpdateClusterStatus(clusterID, func(s *ClusterStatus) {
+		s.Upgrading = version
+		s.UpgradeStarted = t.Format(TimeFormat)
+	})
+}
+
+// MarkUpgraded records that the given cluster's upgrade finished, clearing the record of the
+// upgrade and of any earlier failed one
+func (m *Map) MarkUpgraded(clusterID string) {
+	if _, ok := m.status(clusterID); !ok {
+		return
+	}
+	m.UpdateClusterStatus(clusterID, func(s *ClusterStatus) {
+		s.Upgrading = ""
+		s.UpgradeStarted = ""
+		s.UpgradeFailed = ""
+		s.UpgradeError = ""
+	})
+}
+
+// MarkUpgradeFailed records that the given cluster's upgrade to version failed, for the given
+// reason
+func (m *Map) MarkUpgradeFailed(clusterID, version, reason string) {
+	m.UpdateClusterStatus(clusterID, func(s *ClusterStatus) {
+		s.Upgrading = ""
+		s.UpgradeStarted = ""
+		s.UpgradeFailed = version
+		s.UpgradeError = reason
+	})
+}
+
+// Usage returns the usage ledger of the identity whose ID is name. Returns an empty ledger if nothing
+// has been recorded for it yet
+func (m Map) Usage(name string) Usage {
+	usage, ok := m.usageMap[name]
+	if !ok {
+		return Usage{Identity: name}
+	}
+	return *usage
+}
+
+// Usages returns the usage ledgers of every identity that created a lease in the week before now,
+// sorted by identity ID
+func (m Map) Usages(now time.Time) []Usage {
+	names := make([]string, 0, len(m.usageMap))
+	for name, usage := range m.usageMap {
+		if usage.startedAfter(now.Add(-usageReportAge)) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	usages := make([]Usage, len(names))
+	for i, name := range names {
+		usages[i] = *m.usageMap[name]
+	}
+	return usages
+}
+
+// RecordUsage records in the usage ledger of the identity whose ID is name that it created the
+// lease under u at start, which lasts until end. Entries of every ledger that started too long
+// before start to count against any quota are dropped, along with the ledgers that are left
+// empty. Does nothing if name isn't an identity ID, since the lease wasn't created by a known
+// identity
+func (m *Map) RecordUsage(name string, u uuid.UUID, start, end time.Time) {
+	if !auth.ValidID(name) {
+		return
+	}
+	if m.usageMap == nil {
+		m.usageMap = make(map[string]*Usage)
+	}
+	cutoff := start.Add(-usageRetention)
+	for ledgerName, ledger := range m.usageMap {
+		ledger.prune(cutoff)
+		if len(ledger.Leases) == 0 {
+			delete(m.usageMap, ledgerName)
+		}
+	}
+	usage, ok := m.usageMap[name]
+	if !ok {
+		usage = &Usage{Identity: name}
+		m.usageMap[name] = usage
+	}
+	usage.Leases = append(usage.Leases, UsageEntry{
+		Token: u.String(),
+		Start: start.Format(TimeFormat),
+		End:   end.Format(TimeFormat),
+	})
+}
+
+// EndUsage records in the usage ledger of the identity whose ID is name that the lease under u was
+// released at end. Does nothing if the lease isn't in the ledger, or if it ended before end
+func (m *Map) EndUsage(name string, u uuid.UUID, end time.Time) {
+	usage, ok := m.usageMap[name]
+	if !ok {
+		return
+	}
+	for i, entry := range usage.Leases {
+		if entry.Token != u.String() {
+			continue
+		}
+		if recorded, err := time.Parse(TimeFormat, entry.End); err == nil && recorded.Before(end) {
+			return
+		}
+		usage.Leases[i].End = end.Format(TimeFormat)
+		return
+	}
+}
+
+// ToAnnotations returns a raw map[string]string of lease tokens and json-encoded leases, plus one
+// entry per cluster status and per usage ledger. This map is suitable for use in Kubernetes annotations, and will be
+// parseable by ParseMapFromAnnotations
 func (m *Map) ToAnnotations() (map[string]string, error) {
 	ret := make(map[string]string)
 	for token, lease := range m.uuidMap {
@@ -111,5 +488,21 @@ func (m *Map) ToAnnotations() (map[string]string, error) {
 		}
 		ret[token] = string(leaseBytes)
 	}
+	for clusterID, status := range m.statusMap {
+		stored := *status
+		stored.ClusterID = clusterID
+		statusBytes, err := json.Marshal(stored)
+		if err != nil {
+			return map[string]string{}, err
+		}
+		ret[clusterStatusAnnotationKey(clusterID)] = string(statusBytes)
+	}
+	for name, usage := range m.usageMap {
+		usageBytes, err := json.Marshal(usage)
+		if err != nil {
+			return map[string]string{}, err
+		}
+		ret[usageAnnotationKey(name)] = string(usageBytes)
+	}
 	return ret, nil
 }
@@ -2,6 +2,7 @@ package leases
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
 	"time"
 
@@ -122,3 +123,356 @@ func TestToAnnotations(t *testing.T) {
 		i++
 	}
 }
+
+func TestClusterStatusRoundTrip(t *testing.T) {
+	m, err := ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	assert.Equal(t, m.ClusterStatus("cluster1"), ClusterStatus{}, "status of unknown cluster")
+
+	leased := time.Now().Add(-2 * time.Hour)
+	released := time.Now().Add(-1 * time.Hour)
+	m.MarkLeased("cluster1", leased)
+	m.MarkReleased("cluster1", released)
+	m.MarkCleaned("cluster1", released)
+	m.MarkHeld("cluster1", "ci", "pipeline-1")
+	assert.True(t, m.CreateLease(uuid.NewUUID(), NewLease("cluster2", time.Now().Add(1*time.Hour))), "failed to create a new lease")
+
+	annos, err := m.ToAnnotations()
+	assert.NoErr(t, err)
+	assert.Equal(t, len(annos), 2, "number of annotations")
+
+	parsed, err := ParseMapFromAnnotations(annos)
+	assert.NoErr(t, err)
+	status := parsed.ClusterStatus("cluster1")
+	assert.Equal(t, status.LastLeasedTime().Format(TimeFormat), leased.Format(TimeFormat), "last leased time")
+	assert.Equal(t, status.LastCleanedTime().Format(TimeFormat), released.Format(TimeFormat), "last cleaned time")
+	assert.Equal(t, status.LastUsedTime().Format(TimeFormat), released.Format(TimeFormat), "last used time")
+	assert.Equal(t, status.LastHolder, "ci", "last holder")
+	assert.Equal(t, status.AffinityKey, "pipeline-1", "affinity key")
+	_, found := parsed.LeaseByClusterName("cluster2")
+	assert.True(t, found, "lease for cluster2 not found after round trip")
+	_, found = parsed.LeaseByClusterName("cluster1")
+	assert.False(t, found, "cluster status was parsed as a lease")
+}
+
+func TestScaledDownRoundTrip(t *testing.T) {
+	m, err := ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	scaledDown := time.Now().Add(-1 * time.Hour)
+	m.MarkScaledDown("cluster1", scaledDown, map[string]int64{"default-pool": 3})
+
+	annos, err := m.ToAnnotations()
+	assert.NoErr(t, err)
+	parsed, err := ParseMapFromAnnotations(annos)
+	assert.NoErr(t, err)
+	status := parsed.ClusterStatus("cluster1")
+	assert.True(t, status.IsScaledDown(), "cluster1 isn't scaled down after round trip")
+	assert.Equal(t, status.ScaledDownTime().Format(TimeFormat), scaledDown.Format(TimeFormat), "scaled down time")
+	assert.Equal(t, status.NodePoolSizes, map[string]int64{"default-pool": 3}, "node pool sizes")
+
+	parsed.MarkRestored("cluster1")
+	parsed.MarkRestored("cluster2")
+	assert.False(t, parsed.ClusterStatus("cluster1").IsScaledDown(), "cluster1 is still scaled down")
+	assert.Equal(t, len(parsed.ClusterStatus("cluster1").NodePoolSizes), 0, "number of node pool sizes")
+	assert.Equal(t, parsed.ClusterStatus("cluster2"), ClusterStatus{}, "status of unknown cluster")
+}
+
+func TestRecyclingRoundTrip(t *testing.T) {
+	m, err := ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	m.MarkRecycling("cluster1", RecycleDeleting, time.Now())
+	m.MarkRecycleFailed("cluster2", time.Now(), "quota exceeded")
+
+	annos, err := m.ToAnnotations()
+	assert.NoErr(t, err)
+	parsed, err := ParseMapFromAnnotations(annos)
+	assert.NoErr(t, err)
+	assert.True(t, parsed.ClusterStatus("cluster1").IsRecycling(), "cluster1 isn't recycling after round trip")
+	assert.Equal(t, parsed.ClusterStatus("cluster1").Recycling, RecycleDeleting, "cluster1 recycle phase")
+	assert.Equal(t, parsed.ClusterStatus("cluster2").Recycling, RecycleFailed, "cluster2 recycle phase")
+	assert.Equal(t, parsed.ClusterStatus("cluster2").RecycleError, "quota exceeded", "cluster2 recycle error")
+
+	parsed.MarkRecycled("cluster1")
+	assert.False(t, parsed.ClusterStatus("cluster1").IsRecycling(), "cluster1 is still recycling")
+	assert.Equal(t, parsed.ClusterStatus("cluster1").RecycleUpdated, "", "cluster1 recycle update time")
+}
+
+func TestUpgradeRoundTrip(t *testing.T) {
+	m, err := ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	started := time.Now()
+	m.MarkUpgrading("cluster1", "1.7.8-gke.0", started)
+	m.MarkUpgradeFailed("cluster2", "1.7.8-gke.0", "node pool upgrade timed out")
+
+	annos, err := m.ToAnnotations()
+	assert.NoErr(t, err)
+	parsed, err := ParseMapFromAnnotations(annos)
+	assert.NoErr(t, err)
+	status := parsed.ClusterStatus("cluster1")
+	assert.True(t, status.IsUpgrading(), "cluster1 isn't upgrading after round trip")
+	assert.Equal(t, status.Upgrading, "1.7.8-gke.0", "cluster1 upgrade version")
+	assert.Equal(t, status.UpgradeStartedTime().Format(TimeFormat), started.Format(TimeFormat), "cluster1 upgrade start time")
+	status = parsed.ClusterStatus("cluster2")
+	assert.False(t, status.IsUpgrading(), "cluster2 is upgrading")
+	assert.Equal(t, status.UpgradeFailed, "1.7.8-gke.0", "cluster2 failed upgrade version")
+	assert.Equal(t, status.UpgradeError, "node pool upgrade timed out", "cluster2 upgrade error")
+
+	parsed.MarkUpgraded("cluster1")
+	parsed.MarkUpgraded("cluster2")
+	assert.False(t, parsed.ClusterStatus("cluster1").IsUpgrading(), "cluster1 is still upgrading")
+	assert.Equal(t, parsed.ClusterStatus("cluster2").UpgradeFailed, "", "cluster2 failed upgrade version")
+}
+
+func TestProviderQualifiedClusterIDs(t *testing.T) {
+	m, err := ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	gkeLease := NewLease("cluster1", time.Now().Add(1*time.Hour))
+	gkeLease.Provider = ProviderGoogle
+	azureLease := NewLease("cluster1", time.Now().Add(1*time.Hour))
+	azureLease.Provider = ProviderAzure
+	assert.True(t, m.CreateLease(uuid.NewUUID(), gkeLease), "failed to create the GKE lease")
+	// clusters with the same name in different providers don't block each other
+	assert.True(t, m.CreateLease(uuid.NewUUID(), azureLease), "failed to create the Azure lease")
+	m.MarkLeased(gkeLease.ClusterID(), time.Now())
+	m.MarkUnhealthy("google/proj1/zone1/cluster2", time.Now(), "node is not ready")
+
+	annos, err := m.ToAnnotations()
+	assert.NoErr(t, err)
+	_, found := annos[clusterStatusAnnotationKey("google/cluster1")]
+	assert.True(t, found, "status annotation for google/cluster1 not found")
+	parsed, err := ParseMapFromAnnotations(annos)
+	assert.NoErr(t, err)
+	lease, found := parsed.LeaseByClusterName("azure/cluster1")
+	assert.True(t, found, "lease for azure/cluster1 not found after round trip")
+	assert.Equal(t, lease.Provider, ProviderAzure, "lease provider")
+	assert.False(t, parsed.ClusterStatus("google/cluster1").LastLeasedTime().IsZero(), "google/cluster1 wasn't leased")
+	assert.True(t, parsed.ClusterStatus("azure/cluster1").LastLeasedTime().IsZero(), "azure/cluster1 was leased")
+	assert.Equal(t, parsed.ClusterStatus("google/proj1/zone1/cluster2").UnhealthyReason, "node is not ready", "unhealthy reason")
+}
+
+func TestLegacyClusterIDs(t *testing.T) {
+	m, err := ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	assert.True(t, m.CreateLease(uuid.NewUUID(), NewLease("cluster1", time.Now().Add(1*time.Hour))), "failed to create the legacy lease")
+	m.MarkScaledDown("cluster2", time.Now(), map[string]int64{"default-pool": 3})
+
+	// leases and statuses recorded under the bare name are found by the qualified ID
+	_, found := m.LeaseByClusterName("google/cluster1")
+	assert.True(t, found, "legacy lease for cluster1 not found")
+	lease := NewLease("cluster1", time.Now().Add(1*time.Hour))
+	lease.Provider = ProviderGoogle
+	assert.False(t, m.CreateLease(uuid.NewUUID(), lease), "created a lease for a cluster with a legacy lease")
+	assert.True(t, m.ClusterStatus("google/cluster2").IsScaledDown(), "legacy status for cluster2 not found")
+
+	// and move to the qualified ID when they're updated
+	m.MarkRestored("google/cluster2")
+	annos, err := m.ToAnnotations()
+	assert.NoErr(t, err)
+	_, found = annos[clusterStatusAnnotationKey("cluster2")]
+	assert.False(t, found, "legacy status annotation for cluster2 wasn't removed")
+	_, found = annos[clusterStatusAnnotationKey("google/cluster2")]
+	assert.True(t, found, "status annotation for google/cluster2 not found")
+}
+
+func TestLegacyGKEClusterIDs(t *testing.T) {
+	m, err := ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	lease := NewLease("cluster1", time.Now().Add(1*time.Hour))
+	lease.Provider = ProviderGoogle
+	assert.True(t, m.CreateLease(uuid.NewUUID(), lease), "failed to create the legacy lease")
+	m.MarkScaledDown("cluster2", time.Now(), map[string]int64{"default-pool": 3})
+
+	// GKE leases and statuses recorded under the bare name are found by the qualified ID
+	_, found := m.LeaseByClusterName("google/proj1/zone1/cluster1")
+	assert.True(t, found, "legacy lease for cluster1 not found")
+	assert.True(t, m.ClusterStatus("google/proj1/zone1/cluster2").IsScaledDown(), "legacy status for cluster2 not found")
+	// but not those of other providers
+	_, found = m.LeaseByClusterName("azure/proj1/zone1/cluster1")
+	assert.False(t, found, "legacy GKE lease found by an Azure ID")
+
+	m.MarkRestored("google/proj1/zone1/cluster2")
+	annos, err := m.ToAnnotations()
+	assert.NoErr(t, err)
+	_, found = annos[clusterStatusAnnotationKey("cluster2")]
+	assert.False(t, found, "legacy status annotation for cluster2 wasn't removed")
+}
+
+func TestQualifiedClusterNameStatus(t *testing.T) {
+	m, err := ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	clusterID := "google/a-long-project-name-1234/europe-west1-b/a-cluster-name-that-is-forty-chars-long"
+	m.MarkUnhealthy(clusterID, time.Now(), "node is not ready")
+
+	annos, err := m.ToAnnotations()
+	assert.NoErr(t, err)
+	assert.Equal(t, len(annos), 1, "number of annotations")
+	for key := range annos {
+		name := strings.TrimPrefix(key, ClusterStatusAnnotationPrefix)
+		assert.True(t, len(name) <= 63, "annotation key name %s is longer than 63 characters", name)
+		assert.False(t, strings.Contains(name, "/"), "annotation key name %s contains a slash", name)
+	}
+	parsed, err := ParseMapFromAnnotations(annos)
+	assert.NoErr(t, err)
+	assert.Equal(t, parsed.ClusterStatus(clusterID).UnhealthyReason, "node is not ready", "unhealthy reason")
+	assert.Equal(t, parsed.ClusterStatus(clusterID).ClusterID, "", "cluster ID of the parsed status")
+}
+
+func TestLegacyClusterStatusAnnotationKeys(t *testing.T) {
+	// older versions derived the key from the cluster ID, and didn't store the ID in the status
+	annos := map[string]string{
+		ClusterStatusAnnotationPrefix + "google.proj1.zone1.cluster1": `{"unhealthy_reason":"node is not ready"}`,
+		ClusterStatusAnnotationPrefix + "cluster2":                    `{"scaled_down":"2017-01-01T00:00:00Z"}`,
+	}
+	m, err := ParseMapFromAnnotations(annos)
+	assert.NoErr(t, err)
+	assert.Equal(t, m.ClusterStatus("google/proj1/zone1/cluster1").UnhealthyReason, "node is not ready", "unhealthy reason")
+	assert.True(t, m.ClusterStatus("cluster2").IsScaledDown(), "legacy status for cluster2 not found")
+
+	saved, err := m.ToAnnotations()
+	assert.NoErr(t, err)
+	_, found := saved[clusterStatusAnnotationKey("google/proj1/zone1/cluster1")]
+	assert.True(t, found, "status of google/proj1/zone1/cluster1 isn't saved under the hashed key")
+}
+
+func TestCountCreatedBy(t *testing.T) {
+	m, err := ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	now := time.Now()
+	for i, l := range []*Lease{
+		{ClusterName: "cluster1", CreatedBy: "ci"},
+		{ClusterName: "cluster2", CreatedBy: "ci"},
+		{ClusterName: "cluster3", CreatedBy: "dev@example.com"},
+	} {
+		l.LeaseExpirationTime = now.Add(time.Hour).Format(TimeFormat)
+		if i == 1 {
+			l.LeaseExpirationTime = now.Add(-time.Hour).Format(TimeFormat)
+		}
+		assert.True(t, m.CreateLease(uuid.NewRandom(), l), "failed to create the lease for %s", l.ClusterName)
+	}
+	assert.Equal(t, m.CountCreatedBy("ci", now), 1, "leases created by ci")
+	assert.Equal(t, m.CountCreatedBy("dev@example.com", now), 1, "leases created by dev@example.com")
+	assert.Equal(t, m.CountCreatedBy("ops", now), 0, "leases created by ops")
+}
+
+func TestUsageRoundTrip(t *testing.T) {
+	m, err := ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	now := time.Date(2017, 11, 8, 12, 0, 0, 0, time.UTC)
+	old := uuid.NewRandom()
+	released := uuid.NewRandom()
+	active := uuid.NewRandom()
+	m.RecordUsage("oidc:dev@example.com", old, now.Add(-9*24*time.Hour), now.Add(-9*24*time.Hour+time.Hour))
+	m.RecordUsage("oidc:dev@example.com", released, now.Add(-2*time.Hour), now.Add(2*time.Hour))
+	m.RecordUsage("oidc:dev@example.com", active, now, now.Add(3*time.Hour))
+	m.RecordUsage("", uuid.NewRandom(), now, now.Add(time.Hour))
+	m.EndUsage("oidc:dev@example.com", released, now.Add(-time.Hour))
+	// leases that already ended don't end again
+	m.EndUsage("oidc:dev@example.com", released, now)
+
+	annos, err := m.ToAnnotations()
+	assert.NoErr(t, err)
+	for key := range annos {
+		assert.False(t, strings.Contains(key, "@"), "the identity is in annotation key %s", key)
+	}
+	parsed, err := ParseMapFromAnnotations(annos)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(parsed.Usages(now)), 1, "number of usage ledgers")
+	usage := parsed.Usage("oidc:dev@example.com")
+	assert.Equal(t, usage.Identity, "oidc:dev@example.com", "identity")
+	// the entry that started more than a week ago was dropped
+	assert.Equal(t, len(usage.Leases), 2, "number of ledger entries")
+	assert.Equal(t, usage.Leases[0].Token, released.String(), "released lease token")
+	assert.Equal(t, usage.Leases[0].Duration(), time.Hour, "released lease duration")
+	assert.Equal(t, usage.Used(now.Add(-24*time.Hour), now.Add(24*time.Hour)), 4*time.Hour, "used time")
+	assert.Equal(t, usage.Used(now, now.Add(24*time.Hour)), 3*time.Hour, "used time since now")
+	assert.Equal(t, len(parsed.Usage("token:ops").Leases), 0, "number of ledger entries of ops")
+}
+
+func TestUsagePruning(t *testing.T) {
+	m, err := ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	now := time.Date(2017, 11, 8, 12, 0, 0, 0, time.UTC)
+	m.RecordUsage("oidc:gone@example.com", uuid.NewRandom(), now.Add(-9*24*time.Hour), now.Add(-9*24*time.Hour+time.Hour))
+	m.RecordUsage("oidc:idle@example.com", uuid.NewRandom(), now.Add(-7*24*time.Hour-time.Hour), now.Add(-7*24*time.Hour))
+	// ledgers are only reported if their identity created a lease in the last week
+	assert.Equal(t, len(m.Usages(now)), 0, "number of reported usage ledgers")
+	assert.Equal(t, len(m.Usages(now.Add(-2*24*time.Hour))), 1, "number of usage ledgers reported two days ago")
+
+	// and dropped once none of their leases counts against any quota
+	m.RecordUsage("oidc:dev@example.com", uuid.NewRandom(), now, now.Add(time.Hour))
+	annos, err := m.ToAnnotations()
+	assert.NoErr(t, err)
+	parsed, err := ParseMapFromAnnotations(annos)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(parsed.Usage("oidc:gone@example.com").Leases), 0, "number of ledger entries of gone")
+	assert.Equal(t, len(parsed.Usage("oidc:idle@example.com").Leases), 1, "number of ledger entries of idle")
+	usages := parsed.Usages(now)
+	assert.Equal(t, len(usages), 1, "number of reported usage ledgers")
+	assert.Equal(t, usages[0].Identity, "oidc:dev@example.com", "identity")
+	ledgers := 0
+	for key := range annos {
+		if isUsageAnnotationKey(key) {
+			ledgers++
+		}
+	}
+	assert.Equal(t, ledgers, 2, "number of usage ledger annotations")
+}
+
+func TestUsageUnqualifiedLedgers(t *testing.T) {
+	now := time.Date(2017, 11, 8, 12, 0, 0, 0, time.UTC)
+	entries := []UsageEntry{{Token: uuid.NewRandom().String(), Start: now.Format(TimeFormat), End: now.Add(time.Hour).Format(TimeFormat)}}
+	annos := make(map[string]string)
+	for _, name := range []string{"ci", "token:ci"} {
+		usageBytes, err := json.Marshal(Usage{Identity: name, Leases: entries})
+		assert.NoErr(t, err)
+		annos[usageAnnotationKey(name)] = string(usageBytes)
+	}
+
+	// ledgers of bare names, which an API token and an ID token holder could share, aren't charged
+	// to either of them
+	m, err := ParseMapFromAnnotations(annos)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(m.Usage("ci").Leases), 0, "number of ledger entries of ci")
+	assert.Equal(t, len(m.Usage("oidc:ci").Leases), 0, "number of ledger entries of oidc:ci")
+	assert.Equal(t, len(m.Usage("token:ci").Leases), 1, "number of ledger entries of token:ci")
+	m.RecordUsage("ci", uuid.NewRandom(), now, now.Add(time.Hour))
+	assert.Equal(t, len(m.Usages(now)), 1, "number of usage ledgers")
+
+	// and they're dropped when the map is saved
+	saved, err := m.ToAnnotations()
+	assert.NoErr(t, err)
+	_, ok := saved[usageAnnotationKey("ci")]
+	assert.False(t, ok, "the ledger of a bare name was saved")
+	_, ok = saved[usageAnnotationKey("token:ci")]
+	assert.True(t, ok, "the ledger of token:ci wasn't saved")
+}
+
+func TestUnrevokedServiceAccounts(t *testing.T) {
+	m, err := ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	m.MarkUnrevoked("google/cluster1", "kube-system/sa1")
+	m.MarkUnrevoked("google/cluster1", "kube-system/sa1")
+	m.MarkUnrevoked("google/cluster1", "kube-system/sa2")
+	m.MarkUnrevoked("azure/cluster2", "kube-system/sa3")
+	annos, err := m.ToAnnotations()
+	assert.NoErr(t, err)
+	parsed, err := ParseMapFromAnnotations(annos)
+	assert.NoErr(t, err)
+	assert.Equal(t, parsed.UnrevokedClusterIDs(), []string{"azure/cluster2", "google/cluster1"}, "unrevoked cluster IDs")
+	assert.Equal(t, parsed.ClusterStatus("google/cluster1").UnrevokedServiceAccounts, []string{"kube-system/sa1", "kube-system/sa2"}, "unrevoked service accounts")
+
+	parsed.MarkRevoked("google/cluster1", "kube-system/sa1")
+	parsed.MarkRevoked("azure/cluster2", "kube-system/sa3")
+	parsed.MarkRevoked("azure/cluster3", "kube-system/sa4")
+	assert.Equal(t, parsed.UnrevokedClusterIDs(), []string{"google/cluster1"}, "unrevoked cluster IDs")
+	assert.Equal(t, parsed.ClusterStatus("google/cluster1").UnrevokedServiceAccounts, []string{"kube-system/sa2"}, "unrevoked service accounts")
+
+	token := uuid.NewRandom()
+	lease := NewLease("cluster1", time.Now())
+	lease.ServiceAccount = "kube-system/sa5"
+	parsed.CreateLease(token, lease)
+	parsed.MarkLeaseRevoked(token, "kube-system/sa6")
+	assert.Equal(t, lease.ServiceAccount, "kube-system/sa5", "service account after revoking another one")
+	parsed.MarkLeaseRevoked(token, "kube-system/sa5")
+	assert.Equal(t, lease.ServiceAccount, "", "service account after revoking it")
+}
@@ -0,0 +1,68 @@
+package leases
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+)
+
+const (
+	secretBytes = 32
+	saltBytes   = 16
+	// saltSeparator separates the salt from the hash in a salted hash
+	saltSeparator = ":"
+)
+
+// NewSecret creates a new random secret, such as the secret of a lease or the bearer token of its
+// API proxy. Returns the secret and its salted hash, which is what leases record
+func NewSecret() (string, string, error) {
+	secret, err := randomHex(secretBytes)
+	if err != nil {
+		return "", "", err
+	}
+	salt, err := randomHex(saltBytes)
+	if err != nil {
+		return "", "", err
+	}
+	return secret, salt + saltSeparator + hashSecret(salt, secret), nil
+}
+
+// SecretMatches returns true if secret is the secret of l. Leases created before leases had
+// secrets have none, so nothing matches them
+func (l Lease) SecretMatches(secret string) bool {
+	return secretMatches(l.SecretHash, secret)
+}
+
+// ProxyTokenMatches returns true if l has an API proxy and token is its bearer token
+func (l Lease) ProxyTokenMatches(token string) bool {
+	return secretMatches(l.ProxyTokenHash, token)
+}
+
+// secretMatches returns true if secret hashes to saltedHash. The hashes are compared in constant
+// time
+func secretMatches(saltedHash, secret string) bool {
+	if saltedHash == "" || secret == "" {
+		return false
+	}
+	i := strings.Index(saltedHash, saltSeparator)
+	if i < 0 {
+		return false
+	}
+	salt, hash := saltedHash[:i], saltedHash[i+len(saltSeparator):]
+	return subtle.ConstantTimeCompare([]byte(hashSecret(salt, secret)), []byte(hash)) == 1
+}
+
+func hashSecret(salt, secret string) string {
+	sum := sha256.Sum256([]byte(salt + secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
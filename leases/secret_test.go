@@ -0,0 +1,38 @@
+package leases
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+)
+
+func TestNewSecret(t *testing.T) {
+	secret, hash, err := NewSecret()
+	assert.NoErr(t, err)
+	assert.Equal(t, len(secret), 2*secretBytes, "secret length")
+	assert.False(t, strings.Contains(hash, secret), "the hash holds the secret")
+	other, otherHash, err := NewSecret()
+	assert.NoErr(t, err)
+	assert.False(t, secret == other, "secrets aren't random")
+	assert.False(t, hash[:2*saltBytes] == otherHash[:2*saltBytes], "salts aren't random")
+}
+
+func TestSecretMatches(t *testing.T) {
+	secret, hash, err := NewSecret()
+	assert.NoErr(t, err)
+	other, _, err := NewSecret()
+	assert.NoErr(t, err)
+
+	l := NewLease(clusterName, time.Now())
+	assert.False(t, l.SecretMatches(secret), "lease without a secret matched")
+	l.SecretHash = hash
+	assert.True(t, l.SecretMatches(secret), "secret didn't match")
+	assert.False(t, l.SecretMatches(other), "other secret matched")
+	assert.False(t, l.SecretMatches(""), "empty secret matched")
+	assert.False(t, l.SecretMatches(hash), "hash matched")
+	l.SecretHash = hash[2*saltBytes+len(saltSeparator):]
+	assert.False(t, l.SecretMatches(secret), "secret matched a hash without its salt")
+	assert.False(t, l.ProxyTokenMatches(secret), "lease without an API proxy matched")
+}
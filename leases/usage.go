@@ -0,0 +1,110 @@
+package leases
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+const (
+	// UsageAnnotationPrefix is the prefix of the k8s annotation keys that hold the usage ledgers of
+	// identities. Identity IDs can hold characters that annotation keys can't, so the rest of the
+	// key is a hash of the ID, and the ledger holds the ID itself
+	UsageAnnotationPrefix = "usage.k8s-claimer.deis.io/"
+
+	// usageRetention is how long the entries of usage ledgers are kept after their leases started.
+	// It's longer than the longest quota window, a week
+	usageRetention = 8 * 24 * time.Hour
+	// usageReportAge is how recently an identity must have created a lease for its usage ledger to
+	// be reported. It's the length of the longest quota window
+	usageReportAge = 7 * 24 * time.Hour
+)
+
+// UsageEntry is the json-encodable record of the cluster time that one lease was held for. End
+// is the lease's expiration time until it's released, and the time it was released afterwards
+type UsageEntry struct {
+	Token string `json:"token"`
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// Duration returns how long the lease of e was held for. Returns 0 if e's times are malformed
+func (e UsageEntry) Duration() time.Duration {
+	start, err := time.Parse(TimeFormat, e.Start)
+	if err != nil {
+		return 0
+	}
+	end, err := time.Parse(TimeFormat, e.End)
+	if err != nil || end.Before(start) {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+// Usage is the json-encodable ledger of the leases that one identity created in the last week.
+// It's stored in one annotation per identity, next to the lease annotations. Identity is the
+// identity's ID, such as token:ci or oidc:dev@example.com
+type Usage struct {
+	Identity string       `json:"identity"`
+	Leases   []UsageEntry `json:"leases"`
+}
+
+// ParseUsage decodes usageStr from json into a Usage structure. Returns nil and any decoding error
+// if there was one, and a valid ledger and nil otherwise
+func ParseUsage(usageStr string) (*Usage, error) {
+	u := new(Usage)
+	if err := json.Unmarshal([]byte(usageStr), u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Used returns how long the leases in u that started at or after from and before to were held
+// for. Leases that haven't been released yet count for the whole time they were requested for
+func (u Usage) Used(from, to time.Time) time.Duration {
+	var used time.Duration
+	for _, entry := range u.Leases {
+		start, err := time.Parse(TimeFormat, entry.Start)
+		if err != nil || start.Before(from) || !start.Before(to) {
+			continue
+		}
+		used += entry.Duration()
+	}
+	return used
+}
+
+// startedAfter returns true if a lease in u started after t
+func (u Usage) startedAfter(t time.Time) bool {
+	for _, entry := range u.Leases {
+		if start, err := time.Parse(TimeFormat, entry.Start); err == nil && start.After(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// prune drops the entries of u whose leases started at or before cutoff, or whose start is
+// malformed
+func (u *Usage) prune(cutoff time.Time) {
+	kept := u.Leases[:0]
+	for _, entry := range u.Leases {
+		if start, err := time.Parse(TimeFormat, entry.Start); err == nil && start.After(cutoff) {
+			kept = append(kept, entry)
+		}
+	}
+	u.Leases = kept
+}
+
+// usageAnnotationKey returns the annotation key that holds the usage ledger of the identity whose
+// ID is name
+func usageAnnotationKey(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return UsageAnnotationPrefix + hex.EncodeToString(sum[:16])
+}
+
+// isUsageAnnotationKey returns true if key is a usage ledger annotation key
+func isUsageAnnotationKey(key string) bool {
+	return strings.HasPrefix(key, UsageAnnotationPrefix)
+}
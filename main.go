@@ -1,15 +1,26 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/deis/k8s-claimer/auth"
 	"github.com/deis/k8s-claimer/handlers"
 	"github.com/deis/k8s-claimer/htp"
 	"github.com/deis/k8s-claimer/k8s"
+	"github.com/deis/k8s-claimer/leases"
+	"github.com/deis/k8s-claimer/policy"
 	"github.com/deis/k8s-claimer/providers/azure"
 	"github.com/deis/k8s-claimer/providers/gke"
+	"github.com/deis/k8s-claimer/proxy"
+	"github.com/deis/k8s-claimer/quota"
+	"github.com/deis/k8s-claimer/selection"
+	container "google.golang.org/api/container/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
@@ -20,9 +31,19 @@ const (
 )
 
 var (
-	errNilConfig = errors.New("nil config")
+	errNilConfig          = errors.New("nil config")
+	errNoAuthenticators   = errors.New("AUTH_TOKEN, AUTH_TOKENS_FILE or OIDC_ISSUER_URL must be set")
+	errInvalidDefaultRole = errors.New("OIDC_DEFAULT_ROLE must be empty or one of the roles")
 )
 
+type errProviderNotConfigured struct {
+	provider string
+}
+
+func (e errProviderNotConfigured) Error() string {
+	return "the " + e.provider + " provider isn't configured"
+}
+
 func kubeNamespacesFromConfig() func(*k8s.KubeConfig) (k8s.NamespaceListerDeleter, error) {
 	return func(conf *k8s.KubeConfig) (k8s.NamespaceListerDeleter, error) {
 		if conf == nil {
@@ -36,12 +57,31 @@ func kubeNamespacesFromConfig() func(*k8s.KubeConfig) (k8s.NamespaceListerDelete
 	}
 }
 
-func configureRoutesWithAuth(serveMux *http.ServeMux, createLeaseHandler http.Handler, deleteLeaseHandler http.Handler, authToken string) {
+func configureRoutesWithAuth(serveMux *http.ServeMux, createLeaseHandler http.Handler, deleteLeaseHandler http.Handler, authn auth.Authenticator) {
 	createLeaseHandler = htp.MethodMux(map[htp.Method]http.Handler{htp.Post: createLeaseHandler})
 	deleteLeaseHandler = htp.MethodMux(map[htp.Method]http.Handler{htp.Delete: deleteLeaseHandler})
 
-	serveMux.Handle("/lease", handlers.WithAuth(authToken, authTokenKey, createLeaseHandler))
-	serveMux.Handle("/lease/", handlers.WithAuth(authToken, authTokenKey, deleteLeaseHandler))
+	serveMux.Handle("/lease", handlers.WithAuth(authn, auth.RoleUser, authTokenKey, createLeaseHandler))
+	serveMux.Handle("/lease/", handlers.WithAuth(authn, auth.RoleUser, authTokenKey, deleteLeaseHandler))
+}
+
+// reloadPolicyOnHangup reloads policies whenever the process gets a SIGHUP, so that a changed
+// policy can be loaded without waiting for it to be reloaded
+func reloadPolicyOnHangup(policies *policy.File) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		reloaded, err := policies.Reload()
+		if err != nil {
+			log.Printf("Error reloading the policy, the previous policy is kept (%s)", err)
+			continue
+		}
+		if reloaded {
+			log.Println("Reloaded the policy")
+		} else {
+			log.Println("The policy didn't change, so it wasn't reloaded")
+		}
+	}
 }
 
 //CreateHealthzHandler returns an http.Handler
@@ -57,22 +97,176 @@ func main() {
 		log.Fatalf("Error getting server config (%s)", err)
 	}
 	serverConf.Print()
+	oidcConfig, err := parseOIDCConfig(appName)
+	if err != nil {
+		log.Fatalf("Error getting OIDC config (%s)", err)
+	}
+	oidcConfig.Print()
+	if err := oidcConfig.Validate(); err != nil {
+		log.Fatalf("Invalid OIDC config (%s)", err)
+	}
+	authn, err := parseAuthenticator(serverConf, oidcConfig)
+	if err != nil {
+		log.Fatalf("Error setting up authentication (%s)", err)
+	}
+	if _, err := selection.ByName(serverConf.SelectionStrategy); err != nil {
+		log.Fatalf("Error getting the default selection strategy (%s)", err)
+	}
 	googleConfig, err := parseGoogleConfig(appName)
 	if err != nil {
 		log.Fatalf("Error getting google cloud config (%s) -- %+v", err, googleConfig)
 	}
+	gkeScopes, err := googleConfig.ClusterScopes()
+	if err != nil {
+		log.Fatalf("Invalid GOOGLE_CLOUD_SCOPES (%s)", err)
+	}
+	gkePrimaryScope := googleConfig.PrimaryScope()
 
 	azureConfig, err := parseAzureConfig(appName)
 	if err != nil {
 		log.Fatalf("Error getting azure config (%s) -- %+v", err, azureConfig)
 	}
+	if azureConfig.ValidConfig() {
+		if _, err := azureConfig.CloudEnvironment(); err != nil {
+			log.Fatalf("Invalid AZURE_ENVIRONMENT (%s)", err)
+		}
+	}
 
-	containerService, err := gke.GetContainerService(googleConfig.AccountFile.ClientEmail, gke.PrivateKey(googleConfig.AccountFile.PrivateKey))
+	// GKE is left out, rather than failing startup, if no project to lease clusters from is set
+	gkeEnabled := googleConfig.ValidConfig()
+	var containerService *container.Service
+	var gkeClusterLister gke.ClusterLister
+	if gkeEnabled {
+		containerService, err = gke.NewContainerService(context.Background(), googleConfig)
+		if err != nil {
+			log.Fatalf("Error creating GKE client (%s)", err)
+		}
+		gkeClusterLister = gke.NewGKEClusterLister(containerService)
+	} else {
+		log.Println("GKE isn't configured, GKE clusters won't be leased")
+	}
+	gkeProvisioningConfig, err := parseGKEProvisioningConfig(appName)
+	if err != nil {
+		log.Fatalf("Error getting GKE provisioning config (%s)", err)
+	}
+	// provisioned clusters carry the pool label, so that they can be leased
+	for key, val := range googleConfig.Membership().Labels() {
+		if gkeProvisioningConfig.Labels == nil {
+			gkeProvisioningConfig.Labels = make(map[string]string)
+		}
+		gkeProvisioningConfig.Labels[key] = val
+	}
+	gkeProvisioningConfig.Print()
+	if err := gkeProvisioningConfig.Validate(gkePrimaryScope.Location); err != nil {
+		log.Fatalf("Invalid GKE provisioning config (%s)", err)
+	}
+	var gkeProvisioner *gke.Provisioner
+	if gkeEnabled && gkeProvisioningConfig.Enabled {
+		gkeProvisioner = gke.NewProvisioner(
+			gke.NewGKEClusterCreator(containerService),
+			*gkeProvisioningConfig,
+			gkePrimaryScope.ProjectID,
+			gkePrimaryScope.Location,
+		)
+	}
+	gkePoolConfig, err := parseGKEPoolConfig(appName)
+	if err != nil {
+		log.Fatalf("Error getting GKE pool manager config (%s)", err)
+	}
+	gkePoolConfig.Print()
+	if err := gkePoolConfig.Validate(); err != nil {
+		log.Fatalf("Invalid GKE pool manager config (%s)", err)
+	}
+	gkeRecyclingConfig, err := parseGKERecyclingConfig(appName)
 	if err != nil {
-		log.Fatalf("Error creating GKE client (%s)", err)
+		log.Fatalf("Error getting GKE recycling config (%s)", err)
 	}
-	gkeClusterLister := gke.NewGKEClusterLister(containerService)
-	azureClusterLister := azure.NewAzureClusterLister(azureConfig)
+	gkeRecyclingConfig.Print()
+	if err := gkeRecyclingConfig.Validate(); err != nil {
+		log.Fatalf("Invalid GKE recycling config (%s)", err)
+	}
+	gkeUpgradesConfig, err := parseGKEUpgradesConfig(appName)
+	if err != nil {
+		log.Fatalf("Error getting GKE upgrade config (%s)", err)
+	}
+	gkeUpgradesConfig.Print()
+	if err := gkeUpgradesConfig.Validate(); err != nil {
+		log.Fatalf("Invalid GKE upgrade config (%s)", err)
+	}
+	var azureClusterLister azure.ClusterLister = azure.NewAzureClusterLister(azureConfig)
+	inventoryConfig, err := parseInventoryConfig(appName)
+	if err != nil {
+		log.Fatalf("Error getting inventory cache config (%s)", err)
+	}
+	inventoryConfig.Print()
+	if err := inventoryConfig.Validate(); err != nil {
+		log.Fatalf("Invalid inventory cache config (%s)", err)
+	}
+	if inventoryConfig.Enabled {
+		if gkeEnabled {
+			gkeInventory := gke.NewCachedClusterLister(gkeClusterLister, *inventoryConfig)
+			go gkeInventory.Run(nil)
+			gkeClusterLister = gkeInventory
+		}
+		azureInventory := azure.NewCachedClusterLister(azureClusterLister, *inventoryConfig)
+		go azureInventory.Run(nil)
+		azureClusterLister = azureInventory
+	}
+	azureVersions := azure.NewVersionCache(azure.NewAPIServerVersionFetcher())
+	leaseCredentialsConfig, err := parseLeaseCredentialsConfig(appName)
+	if err != nil {
+		log.Fatalf("Error getting lease credentials config (%s)", err)
+	}
+	leaseCredentialsConfig.Print()
+	if err := leaseCredentialsConfig.Validate(); err != nil {
+		log.Fatalf("Invalid lease credentials config (%s)", err)
+	}
+	leaseCredentials := k8s.NewLeaseCredentials(
+		leaseCredentialsConfig.Enabled,
+		leaseCredentialsConfig.Namespace,
+		leaseCredentialsConfig.WorkNamespaceNames(),
+		leaseCredentialsConfig.Timeout,
+	)
+	proxyConfig, err := parseProxyConfig(appName)
+	if err != nil {
+		log.Fatalf("Error getting API proxy config (%s)", err)
+	}
+	proxyConfig.Print()
+	if err := proxyConfig.Validate(); err != nil {
+		log.Fatalf("Invalid API proxy config (%s)", err)
+	}
+	var proxyActivity *proxy.Activity
+	var proxyTransports *proxy.Transports
+	if proxyConfig.Enabled {
+		proxyActivity = proxy.NewActivity()
+		proxyTransports = proxy.NewTransports()
+	}
+	policyConfig, err := parsePolicyConfig(appName)
+	if err != nil {
+		log.Fatalf("Error getting policy config (%s)", err)
+	}
+	policyConfig.Print()
+	if err := policyConfig.Validate(); err != nil {
+		log.Fatalf("Invalid policy config (%s)", err)
+	}
+	var policies *policy.File
+	if policyConfig.Enabled() {
+		policies, err = policy.NewFile(policyConfig.File, policyConfig.ReloadInterval)
+		if err != nil {
+			log.Fatalf("Error loading the policy (%s)", err)
+		}
+		go policies.Run(nil)
+		go reloadPolicyOnHangup(policies)
+	}
+	quotaConfig, err := parseQuotaConfig(appName)
+	if err != nil {
+		log.Fatalf("Error getting quota config (%s)", err)
+	}
+	quotaConfig.Print()
+	if err := quotaConfig.Validate(); err != nil {
+		log.Fatalf("Invalid quota config (%s)", err)
+	}
+	budget := quota.Budget{Daily: quotaConfig.DailyBudget, Weekly: quotaConfig.WeeklyBudget}
 
 	config, err := rest.InClusterConfig()
 	if err != nil {
@@ -83,15 +277,105 @@ func main() {
 		log.Fatalf("Error creating Kubernetes client (%s)", err)
 	}
 
+	var healthChecker k8s.HealthChecker
+	if serverConf.HealthCheck {
+		healthChecker, err = k8s.NewAPIServerHealthChecker(serverConf.RequiredPods)
+		if err != nil {
+			log.Fatalf("Error creating the cluster health checker (%s)", err)
+		}
+	}
+
 	services := k8sClient.Services(serverConf.Namespace)
+	var gkePoolManager *gke.PoolManager
+	if gkeEnabled && gkePoolConfig.Enabled {
+		computeService, err := gke.NewComputeService(context.Background(), googleConfig)
+		if err != nil {
+			log.Fatalf("Error creating Compute Engine client (%s)", err)
+		}
+		gkePoolManager = gke.NewPoolManager(
+			gkeClusterLister,
+			gke.NewGKENodePoolScaler(containerService, computeService),
+			services,
+			serverConf.ServiceName,
+			gkeScopes,
+			googleConfig.Membership(),
+			*gkePoolConfig,
+		)
+		go gkePoolManager.Run(nil)
+	}
+
+	var gkeRecycler *gke.Recycler
+	if gkeEnabled && gkeRecyclingConfig.Enabled() {
+		gkeRecycler, err = gke.NewRecycler(
+			gke.NewGKEClusterCreator(containerService),
+			gkeClusterLister,
+			services,
+			serverConf.ServiceName,
+			gkeScopes,
+			*gkeRecyclingConfig,
+		)
+		if err != nil {
+			log.Fatalf("Error creating the GKE cluster recycler (%s)", err)
+		}
+		// resumes the recycles that the last server process didn't finish
+		go gkeRecycler.Run(nil)
+	}
+
+	var gkeUpgrader *gke.Upgrader
+	if gkeEnabled && gkeUpgradesConfig.Enabled() {
+		gkeUpgrader, err = gke.NewUpgrader(
+			gkeClusterLister,
+			gke.NewGKEClusterUpdater(containerService),
+			services,
+			serverConf.ServiceName,
+			gkeScopes,
+			googleConfig.Membership(),
+			*gkeUpgradesConfig,
+		)
+		if err != nil {
+			log.Fatalf("Error creating the GKE cluster upgrader (%s)", err)
+		}
+		go gkeUpgrader.Run(nil)
+	}
+
+	// the credentials of ended leases are revoked whether or not new leases get any
+	credentialRevoker := k8s.NewCredentialRevoker(
+		leaseCredentials,
+		services,
+		serverConf.ServiceName,
+		func(ctx context.Context, lease *leases.Lease) (*k8s.KubeConfig, error) {
+			switch {
+			case lease.Provider == leases.ProviderGoogle && gkeEnabled:
+				return gke.AdminKubeConfig(ctx, lease, gkeClusterLister, gkeScopes)
+			case lease.Provider == leases.ProviderAzure && azureConfig.ValidConfig():
+				return azure.AdminKubeConfig(ctx, lease, azureClusterLister)
+			default:
+				return nil, errProviderNotConfigured{provider: lease.Provider}
+			}
+		},
+		leaseCredentialsConfig.RevokeInterval,
+	)
+	go credentialRevoker.Run(nil)
+
 	mux := http.NewServeMux()
 	createLeaseHandler := handlers.CreateLease(
 		services,
 		serverConf.ServiceName,
 		gkeClusterLister,
 		azureClusterLister,
+		azureVersions,
 		azureConfig,
 		googleConfig,
+		serverConf.SelectionStrategy,
+		healthChecker,
+		serverConf.HealthCheckBudget,
+		leaseCredentials,
+		proxyConfig.Enabled,
+		policies,
+		budget,
+		gkeProvisioner,
+		gkePoolManager,
+		gkeRecycler,
 	)
 	deleteLeaseHandler := handlers.DeleteLease(
 		services,
@@ -102,11 +386,59 @@ func main() {
 		googleConfig,
 		serverConf.ClearNamespaces,
 		kubeNamespacesFromConfig(),
+		leaseCredentials,
+		proxyActivity,
+		proxyTransports,
+		policies,
+		gkeRecycler,
 	)
 
 	mux.Handle("/healthz", CreateHealthzHandler())
 
-	configureRoutesWithAuth(mux, createLeaseHandler, deleteLeaseHandler, serverConf.AuthToken)
+	configureRoutesWithAuth(mux, createLeaseHandler, deleteLeaseHandler, authn)
+	poolStatusHandler := htp.MethodMux(map[htp.Method]http.Handler{htp.Get: handlers.PoolStatus(gkePoolManager)})
+	mux.Handle("/pool", handlers.WithAuth(authn, auth.RoleReadOnly, authTokenKey, poolStatusHandler))
+	upgradeStatusHandler := htp.MethodMux(map[htp.Method]http.Handler{htp.Get: handlers.UpgradeStatus(gkeUpgrader)})
+	mux.Handle("/upgrades", handlers.WithAuth(authn, auth.RoleReadOnly, authTokenKey, upgradeStatusHandler))
+	excludedClustersHandler := htp.MethodMux(map[htp.Method]http.Handler{
+		htp.Get: handlers.ExcludedClusters(gkeClusterLister, googleConfig, azureClusterLister, azureConfig),
+	})
+	mux.Handle("/excluded", handlers.WithAuth(authn, auth.RoleReadOnly, authTokenKey, excludedClustersHandler))
+	leaseCredentialHandler := htp.MethodMux(map[htp.Method]http.Handler{
+		htp.Get: handlers.LeaseCredential(
+			services,
+			serverConf.ServiceName,
+			gkeClusterLister,
+			azureClusterLister,
+			azureConfig,
+			googleConfig,
+			leaseCredentials,
+			leaseCredentialsConfig.ExecTTL,
+		),
+	})
+	mux.Handle("/credential/", handlers.WithAuth(authn, auth.RoleUser, authTokenKey, leaseCredentialHandler))
+	proxyActivityHandler := htp.MethodMux(map[htp.Method]http.Handler{
+		htp.Get: handlers.ProxyActivity(services, serverConf.ServiceName, proxyActivity),
+	})
+	mux.Handle("/activity", handlers.WithAuth(authn, auth.RoleReadOnly, authTokenKey, proxyActivityHandler))
+	quotaHandler := htp.MethodMux(map[htp.Method]http.Handler{
+		htp.Get: handlers.Quota(services, serverConf.ServiceName, budget),
+	})
+	mux.Handle("/quota", handlers.WithAuth(authn, auth.RoleReadOnly, authTokenKey, quotaHandler))
+	if proxyConfig.Enabled {
+		// the API proxy authenticates requests with the bearer tokens of leases instead of API tokens
+		mux.Handle("/proxy/", handlers.Proxy(
+			services,
+			serverConf.ServiceName,
+			gkeClusterLister,
+			azureClusterLister,
+			azureConfig,
+			googleConfig,
+			proxyTransports,
+			proxyActivity,
+			proxyConfig.FlushInterval,
+		))
+	}
 
 	log.Println("k8s claimer started!")
 	http.ListenAndServe(serverConf.HostStr(), mux)
@@ -8,6 +8,7 @@ import (
 	"testing"
 
 	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/auth"
 	"github.com/deis/k8s-claimer/k8s"
 )
 
@@ -72,9 +73,11 @@ func TestConfigureRoutes(t *testing.T) {
 		},
 	}
 
+	authTokens, err := auth.NewTokens([]auth.Token{{Name: "ci", Token: "auth token", Role: auth.RoleUser}})
+	assert.NoErr(t, err)
 	for _, testCase := range testCases {
 		mux := http.NewServeMux()
-		configureRoutesWithAuth(mux, testCase.postHandler, testCase.deleteHandler, "auth token")
+		configureRoutesWithAuth(mux, testCase.postHandler, testCase.deleteHandler, authTokens)
 		req, err := http.NewRequest(testCase.method, testCase.path, nil)
 		req.Header.Set("Authorization", "auth token")
 		assert.NoErr(t, err)
@@ -0,0 +1,89 @@
+package policy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"log"
+	"sync"
+	"time"
+)
+
+// File is a policy that's loaded from a file, and reloaded when the file changes, so that it can
+// be changed without restarting the server. A policy that can't be parsed isn't loaded, and the
+// policy that was loaded before it is kept
+type File struct {
+	path     string
+	interval time.Duration
+
+	mut    sync.RWMutex
+	policy *Policy
+	sum    []byte
+}
+
+// NewFile loads the policy in the file at path. Run reloads it every interval
+func NewFile(path string, interval time.Duration) (*File, error) {
+	f := &File{path: path, interval: interval}
+	if _, err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Policy returns the policy that was loaded last. A nil File has no policy, which allows
+// everything
+func (f *File) Policy() *Policy {
+	if f == nil {
+		return nil
+	}
+	f.mut.RLock()
+	defer f.mut.RUnlock()
+	return f.policy
+}
+
+// Reload loads the policy in the file again, if the file changed since it was loaded last. Returns
+// true if it was loaded
+func (f *File) Reload() (bool, error) {
+	b, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256(b)
+	f.mut.RLock()
+	unchanged := f.sum != nil && bytes.Equal(f.sum, sum[:])
+	f.mut.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	p, err := Parse(b)
+	if err != nil {
+		return false, err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.policy = p
+	f.sum = sum[:]
+	return true, nil
+}
+
+// Run reloads the policy every interval, until stopCh is closed. It logs the policy's errors, and
+// whenever it's reloaded
+func (f *File) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			reloaded, err := f.Reload()
+			if err != nil {
+				log.Printf("Error reloading the policy in %s, the previous policy is kept -- %s", f.path, err)
+				continue
+			}
+			if reloaded {
+				log.Printf("Reloaded the policy in %s", f.path)
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package policy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+)
+
+func TestFileReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8s-claimer-policy")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "policy.json")
+	assert.NoErr(t, ioutil.WriteFile(path, []byte(`{"rules": [{"name": "max-4h", "max_time": "4h"}]}`), 0600))
+
+	f, err := NewFile(path, time.Minute)
+	assert.NoErr(t, err)
+	assert.Equal(t, f.Policy().Rules[0].Name, "max-4h", "rule name")
+
+	reloaded, err := f.Reload()
+	assert.NoErr(t, err)
+	assert.False(t, reloaded, "an unchanged policy was reloaded")
+
+	assert.NoErr(t, ioutil.WriteFile(path, []byte(`{"rules": [{"name": "max-1h", "max_time": "1h"}]}`), 0600))
+	reloaded, err = f.Reload()
+	assert.NoErr(t, err)
+	assert.True(t, reloaded, "a changed policy wasn't reloaded")
+	assert.Equal(t, f.Policy().Rules[0].Name, "max-1h", "rule name")
+
+	// an invalid policy isn't loaded, and the previous one is kept
+	assert.NoErr(t, ioutil.WriteFile(path, []byte(`{"rules": [{"name": "max-1h", "max_time": "soon"}]}`), 0600))
+	_, err = f.Reload()
+	assert.True(t, err != nil, "an invalid policy was loaded")
+	assert.Equal(t, f.Policy().Rules[0].Name, "max-1h", "rule name")
+
+	_, err = NewFile(path, time.Minute)
+	assert.True(t, err != nil, "a file with an invalid policy was loaded")
+	var nilFile *File
+	assert.True(t, nilFile.Policy() == nil, "a nil file has a policy")
+}
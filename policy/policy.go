@@ -0,0 +1,221 @@
+// Package policy decides who may lease which clusters, for how long and how many at once, and
+// who may release which leases, according to rules in a policy file
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/deis/k8s-claimer/auth"
+	"github.com/deis/k8s-claimer/leases"
+)
+
+// Rule restricts what the identities it applies to may do. It applies to the identities whose ID,
+// such as token:ci or oidc:dev@example.com, is one of Identities and with one of Roles, and empty
+// lists match every identity. Every restriction that's set must be met:
+//
+//   - ClusterRegex: leased and released clusters' names must match it
+//   - Providers: leased and released clusters must be from one of these cloud providers
+//   - MaxTime: leases can't be requested for longer than this, such as 4h
+//   - MaxLeases: leases can't be created while this many leases created by the same identity are
+//     still active
+//   - OwnLeasesOnly: only leases created by the same identity can be released
+type Rule struct {
+	Name          string   `json:"name"`
+	Identities    []string `json:"identities"`
+	Roles         []string `json:"roles"`
+	ClusterRegex  string   `json:"cluster_regex"`
+	Providers     []string `json:"providers"`
+	MaxTime       string   `json:"max_time"`
+	MaxLeases     int      `json:"max_leases"`
+	OwnLeasesOnly bool     `json:"own_leases_only"`
+
+	clusterRegex *regexp.Regexp
+	maxTime      time.Duration
+}
+
+// ErrInvalidRule is the error returned when a rule of a policy can't be used
+type ErrInvalidRule struct {
+	name   string
+	reason string
+}
+
+// Error is the error interface implementation
+func (e ErrInvalidRule) Error() string {
+	return fmt.Sprintf("invalid policy rule %q (%s)", e.name, e.reason)
+}
+
+// ErrDenied is the error returned when a rule of a policy denies a request
+type ErrDenied struct {
+	Rule   string
+	Reason string
+}
+
+// Error is the error interface implementation
+func (e ErrDenied) Error() string {
+	return fmt.Sprintf("denied by policy rule %q: %s", e.Rule, e.Reason)
+}
+
+// Policy is a set of rules, all of which must allow a request
+type Policy struct {
+	Rules []*Rule `json:"rules"`
+}
+
+// Parse decodes the JSON policy in b, and checks that all of its rules are valid
+func Parse(b []byte) (*Policy, error) {
+	p := new(Policy)
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(p.Rules))
+	for _, rule := range p.Rules {
+		if err := rule.compile(); err != nil {
+			return nil, err
+		}
+		if names[rule.Name] {
+			return nil, ErrInvalidRule{name: rule.Name, reason: "another rule has the same name"}
+		}
+		names[rule.Name] = true
+	}
+	return p, nil
+}
+
+func (r *Rule) compile() error {
+	if r.Name == "" {
+		return ErrInvalidRule{name: r.Name, reason: "the name is empty"}
+	}
+	// an unqualified name could belong to an API token or to an ID token holder, and a rule that
+	// doesn't apply lifts its restrictions, so those are refused rather than guessed at
+	for _, id := range r.Identities {
+		if !auth.ValidID(id) {
+			return ErrInvalidRule{name: r.Name, reason: fmt.Sprintf("identity %q isn't qualified with token: or oidc:", id)}
+		}
+	}
+	for _, role := range r.Roles {
+		if !auth.Role(role).Valid() {
+			return ErrInvalidRule{name: r.Name, reason: fmt.Sprintf("unknown role %q", role)}
+		}
+	}
+	for _, provider := range r.Providers {
+		if provider != leases.ProviderGoogle && provider != leases.ProviderAzure {
+			return ErrInvalidRule{name: r.Name, reason: fmt.Sprintf("unknown provider %q", provider)}
+		}
+	}
+	if r.ClusterRegex != "" {
+		regex, err := regexp.Compile(r.ClusterRegex)
+		if err != nil {
+			return ErrInvalidRule{name: r.Name, reason: err.Error()}
+		}
+		r.clusterRegex = regex
+	}
+	if r.MaxTime != "" {
+		maxTime, err := time.ParseDuration(r.MaxTime)
+		if err != nil || maxTime <= 0 {
+			return ErrInvalidRule{name: r.Name, reason: fmt.Sprintf("max_time %q isn't a positive duration", r.MaxTime)}
+		}
+		r.maxTime = maxTime
+	}
+	if r.MaxLeases < 0 {
+		return ErrInvalidRule{name: r.Name, reason: "max_leases is negative"}
+	}
+	return nil
+}
+
+// appliesTo returns true if r restricts id
+func (r *Rule) appliesTo(id auth.Identity) bool {
+	return (len(r.Identities) == 0 || contains(r.Identities, id.ID())) &&
+		(len(r.Roles) == 0 || contains(r.Roles, string(id.Role)))
+}
+
+// CreateReq is a request to create a lease, as a policy sees it
+type CreateReq struct {
+	Identity auth.Identity
+	Provider string
+	MaxTime  time.Duration
+}
+
+// CheckCreate returns an ErrDenied if a rule of p denies req. activeLeases is only called if a
+// rule limits the number of leases, and returns how many leases req.Identity created that are
+// still active. Its errors are returned as they are. Otherwise, CheckCreate returns the regular
+// expressions that the names of the clusters leased for req must match. A nil policy allows
+// everything
+func (p *Policy) CheckCreate(req CreateReq, activeLeases func() (int, error)) ([]string, error) {
+	if p == nil {
+		return nil, nil
+	}
+	var clusterRegexes []string
+	active := -1
+	for _, rule := range p.Rules {
+		if !rule.appliesTo(req.Identity) {
+			continue
+		}
+		if len(rule.Providers) > 0 && !contains(rule.Providers, req.Provider) {
+			return nil, ErrDenied{Rule: rule.Name, Reason: fmt.Sprintf("%s may not lease %s clusters", req.Identity.ID(), req.Provider)}
+		}
+		if rule.maxTime > 0 && req.MaxTime > rule.maxTime {
+			return nil, ErrDenied{Rule: rule.Name, Reason: fmt.Sprintf("max_time %s is longer than %s", req.MaxTime, rule.maxTime)}
+		}
+		if rule.MaxLeases > 0 {
+			if active < 0 {
+				count, err := activeLeases()
+				if err != nil {
+					return nil, err
+				}
+				active = count
+			}
+			if active >= rule.MaxLeases {
+				return nil, ErrDenied{Rule: rule.Name, Reason: fmt.Sprintf("%s already has %d active leases, and may have at most %d", req.Identity.ID(), active, rule.MaxLeases)}
+			}
+		}
+		if rule.ClusterRegex != "" {
+			clusterRegexes = append(clusterRegexes, rule.ClusterRegex)
+		}
+	}
+	return clusterRegexes, nil
+}
+
+// CheckRelease returns an ErrDenied if a rule of p denies id releasing lease, whose cluster is
+// from provider. A nil policy allows everything
+func (p *Policy) CheckRelease(id auth.Identity, lease *leases.Lease, provider string) error {
+	if p == nil {
+		return nil
+	}
+	for _, rule := range p.Rules {
+		if !rule.appliesTo(id) {
+			continue
+		}
+		if len(rule.Providers) > 0 && !contains(rule.Providers, provider) {
+			return ErrDenied{Rule: rule.Name, Reason: fmt.Sprintf("%s may not release leases of %s clusters", id.ID(), provider)}
+		}
+		if rule.clusterRegex != nil && !rule.clusterRegex.MatchString(clusterName(lease)) {
+			return ErrDenied{Rule: rule.Name, Reason: fmt.Sprintf("%s may only release leases of clusters that match %s", id.ID(), rule.ClusterRegex)}
+		}
+		if rule.OwnLeasesOnly && lease.CreatedBy != id.ID() {
+			return ErrDenied{Rule: rule.Name, Reason: fmt.Sprintf("%s may only release leases created by %s", id.ID(), id.ID())}
+		}
+	}
+	return nil
+}
+
+// clusterName returns the name of the cluster of lease, without the project and location that
+// GKE cluster IDs are qualified with, so that rules match the same names
+// as cluster_regex does
+func clusterName(lease *leases.Lease) string {
+	name := lease.ClusterName
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+func contains(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
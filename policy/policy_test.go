@@ -0,0 +1,131 @@
+package policy
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/auth"
+	"github.com/deis/k8s-claimer/leases"
+)
+
+const testPolicy = `{"rules": [
+	{"name": "team-a-clusters", "identities": ["token:ci-team-a"], "cluster_regex": "^team-a-", "own_leases_only": true},
+	{"name": "max-4h", "max_time": "4h"},
+	{"name": "three-leases", "roles": ["user"], "max_leases": 3},
+	{"name": "gke-only", "identities": ["oidc:dev@example.com"], "providers": ["google"]}
+]}`
+
+var (
+	teamA = auth.Identity{Name: "ci-team-a", Source: auth.SourceToken, Role: auth.RoleUser}
+	dev   = auth.Identity{Name: "dev@example.com", Source: auth.SourceOIDC, Role: auth.RoleUser}
+	ops   = auth.Identity{Name: "ops", Source: auth.SourceToken, Role: auth.RoleAdmin}
+)
+
+func countLeases(n int) func() (int, error) {
+	return func() (int, error) {
+		return n, nil
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	testCases := []string{
+		`{"rules": [`,
+		`{"rules": [{"max_time": "4h"}]}`,
+		`{"rules": [{"name": "a", "roles": ["root"]}]}`,
+		`{"rules": [{"name": "a", "providers": ["aws"]}]}`,
+		`{"rules": [{"name": "a", "cluster_regex": "("}]}`,
+		`{"rules": [{"name": "a", "max_time": "forever"}]}`,
+		`{"rules": [{"name": "a", "max_time": "-1h"}]}`,
+		`{"rules": [{"name": "a", "max_leases": -1}]}`,
+		`{"rules": [{"name": "a"}, {"name": "a"}]}`,
+		`{"rules": [{"name": "a", "identities": ["ci"]}]}`,
+		`{"rules": [{"name": "a", "identities": ["token:"]}]}`,
+		`{"rules": [{"name": "a", "identities": ["github:ci"]}]}`,
+	}
+	for _, testCase := range testCases {
+		_, err := Parse([]byte(testCase))
+		assert.True(t, err != nil, "policy %s was parsed", testCase)
+	}
+}
+
+func TestCheckCreate(t *testing.T) {
+	p, err := Parse([]byte(testPolicy))
+	assert.NoErr(t, err)
+
+	regexes, err := p.CheckCreate(CreateReq{Identity: teamA, Provider: leases.ProviderGoogle, MaxTime: time.Hour}, countLeases(2))
+	assert.NoErr(t, err)
+	assert.Equal(t, regexes, []string{"^team-a-"}, "cluster regexes")
+
+	_, err = p.CheckCreate(CreateReq{Identity: teamA, Provider: leases.ProviderGoogle, MaxTime: 5 * time.Hour}, countLeases(0))
+	assert.Err(t, ErrDenied{Rule: "max-4h", Reason: "max_time 5h0m0s is longer than 4h0m0s"}, err)
+
+	_, err = p.CheckCreate(CreateReq{Identity: teamA, Provider: leases.ProviderGoogle, MaxTime: time.Hour}, countLeases(3))
+	assert.Err(t, ErrDenied{Rule: "three-leases", Reason: "token:ci-team-a already has 3 active leases, and may have at most 3"}, err)
+
+	_, err = p.CheckCreate(CreateReq{Identity: dev, Provider: leases.ProviderAzure, MaxTime: time.Hour}, countLeases(0))
+	assert.Err(t, ErrDenied{Rule: "gke-only", Reason: "oidc:dev@example.com may not lease azure clusters"}, err)
+
+	// the lease limit only applies to the user role, so the leases of admins aren't counted
+	regexes, err = p.CheckCreate(CreateReq{Identity: ops, Provider: leases.ProviderAzure, MaxTime: time.Hour}, func() (int, error) {
+		t.Fatal("the leases of an admin were counted")
+		return 0, nil
+	})
+	assert.NoErr(t, err)
+	assert.Equal(t, len(regexes), 0, "number of cluster regexes")
+
+	countErr := errors.New("the k8s API is down")
+	_, err = p.CheckCreate(CreateReq{Identity: dev, Provider: leases.ProviderGoogle, MaxTime: time.Hour}, func() (int, error) {
+		return 0, countErr
+	})
+	assert.Err(t, countErr, err)
+
+	var nilPolicy *Policy
+	_, err = nilPolicy.CheckCreate(CreateReq{Identity: dev, Provider: leases.ProviderAzure, MaxTime: 24 * time.Hour}, countLeases(100))
+	assert.NoErr(t, err)
+}
+
+func TestCheckRelease(t *testing.T) {
+	p, err := Parse([]byte(testPolicy))
+	assert.NoErr(t, err)
+
+	own := &leases.Lease{ClusterName: "proj1/zone1/team-a-1", CreatedBy: "token:ci-team-a"}
+	assert.NoErr(t, p.CheckRelease(teamA, own, leases.ProviderGoogle))
+
+	others := &leases.Lease{ClusterName: "team-a-2", CreatedBy: "oidc:dev@example.com"}
+	err = p.CheckRelease(teamA, others, leases.ProviderGoogle)
+	assert.Err(t, ErrDenied{Rule: "team-a-clusters", Reason: "token:ci-team-a may only release leases created by token:ci-team-a"}, err)
+
+	otherCluster := &leases.Lease{ClusterName: "team-b-1", CreatedBy: "token:ci-team-a"}
+	err = p.CheckRelease(teamA, otherCluster, leases.ProviderGoogle)
+	assert.Err(t, ErrDenied{Rule: "team-a-clusters", Reason: "token:ci-team-a may only release leases of clusters that match ^team-a-"}, err)
+
+	err = p.CheckRelease(dev, others, leases.ProviderAzure)
+	assert.Err(t, ErrDenied{Rule: "gke-only", Reason: "oidc:dev@example.com may not release leases of azure clusters"}, err)
+	assert.NoErr(t, p.CheckRelease(ops, others, leases.ProviderAzure))
+}
+
+func TestIdentitySources(t *testing.T) {
+	p, err := Parse([]byte(testPolicy))
+	assert.NoErr(t, err)
+
+	// a user whose ID token names them like an API token isn't matched by the token's rules
+	oidcTeamA := auth.Identity{Name: "ci-team-a", Source: auth.SourceOIDC, Role: auth.RoleUser}
+	regexes, err := p.CheckCreate(CreateReq{Identity: oidcTeamA, Provider: leases.ProviderGoogle, MaxTime: time.Hour}, countLeases(0))
+	assert.NoErr(t, err)
+	assert.Equal(t, len(regexes), 0, "number of cluster regexes")
+
+	// nor do they own the leases created with the token
+	p, err = Parse([]byte(`{"rules": [{"name": "own", "own_leases_only": true}]}`))
+	assert.NoErr(t, err)
+	own := &leases.Lease{ClusterName: "team-a-1", CreatedBy: "token:ci-team-a"}
+	err = p.CheckRelease(oidcTeamA, own, leases.ProviderGoogle)
+	assert.Err(t, ErrDenied{Rule: "own", Reason: "oidc:ci-team-a may only release leases created by oidc:ci-team-a"}, err)
+	assert.NoErr(t, p.CheckRelease(teamA, own, leases.ProviderGoogle))
+
+	// leases created before identities were qualified aren't anyone's own
+	legacy := &leases.Lease{ClusterName: "team-a-1", CreatedBy: "ci-team-a"}
+	err = p.CheckRelease(teamA, legacy, leases.ProviderGoogle)
+	assert.Err(t, ErrDenied{Rule: "own", Reason: "token:ci-team-a may only release leases created by token:ci-team-a"}, err)
+}
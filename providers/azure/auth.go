@@ -6,7 +6,6 @@ import (
 
 	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/adal"
-	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/deis/k8s-claimer/config"
 )
 
@@ -15,8 +14,14 @@ const (
 )
 
 // NewBearerAuthorizer creates a new BearerAuthorizer using values of the passed credentials map.
+// Tokens are requested from the Active Directory endpoint of the Azure cloud that a selects
 func NewBearerAuthorizer(a *config.Azure, scope string) (*autorest.BearerAuthorizer, error) {
-	oauthConfig, err := adal.NewOAuthConfig(azure.PublicCloud.ActiveDirectoryEndpoint, a.TenantID)
+	env, err := a.CloudEnvironment()
+	if err != nil {
+		log.Printf("Error trying to find the Azure cloud environment:%s\n", err)
+		return nil, err
+	}
+	oauthConfig, err := adal.NewOAuthConfig(env.ActiveDirectoryEndpoint, a.TenantID)
 	if err != nil {
 		log.Printf("Error trying to create new OAuth Config:%s\n", err)
 		return nil, err
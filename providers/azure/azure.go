@@ -10,8 +10,10 @@ import (
 	"os/exec"
 	"time"
 
+	apierrors "k8s.io/client-go/pkg/api/errors"
 	"k8s.io/client-go/pkg/api/v1"
 
+	"github.com/deis/k8s-claimer/auth"
 	"github.com/deis/k8s-claimer/config"
 	"github.com/deis/k8s-claimer/htp"
 	"github.com/deis/k8s-claimer/leases"
@@ -21,136 +23,265 @@ import (
 	"github.com/deis/k8s-claimer/k8s"
 )
 
+const (
+	// apiTimeout is how long a lease request waits for the Azure and k8s APIs
+	apiTimeout = 10 * time.Second
+)
+
 // Lease will search for an available cluster on Azure which matches the parameters passed in on the request
+// Only clusters that are members of the pool according to azureConfig are leased.
+// If healthChecker is not nil, free clusters are probed in order until a healthy one is found or
+// healthBudget has passed.
+// The request is checked again with admit, against the leases that the new lease is saved with.
+// If admit returns false, it has responded, and no lease is created. admit may be nil. If another request saves the
+// leases first, the request is tried again, up to k8s.LeaseUpdateAttempts times.
+// If credentials is enabled, the lease is handed out its own credentials instead of the cluster's
+// admin credentials, and the credentials of expired leases are revoked before they're reclaimed.
+// If req asks for an exec credential, the kubeconfig runs the CLI to fetch them instead. If req
+// asks for the API proxy, the kubeconfig talks to the cluster through it with a new bearer token,
+// whose hash the lease records.
+// The Azure and k8s APIs are called with ctx, which should be the context of the request. If
+// they time out, the response status is 504, and if they fail, it's 502.
+// The lease's token is random, and its secret is only written back on the response, while the
+// lease records the secret's salted hash, and the name of the API token that ctx carries, whose
+// usage ledger records the lease.
 // It will write back on the response the necessary connection information in json format
-func Lease(w http.ResponseWriter,
+func Lease(ctx context.Context,
+	w http.ResponseWriter,
 	req *api.CreateLeaseReq,
 	clusterLister ClusterLister,
 	services k8s.ServiceGetterUpdater,
 	azureConfig *config.Azure,
+	versions *VersionCache,
+	healthChecker k8s.HealthChecker,
+	healthBudget time.Duration,
+	credentials *k8s.LeaseCredentials,
+	admit func(http.ResponseWriter, *leases.Map) bool,
 	k8sServiceName string) {
+	for attempt := 1; ; attempt++ {
+		if !tryLease(ctx, w, req, clusterLister, services, azureConfig, versions, healthChecker, healthBudget, credentials, admit, k8sServiceName, attempt < k8s.LeaseUpdateAttempts) {
+			return
+		}
+	}
+}
 
-	clusterMap, svc, err := getSvcsAndClusters(clusterLister, services, k8sServiceName)
+// tryLease tries to lease a cluster for req as described in Lease. If retryConflict is true and
+// the leases were saved by another request while it ran, it returns true without responding, so
+// that the request is tried again with the leases that were saved. Returns false otherwise
+func tryLease(ctx context.Context,
+	w http.ResponseWriter,
+	req *api.CreateLeaseReq,
+	clusterLister ClusterLister,
+	services k8s.ServiceGetterUpdater,
+	azureConfig *config.Azure,
+	versions *VersionCache,
+	healthChecker k8s.HealthChecker,
+	healthBudget time.Duration,
+	credentials *k8s.LeaseCredentials,
+	admit func(http.ResponseWriter, *leases.Map) bool,
+	k8sServiceName string,
+	retryConflict bool) bool {
+
+	clusterMap, svc, err := getSvcsAndClusters(ctx, clusterLister, versions, azureConfig.Membership(), services, k8sServiceName)
 	if err != nil {
+		if ctx.Err() == context.Canceled {
+			log.Printf("The client went away while Azure clusters were listed")
+			return false
+		}
 		log.Printf("Error listing Azure clusters or talking to the k8s API -- %s", err)
-		htp.Error(w, http.StatusInternalServerError, "Error listing Azure clusters or talking to the k8s API -- %s", err)
-		return
+		htp.Error(w, htp.UpstreamStatus(err), "Error listing Azure clusters or talking to the k8s API -- %s", err)
+		return false
 	}
 
 	leaseMap, err := leases.ParseMapFromAnnotations(svc.Annotations)
 	if err != nil {
 		log.Printf("Error parsing leases from Kubernetes annotations -- %s", err)
 		htp.Error(w, http.StatusInternalServerError, "error parsing leases from Kubernetes annotations -- %s", err)
-		return
+		return false
 	}
 
-	availableCluster, err := searchForFreeCluster(clusterMap, leaseMap, req.ClusterRegex, req.ClusterVersion)
+	freeClusters, err := searchForFreeClusters(clusterMap, leaseMap, req)
 	if err != nil {
 		switch e := err.(type) {
 		case errNoAvailableOrExpiredClustersFound:
 			log.Printf("No available clusters found")
 			htp.Error(w, http.StatusConflict, "No available clusters found")
-			return
+			return false
 		case errExpiredLeaseAzureMissing:
 			log.Printf("Cluster %s has an expired lease but doesn't exist in Azure", e.clusterName)
 			htp.Error(w, http.StatusInternalServerError, "Cluster %s has an expired lease but doesn't exist in Azure", e.clusterName)
-			return
+			return false
 		default:
 			log.Printf("Unknown error %s", e.Error())
 			htp.Error(w, http.StatusInternalServerError, "Unknown error %s", e.Error())
-			return
+			return false
 		}
 	}
 
 	// There is currently no way to fetch the kubeconfig from the Azure API
 	// So we must scp the file off the master node
-	kubeConfig, err := FetchKubeConfig(*availableCluster.MasterProfile.Fqdn)
+	availableCluster, kubeConfig, err := firstHealthyCluster(ctx, freeClusters, leaseMap, FetchKubeConfig, healthChecker, healthBudget)
 	if err != nil {
-		log.Printf("Error creating kubeconfig file for cluster %s -- %s", *availableCluster.Name, err)
-		htp.Error(w, http.StatusInternalServerError, "Error creating kubeconfig file for cluster %s -- %s", *availableCluster.Name, err)
-		return
+		// save the unhealthy marks, even though no lease is created
+		if saveErr := k8s.SaveAnnotations(ctx, services, svc, leaseMap); saveErr != nil {
+			log.Printf("Error saving cluster health to Kubernetes annotations -- %s", saveErr)
+		}
+		if err == ctx.Err() {
+			log.Printf("The health checks of the free clusters were cut off -- %s", err)
+			htp.Error(w, htp.UpstreamStatus(err), "The health checks of the free clusters were cut off -- %s", err)
+			return false
+		}
+		switch e := err.(type) {
+		case k8s.ErrNoHealthyClusters:
+			log.Printf("No healthy clusters found -- %s", e)
+			htp.Error(w, http.StatusConflict, "No healthy clusters found -- %s", e)
+			return false
+		case k8s.ErrCreatingKubeConfig:
+			log.Printf("Error creating kubeconfig file for cluster %s -- %s", e.ClusterID, e.Err)
+			htp.Error(w, http.StatusInternalServerError, "Error creating kubeconfig file for cluster %s -- %s", e.ClusterID, e.Err)
+			return false
+		default:
+			log.Printf("Unknown error %s", e.Error())
+			htp.Error(w, http.StatusInternalServerError, "Unknown error %s", e.Error())
+			return false
+		}
+	}
+	// the request is checked against the leases that the new lease is saved with, so that other
+	// requests can't get past the policy or the budget at the same time
+	if admit != nil && !admit(w, leaseMap) {
+		// save the unhealthy marks, even though no lease is created
+		if saveErr := k8s.SaveAnnotations(ctx, services, svc, leaseMap); saveErr != nil {
+			log.Printf("Error saving cluster health to Kubernetes annotations -- %s", saveErr)
+		}
+		return false
+	}
+
+	// lease tokens are public, the secret is what the lease is released with
+	newToken := uuid.NewRandom()
+	secret, secretHash, err := leases.NewSecret()
+	if err != nil {
+		log.Printf("Error creating the secret of the lease -- %s", err)
+		htp.Error(w, http.StatusInternalServerError, "Error creating the secret of the lease -- %s", err)
+		return false
+	}
+	adminKubeConfig := kubeConfig
+	var serviceAccount string
+	if credentials != nil && credentials.Enabled {
+		kubeConfig, serviceAccount, err = credentials.Issue(adminKubeConfig, newToken.String())
+		if err != nil {
+			log.Printf("Error creating the credentials of the lease on cluster %s -- %s", *availableCluster.Name, err)
+			htp.Error(w, http.StatusInternalServerError, "Error creating the credentials of the lease on cluster %s -- %s", *availableCluster.Name, err)
+			return false
+		}
+	}
+	if req.ExecCredential != nil {
+		kubeConfig = k8s.ExecKubeConfig(kubeConfig, req.ExecCredential.CommandName(), req.ExecCredential.Args(newToken.String()), req.ExecCredential.Env(secret))
+	}
+	var proxyTokenHash string
+	if req.Proxy != nil {
+		var proxyToken string
+		proxyToken, proxyTokenHash, err = leases.NewSecret()
+		if err != nil {
+			log.Printf("Error creating the API proxy token of the lease -- %s", err)
+			credentials.RevokeUnsaved(adminKubeConfig, serviceAccount)
+			htp.Error(w, http.StatusInternalServerError, "Error creating the API proxy token of the lease -- %s", err)
+			return false
+		}
+		kubeConfig = k8s.ProxyKubeConfig(kubeConfig, req.Proxy.URL(newToken.String()), proxyToken)
 	}
-	newToken := uuid.NewUUID()
 	kubeConfigStr, err := k8s.MarshalAndEncodeKubeConfig(kubeConfig)
 	if err != nil {
 		log.Printf("Error marshaling & encoding kubeconfig -- %s", err)
 		htp.Error(w, http.StatusInternalServerError, "Error marshaling & encoding kubeconfig -- %s", err)
-		return
+		return false
+	}
+
+	clusterVersion, err := clusterMap.ClusterVersion(*availableCluster.Name)
+	if err != nil {
+		log.Printf("Couldn't determine the version of cluster %s -- %s", *availableCluster.Name, err)
 	}
 
 	resp := api.CreateLeaseResp{
-		KubeConfigStr: kubeConfigStr,
-		IP:            *availableCluster.MasterProfile.Fqdn,
-		Token:         newToken.String(),
-		ClusterName:   *availableCluster.Name,
+		KubeConfigStr:  kubeConfigStr,
+		IP:             *availableCluster.MasterProfile.Fqdn,
+		Token:          newToken.String(),
+		Secret:         secret,
+		ClusterName:    *availableCluster.Name,
+		ClusterID:      leaseID(*availableCluster.Name),
+		ClusterVersion: clusterVersion,
+		CloudProvider:  req.CloudProvider,
 	}
 
-	leaseMap.CreateLease(newToken, leases.NewLease(*availableCluster.Name, req.ExpirationTime(time.Now())))
-	if err := k8s.SaveAnnotations(services, svc, leaseMap); err != nil {
+	now := time.Now()
+	lease := leases.NewLease(*availableCluster.Name, req.ExpirationTime(now))
+	lease.Provider = leases.ProviderAzure
+	lease.ServiceAccount = serviceAccount
+	lease.SecretHash = secretHash
+	lease.ProxyTokenHash = proxyTokenHash
+	lease.CreatedBy = auth.ID(ctx)
+	leaseMap.CreateLease(newToken, lease)
+	leaseMap.RecordUsage(lease.CreatedBy, newToken, now, req.ExpirationTime(now))
+	leaseMap.MarkLeased(leaseID(*availableCluster.Name), now)
+	leaseMap.MarkHeld(leaseID(*availableCluster.Name), req.Holder, req.AffinityKey)
+	if err := k8s.SaveAnnotations(ctx, services, svc, leaseMap); err != nil {
+		credentials.RevokeUnsaved(adminKubeConfig, serviceAccount)
+		if retryConflict && apierrors.IsConflict(err) {
+			log.Printf("The leases were saved by another request while lease %s was created, trying again", newToken)
+			return true
+		}
 		log.Printf("Error saving new lease to Kubernetes annotations -- %s", err)
 		htp.Error(w, http.StatusInternalServerError, "Error saving new lease to Kubernetes annotations -- %s", err)
-		return
+		return false
 	}
 
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		log.Printf("Error encoding json -- %s", err)
 		htp.Error(w, http.StatusInternalServerError, "Error encoding json -- %s", err)
-		return
+		return false
 	}
+	return false
 }
 
-func getSvcsAndClusters(clusterLister ClusterLister, services k8s.ServiceGetterUpdater, k8sServiceName string) (*Map, *v1.Service, error) {
-
-	errCh := make(chan error)
-	clusterMapCh := make(chan *Map)
-	apiServiceCh := make(chan *v1.Service)
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// getSvcsAndClusters gets the k8s service with the given name and lists the pool members at the
+// same time. It gives up when ctx is done or apiTimeout has passed, whichever comes first
+func getSvcsAndClusters(ctx context.Context, clusterLister ClusterLister, versions *VersionCache, membership config.PoolMembership, services k8s.ServiceGetterUpdater, k8sServiceName string) (*Map, *v1.Service, error) {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
 	defer cancel()
+
+	// the channels are buffered, so that neither goroutine blocks once this func has returned
+	errCh := make(chan error, 2)
+	clusterMapCh := make(chan *Map, 1)
+	apiServiceCh := make(chan *v1.Service, 1)
 	go func() {
-		svc, err := services.Get(k8sServiceName)
+		svc, err := k8s.GetService(ctx, services, k8sServiceName)
 		if err != nil {
-			select {
-			case errCh <- err:
-			}
+			errCh <- err
 			return
 		}
-		select {
-		case apiServiceCh <- svc:
-		case <-ctx.Done():
-			errCh <- fmt.Errorf("Timeout exceeded while trying to fetch services from Kubernetes API")
-		}
+		apiServiceCh <- svc
 	}()
 	go func() {
-		clusterMap, err := ParseMapFromAzure(clusterLister)
+		clusterMap, err := ParseMapFromAzure(ctx, clusterLister, versions, membership)
 		if err != nil {
-			select {
-			case errCh <- err:
-			}
+			errCh <- err
 			return
 		}
-		select {
-		case clusterMapCh <- clusterMap:
-		case <-ctx.Done():
-			errCh <- fmt.Errorf("Timeout exceeded while trying to fetch clusters from Azure API")
-		}
+		clusterMapCh <- clusterMap
 	}()
 
 	var clusterMapRet *Map
 	var apiServiceRet *v1.Service
-	for {
+	for clusterMapRet == nil || apiServiceRet == nil {
 		select {
 		case err := <-errCh:
 			return nil, nil, err
-		case cm := <-clusterMapCh:
-			clusterMapRet = cm
-		case svc := <-apiServiceCh:
-			apiServiceRet = svc
-		}
-		if clusterMapRet != nil && apiServiceRet != nil {
-			return clusterMapRet, apiServiceRet, nil
+		case clusterMapRet = <-clusterMapCh:
+		case apiServiceRet = <-apiServiceCh:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
 		}
 	}
+	return clusterMapRet, apiServiceRet, nil
 }
 
 // FetchKubeConfig will scp the kubeconfig file from the master server into /tmp/kubeconfig<tempfile>
@@ -1,17 +1,27 @@
 package azure
 
 import (
+	"context"
 	"log"
+	"net/http"
+	"sync"
 
 	"github.com/Azure/azure-sdk-for-go/arm/containerservice"
-	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest"
+	autorestazure "github.com/Azure/go-autorest/autorest/azure"
 	"github.com/deis/k8s-claimer/config"
+	"github.com/deis/k8s-claimer/retry"
 )
 
 // AzureClusterLister is a ClusterLister implementation that uses the Azure Go SDK to list clusters
-// on a live Azure cluster
+// on a live Azure cluster. Only clusters in the configured resource groups (or the whole
+// subscription, if there are none) are listed. The bearer authorizer is created on the first
+// call and reused afterward, since its token refreshes itself before it expires
 type AzureClusterLister struct {
 	Config *config.Azure
+
+	mut        sync.Mutex
+	authorizer *autorest.BearerAuthorizer
 }
 
 // NewAzureClusterLister creates a new AzureClusterLister configured to use the given client.
@@ -19,20 +29,105 @@ func NewAzureClusterLister(azureConfig *config.Azure) *AzureClusterLister {
 	return &AzureClusterLister{Config: azureConfig}
 }
 
-// List is the ClusterLister interface implementation
-func (a *AzureClusterLister) List() (*containerservice.ListResult, error) {
-	bearerAuthorizer, err := NewBearerAuthorizer(a.Config, azure.PublicCloud.ResourceManagerEndpoint)
+// List is the ClusterLister interface implementation. Transient errors are retried
+func (a *AzureClusterLister) List(ctx context.Context) (*containerservice.ListResult, error) {
+	env, err := a.Config.CloudEnvironment()
+	if err != nil {
+		log.Printf("Error trying to find the Azure cloud environment: %s", err)
+		return nil, err
+	}
+	bearerAuthorizer, err := a.bearerAuthorizer(env.ResourceManagerEndpoint)
 	if err != nil {
 		log.Printf("Error trying to create Bearer Authorizer: %s", err)
 		return nil, err
 	}
 
-	csClient := containerservice.NewContainerServicesClient(a.Config.SubscriptionID)
+	csClient := containerservice.NewContainerServicesClientWithBaseURI(env.ResourceManagerEndpoint, a.Config.SubscriptionID)
 	csClient.Authorizer = bearerAuthorizer
-	listResult, err := csClient.List()
+	var clusters []containerservice.ContainerService
+	if len(a.Config.ResourceGroups) == 0 {
+		listResult, err := list(ctx, csClient.ListPreparer, csClient.ListSender, csClient.ListResponder)
+		if err != nil {
+			log.Printf("Error trying to fetch Azure Cluster List: %s\n", err)
+			return nil, err
+		}
+		clusters = appendClusters(clusters, listResult)
+	}
+	for _, resourceGroup := range a.Config.ResourceGroups {
+		prepare := func() (*http.Request, error) {
+			return csClient.ListByResourceGroupPreparer(resourceGroup)
+		}
+		listResult, err := list(ctx, prepare, csClient.ListByResourceGroupSender, csClient.ListByResourceGroupResponder)
+		if err != nil {
+			log.Printf("Error trying to fetch Azure Cluster List for resource group %s: %s\n", resourceGroup, err)
+			return nil, err
+		}
+		clusters = appendClusters(clusters, listResult)
+	}
+	return &containerservice.ListResult{Value: &clusters}, nil
+}
+
+func (a *AzureClusterLister) bearerAuthorizer(scope string) (*autorest.BearerAuthorizer, error) {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	if a.authorizer != nil {
+		return a.authorizer, nil
+	}
+	authorizer, err := NewBearerAuthorizer(a.Config, scope)
 	if err != nil {
-		log.Printf("Error trying to fetch Azure Cluster List: %s\n", err)
 		return nil, err
 	}
-	return &listResult, nil
+	a.authorizer = authorizer
+	return authorizer, nil
+}
+
+// list sends the request that prepare creates with send, and reads the response with respond.
+// The request is sent with ctx, and is sent again if it fails with a transient error
+func list(
+	ctx context.Context,
+	prepare func() (*http.Request, error),
+	send func(*http.Request) (*http.Response, error),
+	respond func(*http.Response) (containerservice.ListResult, error),
+) (containerservice.ListResult, error) {
+	var result containerservice.ListResult
+	err := retry.Do(ctx, retry.DefaultBackoff, isTransientAzureError, func() error {
+		req, err := prepare()
+		if err != nil {
+			return err
+		}
+		resp, err := send(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		result, err = respond(resp)
+		return err
+	})
+	return result, err
+}
+
+// isTransientAzureError returns true if err is an Azure API error that may go away if the call
+// that returned it is made again
+func isTransientAzureError(err error) bool {
+	switch e := err.(type) {
+	case *autorestazure.RequestError:
+		return isTransientStatusCode(e.StatusCode)
+	case autorest.DetailedError:
+		return isTransientStatusCode(e.StatusCode)
+	default:
+		return retry.IsTransientNetError(err)
+	}
+}
+
+// isTransientStatusCode returns true if code, the status code of an autorest error, is an int
+// that retry.IsTransientStatus returns true for
+func isTransientStatusCode(code interface{}) bool {
+	statusCode, ok := code.(int)
+	return ok && retry.IsTransientStatus(statusCode)
+}
+
+func appendClusters(clusters []containerservice.ContainerService, listResult containerservice.ListResult) []containerservice.ContainerService {
+	if listResult.Value == nil {
+		return clusters
+	}
+	return append(clusters, *listResult.Value...)
 }
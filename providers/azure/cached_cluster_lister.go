@@ -0,0 +1,32 @@
+package azure
+
+import (
+	"context"
+
+	"github.com/Azure/azure-sdk-for-go/arm/containerservice"
+	"github.com/deis/k8s-claimer/config"
+	"github.com/deis/k8s-claimer/inventory"
+)
+
+// CachedClusterLister is a ClusterLister that keeps the clusters it lists in an inventory.Cache.
+// Run and Invalidate are promoted from the cache. It's safe for concurrent use
+type CachedClusterLister struct {
+	*inventory.Cache
+	lister ClusterLister
+}
+
+// NewCachedClusterLister creates a new, empty CachedClusterLister that lists clusters with lister
+func NewCachedClusterLister(lister ClusterLister, conf config.Inventory) *CachedClusterLister {
+	return &CachedClusterLister{Cache: inventory.NewCache(conf), lister: lister}
+}
+
+// List is the ClusterLister interface implementation
+func (c *CachedClusterLister) List(ctx context.Context) (*containerservice.ListResult, error) {
+	result, err := c.Get(ctx, "the Azure clusters", func(ctx context.Context) (interface{}, error) {
+		return c.lister.List(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*containerservice.ListResult), nil
+}
@@ -0,0 +1,53 @@
+package azure
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/containerservice"
+	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/config"
+	"github.com/deis/k8s-claimer/leases"
+)
+
+// countingClusterLister is a ClusterLister that counts its calls and returns resp and err
+type countingClusterLister struct {
+	resp  *containerservice.ListResult
+	err   error
+	calls int
+}
+
+func (c *countingClusterLister) List(ctx context.Context) (*containerservice.ListResult, error) {
+	c.calls++
+	return c.resp, c.err
+}
+
+func TestCachedClusterLister(t *testing.T) {
+	clusters := []containerservice.ContainerService{cluster1}
+	lister := &countingClusterLister{resp: &containerservice.ListResult{Value: &clusters}}
+	cache := NewCachedClusterLister(lister, config.Inventory{Enabled: true, RefreshInterval: time.Minute})
+
+	// nothing is refreshed before the first list
+	cache.Refresh()
+	assert.Equal(t, lister.calls, 0, "number of calls before the first list")
+	result, err := cache.List(context.Background())
+	assert.NoErr(t, err)
+	assert.Equal(t, result, lister.resp, "listed clusters")
+	_, err = cache.List(context.Background())
+	assert.NoErr(t, err)
+	assert.Equal(t, lister.calls, 1, "number of calls after a cached list")
+}
+
+func TestGetClusterFromLeaseInvalidatesMissingCluster(t *testing.T) {
+	lister := &countingClusterLister{resp: &containerservice.ListResult{Value: &[]containerservice.ContainerService{}}}
+	cache := NewCachedClusterLister(lister, config.Inventory{Enabled: true, RefreshInterval: time.Minute})
+	_, err := cache.List(context.Background())
+	assert.NoErr(t, err)
+
+	lister.resp = &containerservice.ListResult{Value: &[]containerservice.ContainerService{cluster1}}
+	cluster, err := GetClusterFromLease(context.Background(), &leases.Lease{ClusterName: clusterName}, cache)
+	assert.NoErr(t, err)
+	assert.Equal(t, *cluster.Name, clusterName, "cluster name")
+	assert.Equal(t, lister.calls, 2, "number of calls")
+}
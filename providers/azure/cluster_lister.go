@@ -1,6 +1,8 @@
 package azure
 
 import (
+	"context"
+
 	"github.com/Azure/azure-sdk-for-go/arm/containerservice"
 )
 
@@ -9,5 +11,6 @@ import (
 // to be used in unit tests. Use this as a parameter in your funcs so that they can be more
 // easily unit tested
 type ClusterLister interface {
-	List() (*containerservice.ListResult, error)
+	// List lists all of the clusters. It gives up when ctx is done
+	List(ctx context.Context) (*containerservice.ListResult, error)
 }
@@ -1,6 +1,10 @@
 package azure
 
-import "github.com/Azure/azure-sdk-for-go/arm/containerservice"
+import (
+	"context"
+
+	"github.com/Azure/azure-sdk-for-go/arm/containerservice"
+)
 
 // FakeClusterLister is a ClusterLister implementation for use in unit tests
 type FakeClusterLister struct {
@@ -9,7 +13,7 @@ type FakeClusterLister struct {
 }
 
 // List is the ClusterLister interface implementation. It just returns f.Resp, f.Err
-func (f FakeClusterLister) List() (*containerservice.ListResult, error) {
+func (f FakeClusterLister) List(ctx context.Context) (*containerservice.ListResult, error) {
 	return f.Resp, f.Err
 }
 
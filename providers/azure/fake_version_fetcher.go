@@ -0,0 +1,27 @@
+package azure
+
+import "github.com/Azure/azure-sdk-for-go/arm/containerservice"
+
+// FakeVersionFetcher is a VersionFetcher implementation for use in unit tests
+type FakeVersionFetcher struct {
+	// Versions maps cluster names to the version that FetchVersion returns for them
+	Versions map[string]string
+	Err      error
+	// Fetched holds the names of all clusters that FetchVersion was called for, in order
+	Fetched []string
+}
+
+// FetchVersion is the VersionFetcher interface implementation. It records the cluster name and
+// returns f.Versions[name], f.Err
+func (f *FakeVersionFetcher) FetchVersion(cluster *containerservice.ContainerService) (string, error) {
+	f.Fetched = append(f.Fetched, *cluster.Name)
+	return f.Versions[*cluster.Name], f.Err
+}
+
+// NewFakeVersionFetcher returns a new FakeVersionFetcher
+func NewFakeVersionFetcher(versions map[string]string, err error) *FakeVersionFetcher {
+	return &FakeVersionFetcher{
+		Versions: versions,
+		Err:      err,
+	}
+}
@@ -1,14 +1,20 @@
 package azure
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"math/rand"
-	"regexp"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/arm/containerservice"
+	"github.com/deis/k8s-claimer/api"
+	"github.com/deis/k8s-claimer/config"
+	"github.com/deis/k8s-claimer/inventory"
+	"github.com/deis/k8s-claimer/k8s"
 	"github.com/deis/k8s-claimer/leases"
+	"github.com/deis/k8s-claimer/selection"
+	"github.com/deis/k8s-claimer/semver"
+	"k8s.io/client-go/pkg/labels"
 )
 
 type errNoAvailableOrExpiredClustersFound struct{}
@@ -30,24 +36,31 @@ func (e errExpiredLeaseAzureMissing) Error() string {
 	return fmt.Sprintf("cluster %s has an expired lease but does not exist in Azure", e.clusterName)
 }
 
-// searchForFreeCluster looks for an available Azure cluster to lease.
-// It will try and match clusterRegex if possible or clusterVersion
+// searchForFreeClusters looks for available Azure clusters to lease, and returns them in the order
+// they should be tried. It will only consider clusters that match the criteria in req. Expired
+// leases are reclaimed, and their credentials are marked unrevoked, for k8s.CredentialRevoker
 //
 // Returns errNoAvailableOrExpiredClustersFound if it found no free or expired lease
 // Returns errExpiredLeaseAzureMissing if it found an expired lease but the cluster associated with
 // that lease doesn't exist in Azure
-func searchForFreeCluster(clusterMap *Map, leaseMap *leases.Map, clusterRegex string, clusterVersion string) (*containerservice.ContainerService, error) {
+func searchForFreeClusters(clusterMap *Map, leaseMap *leases.Map, req *api.CreateLeaseReq) ([]*containerservice.ContainerService, error) {
 	uuidAndLeases, expiredLeaseErr := findExpiredLeases(leaseMap)
 	if expiredLeaseErr == nil {
 		for _, expiredLease := range uuidAndLeases {
 			leaseMap.DeleteLease(expiredLease.UUID)
+			if exprTime, err := expiredLease.Lease.ExpirationTime(); err == nil {
+				leaseMap.MarkReleased(expiredLease.Lease.ClusterID(), exprTime)
+			}
+			if expiredLease.Lease.ServiceAccount != "" {
+				leaseMap.MarkUnrevoked(expiredLease.Lease.ClusterID(), expiredLease.Lease.ServiceAccount)
+			}
 		}
 	}
-	cluster, err := findUnusedCluster(clusterMap, leaseMap, clusterRegex, clusterVersion)
+	clusters, err := findUnusedClusters(clusterMap, leaseMap, req)
 	if err != nil {
 		return nil, errNoAvailableOrExpiredClustersFound{}
 	}
-	return cluster, nil
+	return clusters, nil
 }
 
 // findExpiredLeases searches in the leases in the svc annotations and returns the cluster name of
@@ -75,74 +88,80 @@ func findExpiredLeases(leaseMap *leases.Map) ([]*leases.UUIDAndLease, error) {
 	return nil, errNoExpiredLeases
 }
 
-// findUnusedCluster finds a Azure cluster that's not currently in use according to the
-// annotations in svc. It will also attempt to match the clusterRegex passed in if possible.
+// findUnusedClusters finds the Azure clusters that aren't currently in use according to the
+// annotations in svc, in the order they should be tried. Only clusters that match the cluster
+// regex, version constraint and tag selector in req (whichever are given) are considered, and
+// every one of them is considered. The selection strategy in req orders the free clusters, and
+// the hints in req (preferred cluster, affinity key and clusters to avoid) then reorder its
+// choices. If a version constraint is given, clusters with higher versions are preferred among
+// those the strategy considers equal.
 // Returns errUnusedClusterNotFound if none is found
-func findUnusedCluster(clusterMap *Map, leaseMap *leases.Map, clusterRegex string, clusterVersion string) (*containerservice.ContainerService, error) {
-	if clusterRegex != "" {
-		return findUnusuedClusterByName(clusterMap, leaseMap, clusterRegex)
-	} else if clusterVersion != "" {
-		return findUnusedClusterByVersion(clusterMap, leaseMap, clusterVersion)
-	} else {
-		return findRandomUnusuedCluster(clusterMap, leaseMap)
+func findUnusedClusters(clusterMap *Map, leaseMap *leases.Map, req *api.CreateLeaseReq) ([]*containerservice.ContainerService, error) {
+	strategy, err := req.Strategy()
+	if err != nil {
+		return nil, err
 	}
-}
-
-// findUnusuedClusterByName attempts to find a unused Azure cluster that matches the regex passed in via the cli.
-func findUnusuedClusterByName(clusterMap *Map, leaseMap *leases.Map, clusterRegex string) (*containerservice.ContainerService, error) {
-	regex, err := regexp.Compile(clusterRegex)
+	clusterNames, err := findMatchingClusterNames(clusterMap, req)
 	if err != nil {
 		return nil, err
 	}
-	for _, clusterName := range clusterMap.Names() {
-		if regex.MatchString(clusterName) {
-			cluster, err := checkLease(clusterMap, leaseMap, clusterName)
-			if err == nil {
-				return cluster, nil
-			}
+	// looking up versions may mean talking to each cluster's API server, so only do it when the
+	// versions will be used
+	needVersions := req.ClusterVersion != "" || req.StrategyName() == selection.BinPack
+	candidates := make([]selection.Candidate, len(clusterNames))
+	for i, clusterName := range clusterNames {
+		_, isLeased := leaseMap.LeaseByClusterName(leaseID(clusterName))
+		candidates[i] = selection.Candidate{
+			Name:   clusterName,
+			Status: leaseMap.ClusterStatus(leaseID(clusterName)),
+			Leased: isLeased,
 		}
-	}
-	return nil, errUnusedAzureClusterNotFound
-}
-
-// findUnusedClusterByVersion attempts to find an unused Azure cluster that matches the version passed in via the CLI.
-func findUnusedClusterByVersion(clusterMap *Map, leaseMap *leases.Map, clusterVersion string) (*containerservice.ContainerService, error) {
-	clusterNames := clusterMap.ClusterNamesByVersion(clusterVersion)
-	if len(clusterNames) > 0 {
-		for tries := 0; tries < 10; tries++ {
-			clusterName := clusterNames[rand.Intn(len(clusterNames))]
-			cluster, err := checkLease(clusterMap, leaseMap, clusterName)
-			if err == nil {
-				return cluster, nil
-			}
+		if !needVersions || isLeased {
+			continue
+		}
+		if verStr, err := clusterMap.ClusterVersion(clusterName); err == nil {
+			ver, err := semver.Parse(verStr)
+			candidates[i].Version, candidates[i].HasVersion = ver, err == nil
 		}
 	}
-	return nil, errUnusedAzureClusterNotFound
+	ordered := req.Hints().Apply(strategy.Order(candidates, req.ClusterVersion != ""), candidates)
+	if len(ordered) == 0 {
+		return nil, errUnusedAzureClusterNotFound
+	}
+	ret := make([]*containerservice.ContainerService, len(ordered))
+	for i, clusterName := range ordered {
+		ret[i], _ = clusterMap.ClusterByName(clusterName)
+	}
+	return ret, nil
 }
 
-// findUnusuedCluster attempts to find a random unused Azure cluster
-func findRandomUnusuedCluster(clusterMap *Map, leaseMap *leases.Map) (*containerservice.ContainerService, error) {
+// findMatchingClusterNames returns the names of all clusters in clusterMap that match the
+// cluster regex, version constraint and tag selector in req
+func findMatchingClusterNames(clusterMap *Map, req *api.CreateLeaseReq) ([]string, error) {
 	clusterNames := clusterMap.Names()
-	if len(clusterNames) > 0 {
-		for tries := 0; tries < 10; tries++ {
-			clusterName := clusterNames[rand.Intn(len(clusterNames))]
-			cluster, err := checkLease(clusterMap, leaseMap, clusterName)
-			if err == nil {
-				return cluster, nil
-			}
+	if req.ClusterVersion != "" {
+		constraint, err := req.VersionConstraint()
+		if err != nil {
+			return nil, err
 		}
+		clusterNames = clusterMap.ClusterNamesByVersion(constraint)
 	}
-	return nil, errUnusedAzureClusterNotFound
-}
-
-// checkLease takes a clusterName and determines if there is an available lease
-func checkLease(clusterMap *Map, leaseMap *leases.Map, clusterName string) (*containerservice.ContainerService, error) {
-	cluster, _ := clusterMap.ClusterByName(clusterName)
-	_, isLeased := leaseMap.LeaseByClusterName(clusterName)
-	if !isLeased {
-		return cluster, nil
+	regex, err := req.ClusterNameRegexps()
+	if err != nil {
+		return nil, err
+	}
+	selector, err := req.LabelSelector()
+	if err != nil {
+		return nil, err
 	}
-	return nil, errUnusedAzureClusterNotFound
+	var ret []string
+	for _, clusterName := range clusterNames {
+		cluster, _ := clusterMap.ClusterByName(clusterName)
+		if regex.MatchString(clusterName) && selector.Matches(labels.Set(clusterTags(cluster))) {
+			ret = append(ret, clusterName)
+		}
+	}
+	return ret, nil
 }
 
 type errNoSuchCluster struct {
@@ -153,16 +172,46 @@ func (e errNoSuchCluster) Error() string {
 	return fmt.Sprintf("no such cluster %s", e.name)
 }
 
-// GetClusterFromLease takes a lease and will find the appropriate cluster
-func GetClusterFromLease(lease *leases.Lease, clusterLister ClusterLister) (*containerservice.ContainerService, error) {
-	clusterMap, err := ParseMapFromAzure(clusterLister)
+// IsNoSuchCluster returns true if err means that GetClusterFromLease found no leased cluster
+func IsNoSuchCluster(err error) bool {
+	_, ok := err.(errNoSuchCluster)
+	return ok
+}
+
+// GetClusterFromLease takes a lease and will find the appropriate cluster. The leased cluster is
+// looked for whether or not it's still a member of the pool, so that it can always be released.
+// If clusterLister keeps clusters in memory and the cluster isn't among them, they're invalidated
+// and listed again
+func GetClusterFromLease(ctx context.Context, lease *leases.Lease, clusterLister ClusterLister) (*containerservice.ContainerService, error) {
+	clusterMap, err := ParseMapFromAzure(ctx, clusterLister, nil, config.PoolMembership{})
 	if err != nil {
 		return nil, err
 	}
 	cl, exists := clusterMap.ClusterByName(lease.ClusterName)
+	if _, cached := clusterLister.(inventory.Invalidator); !exists && cached {
+		inventory.Invalidate(clusterLister)
+		if clusterMap, err = ParseMapFromAzure(ctx, clusterLister, nil, config.PoolMembership{}); err != nil {
+			return nil, err
+		}
+		cl, exists = clusterMap.ClusterByName(lease.ClusterName)
+	}
 	if !exists {
 		return nil, errNoSuchCluster{name: lease.ClusterName}
 	}
 
 	return cl, nil
 }
+
+// AdminKubeConfig returns the admin kubeconfig of the cluster of lease, fetched from its master.
+// It's a k8s.AdminKubeConfigFunc, so it returns nil and no error if the cluster doesn't exist
+// anymore
+func AdminKubeConfig(ctx context.Context, lease *leases.Lease, clusterLister ClusterLister) (*k8s.KubeConfig, error) {
+	cluster, err := GetClusterFromLease(ctx, lease, clusterLister)
+	if IsNoSuchCluster(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fetchClusterKubeConfig(cluster, FetchKubeConfig)
+}
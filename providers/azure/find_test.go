@@ -1,14 +1,17 @@
 package azure
 
 import (
+	"context"
 	"reflect"
 	"testing"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/arm/containerservice"
 	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/api"
 	"github.com/deis/k8s-claimer/config"
 	"github.com/deis/k8s-claimer/leases"
+	"github.com/deis/k8s-claimer/selection"
 	"github.com/deis/k8s-claimer/testutil"
 	"github.com/pborman/uuid"
 )
@@ -24,10 +27,10 @@ func TestSearchForFreeClusterNoneAvailable(t *testing.T) {
 	leaseMap, err := leases.ParseMapFromAnnotations(map[string]string{})
 	assert.NoErr(t, err)
 	clusterLister := FakeClusterLister{Err: nil, Resp: &containerservice.ListResult{Value: nil}}
-	clusterMap, err := ParseMapFromAzure(clusterLister)
+	clusterMap, err := ParseMapFromAzure(context.Background(), clusterLister, nil, config.PoolMembership{})
 	assert.NoErr(t, err)
-	cluster, err := searchForFreeCluster(clusterMap, leaseMap, "", "")
-	assert.Nil(t, cluster, "cluster")
+	clusters, err := searchForFreeClusters(clusterMap, leaseMap, &api.CreateLeaseReq{})
+	assert.Equal(t, len(clusters), 0, "number of clusters")
 	switch tErr := err.(type) {
 	case errNoAvailableOrExpiredClustersFound:
 	default:
@@ -46,10 +49,10 @@ func TestSearchForClusterNoLeaseFound(t *testing.T) {
 		Err:  nil,
 		Resp: &containerservice.ListResult{Value: nil},
 	}
-	clusterMap, err := ParseMapFromAzure(clusterLister)
+	clusterMap, err := ParseMapFromAzure(context.Background(), clusterLister, nil, config.PoolMembership{})
 	assert.NoErr(t, err)
-	cluster, err := searchForFreeCluster(clusterMap, leaseMap, "", "")
-	assert.Nil(t, cluster, "cluster")
+	clusters, err := searchForFreeClusters(clusterMap, leaseMap, &api.CreateLeaseReq{})
+	assert.Equal(t, len(clusters), 0, "number of clusters")
 	assert.Err(t, errNoAvailableOrExpiredClustersFound{}, err)
 }
 
@@ -62,13 +65,50 @@ func TestFindUnusedAzureClusterByName(t *testing.T) {
 		Err:  nil,
 	}
 
-	clusterMap, err := ParseMapFromAzure(fakeLister)
+	clusterMap, err := ParseMapFromAzure(context.Background(), fakeLister, nil, config.PoolMembership{})
 	assert.NoErr(t, err)
 	leaseMap, err := leases.ParseMapFromAnnotations(nil)
 
-	unusedCluster, err := findUnusedCluster(clusterMap, leaseMap, "getClusterByName", "")
+	unusedClusters, err := findUnusedClusters(clusterMap, leaseMap, &api.CreateLeaseReq{ClusterRegex: "getClusterByName"})
 	assert.NoErr(t, err)
-	assert.Equal(t, *unusedCluster.Name, "getClusterByName", "free cluster name")
+	assert.Equal(t, *unusedClusters[0].Name, "getClusterByName", "free cluster name")
+}
+
+func TestFindUnusedAzureClusterByVersion(t *testing.T) {
+	leaseableClusters := testutil.GetAzureClusters()
+
+	fakeLister := &FakeClusterLister{
+		Resp: &containerservice.ListResult{Value: leaseableClusters},
+		Err:  nil,
+	}
+	fetcher := NewFakeVersionFetcher(map[string]string{"getClusterByVersion": "v1.1.1"}, nil)
+
+	clusterMap, err := ParseMapFromAzure(context.Background(), fakeLister, NewVersionCache(fetcher), config.PoolMembership{})
+	assert.NoErr(t, err)
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+
+	unusedClusters, err := findUnusedClusters(clusterMap, leaseMap, &api.CreateLeaseReq{ClusterVersion: "1.1.1"})
+	assert.NoErr(t, err)
+	assert.Equal(t, *unusedClusters[0].Name, "getClusterByVersion", "free cluster name")
+}
+
+func TestFindUnusedAzureClusterBySelector(t *testing.T) {
+	gpu, noGPU := "true", "false"
+	withGPU, withoutGPU := "with-gpu", "without-gpu"
+	fakeLister := &FakeClusterLister{
+		Resp: &containerservice.ListResult{Value: &[]containerservice.ContainerService{
+			containerservice.ContainerService{ID: &withGPU, Name: &withGPU, Tags: &map[string]*string{"gpu": &gpu}},
+			containerservice.ContainerService{ID: &withoutGPU, Name: &withoutGPU, Tags: &map[string]*string{"gpu": &noGPU}},
+		}},
+	}
+	clusterMap, err := ParseMapFromAzure(context.Background(), fakeLister, nil, config.PoolMembership{})
+	assert.NoErr(t, err)
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+
+	unusedClusters, err := findUnusedClusters(clusterMap, leaseMap, &api.CreateLeaseReq{ClusterRegex: "gpu", ClusterSelector: "gpu=false"})
+	assert.NoErr(t, err)
+	assert.Equal(t, *unusedClusters[0].Name, withoutGPU, "free cluster name")
 }
 
 func TestFindRandomUnusedAzureCluster(t *testing.T) {
@@ -80,13 +120,57 @@ func TestFindRandomUnusedAzureCluster(t *testing.T) {
 		Err:  nil,
 	}
 
-	clusterMap, err := ParseMapFromAzure(fakeLister)
+	clusterMap, err := ParseMapFromAzure(context.Background(), fakeLister, nil, config.PoolMembership{})
 	assert.NoErr(t, err)
 	leaseMap, err := leases.ParseMapFromAnnotations(nil)
 
-	unusedCluster, err := findUnusedCluster(clusterMap, leaseMap, "", "")
+	unusedClusters, err := findUnusedClusters(clusterMap, leaseMap, &api.CreateLeaseReq{})
+	assert.NoErr(t, err)
+	assert.NotNil(t, unusedClusters, "free cluster name")
+}
+
+func TestFindUnusedAzureClusterExhaustive(t *testing.T) {
+	leaseableClusters := *testutil.GetAzureClusters()
+	fakeLister := &FakeClusterLister{
+		Resp: &containerservice.ListResult{Value: &leaseableClusters},
+		Err:  nil,
+	}
+	clusterMap, err := ParseMapFromAzure(context.Background(), fakeLister, nil, config.PoolMembership{})
+	assert.NoErr(t, err)
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	// lease everything but the last cluster
+	for _, cluster := range leaseableClusters[:len(leaseableClusters)-1] {
+		leaseMap.CreateLease(uuid.NewUUID(), leases.NewLease(*cluster.Name, time.Now().Add(1*time.Hour)))
+	}
+	freeName := *leaseableClusters[len(leaseableClusters)-1].Name
+	for _, strategy := range selection.Names {
+		for i := 0; i < 20; i++ {
+			unusedClusters, err := findUnusedClusters(clusterMap, leaseMap, &api.CreateLeaseReq{SelectionStrategy: strategy})
+			assert.NoErr(t, err)
+			assert.Equal(t, *unusedClusters[0].Name, freeName, "free cluster name for strategy "+strategy)
+		}
+	}
+}
+
+func TestFindUnusedAzureClusterLeastRecentlyUsed(t *testing.T) {
+	fakeLister := &FakeClusterLister{
+		Resp: &containerservice.ListResult{Value: testutil.GetAzureClusters()},
+		Err:  nil,
+	}
+	clusterMap, err := ParseMapFromAzure(context.Background(), fakeLister, nil, config.PoolMembership{})
+	assert.NoErr(t, err)
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	now := time.Now()
+	for _, name := range clusterMap.Names() {
+		leaseMap.MarkReleased(leaseID(name), now.Add(-1*time.Hour))
+	}
+	leaseMap.MarkReleased(leaseID("cluster4"), now.Add(-5*time.Hour))
+
+	unusedClusters, err := findUnusedClusters(clusterMap, leaseMap, &api.CreateLeaseReq{SelectionStrategy: selection.LeastRecentlyUsed})
 	assert.NoErr(t, err)
-	assert.NotNil(t, unusedCluster, "free cluster name")
+	assert.Equal(t, *unusedClusters[0].Name, "cluster4", "least recently used cluster")
 }
 
 func TestGetClusterFromLease(t *testing.T) {
@@ -94,7 +178,7 @@ func TestGetClusterFromLease(t *testing.T) {
 		Resp: &containerservice.ListResult{Value: &[]containerservice.ContainerService{cluster1}},
 	}
 	lease := leases.NewLease(clusterName, time.Now().Add(1*time.Hour))
-	cluster, err := GetClusterFromLease(lease, clusterLister)
+	cluster, err := GetClusterFromLease(context.Background(), lease, clusterLister)
 	assert.NoErr(t, err)
 	assert.Equal(t, cluster.Name, cluster1.Name, "cluster name")
 }
@@ -0,0 +1,49 @@
+package azure
+
+import (
+	"context"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/containerservice"
+
+	"github.com/deis/k8s-claimer/k8s"
+	"github.com/deis/k8s-claimer/leases"
+)
+
+// firstHealthyCluster returns the first of clusters that passes a probe by healthChecker, along
+// with its kubeconfig, which is fetched from the cluster's master with fetchKubeConfig. Clusters
+// whose kubeconfig can't be fetched are skipped like unhealthy ones. See k8s.FirstHealthyCluster
+// for how clusters are probed and the errors that are returned
+func firstHealthyCluster(
+	ctx context.Context,
+	clusters []*containerservice.ContainerService,
+	leaseMap *leases.Map,
+	fetchKubeConfig func(string) (*k8s.KubeConfig, error),
+	healthChecker k8s.HealthChecker,
+	budget time.Duration,
+) (*containerservice.ContainerService, *k8s.KubeConfig, error) {
+	candidates := make([]k8s.HealthCandidate, len(clusters))
+	for i, cluster := range clusters {
+		cluster := cluster
+		candidates[i] = k8s.HealthCandidate{
+			ClusterID:  leaseID(*cluster.Name),
+			KubeConfig: func() (*k8s.KubeConfig, error) { return fetchClusterKubeConfig(cluster, fetchKubeConfig) },
+		}
+	}
+	i, kubeConfig, err := k8s.FirstHealthyCluster(ctx, candidates, leaseMap, healthChecker, budget)
+	if err != nil {
+		return nil, nil, err
+	}
+	return clusters[i], kubeConfig, nil
+}
+
+// fetchClusterKubeConfig fetches the kubeconfig of cluster from its master with fetchKubeConfig
+func fetchClusterKubeConfig(
+	cluster *containerservice.ContainerService,
+	fetchKubeConfig func(string) (*k8s.KubeConfig, error),
+) (*k8s.KubeConfig, error) {
+	if cluster.Properties == nil || cluster.MasterProfile == nil || cluster.MasterProfile.Fqdn == nil {
+		return nil, errNoMasterFQDN{name: *cluster.Name}
+	}
+	return fetchKubeConfig(*cluster.MasterProfile.Fqdn)
+}
@@ -0,0 +1,57 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/containerservice"
+	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/k8s"
+	"github.com/deis/k8s-claimer/leases"
+)
+
+func healthTestCluster(name, fqdn string) *containerservice.ContainerService {
+	return &containerservice.ContainerService{
+		ID:   &name,
+		Name: &name,
+		Properties: &containerservice.Properties{
+			MasterProfile: &containerservice.MasterProfile{Fqdn: &fqdn},
+		},
+	}
+}
+
+func TestFirstHealthyClusterSkipsUnreachableMaster(t *testing.T) {
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	clusters := []*containerservice.ContainerService{
+		healthTestCluster("down", "down.westus.cloudapp.azure.com"),
+		healthTestCluster("unhealthy", "unhealthy.westus.cloudapp.azure.com"),
+		healthTestCluster("healthy", "healthy.westus.cloudapp.azure.com"),
+	}
+	fetch := func(fqdn string) (*k8s.KubeConfig, error) {
+		if fqdn == "down.westus.cloudapp.azure.com" {
+			return nil, errors.New("connection refused")
+		}
+		return &k8s.KubeConfig{Clusters: []k8s.NamedCluster{k8s.NamedCluster{Cluster: k8s.Cluster{Server: "https://" + fqdn}}}}, nil
+	}
+	checker := k8s.NewFakeHealthChecker(map[string]error{
+		"https://unhealthy.westus.cloudapp.azure.com": errors.New("node is not ready"),
+	})
+	cluster, _, err := firstHealthyCluster(context.Background(), clusters, leaseMap, fetch, checker, 10*time.Second)
+	assert.NoErr(t, err)
+	assert.Equal(t, *cluster.Name, "healthy", "healthy cluster name")
+	assert.Equal(t, leaseMap.ClusterStatus(leaseID("down")).UnhealthyReason, "connection refused", "unhealthy reason")
+	assert.Equal(t, leaseMap.ClusterStatus(leaseID("unhealthy")).UnhealthyReason, "node is not ready", "unhealthy reason")
+}
+
+func TestFirstHealthyClusterNoCheckerFetchError(t *testing.T) {
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	fetchErr := errors.New("connection refused")
+	fetch := func(string) (*k8s.KubeConfig, error) { return nil, fetchErr }
+	clusters := []*containerservice.ContainerService{healthTestCluster("down", "down.westus.cloudapp.azure.com")}
+	_, _, err = firstHealthyCluster(context.Background(), clusters, leaseMap, fetch, nil, 0)
+	assert.Err(t, k8s.ErrCreatingKubeConfig{ClusterID: leaseID("down"), Err: fetchErr}, err)
+}
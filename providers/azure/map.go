@@ -1,14 +1,29 @@
 package azure
 
 import (
+	"context"
 	"log"
+	"sort"
 
 	"github.com/Azure/azure-sdk-for-go/arm/containerservice"
+	"github.com/deis/k8s-claimer/api"
+	"github.com/deis/k8s-claimer/config"
+	"github.com/deis/k8s-claimer/leases"
+	"github.com/deis/k8s-claimer/semver"
 )
 
-// Map is a map from cluster name to ACS cluster
+// Map is a map from cluster name to ACS cluster. Clusters that aren't in the pool are left out of
+// the map, and only reported by Excluded
 type Map struct {
-	nameMap map[string]*containerservice.ContainerService
+	nameMap  map[string]*containerservice.ContainerService
+	versions *VersionCache
+	excluded []api.ExcludedCluster
+}
+
+// leaseID returns the provider-qualified ID that leases and statuses of the cluster with the
+// given name are recorded under
+func leaseID(clusterName string) string {
+	return leases.ClusterID(leases.ProviderAzure, clusterName)
 }
 
 func clusterNamesToMap(c *[]containerservice.ContainerService) map[string]*containerservice.ContainerService {
@@ -24,15 +39,43 @@ func clusterNamesToMap(c *[]containerservice.ContainerService) map[string]*conta
 }
 
 // ParseMapFromAzure calls the Azure API to get a list of clusters, then returns a Map representation
-// of those clusters. Returns nil and an appropriate error if any errors occurred along the way
-func ParseMapFromAzure(clusterLister ClusterLister) (*Map, error) {
-	listResult, err := clusterLister.List()
+// of those clusters that are members of the pool according to membership. Cluster versions are
+// looked up in versions, which may be nil if versions aren't needed. Returns nil and an
+// appropriate error if any errors occurred along the way, or if ctx is done first
+func ParseMapFromAzure(ctx context.Context, clusterLister ClusterLister, versions *VersionCache, membership config.PoolMembership) (*Map, error) {
+	listResult, err := clusterLister.List(ctx)
 	if err != nil {
 		log.Printf("Parse Map From Azure: %v", err)
 		return nil, err
 	}
 
-	return &Map{nameMap: clusterNamesToMap(listResult.Value)}, nil
+	var members []containerservice.ContainerService
+	var excluded []api.ExcludedCluster
+	if listResult.Value != nil {
+		for _, cluster := range *listResult.Value {
+			if cluster.Name == nil {
+				continue
+			}
+			reason := membership.ExclusionReason(clusterTags(&cluster), *cluster.Name)
+			if reason == "" {
+				members = append(members, cluster)
+				continue
+			}
+			excluded = append(excluded, api.ExcludedCluster{
+				CloudProvider: leases.ProviderAzure,
+				ClusterName:   *cluster.Name,
+				ClusterID:     leaseID(*cluster.Name),
+				Reason:        reason,
+			})
+		}
+	}
+	return &Map{nameMap: clusterNamesToMap(&members), versions: versions, excluded: excluded}, nil
+}
+
+// Excluded returns the clusters that were listed but left out of m, because they aren't in the
+// pool
+func (m Map) Excluded() []api.ExcludedCluster {
+	return m.excluded
 }
 
 // ClusterByName returns the cluster of the given cluster name. Returns nil and false if no
@@ -42,17 +85,57 @@ func (m Map) ClusterByName(name string) (*containerservice.ContainerService, boo
 	return cl, found
 }
 
-// ClusterNamesByVersion returns a slice of all cluster names which match a given cluster version
-func (m Map) ClusterNamesByVersion(matchingVersion string) []string {
-	// var ret []string
-	// for name, cluster := range m.nameMap {
-	// 	cluster.
-	// 	if matchingVersion == cluster.CurrentNodeVersion {
-	// 		ret = append(ret, name)
-	// 	}
-	// }
-	// return ret
-	return nil
+// ClusterVersion returns the Kubernetes version of the cluster with the given name. Returns an
+// empty string and an appropriate error if there is no such cluster or its version couldn't be
+// determined
+func (m Map) ClusterVersion(name string) (string, error) {
+	cluster, found := m.nameMap[name]
+	if !found {
+		return "", errNoSuchCluster{name: name}
+	}
+	if m.versions == nil {
+		ver, _, err := versionFromOrchestrator(cluster)
+		return ver, err
+	}
+	return m.versions.Version(cluster)
+}
+
+// ClusterNamesByVersion returns a slice of all cluster names whose version satisfies constraint,
+// ordered from the highest version to the lowest. Clusters whose version couldn't be determined
+// are skipped
+func (m Map) ClusterNamesByVersion(constraint *semver.Constraint) []string {
+	var matching semver.ByVersionDesc
+	for name := range m.nameMap {
+		verStr, err := m.ClusterVersion(name)
+		if err != nil {
+			log.Printf("Skipping cluster %s, couldn't determine its version -- %s", name, err)
+			continue
+		}
+		ver, err := semver.Parse(verStr)
+		if err != nil || !constraint.Check(ver) {
+			continue
+		}
+		matching = append(matching, semver.Named{Name: name, Version: ver})
+	}
+	sort.Sort(matching)
+	return matching.Names()
+}
+
+// clusterTags returns the resource tags of cluster as a plain map. Tags without a value map to
+// an empty string
+func clusterTags(cluster *containerservice.ContainerService) map[string]string {
+	ret := make(map[string]string)
+	if cluster.Tags == nil {
+		return ret
+	}
+	for key, val := range *cluster.Tags {
+		if val == nil {
+			ret[key] = ""
+			continue
+		}
+		ret[key] = *val
+	}
+	return ret
 }
 
 // Names returns all cluster names in the map. The order of the returned slice is undefined
@@ -1,13 +1,24 @@
 package azure
 
 import (
+	"context"
 	"fmt"
 	"testing"
 
 	"github.com/Azure/azure-sdk-for-go/arm/containerservice"
 	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/config"
 )
 
+func taggedCluster(name string, tags map[string]string) containerservice.ContainerService {
+	tagPtrs := make(map[string]*string)
+	for key, val := range tags {
+		val := val
+		tagPtrs[key] = &val
+	}
+	return containerservice.ContainerService{ID: &name, Name: &name, Tags: &tagPtrs}
+}
+
 func TestClusterByName(t *testing.T) {
 	cluster1 := "cluster1"
 	cluster2 := "cluster2"
@@ -33,3 +44,34 @@ func TestNames(t *testing.T) {
 	retNames := m.Names()
 	assert.Equal(t, len(retNames), len(names), "length of names slice")
 }
+
+func TestParseMapFromAzureExcludesNonMembers(t *testing.T) {
+	clusters := []containerservice.ContainerService{
+		taggedCluster("claimable", map[string]string{"k8s-claimer": "true", "gpu": "false"}),
+		taggedCluster("not-claimable", map[string]string{"k8s-claimer": "false"}),
+		taggedCluster("production", map[string]string{"gpu": "false"}),
+		taggedCluster("pinned", map[string]string{"k8s-claimer": "true"}),
+		{Name: &clusterName},
+	}
+	lister := NewFakeClusterLister(&containerservice.ListResult{Value: &clusters}, nil)
+	membership := config.PoolMembership{Label: "k8s-claimer=true", Exclude: []string{"pinned"}}
+	m, err := ParseMapFromAzure(context.Background(), lister, nil, membership)
+	assert.NoErr(t, err)
+	assert.Equal(t, m.Names(), []string{"claimable"}, "cluster names")
+	reasons := make(map[string]string)
+	for _, cl := range m.Excluded() {
+		assert.Equal(t, cl.CloudProvider, "azure", "cloud provider")
+		reasons[cl.ClusterID] = cl.Reason
+	}
+	assert.Equal(t, reasons, map[string]string{
+		"azure/not-claimable": `the k8s-claimer label is "false", not "true"`,
+		"azure/production":    "missing the k8s-claimer label",
+		"azure/pinned":        "pinned is in the exclude list",
+		"azure/cluster1":      "missing the k8s-claimer label",
+	}, "exclusion reasons")
+
+	// without a value, the tag only has to be present
+	m, err = ParseMapFromAzure(context.Background(), lister, nil, config.PoolMembership{Label: "k8s-claimer"})
+	assert.NoErr(t, err)
+	assert.Equal(t, len(m.Names()), 3, "number of member clusters")
+}
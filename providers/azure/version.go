@@ -0,0 +1,109 @@
+package azure
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/arm/containerservice"
+)
+
+const (
+	// orchestratorTagName is the resource tag that ACS and acs-engine set on container services.
+	// Its value is of the form Kubernetes:1.6.6
+	orchestratorTagName = "orchestrator"
+)
+
+type errNoMasterFQDN struct {
+	name string
+}
+
+func (e errNoMasterFQDN) Error() string {
+	return fmt.Sprintf("cluster %s has no master FQDN", e.name)
+}
+
+type errNotKubernetes struct {
+	name string
+}
+
+func (e errNotKubernetes) Error() string {
+	return fmt.Sprintf("cluster %s is not orchestrated by Kubernetes", e.name)
+}
+
+// VersionCache holds the Kubernetes versions of ACS clusters. The container service API doesn't
+// return the orchestrator version, so versions that can't be read from the orchestrator profile
+// are fetched once with a VersionFetcher and remembered by cluster ID afterward.
+// It is safe for concurrent use
+type VersionCache struct {
+	fetcher  VersionFetcher
+	mut      sync.RWMutex
+	versions map[string]string
+}
+
+// NewVersionCache returns a new, empty VersionCache that uses fetcher to discover versions it
+// doesn't know about
+func NewVersionCache(fetcher VersionFetcher) *VersionCache {
+	return &VersionCache{fetcher: fetcher, versions: make(map[string]string)}
+}
+
+// Version returns the Kubernetes version of cluster, without a leading 'v' (i.e. 1.6.6).
+// Returns an empty string and an appropriate error if the version couldn't be determined
+func (v *VersionCache) Version(cluster *containerservice.ContainerService) (string, error) {
+	if ver, ok, err := versionFromOrchestrator(cluster); ok || err != nil {
+		return ver, err
+	}
+	key := clusterKey(cluster)
+	v.mut.RLock()
+	ver, cached := v.versions[key]
+	v.mut.RUnlock()
+	if cached {
+		return ver, nil
+	}
+	fetched, err := v.fetcher.FetchVersion(cluster)
+	if err != nil {
+		return "", err
+	}
+	ver = normalizeVersion(fetched)
+	v.mut.Lock()
+	v.versions[key] = ver
+	v.mut.Unlock()
+	return ver, nil
+}
+
+// versionFromOrchestrator attempts to read the Kubernetes version of cluster from its
+// orchestrator profile and orchestrator tag. The returned bool is false if the version isn't
+// recorded there. Returns a non-nil error if the cluster isn't orchestrated by Kubernetes
+func versionFromOrchestrator(cluster *containerservice.ContainerService) (string, bool, error) {
+	if cluster.Properties != nil && cluster.OrchestratorProfile != nil {
+		if cluster.OrchestratorProfile.OrchestratorType != containerservice.Kubernetes {
+			return "", false, errNotKubernetes{name: *cluster.Name}
+		}
+	}
+	if cluster.Tags == nil {
+		return "", false, nil
+	}
+	tag, ok := (*cluster.Tags)[orchestratorTagName]
+	if !ok || tag == nil {
+		return "", false, nil
+	}
+	parts := strings.SplitN(*tag, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", false, nil
+	}
+	return normalizeVersion(parts[1]), true, nil
+}
+
+// normalizeVersion strips surrounding whitespace and the leading 'v' that the API server's
+// /version endpoint includes, so that versions compare the same way they do for GKE
+func normalizeVersion(ver string) string {
+	return strings.TrimPrefix(strings.TrimSpace(ver), "v")
+}
+
+// clusterKey returns the cluster ID, which is unique across resource groups, or the name if the
+// cluster has no ID
+func clusterKey(cluster *containerservice.ContainerService) string {
+	if cluster.ID != nil {
+		return *cluster.ID
+	}
+	return *cluster.Name
+}
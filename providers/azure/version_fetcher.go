@@ -0,0 +1,35 @@
+package azure
+
+import (
+	"github.com/Azure/azure-sdk-for-go/arm/containerservice"
+	"github.com/deis/k8s-claimer/k8s"
+)
+
+// VersionFetcher is an interface for discovering the Kubernetes version that an ACS cluster runs.
+// It has an implementation that queries the cluster's API server as well as a fake
+// implementation, to be used in unit tests
+type VersionFetcher interface {
+	// FetchVersion returns the Kubernetes version of the given cluster
+	FetchVersion(cluster *containerservice.ContainerService) (string, error)
+}
+
+// APIServerVersionFetcher is a VersionFetcher implementation that fetches the cluster's kubeconfig
+// from its master node and queries the API server's /version endpoint with it
+type APIServerVersionFetcher struct{}
+
+// NewAPIServerVersionFetcher returns a new APIServerVersionFetcher
+func NewAPIServerVersionFetcher() *APIServerVersionFetcher {
+	return &APIServerVersionFetcher{}
+}
+
+// FetchVersion is the VersionFetcher interface implementation
+func (a *APIServerVersionFetcher) FetchVersion(cluster *containerservice.ContainerService) (string, error) {
+	if cluster.Properties == nil || cluster.MasterProfile == nil || cluster.MasterProfile.Fqdn == nil {
+		return "", errNoMasterFQDN{name: *cluster.Name}
+	}
+	kubeConfig, err := FetchKubeConfig(*cluster.MasterProfile.Fqdn)
+	if err != nil {
+		return "", err
+	}
+	return k8s.ServerVersion(kubeConfig)
+}
@@ -0,0 +1,47 @@
+package azure
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/containerservice"
+	"github.com/arschles/assert"
+)
+
+func TestVersionCacheFetchesOnce(t *testing.T) {
+	name := "cluster1"
+	cluster := &containerservice.ContainerService{ID: &name, Name: &name}
+	fetcher := NewFakeVersionFetcher(map[string]string{name: "v1.6.6"}, nil)
+	cache := NewVersionCache(fetcher)
+	for i := 0; i < 3; i++ {
+		ver, err := cache.Version(cluster)
+		assert.NoErr(t, err)
+		assert.Equal(t, ver, "1.6.6", "cluster version")
+	}
+	assert.Equal(t, len(fetcher.Fetched), 1, "number of version fetches")
+}
+
+func TestVersionCacheOrchestratorTag(t *testing.T) {
+	name := "cluster1"
+	tag := "Kubernetes:1.7.2"
+	cluster := &containerservice.ContainerService{
+		ID:   &name,
+		Name: &name,
+		Tags: &map[string]*string{orchestratorTagName: &tag},
+	}
+	fetcher := NewFakeVersionFetcher(nil, errors.New("should not be called"))
+	ver, err := NewVersionCache(fetcher).Version(cluster)
+	assert.NoErr(t, err)
+	assert.Equal(t, ver, "1.7.2", "cluster version")
+	assert.Equal(t, len(fetcher.Fetched), 0, "number of version fetches")
+}
+
+func TestVersionCacheFetchError(t *testing.T) {
+	name := "cluster1"
+	cluster := &containerservice.ContainerService{ID: &name, Name: &name}
+	fetchErr := errors.New("unreachable")
+	cache := NewVersionCache(NewFakeVersionFetcher(nil, fetchErr))
+	ver, err := cache.Version(cluster)
+	assert.Err(t, fetchErr, err)
+	assert.Equal(t, ver, "", "cluster version")
+}
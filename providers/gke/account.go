@@ -1,10 +1,15 @@
 package gke
 
 import (
+	"context"
+	"io/ioutil"
 	"net/http"
 
+	"github.com/deis/k8s-claimer/config"
 	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
 	"golang.org/x/oauth2/jwt"
+	compute "google.golang.org/api/compute/v1"
 	container "google.golang.org/api/container/v1"
 )
 
@@ -51,3 +56,50 @@ func GetContainerService(email string, pk PrivateKey) (*container.Service, error
 	cl := getOAuthClient(conf)
 	return container.New(cl)
 }
+
+// NewContainerService creates a GKE client that authenticates with the credentials conf picks.
+// Key files are read and Application Default Credentials are looked up right away, so that
+// missing credentials are reported here rather than on the first GKE API call
+func NewContainerService(ctx context.Context, conf *config.Google) (*container.Service, error) {
+	cl, err := newOAuthClient(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+	return container.New(cl)
+}
+
+// NewComputeService creates a Compute Engine client that authenticates like NewContainerService.
+// It's used to read the sizes of node pools, which the GKE API doesn't report
+func NewComputeService(ctx context.Context, conf *config.Google) (*compute.Service, error) {
+	cl, err := newOAuthClient(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+	return compute.New(cl)
+}
+
+// newOAuthClient creates an OAuth2 capable HTTP client from the credentials conf picks
+func newOAuthClient(ctx context.Context, conf *config.Google) (*http.Client, error) {
+	src, err := conf.CredentialsSource()
+	if err != nil {
+		return nil, err
+	}
+	switch src {
+	case config.GoogleCredentialsAccountFile:
+		return getOAuthClient(getJWTConf(conf.AccountFile.ClientEmail, PrivateKey(conf.AccountFile.PrivateKey))), nil
+	case config.GoogleCredentialsKeyFile:
+		keyJSON, err := ioutil.ReadFile(conf.AccountFilePath)
+		if err != nil {
+			return nil, err
+		}
+		jwtConf, err := google.JWTConfigFromJSON(keyJSON, ContainerScope)
+		if err != nil {
+			return nil, err
+		}
+		return jwtConf.Client(ctx), nil
+	case config.GoogleCredentialsMetadata:
+		return oauth2.NewClient(ctx, google.ComputeTokenSource("")), nil
+	default:
+		return google.DefaultClient(ctx, ContainerScope)
+	}
+}
@@ -0,0 +1,35 @@
+package gke
+
+import (
+	"context"
+
+	container "google.golang.org/api/container/v1"
+
+	"github.com/deis/k8s-claimer/config"
+	"github.com/deis/k8s-claimer/inventory"
+)
+
+// CachedClusterLister is a ClusterLister that keeps the clusters of each project and zone that it
+// lists in an inventory.Cache. Run and Invalidate are promoted from the cache. It's safe for
+// concurrent use
+type CachedClusterLister struct {
+	*inventory.Cache
+	lister ClusterLister
+}
+
+// NewCachedClusterLister creates a new, empty CachedClusterLister that lists clusters with lister
+func NewCachedClusterLister(lister ClusterLister, conf config.Inventory) *CachedClusterLister {
+	return &CachedClusterLister{Cache: inventory.NewCache(conf), lister: lister}
+}
+
+// List is the ClusterLister interface implementation
+func (c *CachedClusterLister) List(ctx context.Context, projectID, zone string) (*container.ListClustersResponse, error) {
+	key := "the GKE clusters in " + projectID + "/" + zone
+	result, err := c.Get(ctx, key, func(ctx context.Context) (interface{}, error) {
+		return c.lister.List(ctx, projectID, zone)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*container.ListClustersResponse), nil
+}
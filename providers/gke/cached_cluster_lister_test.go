@@ -0,0 +1,73 @@
+package gke
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/config"
+	"github.com/deis/k8s-claimer/inventory"
+	"github.com/deis/k8s-claimer/leases"
+	container "google.golang.org/api/container/v1"
+)
+
+// countingClusterLister is a ClusterLister that counts its calls and returns resp and err
+type countingClusterLister struct {
+	resp  *container.ListClustersResponse
+	err   error
+	calls int
+}
+
+func (c *countingClusterLister) List(ctx context.Context, projectID, zone string) (*container.ListClustersResponse, error) {
+	c.calls++
+	return c.resp, c.err
+}
+
+func TestCachedClusterLister(t *testing.T) {
+	lister := &countingClusterLister{resp: &container.ListClustersResponse{Clusters: []*container.Cluster{
+		&container.Cluster{Name: "cluster1"},
+	}}}
+	cache := NewCachedClusterLister(lister, config.Inventory{Enabled: true, RefreshInterval: time.Minute})
+
+	resp, err := cache.List(context.Background(), "proj1", "zone1")
+	assert.NoErr(t, err)
+	assert.Equal(t, resp, lister.resp, "listed clusters")
+	_, err = cache.List(context.Background(), "proj1", "zone1")
+	assert.NoErr(t, err)
+	assert.Equal(t, lister.calls, 1, "number of calls after a cached list")
+
+	// other projects and zones are listed separately
+	lister.err = errors.New("test error")
+	_, err = cache.List(context.Background(), "proj2", "zone1")
+	assert.Equal(t, err, lister.err, "error")
+	assert.Equal(t, lister.calls, 2, "number of calls after listing another zone")
+}
+
+func TestCachedClusterListerInvalidate(t *testing.T) {
+	lister := &countingClusterLister{resp: &container.ListClustersResponse{}}
+	cache := NewCachedClusterLister(lister, config.Inventory{Enabled: true, RefreshInterval: time.Minute})
+	_, err := cache.List(context.Background(), "proj1", "zone1")
+	assert.NoErr(t, err)
+	inventory.Invalidate(cache)
+	_, err = cache.List(context.Background(), "proj1", "zone1")
+	assert.NoErr(t, err)
+	assert.Equal(t, lister.calls, 2, "number of calls")
+}
+
+func TestGetClusterFromLeaseInvalidatesMissingCluster(t *testing.T) {
+	lister := &countingClusterLister{resp: &container.ListClustersResponse{}}
+	cache := NewCachedClusterLister(lister, config.Inventory{Enabled: true, RefreshInterval: time.Minute})
+	scopes := []config.GKEScope{{ProjectID: "proj1", Location: "zone1"}}
+	_, err := cache.List(context.Background(), "proj1", "zone1")
+	assert.NoErr(t, err)
+
+	lister.resp = &container.ListClustersResponse{Clusters: []*container.Cluster{
+		&container.Cluster{Name: "created"},
+	}}
+	cluster, _, err := GetClusterFromLease(context.Background(), &leases.Lease{ClusterName: "created"}, cache, scopes)
+	assert.NoErr(t, err)
+	assert.Equal(t, cluster.Name, "created", "cluster name")
+	assert.Equal(t, lister.calls, 2, "number of calls")
+}
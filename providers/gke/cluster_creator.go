@@ -0,0 +1,22 @@
+package gke
+
+import (
+	container "google.golang.org/api/container/v1"
+)
+
+// ClusterCreator is an interface for creating and deleting GKE clusters and following those
+// operations. It has an adapter for the standard *(google.golang.org/api/container/v1).Service as
+// well as a fake implementation, to be used in unit tests. Use this as a parameter in your funcs
+// so that they can be more easily unit tested
+type ClusterCreator interface {
+	// Create starts creating a cluster in the given project and zone, and returns the operation
+	// that tracks the creation
+	Create(projectID, zone string, req *container.CreateClusterRequest) (*container.Operation, error)
+	// GetOperation returns the current state of the operation with the given name
+	GetOperation(projectID, zone, operationID string) (*container.Operation, error)
+	// Get returns the cluster with the given name
+	Get(projectID, zone, clusterID string) (*container.Cluster, error)
+	// Delete starts deleting the cluster with the given name, and returns the operation that
+	// tracks the deletion
+	Delete(projectID, zone, clusterID string) (*container.Operation, error)
+}
@@ -1,6 +1,8 @@
 package gke
 
 import (
+	"context"
+
 	container "google.golang.org/api/container/v1"
 )
 
@@ -9,6 +11,7 @@ import (
 // to be used in unit tests. Use this as a parameter in your funcs so that they can be more
 // easily unit tested
 type ClusterLister interface {
-	// List lists all of the clusters in the given project and zone
-	List(projectID, zone string) (*container.ListClustersResponse, error)
+	// List lists all of the clusters in the given project and location, which is a zone, a region
+	// or - for all of them. It gives up when ctx is done
+	List(ctx context.Context, projectID, zone string) (*container.ListClustersResponse, error)
 }
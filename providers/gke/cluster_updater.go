@@ -0,0 +1,17 @@
+package gke
+
+import (
+	container "google.golang.org/api/container/v1"
+)
+
+// ClusterUpdater is an interface for updating GKE clusters, i.e. upgrading their masters and
+// node pools, and following those updates. It has an adapter for the standard
+// *(google.golang.org/api/container/v1).Service as well as a fake implementation, to be used in
+// unit tests. Use this as a parameter in your funcs so that they can be more easily unit tested
+type ClusterUpdater interface {
+	// Update starts applying update to the cluster with the given name, and returns the operation
+	// that tracks the update
+	Update(projectID, zone, clusterID string, update *container.ClusterUpdate) (*container.Operation, error)
+	// GetOperation returns the current state of the operation with the given name
+	GetOperation(projectID, zone, operationID string) (*container.Operation, error)
+}
@@ -0,0 +1,126 @@
+package gke
+
+import (
+	"fmt"
+	"net/http"
+
+	container "google.golang.org/api/container/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	createClusterOperation = "CREATE_CLUSTER"
+	deleteClusterOperation = "DELETE_CLUSTER"
+)
+
+// FakeClusterCreator is a ClusterCreator implementation for use in unit tests. Every creation or
+// deletion finishes after PollsUntilDone calls to GetOperation
+type FakeClusterCreator struct {
+	PollsUntilDone int
+	CreateErr      error
+	DeleteErr      error
+	// OperationError, if not empty, makes every creation and deletion fail with this status message
+	OperationError string
+	// Created holds the requests that Create was called with, in order
+	Created []*container.CreateClusterRequest
+	// Deleted holds the names of the clusters that Delete was called with, in order
+	Deleted []string
+
+	clusters     map[string]*container.Cluster
+	opClusters   map[string]string
+	opTypes      map[string]string
+	opPollCounts map[string]int
+}
+
+// Create is the ClusterCreator interface implementation. It records req and returns f.CreateErr
+// if it's set, and a running operation otherwise
+func (f *FakeClusterCreator) Create(projectID, zone string, req *container.CreateClusterRequest) (*container.Operation, error) {
+	f.Created = append(f.Created, req)
+	if f.CreateErr != nil {
+		return nil, f.CreateErr
+	}
+	cluster := *req.Cluster
+	cluster.Status = "PROVISIONING"
+	cluster.Zone = zone
+	cluster.Endpoint = fmt.Sprintf("10.0.0.%d", len(f.Created))
+	cluster.MasterAuth = &container.MasterAuth{}
+	cluster.CurrentMasterVersion = req.Cluster.InitialClusterVersion
+	cluster.CurrentNodeVersion = req.Cluster.InitialClusterVersion
+	f.clusters[cluster.Name] = &cluster
+	return f.startOperation(createClusterOperation, cluster.Name, zone), nil
+}
+
+// Delete is the ClusterCreator interface implementation. It records clusterID and returns
+// f.DeleteErr if it's set, and a running operation otherwise. Any cluster name can be deleted,
+// not only those created with f.Create
+func (f *FakeClusterCreator) Delete(projectID, zone, clusterID string) (*container.Operation, error) {
+	f.Deleted = append(f.Deleted, clusterID)
+	if f.DeleteErr != nil {
+		return nil, f.DeleteErr
+	}
+	if cluster, ok := f.clusters[clusterID]; ok {
+		cluster.Status = "STOPPING"
+	}
+	return f.startOperation(deleteClusterOperation, clusterID, zone), nil
+}
+
+func (f *FakeClusterCreator) startOperation(opType, clusterName, zone string) *container.Operation {
+	opName := fmt.Sprintf("operation-%d", len(f.opClusters)+1)
+	f.opClusters[opName] = clusterName
+	f.opTypes[opName] = opType
+	return &container.Operation{Name: opName, OperationType: opType, Status: "RUNNING", Zone: zone}
+}
+
+// GetOperation is the ClusterCreator interface implementation. The operation is running until it
+// was polled f.PollsUntilDone times, and done afterwards
+func (f *FakeClusterCreator) GetOperation(projectID, zone, operationID string) (*container.Operation, error) {
+	clusterName, ok := f.opClusters[operationID]
+	if !ok {
+		return nil, fmt.Errorf("no such operation %s", operationID)
+	}
+	f.opPollCounts[operationID]++
+	op := &container.Operation{Name: operationID, OperationType: f.opTypes[operationID], Status: "RUNNING", Zone: zone}
+	if f.opPollCounts[operationID] < f.PollsUntilDone {
+		return op, nil
+	}
+	op.Status = "DONE"
+	op.StatusMessage = f.OperationError
+	cluster, exists := f.clusters[clusterName]
+	switch {
+	case !exists:
+	case f.OperationError != "":
+		cluster.Status = "ERROR"
+	case op.OperationType == deleteClusterOperation:
+		delete(f.clusters, clusterName)
+	default:
+		cluster.Status = "RUNNING"
+	}
+	return op, nil
+}
+
+// Get is the ClusterCreator interface implementation. It returns a cluster that was created with
+// f.Create or added with f.Add and not deleted since, and a not found error otherwise
+func (f *FakeClusterCreator) Get(projectID, zone, clusterID string) (*container.Cluster, error) {
+	cluster, ok := f.clusters[clusterID]
+	if !ok {
+		return nil, &googleapi.Error{Code: http.StatusNotFound, Message: fmt.Sprintf("no such cluster %s", clusterID)}
+	}
+	return cluster, nil
+}
+
+// Add adds cluster to the clusters that f.Get returns, as if it had been created before f
+func (f *FakeClusterCreator) Add(cluster *container.Cluster) {
+	f.clusters[cluster.Name] = cluster
+}
+
+// NewFakeClusterCreator returns a new FakeClusterCreator
+func NewFakeClusterCreator(pollsUntilDone int, createErr error) *FakeClusterCreator {
+	return &FakeClusterCreator{
+		PollsUntilDone: pollsUntilDone,
+		CreateErr:      createErr,
+		clusters:       make(map[string]*container.Cluster),
+		opClusters:     make(map[string]string),
+		opTypes:        make(map[string]string),
+		opPollCounts:   make(map[string]int),
+	}
+}
@@ -1,15 +1,28 @@
 package gke
 
-import container "google.golang.org/api/container/v1"
+import (
+	"context"
 
-// FakeClusterLister is a ClusterLister implementation for use in unit tests
+	container "google.golang.org/api/container/v1"
+)
+
+// FakeClusterLister is a ClusterLister implementation for use in unit tests. If ScopedResps is
+// set, it holds the response for each project and zone, keyed in the project/zone format
 type FakeClusterLister struct {
-	Resp *container.ListClustersResponse
-	Err  error
+	Resp        *container.ListClustersResponse
+	Err         error
+	ScopedResps map[string]*container.ListClustersResponse
 }
 
-// List is the ClusterLister interface implementation. It just returns f.Resp, f.Err
-func (f FakeClusterLister) List(projectID, zone string) (*container.ListClustersResponse, error) {
+// List is the ClusterLister interface implementation. It just returns f.Resp, f.Err, or the
+// response in f.ScopedResps for the given project and zone if f.ScopedResps is set
+func (f FakeClusterLister) List(ctx context.Context, projectID, zone string) (*container.ListClustersResponse, error) {
+	if f.ScopedResps != nil && f.Err == nil {
+		if resp, ok := f.ScopedResps[projectID+"/"+zone]; ok {
+			return resp, nil
+		}
+		return &container.ListClustersResponse{}, nil
+	}
 	return f.Resp, f.Err
 }
 
@@ -0,0 +1,75 @@
+package gke
+
+import (
+	"fmt"
+
+	container "google.golang.org/api/container/v1"
+)
+
+const (
+	updateClusterOperation  = "UPGRADE_MASTER"
+	updateNodePoolOperation = "UPGRADE_NODES"
+)
+
+// FakeClusterUpdater is a ClusterUpdater implementation for use in unit tests. Every update is
+// done as soon as it's started, and is applied to the cluster of the same name in Clusters, if
+// there is one
+type FakeClusterUpdater struct {
+	UpdateErr error
+	// OperationError, if not empty, makes every update fail with this status message
+	OperationError string
+	// Clusters holds the clusters that updates are applied to, by name
+	Clusters map[string]*container.Cluster
+	// Updated holds the names of the clusters that Update was called with, in order, and Updates
+	// holds the updates
+	Updated []string
+	Updates []*container.ClusterUpdate
+}
+
+// Update is the ClusterUpdater interface implementation. It records the update and returns
+// f.UpdateErr if it's set, and a done operation otherwise
+func (f *FakeClusterUpdater) Update(projectID, zone, clusterID string, update *container.ClusterUpdate) (*container.Operation, error) {
+	f.Updated = append(f.Updated, clusterID)
+	f.Updates = append(f.Updates, update)
+	if f.UpdateErr != nil {
+		return nil, f.UpdateErr
+	}
+	opType := updateClusterOperation
+	if update.DesiredNodePoolId != "" {
+		opType = updateNodePoolOperation
+	}
+	op := &container.Operation{
+		Name:          fmt.Sprintf("operation-%d", len(f.Updated)),
+		OperationType: opType,
+		Status:        "DONE",
+		StatusMessage: f.OperationError,
+		Zone:          zone,
+	}
+	cluster, ok := f.Clusters[clusterID]
+	if !ok || f.OperationError != "" {
+		return op, nil
+	}
+	if update.DesiredMasterVersion != "" {
+		cluster.CurrentMasterVersion = update.DesiredMasterVersion
+	}
+	for _, nodePool := range cluster.NodePools {
+		if nodePool.Name == update.DesiredNodePoolId && update.DesiredNodeVersion != "" {
+			nodePool.Version = update.DesiredNodeVersion
+			cluster.CurrentNodeVersion = update.DesiredNodeVersion
+		}
+	}
+	return op, nil
+}
+
+// GetOperation is the ClusterUpdater interface implementation. Every operation is done
+func (f *FakeClusterUpdater) GetOperation(projectID, zone, operationID string) (*container.Operation, error) {
+	return &container.Operation{Name: operationID, Status: "DONE", StatusMessage: f.OperationError, Zone: zone}, nil
+}
+
+// NewFakeClusterUpdater returns a new FakeClusterUpdater that applies updates to clusters
+func NewFakeClusterUpdater(clusters []*container.Cluster, updateErr error) *FakeClusterUpdater {
+	return &FakeClusterUpdater{
+		UpdateErr: updateErr,
+		Clusters:  clusterNamesToMap(clusters),
+	}
+}
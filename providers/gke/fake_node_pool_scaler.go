@@ -0,0 +1,52 @@
+package gke
+
+import (
+	"fmt"
+
+	container "google.golang.org/api/container/v1"
+)
+
+// FakeNodePoolScaler is a NodePoolScaler implementation for use in unit tests. Every resize is
+// done as soon as it's started
+type FakeNodePoolScaler struct {
+	SetSizeErr error
+	// Sizes holds the size each node pool was last resized to, keyed by "cluster/node pool"
+	Sizes map[string]int64
+	// Resized holds the "cluster/node pool" keys that SetSize was called with, in order
+	Resized []string
+}
+
+// SetSize is the NodePoolScaler interface implementation. It records the new size and returns
+// f.SetSizeErr if it's set, and a done operation otherwise
+func (f *FakeNodePoolScaler) SetSize(projectID, zone, clusterID, nodePoolID string, nodeCount int64) (*container.Operation, error) {
+	key := clusterID + "/" + nodePoolID
+	f.Resized = append(f.Resized, key)
+	if f.SetSizeErr != nil {
+		return nil, f.SetSizeErr
+	}
+	f.Sizes[key] = nodeCount
+	opName := fmt.Sprintf("operation-%d", len(f.Resized))
+	return &container.Operation{Name: opName, OperationType: "SET_NODE_POOL_SIZE", Status: "DONE", Zone: zone}, nil
+}
+
+// GetSize is the NodePoolScaler interface implementation. It returns the size that nodePool was
+// last resized to, or its initial node count if it never was
+func (f *FakeNodePoolScaler) GetSize(projectID, zone, clusterID string, nodePool *container.NodePool) (int64, error) {
+	if size, ok := f.Sizes[clusterID+"/"+nodePool.Name]; ok {
+		return size, nil
+	}
+	return nodePool.InitialNodeCount, nil
+}
+
+// GetOperation is the NodePoolScaler interface implementation. Every operation is done
+func (f *FakeNodePoolScaler) GetOperation(projectID, zone, operationID string) (*container.Operation, error) {
+	return &container.Operation{Name: operationID, OperationType: "SET_NODE_POOL_SIZE", Status: "DONE", Zone: zone}, nil
+}
+
+// NewFakeNodePoolScaler returns a new FakeNodePoolScaler
+func NewFakeNodePoolScaler(setSizeErr error) *FakeNodePoolScaler {
+	return &FakeNodePoolScaler{
+		SetSizeErr: setSizeErr,
+		Sizes:      make(map[string]int64),
+	}
+}
@@ -1,15 +1,21 @@
 package gke
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"math/rand"
-	"regexp"
 	"time"
 
 	container "google.golang.org/api/container/v1"
+	"k8s.io/client-go/pkg/labels"
 
+	"github.com/deis/k8s-claimer/api"
+	"github.com/deis/k8s-claimer/config"
+	"github.com/deis/k8s-claimer/inventory"
+	"github.com/deis/k8s-claimer/k8s"
 	"github.com/deis/k8s-claimer/leases"
+	"github.com/deis/k8s-claimer/selection"
+	"github.com/deis/k8s-claimer/semver"
 )
 
 type errNoAvailableOrExpiredClustersFound struct{}
@@ -31,24 +37,35 @@ func (e errExpiredLeaseGKEMissing) Error() string {
 	return fmt.Sprintf("cluster %s has an expired lease but does not exist in GKE", e.clusterName)
 }
 
-// searchForFreeCluster looks for an available GKE cluster to lease.
-// It will try and match clusterRegex if possible or clusterVersion
+// searchForFreeClusters looks for available GKE clusters to lease, and returns them in the order
+// they should be tried. It will only consider clusters that match the criteria in req. Expired
+// leases are reclaimed, and the clusters of those that recycler recycles are marked as deleting
+// instead of being leased again, so that recycler recreates them. recycler may be nil. The
+// credentials of other reclaimed leases are marked unrevoked, for k8s.CredentialRevoker
 //
 // Returns errNoAvailableOrExpiredClustersFound if it found no free or expired lease
 // Returns errExpiredLeaseGKEMissing if it found an expired lease but the cluster associated with
 // that lease doesn't exist in GKE
-func searchForFreeCluster(clusterMap *Map, leaseMap *leases.Map, clusterRegex string, clusterVersion string) (*container.Cluster, error) {
+func searchForFreeClusters(clusterMap *Map, leaseMap *leases.Map, req *api.CreateLeaseReq, recycler *Recycler) ([]*container.Cluster, error) {
 	uuidAndLeases, expiredLeaseErr := findExpiredLeases(leaseMap)
 	if expiredLeaseErr == nil {
 		for _, expiredLease := range uuidAndLeases {
 			leaseMap.DeleteLease(expiredLease.UUID)
+			if exprTime, err := expiredLease.Lease.ExpirationTime(); err == nil {
+				leaseMap.MarkReleased(expiredLease.Lease.ClusterID(), exprTime)
+			}
+			if recycler.recyclesLease(expiredLease.Lease) {
+				leaseMap.MarkRecycling(expiredLease.Lease.ClusterID(), leases.RecycleDeleting, time.Now())
+			} else if expiredLease.Lease.ServiceAccount != "" {
+				leaseMap.MarkUnrevoked(expiredLease.Lease.ClusterID(), expiredLease.Lease.ServiceAccount)
+			}
 		}
 	}
-	cluster, err := findUnusedGKECluster(clusterMap, leaseMap, clusterRegex, clusterVersion)
+	clusters, err := findUnusedGKEClusters(clusterMap, leaseMap, req)
 	if err != nil {
 		return nil, errNoAvailableOrExpiredClustersFound{}
 	}
-	return cluster, nil
+	return clusters, nil
 }
 
 // findExpiredLeases searches in the leases in the svc annotations and returns the cluster name of
@@ -76,74 +93,93 @@ func findExpiredLeases(leaseMap *leases.Map) ([]*leases.UUIDAndLease, error) {
 	return nil, errNoExpiredLeases
 }
 
-// findUnusedGKECluster finds a GKE cluster that's not currently in use according to the
-// annotations in svc. It will also attempt to match the clusterRegex passed in if possible.
+// findUnusedGKEClusters finds the GKE clusters that aren't currently in use according to the
+// annotations in svc, in the order they should be tried. Only clusters that match the cluster
+// regex, version constraint and label selector in req (whichever are given) are considered, and
+// every one of them is considered. Clusters that are being recycled or upgraded are never free.
+// The selection strategy in req orders the free clusters, and the hints in req (preferred
+// cluster, affinity key and clusters to avoid) then reorder its choices. If a version constraint
+// is given, clusters with higher versions are preferred among those the strategy considers equal.
 // Returns errUnusedGKEClusterNotFound if none is found
-func findUnusedGKECluster(clusterMap *Map, leaseMap *leases.Map, clusterRegex string, clusterVersion string) (*container.Cluster, error) {
-	if clusterRegex != "" {
-		return findUnusuedGKEClusterByName(clusterMap, leaseMap, clusterRegex)
-	} else if clusterVersion != "" {
-		return findUnusedGKEClusterByVersion(clusterMap, leaseMap, clusterVersion)
-	} else {
-		return findRandomUnusuedGKECluster(clusterMap, leaseMap)
+func findUnusedGKEClusters(clusterMap *Map, leaseMap *leases.Map, req *api.CreateLeaseReq) ([]*container.Cluster, error) {
+	strategy, err := req.Strategy()
+	if err != nil {
+		return nil, err
 	}
-}
-
-// findUnusuedGKEClusterByName attempts to find a unused GKE cluster that matches the regex passed in via the cli.
-func findUnusuedGKEClusterByName(clusterMap *Map, leaseMap *leases.Map, clusterRegex string) (*container.Cluster, error) {
-	regex, err := regexp.Compile(clusterRegex)
+	clusterNames, err := findMatchingClusterNames(clusterMap, req)
 	if err != nil {
 		return nil, err
 	}
-	for _, clusterName := range clusterMap.Names() {
-		if regex.MatchString(clusterName) {
-			cluster, err := checkLease(clusterMap, leaseMap, clusterName)
-			if err == nil {
-				return cluster, nil
-			}
+	candidates := make([]selection.Candidate, 0, len(clusterNames))
+	for _, clusterName := range clusterNames {
+		status := leaseMap.ClusterStatus(leaseID(clusterName))
+		if status.IsRecycling() || status.IsUpgrading() {
+			continue
 		}
+		cluster, _ := clusterMap.ClusterByName(clusterName)
+		_, isLeased := leaseMap.LeaseByClusterName(leaseID(clusterName))
+		ver, verErr := semver.Parse(clusterVersion(cluster, req.VersionSource()))
+		candidates = append(candidates, selection.Candidate{
+			Name:       clusterName,
+			Version:    ver,
+			HasVersion: verErr == nil,
+			Status:     status,
+			Leased:     isLeased,
+		})
+	}
+	ordered := resolveHints(clusterMap, req.Hints()).Apply(strategy.Order(candidates, req.ClusterVersion != ""), candidates)
+	if len(ordered) == 0 {
+		return nil, errUnusedGKEClusterNotFound
+	}
+	ret := make([]*container.Cluster, len(ordered))
+	for i, clusterName := range ordered {
+		ret[i], _ = clusterMap.ClusterByName(clusterName)
 	}
-	return nil, errUnusedGKEClusterNotFound
+	return ret, nil
 }
 
-// findUnusedGKEClusterByVersion attempts to find an unused GKE cluster that matches the version passed in via the CLI.
-func findUnusedGKEClusterByVersion(clusterMap *Map, leaseMap *leases.Map, clusterVersion string) (*container.Cluster, error) {
-	clusterNames := clusterMap.ClusterNamesByVersion(clusterVersion)
-	if len(clusterNames) > 0 {
-		for tries := 0; tries < 10; tries++ {
-			clusterName := clusterNames[rand.Intn(len(clusterNames))]
-			cluster, err := checkLease(clusterMap, leaseMap, clusterName)
-			if err == nil {
-				return cluster, nil
-			}
-		}
+// resolveHints returns hints with the clusters it names replaced by their IDs in clusterMap, so
+// that clusters can be named by their bare name as long as it's unambiguous
+func resolveHints(clusterMap *Map, hints selection.Hints) selection.Hints {
+	if hints.PreferredCluster != "" {
+		hints.PreferredCluster = clusterMap.resolve(hints.PreferredCluster)
+	}
+	avoid := make([]string, len(hints.Avoid))
+	for i, name := range hints.Avoid {
+		avoid[i] = clusterMap.resolve(name)
 	}
-	return nil, errUnusedGKEClusterNotFound
+	hints.Avoid = avoid
+	return hints
 }
 
-// findUnusuedGKECluster attempts to find a random unused GKE cluster
-func findRandomUnusuedGKECluster(clusterMap *Map, leaseMap *leases.Map) (*container.Cluster, error) {
+// findMatchingClusterNames returns the IDs of all clusters in clusterMap that match the
+// cluster regex, version constraint and label selector in req. The regex is matched against
+// cluster names, not IDs
+func findMatchingClusterNames(clusterMap *Map, req *api.CreateLeaseReq) ([]string, error) {
 	clusterNames := clusterMap.Names()
-	if len(clusterNames) > 0 {
-		for tries := 0; tries < 10; tries++ {
-			clusterName := clusterNames[rand.Intn(len(clusterNames))]
-			cluster, err := checkLease(clusterMap, leaseMap, clusterName)
-			if err == nil {
-				return cluster, nil
-			}
+	if req.ClusterVersion != "" {
+		constraint, err := req.VersionConstraint()
+		if err != nil {
+			return nil, err
 		}
+		clusterNames = clusterMap.ClusterNamesByVersion(constraint, req.VersionSource())
 	}
-	return nil, errUnusedGKEClusterNotFound
-}
-
-// checkLease takes a clusterName and determines if there is an available lease
-func checkLease(clusterMap *Map, leaseMap *leases.Map, clusterName string) (*container.Cluster, error) {
-	cluster, _ := clusterMap.ClusterByName(clusterName)
-	_, isLeased := leaseMap.LeaseByClusterName(clusterName)
-	if !isLeased {
-		return cluster, nil
+	regex, err := req.ClusterNameRegexps()
+	if err != nil {
+		return nil, err
 	}
-	return nil, errUnusedGKEClusterNotFound
+	selector, err := req.LabelSelector()
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, clusterName := range clusterNames {
+		cluster, _ := clusterMap.ClusterByName(clusterName)
+		if regex.MatchString(cluster.Name) && selector.Matches(labels.Set(cluster.ResourceLabels)) {
+			ret = append(ret, clusterName)
+		}
+	}
+	return ret, nil
 }
 
 type errNoSuchCluster struct {
@@ -154,16 +190,52 @@ func (e errNoSuchCluster) Error() string {
 	return fmt.Sprintf("no such cluster %s", e.name)
 }
 
-// GetClusterFromLease takes a lease and will find the appropriate cluster
-func GetClusterFromLease(lease *leases.Lease, clusterLister ClusterLister, projID, zone string) (*container.Cluster, error) {
-	clusterMap, err := ParseMapFromGKE(clusterLister, projID, zone)
+// IsNoSuchCluster returns true if err means that GetClusterFromLease found no leased cluster
+func IsNoSuchCluster(err error) bool {
+	_, ok := err.(errNoSuchCluster)
+	return ok
+}
+
+// GetClusterFromLease takes a lease and will find the appropriate cluster, along with the scope
+// it's in. The cluster is looked for in the project and location that the lease recorded, or in
+// every one of scopes if it recorded none. The leased cluster is looked for whether or not it's
+// still a member of the pool, so that it can always be released. If clusterLister keeps clusters
+// in memory and the cluster isn't among them, they're invalidated and listed again
+func GetClusterFromLease(ctx context.Context, lease *leases.Lease, clusterLister ClusterLister, scopes []config.GKEScope) (*container.Cluster, config.GKEScope, error) {
+	clusterID := lease.ClusterName
+	if lease.Project != "" && lease.Location != "" {
+		scopes = []config.GKEScope{{ProjectID: lease.Project, Location: lease.Location}}
+		clusterID = QualifiedClusterID(scopes[0], clusterNameFromID(clusterID))
+	}
+	clusterMap, err := ParseMapFromGKE(ctx, clusterLister, scopes, config.PoolMembership{})
 	if err != nil {
-		return nil, err
+		return nil, config.GKEScope{}, err
+	}
+	cl, exists := clusterMap.ClusterByName(clusterID)
+	if _, cached := clusterLister.(inventory.Invalidator); !exists && cached {
+		inventory.Invalidate(clusterLister)
+		if clusterMap, err = ParseMapFromGKE(ctx, clusterLister, scopes, config.PoolMembership{}); err != nil {
+			return nil, config.GKEScope{}, err
+		}
+		cl, exists = clusterMap.ClusterByName(clusterID)
 	}
-	cl, exists := clusterMap.ClusterByName(lease.ClusterName)
 	if !exists {
-		return nil, errNoSuchCluster{name: lease.ClusterName}
+		return nil, config.GKEScope{}, errNoSuchCluster{name: lease.ClusterName}
 	}
+	scope, _ := clusterMap.Scope(clusterID)
+	return cl, scope, nil
+}
 
-	return cl, nil
+// AdminKubeConfig returns the admin kubeconfig of the cluster of lease, which is looked for in
+// scopes unless the lease records its own. It's a k8s.AdminKubeConfigFunc, so it returns nil and
+// no error if the cluster doesn't exist anymore
+func AdminKubeConfig(ctx context.Context, lease *leases.Lease, clusterLister ClusterLister, scopes []config.GKEScope) (*k8s.KubeConfig, error) {
+	cluster, _, err := GetClusterFromLease(ctx, lease, clusterLister, scopes)
+	if IsNoSuchCluster(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return k8s.CreateKubeConfigFromCluster(cluster)
 }
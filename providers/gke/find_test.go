@@ -1,12 +1,16 @@
 package gke
 
 import (
+	"context"
 	"reflect"
 	"testing"
 	"time"
 
 	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/api"
+	"github.com/deis/k8s-claimer/config"
 	"github.com/deis/k8s-claimer/leases"
+	"github.com/deis/k8s-claimer/selection"
 	"github.com/deis/k8s-claimer/testutil"
 	"github.com/pborman/uuid"
 	container "google.golang.org/api/container/v1"
@@ -21,10 +25,10 @@ func TestSearchForFreeClusterNoneAvailable(t *testing.T) {
 	leaseMap, err := leases.ParseMapFromAnnotations(map[string]string{})
 	assert.NoErr(t, err)
 	clusterLister := FakeClusterLister{Err: nil, Resp: &container.ListClustersResponse{Clusters: nil}}
-	clusterMap, err := ParseMapFromGKE(clusterLister, "", "")
+	clusterMap, err := ParseMapFromGKE(context.Background(), clusterLister, nil, config.PoolMembership{})
 	assert.NoErr(t, err)
-	cluster, err := searchForFreeCluster(clusterMap, leaseMap, "", "")
-	assert.Nil(t, cluster, "cluster")
+	clusters, err := searchForFreeClusters(clusterMap, leaseMap, &api.CreateLeaseReq{}, nil)
+	assert.Equal(t, len(clusters), 0, "number of clusters")
 	switch tErr := err.(type) {
 	case errNoAvailableOrExpiredClustersFound:
 	default:
@@ -43,10 +47,10 @@ func TestSearchForClusterNoLeaseFound(t *testing.T) {
 		Err:  nil,
 		Resp: &container.ListClustersResponse{Clusters: nil},
 	}
-	clusterMap, err := ParseMapFromGKE(clusterLister, "", "")
+	clusterMap, err := ParseMapFromGKE(context.Background(), clusterLister, nil, config.PoolMembership{})
 	assert.NoErr(t, err)
-	cluster, err := searchForFreeCluster(clusterMap, leaseMap, "", "")
-	assert.Nil(t, cluster, "cluster")
+	clusters, err := searchForFreeClusters(clusterMap, leaseMap, &api.CreateLeaseReq{}, nil)
+	assert.Equal(t, len(clusters), 0, "number of clusters")
 	assert.Err(t, errNoAvailableOrExpiredClustersFound{}, err)
 }
 
@@ -55,6 +59,15 @@ const (
 	zone   = "test zone"
 )
 
+var (
+	scopes = []config.GKEScope{{ProjectID: projID, Location: zone}}
+)
+
+// scopedID returns the ID of the cluster with the given name in the first of scopes
+func scopedID(name string) string {
+	return QualifiedClusterID(scopes[0], name)
+}
+
 func TestFindUnusedGKEClusterByName(t *testing.T) {
 	leaseableClusters := testutil.GetGKEClusters()
 
@@ -64,13 +77,36 @@ func TestFindUnusedGKEClusterByName(t *testing.T) {
 		Err:  nil,
 	}
 
-	clusterMap, err := ParseMapFromGKE(fakeLister, projID, zone)
+	clusterMap, err := ParseMapFromGKE(context.Background(), fakeLister, scopes, config.PoolMembership{})
 	assert.NoErr(t, err)
 	leaseMap, err := leases.ParseMapFromAnnotations(nil)
 
-	unusedCluster, err := findUnusedGKECluster(clusterMap, leaseMap, "getClusterByName", "")
+	unusedClusters, err := findUnusedGKEClusters(clusterMap, leaseMap, &api.CreateLeaseReq{ClusterRegex: "getClusterByName"})
 	assert.NoErr(t, err)
-	assert.Equal(t, unusedCluster.Name, "getClusterByName", "free cluster name")
+	assert.Equal(t, unusedClusters[0].Name, "getClusterByName", "free cluster name")
+}
+
+func TestFindUnusedGKEClusterByServerRegexes(t *testing.T) {
+	fakeLister := &FakeClusterLister{
+		Resp: &container.ListClustersResponse{Clusters: testutil.GetGKEClusters()},
+		Err:  nil,
+	}
+	clusterMap, err := ParseMapFromGKE(context.Background(), fakeLister, scopes, config.PoolMembership{})
+	assert.NoErr(t, err)
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+
+	// the regexes that the server sets, such as from its policy, narrow the request's own regex
+	unusedClusters, err := findUnusedGKEClusters(clusterMap, leaseMap, &api.CreateLeaseReq{
+		ClusterRegex:   "^getCluster",
+		ClusterRegexes: []string{"ByName$"},
+	})
+	assert.NoErr(t, err)
+	assert.Equal(t, len(unusedClusters), 1, "number of free clusters")
+	assert.Equal(t, unusedClusters[0].Name, "getClusterByName", "free cluster name")
+
+	_, err = findUnusedGKEClusters(clusterMap, leaseMap, &api.CreateLeaseReq{ClusterRegexes: []string{"^nothing-matches$"}})
+	assert.Err(t, errUnusedGKEClusterNotFound, err)
 }
 
 func TestFindUnusedGKEClusterByVersion(t *testing.T) {
@@ -82,14 +118,88 @@ func TestFindUnusedGKEClusterByVersion(t *testing.T) {
 		Err:  nil,
 	}
 
-	clusterMap, err := ParseMapFromGKE(fakeLister, projID, zone)
+	clusterMap, err := ParseMapFromGKE(context.Background(), fakeLister, scopes, config.PoolMembership{})
+	assert.NoErr(t, err)
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+
+	unusedClusters, err := findUnusedGKEClusters(clusterMap, leaseMap, &api.CreateLeaseReq{ClusterVersion: "1.1.1"})
+	assert.NoErr(t, err)
+	assert.Equal(t, unusedClusters[0].Name, "getClusterByVersion", "free cluster name")
+	assert.Equal(t, unusedClusters[0].CurrentNodeVersion, "1.1.1", "free cluster version")
+}
+
+func TestFindUnusedGKEClusterByVersionConstraint(t *testing.T) {
+	fakeLister := &FakeClusterLister{
+		Resp: &container.ListClustersResponse{Clusters: []*container.Cluster{
+			&container.Cluster{Name: "old", CurrentMasterVersion: "1.7.8-gke.0", CurrentNodeVersion: "1.6.11-gke.0"},
+			&container.Cluster{Name: "new", CurrentMasterVersion: "1.7.12-gke.1", CurrentNodeVersion: "1.7.12-gke.1"},
+			&container.Cluster{Name: "next", CurrentMasterVersion: "1.8.1-gke.0", CurrentNodeVersion: "1.8.1-gke.0"},
+		}},
+	}
+	clusterMap, err := ParseMapFromGKE(context.Background(), fakeLister, scopes, config.PoolMembership{})
+	assert.NoErr(t, err)
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+
+	// the highest matching version wins
+	unusedClusters, err := findUnusedGKEClusters(clusterMap, leaseMap, &api.CreateLeaseReq{ClusterVersion: "~1.7", ClusterVersionSource: api.VersionSourceMaster})
+	assert.NoErr(t, err)
+	assert.Equal(t, unusedClusters[0].Name, "new", "free cluster name")
+
+	// fall back to lower versions when the highest is leased
+	leaseMap.CreateLease(uuid.NewUUID(), leases.NewLease("new", time.Now().Add(1*time.Hour)))
+	unusedClusters, err = findUnusedGKEClusters(clusterMap, leaseMap, &api.CreateLeaseReq{ClusterVersion: ">=1.6 <1.8", ClusterVersionSource: api.VersionSourceMaster})
+	assert.NoErr(t, err)
+	assert.Equal(t, unusedClusters[0].Name, "old", "free cluster name")
+
+	// node versions are matched separately from master versions
+	_, err = findUnusedGKEClusters(clusterMap, leaseMap, &api.CreateLeaseReq{ClusterVersion: "1.7.x", ClusterVersionSource: api.VersionSourceNode})
+	assert.Err(t, errUnusedGKEClusterNotFound, err)
+}
+
+func TestFindUnusedGKEClusterCombinedCriteria(t *testing.T) {
+	fakeLister := &FakeClusterLister{
+		Resp: &container.ListClustersResponse{Clusters: []*container.Cluster{
+			&container.Cluster{
+				Name:               "ci-gpu",
+				CurrentNodeVersion: "1.7.8-gke.0",
+				ResourceLabels:     map[string]string{"gpu": "true", "region": "us-west"},
+			},
+			&container.Cluster{
+				Name:               "ci-cpu-old",
+				CurrentNodeVersion: "1.6.11-gke.0",
+				ResourceLabels:     map[string]string{"gpu": "false", "region": "us-west"},
+			},
+			&container.Cluster{
+				Name:               "ci-cpu",
+				CurrentNodeVersion: "1.7.8-gke.0",
+				ResourceLabels:     map[string]string{"gpu": "false", "region": "us-west"},
+			},
+			&container.Cluster{
+				Name:               "staging-cpu",
+				CurrentNodeVersion: "1.7.8-gke.0",
+				ResourceLabels:     map[string]string{"gpu": "false", "region": "us-west"},
+			},
+		}},
+	}
+	clusterMap, err := ParseMapFromGKE(context.Background(), fakeLister, scopes, config.PoolMembership{})
 	assert.NoErr(t, err)
 	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
 
-	unusedCluster, err := findUnusedGKECluster(clusterMap, leaseMap, "", "1.1.1")
+	req := &api.CreateLeaseReq{
+		ClusterRegex:    "^ci-",
+		ClusterVersion:  "1.7",
+		ClusterSelector: "gpu=false,region=us-west",
+	}
+	unusedClusters, err := findUnusedGKEClusters(clusterMap, leaseMap, req)
 	assert.NoErr(t, err)
-	assert.Equal(t, unusedCluster.Name, "getClusterByVersion", "free cluster name")
-	assert.Equal(t, unusedCluster.CurrentNodeVersion, "1.1.1", "free cluster version")
+	assert.Equal(t, unusedClusters[0].Name, "ci-cpu", "free cluster name")
+
+	// the only cluster matching all criteria is leased
+	leaseMap.CreateLease(uuid.NewUUID(), leases.NewLease("ci-cpu", time.Now().Add(1*time.Hour)))
+	_, err = findUnusedGKEClusters(clusterMap, leaseMap, req)
+	assert.Err(t, errUnusedGKEClusterNotFound, err)
 }
 
 func TestFindRandomUnusedGKECluster(t *testing.T) {
@@ -101,13 +211,136 @@ func TestFindRandomUnusedGKECluster(t *testing.T) {
 		Err:  nil,
 	}
 
-	clusterMap, err := ParseMapFromGKE(fakeLister, projID, zone)
+	clusterMap, err := ParseMapFromGKE(context.Background(), fakeLister, scopes, config.PoolMembership{})
 	assert.NoErr(t, err)
 	leaseMap, err := leases.ParseMapFromAnnotations(nil)
 
-	unusedCluster, err := findUnusedGKECluster(clusterMap, leaseMap, "", "")
+	unusedClusters, err := findUnusedGKEClusters(clusterMap, leaseMap, &api.CreateLeaseReq{})
 	assert.NoErr(t, err)
-	assert.NotNil(t, unusedCluster, "free cluster name")
+	assert.NotNil(t, unusedClusters, "free cluster name")
+}
+
+func TestFindUnusedGKEClusterExhaustive(t *testing.T) {
+	leaseableClusters := testutil.GetGKEClusters()
+	fakeLister := &FakeClusterLister{
+		Resp: &container.ListClustersResponse{Clusters: leaseableClusters},
+		Err:  nil,
+	}
+	clusterMap, err := ParseMapFromGKE(context.Background(), fakeLister, scopes, config.PoolMembership{})
+	assert.NoErr(t, err)
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	// lease everything but the last cluster
+	for _, cluster := range leaseableClusters[:len(leaseableClusters)-1] {
+		leaseMap.CreateLease(uuid.NewUUID(), leases.NewLease(cluster.Name, time.Now().Add(1*time.Hour)))
+	}
+	freeName := leaseableClusters[len(leaseableClusters)-1].Name
+	for _, strategy := range selection.Names {
+		for i := 0; i < 20; i++ {
+			unusedClusters, err := findUnusedGKEClusters(clusterMap, leaseMap, &api.CreateLeaseReq{SelectionStrategy: strategy})
+			assert.NoErr(t, err)
+			assert.Equal(t, unusedClusters[0].Name, freeName, "free cluster name for strategy "+strategy)
+		}
+	}
+}
+
+func TestFindUnusedGKEClusterSkipsRecycling(t *testing.T) {
+	clusterMap := clusterMapWith(t, testutil.GetGKEClusters()[:2])
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	leaseMap.MarkRecycling(leaseID("cluster1"), leases.RecycleCreating, time.Now())
+	unusedClusters, err := findUnusedGKEClusters(clusterMap, leaseMap, &api.CreateLeaseReq{})
+	assert.NoErr(t, err)
+	assert.Equal(t, len(unusedClusters), 1, "number of free clusters")
+	assert.Equal(t, unusedClusters[0].Name, "cluster2", "free cluster name")
+
+	leaseMap.MarkRecycleFailed(leaseID("cluster2"), time.Now(), "quota exceeded")
+	_, err = findUnusedGKEClusters(clusterMap, leaseMap, &api.CreateLeaseReq{})
+	assert.Err(t, errUnusedGKEClusterNotFound, err)
+}
+
+func TestFindUnusedGKEClusterSkipsUpgrading(t *testing.T) {
+	clusterMap := clusterMapWith(t, testutil.GetGKEClusters()[:2])
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	leaseMap.MarkUpgrading(leaseID("cluster1"), "1.8.1-gke.0", time.Now())
+	unusedClusters, err := findUnusedGKEClusters(clusterMap, leaseMap, &api.CreateLeaseReq{})
+	assert.NoErr(t, err)
+	assert.Equal(t, len(unusedClusters), 1, "number of free clusters")
+	assert.Equal(t, unusedClusters[0].Name, "cluster2", "free cluster name")
+
+	leaseMap.MarkUpgraded(leaseID("cluster1"))
+	unusedClusters, err = findUnusedGKEClusters(clusterMap, leaseMap, &api.CreateLeaseReq{})
+	assert.NoErr(t, err)
+	assert.Equal(t, len(unusedClusters), 2, "number of free clusters")
+}
+
+func TestFindUnusedGKEClusterByStrategy(t *testing.T) {
+	fakeLister := &FakeClusterLister{
+		Resp: &container.ListClustersResponse{Clusters: testutil.GetGKEClusters()},
+		Err:  nil,
+	}
+	clusterMap, err := ParseMapFromGKE(context.Background(), fakeLister, scopes, config.PoolMembership{})
+	assert.NoErr(t, err)
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	now := time.Now()
+	for i, name := range []string{"cluster1", "cluster2", "cluster3", "cluster4", "getClusterByVersion", "getClusterByName"} {
+		leaseMap.MarkLeased(leaseID(name), now.Add(-time.Duration(10-i)*time.Hour))
+		leaseMap.MarkReleased(leaseID(name), now.Add(-time.Duration(9-i)*time.Hour))
+	}
+	leaseMap.MarkCleaned(leaseID("cluster3"), now.Add(-1*time.Hour))
+	leaseMap.MarkCleaned(leaseID("cluster2"), now.Add(-2*time.Hour))
+
+	unusedClusters, err := findUnusedGKEClusters(clusterMap, leaseMap, &api.CreateLeaseReq{SelectionStrategy: selection.LeastRecentlyUsed})
+	assert.NoErr(t, err)
+	assert.Equal(t, unusedClusters[0].Name, "cluster1", "least recently used cluster")
+
+	unusedClusters, err = findUnusedGKEClusters(clusterMap, leaseMap, &api.CreateLeaseReq{SelectionStrategy: selection.MostRecentlyCleaned})
+	assert.NoErr(t, err)
+	assert.Equal(t, unusedClusters[0].Name, "cluster3", "most recently cleaned cluster")
+
+	// versions 1.1.1 and 2.2.2 each have one free cluster, the higher of them wins
+	unusedClusters, err = findUnusedGKEClusters(clusterMap, leaseMap, &api.CreateLeaseReq{SelectionStrategy: selection.BinPack})
+	assert.NoErr(t, err)
+	assert.Equal(t, unusedClusters[0].Name, "getClusterByName", "bin-packed cluster")
+
+	// once 2.2.2 is used up, 1.1.1 has the fewest free clusters
+	leaseMap.CreateLease(uuid.NewUUID(), leases.NewLease("getClusterByName", now.Add(1*time.Hour)))
+	unusedClusters, err = findUnusedGKEClusters(clusterMap, leaseMap, &api.CreateLeaseReq{SelectionStrategy: selection.BinPack})
+	assert.NoErr(t, err)
+	assert.Equal(t, unusedClusters[0].Name, "getClusterByVersion", "bin-packed cluster")
+}
+
+func TestFindUnusedGKEClusterHints(t *testing.T) {
+	fakeLister := &FakeClusterLister{
+		Resp: &container.ListClustersResponse{Clusters: testutil.GetGKEClusters()},
+		Err:  nil,
+	}
+	clusterMap, err := ParseMapFromGKE(context.Background(), fakeLister, scopes, config.PoolMembership{})
+	assert.NoErr(t, err)
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	leaseMap.MarkHeld(leaseID("cluster3"), "ci", "pipeline-1")
+
+	for i := 0; i < 20; i++ {
+		unusedClusters, err := findUnusedGKEClusters(clusterMap, leaseMap, &api.CreateLeaseReq{AffinityKey: "pipeline-1"})
+		assert.NoErr(t, err)
+		assert.Equal(t, unusedClusters[0].Name, "cluster3", "cluster with matching affinity key")
+
+		unusedClusters, err = findUnusedGKEClusters(clusterMap, leaseMap, &api.CreateLeaseReq{AffinityKey: "pipeline-1", PreferredCluster: "cluster2"})
+		assert.NoErr(t, err)
+		assert.Equal(t, unusedClusters[0].Name, "cluster2", "preferred cluster")
+
+		unusedClusters, err = findUnusedGKEClusters(clusterMap, leaseMap, &api.CreateLeaseReq{AffinityKey: "pipeline-1", AvoidClusters: []string{"cluster3"}})
+		assert.NoErr(t, err)
+		assert.True(t, unusedClusters[0].Name != "cluster3", "avoided cluster was leased")
+	}
+
+	// avoided clusters are still leased when nothing else is free
+	unusedClusters, err := findUnusedGKEClusters(clusterMap, leaseMap, &api.CreateLeaseReq{ClusterRegex: "^cluster3$", AvoidClusters: []string{"cluster3"}})
+	assert.NoErr(t, err)
+	assert.Equal(t, unusedClusters[0].Name, "cluster3", "avoided cluster")
 }
 
 func TestGetClusterFromLease(t *testing.T) {
@@ -117,7 +350,25 @@ func TestGetClusterFromLease(t *testing.T) {
 		},
 	}
 	lease := leases.NewLease(cluster1.Name, time.Now().Add(1*time.Hour))
-	cluster, err := GetClusterFromLease(lease, clusterLister, projID, zone)
+	cluster, scope, err := GetClusterFromLease(context.Background(), lease, clusterLister, scopes)
 	assert.NoErr(t, err)
 	assert.Equal(t, cluster.Name, cluster1.Name, "cluster name")
+	assert.Equal(t, scope, scopes[0], "cluster scope")
+}
+
+func TestGetClusterFromLeaseWithScope(t *testing.T) {
+	west := &container.Cluster{Name: "ci", Zone: "us-west1-a"}
+	east := &container.Cluster{Name: "ci", Zone: "us-east1-b"}
+	clusterLister := &FakeClusterLister{ScopedResps: map[string]*container.ListClustersResponse{
+		"proj1/us-west1-a": &container.ListClustersResponse{Clusters: []*container.Cluster{west}},
+		"proj2/us-east1-b": &container.ListClustersResponse{Clusters: []*container.Cluster{east}},
+	}}
+	lease := leases.NewLease("proj2/us-east1-b/ci", time.Now().Add(1*time.Hour))
+	lease.Project = "proj2"
+	lease.Location = "us-east1-b"
+	// the recorded scope is used, even if it's no longer configured
+	cluster, scope, err := GetClusterFromLease(context.Background(), lease, clusterLister, []config.GKEScope{{ProjectID: "proj1", Location: "us-west1-a"}})
+	assert.NoErr(t, err)
+	assert.True(t, cluster == east, "the cluster in the lease's scope wasn't found")
+	assert.Equal(t, scope, config.GKEScope{ProjectID: "proj2", Location: "us-east1-b"}, "cluster scope")
 }
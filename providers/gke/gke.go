@@ -8,150 +8,454 @@ import (
 	"net/http"
 	"time"
 
+	container "google.golang.org/api/container/v1"
+	apierrors "k8s.io/client-go/pkg/api/errors"
 	"k8s.io/client-go/pkg/api/v1"
 
 	"github.com/deis/k8s-claimer/api"
+	"github.com/deis/k8s-claimer/auth"
+	"github.com/deis/k8s-claimer/config"
 	"github.com/deis/k8s-claimer/htp"
+	"github.com/deis/k8s-claimer/inventory"
 	"github.com/deis/k8s-claimer/k8s"
 	"github.com/deis/k8s-claimer/leases"
 	"github.com/pborman/uuid"
 )
 
+const (
+	// apiTimeout is how long a lease request waits for the GKE and k8s APIs
+	apiTimeout = 10 * time.Second
+)
+
 // Lease will search for an available cluster on GKE which matches the parameters passed in on the request
+// Clusters are searched for in every one of scopes, and the lease records the scope of the cluster.
+// Only clusters that are members of the pool according to membership are leased.
+// If provisioner is not nil and no free cluster matches, a new cluster is created with it.
+// Free clusters whose node pools are scaled down are only leased if no other cluster is free, or
+// none of the others is healthy, and are restored with poolManager first.
+// The clusters of expired leases that recycler recycles are recycled instead of being leased
+// again. recycler may be nil.
+// If healthChecker is not nil, free clusters are probed in order until a healthy one is found or
+// healthBudget has passed.
+// The request is checked again with admit, against the leases that the new lease is saved with.
+// If admit returns false, it has responded, and no lease is created. admit may be nil. If another request saves the
+// leases first, the request is tried again, up to k8s.LeaseUpdateAttempts times.
+// If credentials is enabled, the lease is handed out its own credentials instead of the cluster's
+// admin credentials, and the credentials of expired leases are revoked before they're reclaimed.
+// If req asks for an exec credential, the kubeconfig runs the CLI to fetch them instead. If req
+// asks for the API proxy, the kubeconfig talks to the cluster through it with a new bearer token,
+// whose hash the lease records.
+// The GKE and k8s APIs are called with ctx, which should be the context of the request. If
+// they time out, the response status is 504, and if they fail, it's 502.
+// The lease's token is random, and its secret is only written back on the response, while the
+// lease records the secret's salted hash, and the name of the API token that ctx carries, whose
+// usage ledger records the lease.
 // It will write back on the response the necessary connection information in json format
-func Lease(w http.ResponseWriter,
+func Lease(ctx context.Context,
+	w http.ResponseWriter,
 	req *api.CreateLeaseReq,
 	clusterLister ClusterLister,
 	services k8s.ServiceGetterUpdater,
-	k8sServiceName,
-	gCloudProjID,
-	gCloudZone string) {
+	provisioner *Provisioner,
+	poolManager *PoolManager,
+	recycler *Recycler,
+	healthChecker k8s.HealthChecker,
+	healthBudget time.Duration,
+	credentials *k8s.LeaseCredentials,
+	admit func(http.ResponseWriter, *leases.Map) bool,
+	k8sServiceName string,
+	scopes []config.GKEScope,
+	membership config.PoolMembership) {
+	for attempt := 1; ; attempt++ {
+		if !tryLease(ctx, w, req, clusterLister, services, provisioner, poolManager, recycler, healthChecker, healthBudget, credentials, admit, k8sServiceName, scopes, membership, attempt < k8s.LeaseUpdateAttempts) {
+			return
+		}
+	}
+}
 
-	clusterMap, svc, err := getSvcsAndClusters(clusterLister, services, gCloudProjID, gCloudZone, k8sServiceName)
+// tryLease tries to lease a cluster for req as described in Lease. If retryConflict is true and
+// the leases were saved by another request while it ran, it returns true without responding, so
+// that the request is tried again with the leases that were saved. Returns false otherwise
+func tryLease(ctx context.Context,
+	w http.ResponseWriter,
+	req *api.CreateLeaseReq,
+	clusterLister ClusterLister,
+	services k8s.ServiceGetterUpdater,
+	provisioner *Provisioner,
+	poolManager *PoolManager,
+	recycler *Recycler,
+	healthChecker k8s.HealthChecker,
+	healthBudget time.Duration,
+	credentials *k8s.LeaseCredentials,
+	admit func(http.ResponseWriter, *leases.Map) bool,
+	k8sServiceName string,
+	scopes []config.GKEScope,
+	membership config.PoolMembership,
+	retryConflict bool) bool {
+
+	clusterMap, svc, err := getSvcsAndClusters(ctx, clusterLister, services, scopes, membership, k8sServiceName)
 	if err != nil {
+		if ctx.Err() == context.Canceled {
+			log.Printf("The client went away while GKE clusters were listed")
+			return false
+		}
 		log.Printf("Error listing GKE clusters or talking to the k8s API -- %s", err)
-		htp.Error(w, http.StatusInternalServerError, "Error listing GKE clusters or talking to the k8s API -- %s", err)
-		return
+		htp.Error(w, htp.UpstreamStatus(err), "Error listing GKE clusters or talking to the k8s API -- %s", err)
+		return false
 	}
 
 	leaseMap, err := leases.ParseMapFromAnnotations(svc.Annotations)
 	if err != nil {
 		log.Printf("Error parsing leases from Kubernetes annotations -- %s", err)
 		htp.Error(w, http.StatusInternalServerError, "error parsing leases from Kubernetes annotations -- %s", err)
-		return
+		return false
 	}
 
-	availableCluster, err := searchForFreeCluster(clusterMap, leaseMap, req.ClusterRegex, req.ClusterVersion)
+	freeClusters, err := searchForFreeClusters(clusterMap, leaseMap, req, recycler)
+	if _, noneFree := err.(errNoAvailableOrExpiredClustersFound); noneFree && provisioner != nil {
+		var newCluster *container.Cluster
+		newCluster, svc, leaseMap, err = provisionCluster(ctx, provisioner, clusterMap, req, services, k8sServiceName)
+		if err != nil {
+			switch e := err.(type) {
+			case errTemplateMismatch, errClusterCapReached:
+				log.Printf("No available clusters found, and no new cluster can be created -- %s", e)
+				htp.Error(w, http.StatusConflict, "No available clusters found, and no new cluster can be created -- %s", e)
+				return false
+			default:
+				log.Printf("Error creating a new GKE cluster -- %s", e)
+				htp.Error(w, http.StatusInternalServerError, "Error creating a new GKE cluster -- %s", e)
+				return false
+			}
+		}
+		// the created cluster isn't in the inventory yet
+		inventory.Invalidate(clusterLister)
+		freeClusters = []*container.Cluster{newCluster}
+	}
 	if err != nil {
 		switch e := err.(type) {
 		case errNoAvailableOrExpiredClustersFound:
 			log.Printf("No available clusters found")
 			htp.Error(w, http.StatusConflict, "No available clusters found")
-			return
+			return false
 		case errExpiredLeaseGKEMissing:
 			log.Printf("Cluster %s has an expired lease but doesn't exist in GKE", e.clusterName)
 			htp.Error(w, http.StatusInternalServerError, "Cluster %s has an expired lease but doesn't exist in GKE", e.clusterName)
-			return
+			return false
 		default:
 			log.Printf("Unknown error %s", e.Error())
 			htp.Error(w, http.StatusInternalServerError, "Unknown error %s", e.Error())
-			return
+			return false
+		}
+	}
+
+	allFree := freeClusters
+	freeClusters, svc, leaseMap, err = restoreIfScaledDown(ctx, poolManager, recycler, freeClusters, clusterMap, leaseMap, svc, req, services, k8sServiceName)
+	if err != nil {
+		switch e := err.(type) {
+		case errNoAvailableOrExpiredClustersFound:
+			log.Printf("No available clusters found")
+			htp.Error(w, http.StatusConflict, "No available clusters found")
+			return false
+		default:
+			log.Printf("Error restoring a scaled down cluster -- %s", e)
+			htp.Error(w, http.StatusInternalServerError, "Error restoring a scaled down cluster -- %s", e)
+			return false
+		}
+	}
+
+	availableCluster, kubeConfig, err := firstHealthyCluster(ctx, clusterMap, freeClusters, leaseMap, healthChecker, healthBudget)
+	if _, noneHealthy := err.(k8s.ErrNoHealthyClusters); noneHealthy && poolManager != nil {
+		if _, scaledDown := splitScaledDown(clusterMap, allFree, leaseMap); len(scaledDown) > 0 {
+			// the leases are fetched again after the restore, so the unhealthy marks are saved first
+			if saveErr := k8s.SaveAnnotations(ctx, services, svc, leaseMap); saveErr != nil {
+				log.Printf("Error saving cluster health to Kubernetes annotations -- %s", saveErr)
+			}
+			log.Printf("None of the running free clusters is healthy, restoring a scaled down cluster")
+			restored, restoredSvc, restoredLeaseMap, restoreErr := restoreScaledDown(ctx, poolManager, recycler, scaledDown[0], leaseMap.ClusterStatus(leaseID(clusterMap.ID(scaledDown[0]))), clusterMap, req, services, k8sServiceName)
+			if restoreErr != nil {
+				log.Printf("Error restoring a scaled down cluster -- %s", restoreErr)
+				htp.Error(w, http.StatusConflict, "No healthy clusters found, and no scaled down cluster could be restored -- %s", restoreErr)
+				return false
+			}
+			svc, leaseMap = restoredSvc, restoredLeaseMap
+			availableCluster, kubeConfig, err = firstHealthyCluster(ctx, clusterMap, restored, leaseMap, healthChecker, healthBudget)
+		}
+	}
+	if err != nil {
+		// save the unhealthy marks, even though no lease is created
+		if saveErr := k8s.SaveAnnotations(ctx, services, svc, leaseMap); saveErr != nil {
+			log.Printf("Error saving cluster health to Kubernetes annotations -- %s", saveErr)
+		}
+		if err == ctx.Err() {
+			log.Printf("The health checks of the free clusters were cut off -- %s", err)
+			htp.Error(w, htp.UpstreamStatus(err), "The health checks of the free clusters were cut off -- %s", err)
+			return false
+		}
+		switch e := err.(type) {
+		case k8s.ErrNoHealthyClusters:
+			log.Printf("No healthy clusters found -- %s", e)
+			htp.Error(w, http.StatusConflict, "No healthy clusters found -- %s", e)
+			return false
+		case k8s.ErrCreatingKubeConfig:
+			log.Printf("Error creating kubeconfig file for cluster %s -- %s", e.ClusterID, e.Err)
+			htp.Error(w, http.StatusInternalServerError, "Error creating kubeconfig file for cluster %s -- %s", e.ClusterID, e.Err)
+			return false
+		default:
+			log.Printf("Unknown error %s", e.Error())
+			htp.Error(w, http.StatusInternalServerError, "Unknown error %s", e.Error())
+			return false
+		}
+	}
+
+	// the request is checked against the leases that the new lease is saved with, so that other
+	// requests can't get past the policy or the budget at the same time
+	if admit != nil && !admit(w, leaseMap) {
+		// save the unhealthy marks, even though no lease is created
+		if saveErr := k8s.SaveAnnotations(ctx, services, svc, leaseMap); saveErr != nil {
+			log.Printf("Error saving cluster health to Kubernetes annotations -- %s", saveErr)
 		}
+		return false
 	}
 
-	newToken := uuid.NewUUID()
-	kubeConfig, err := k8s.CreateKubeConfigFromCluster(availableCluster)
+	// lease tokens are public, the secret is what the lease is released with
+	newToken := uuid.NewRandom()
+	secret, secretHash, err := leases.NewSecret()
 	if err != nil {
-		log.Printf("Error creating kubeconfig file for cluster %s -- %s", availableCluster.Name, err)
-		htp.Error(w, http.StatusInternalServerError, "Error creating kubeconfig file for cluster %s -- %s", availableCluster.Name, err)
-		return
+		log.Printf("Error creating the secret of the lease -- %s", err)
+		htp.Error(w, http.StatusInternalServerError, "Error creating the secret of the lease -- %s", err)
+		return false
+	}
+	clusterID := clusterMap.ID(availableCluster)
+	scope, _ := clusterMap.Scope(clusterID)
+	adminKubeConfig := kubeConfig
+	var serviceAccount string
+	if credentials != nil && credentials.Enabled {
+		kubeConfig, serviceAccount, err = credentials.Issue(adminKubeConfig, newToken.String())
+		if err != nil {
+			log.Printf("Error creating the credentials of the lease on cluster %s -- %s", clusterID, err)
+			htp.Error(w, http.StatusInternalServerError, "Error creating the credentials of the lease on cluster %s -- %s", clusterID, err)
+			return false
+		}
+	}
+	if req.ExecCredential != nil {
+		kubeConfig = k8s.ExecKubeConfig(kubeConfig, req.ExecCredential.CommandName(), req.ExecCredential.Args(newToken.String()), req.ExecCredential.Env(secret))
+	}
+	var proxyTokenHash string
+	if req.Proxy != nil {
+		var proxyToken string
+		proxyToken, proxyTokenHash, err = leases.NewSecret()
+		if err != nil {
+			log.Printf("Error creating the API proxy token of the lease -- %s", err)
+			credentials.RevokeUnsaved(adminKubeConfig, serviceAccount)
+			htp.Error(w, http.StatusInternalServerError, "Error creating the API proxy token of the lease -- %s", err)
+			return false
+		}
+		kubeConfig = k8s.ProxyKubeConfig(kubeConfig, req.Proxy.URL(newToken.String()), proxyToken)
 	}
 
 	kubeConfigStr, err := k8s.MarshalAndEncodeKubeConfig(kubeConfig)
 	if err != nil {
 		log.Printf("Error marshaling & encoding kubeconfig -- %s", err)
 		htp.Error(w, http.StatusInternalServerError, "Error marshaling & encoding kubeconfig -- %s", err)
-		return
+		return false
 	}
 
 	resp := api.CreateLeaseResp{
 		KubeConfigStr:  kubeConfigStr,
 		IP:             availableCluster.Endpoint,
 		Token:          newToken.String(),
+		Secret:         secret,
 		ClusterName:    availableCluster.Name,
-		ClusterVersion: availableCluster.CurrentNodeVersion,
+		ClusterID:      leaseID(clusterID),
+		ClusterVersion: clusterVersion(availableCluster, req.VersionSource()),
+		CloudProvider:  req.CloudProvider,
 	}
 
-	leaseMap.CreateLease(newToken, leases.NewLease(availableCluster.Name, req.ExpirationTime(time.Now())))
-	if err := k8s.SaveAnnotations(services, svc, leaseMap); err != nil {
+	now := time.Now()
+	lease := leases.NewLease(clusterID, req.ExpirationTime(now))
+	lease.Provider = leases.ProviderGoogle
+	lease.Project = scope.ProjectID
+	lease.Location = scope.Location
+	lease.ServiceAccount = serviceAccount
+	lease.SecretHash = secretHash
+	lease.ProxyTokenHash = proxyTokenHash
+	lease.CreatedBy = auth.ID(ctx)
+	leaseMap.CreateLease(newToken, lease)
+	leaseMap.RecordUsage(lease.CreatedBy, newToken, now, req.ExpirationTime(now))
+	leaseMap.MarkLeased(leaseID(clusterID), now)
+	leaseMap.MarkHeld(leaseID(clusterID), req.Holder, req.AffinityKey)
+	if err := k8s.SaveAnnotations(ctx, services, svc, leaseMap); err != nil {
+		credentials.RevokeUnsaved(adminKubeConfig, serviceAccount)
+		if retryConflict && apierrors.IsConflict(err) {
+			log.Printf("The leases were saved by another request while lease %s was created, trying again", newToken)
+			return true
+		}
 		log.Printf("Error saving new lease to Kubernetes annotations -- %s", err)
 		htp.Error(w, http.StatusInternalServerError, "Error saving new lease to Kubernetes annotations -- %s", err)
-		return
+		return false
 	}
 
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		log.Printf("Error encoding json -- %s", err)
 		htp.Error(w, http.StatusInternalServerError, "Error encoding json -- %s", err)
-		return
+		return false
+	}
+	return false
+}
+
+// provisionCluster creates a new cluster for req with provisioner and adds it to clusterMap.
+// Since that takes minutes, the k8s service that holds the leases is fetched again afterwards,
+// and returned along with its parsed leases
+func provisionCluster(
+	ctx context.Context,
+	provisioner *Provisioner,
+	clusterMap *Map,
+	req *api.CreateLeaseReq,
+	services k8s.ServiceGetterUpdater,
+	k8sServiceName string,
+) (*container.Cluster, *v1.Service, *leases.Map, error) {
+	cluster, err := provisioner.Provision(clusterMap, req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	clusterMap.add(cluster.Name, cluster, provisioner.Scope())
+	svc, err := k8s.GetService(ctx, services, k8sServiceName)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	leaseMap, err := leases.ParseMapFromAnnotations(svc.Annotations)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return cluster, svc, leaseMap, nil
+}
+
+type errRestoringCluster struct {
+	clusterName string
+	err         error
+}
+
+func (e errRestoringCluster) Error() string {
+	return fmt.Sprintf("error restoring the node pools of cluster %s -- %s", e.clusterName, e.err)
+}
+
+// restoreIfScaledDown returns the clusters in free whose node pools are running, in order. If the
+// node pools of every one are scaled down and poolManager is not nil, the first one is restored
+// with restoreScaledDown and returned instead, along with the k8s service and leases that
+// restoreScaledDown fetched, and its errors. Otherwise svc and leaseMap are returned as they are
+func restoreIfScaledDown(
+	ctx context.Context,
+	poolManager *PoolManager,
+	recycler *Recycler,
+	free []*container.Cluster,
+	clusterMap *Map,
+	leaseMap *leases.Map,
+	svc *v1.Service,
+	req *api.CreateLeaseReq,
+	services k8s.ServiceGetterUpdater,
+	k8sServiceName string,
+) ([]*container.Cluster, *v1.Service, *leases.Map, error) {
+	running, scaledDown := splitScaledDown(clusterMap, free, leaseMap)
+	if len(running) > 0 || len(scaledDown) == 0 || poolManager == nil {
+		if len(running) == 0 {
+			return free, svc, leaseMap, nil
+		}
+		return running, svc, leaseMap, nil
+	}
+	log.Printf("The node pools of all free clusters are scaled down, restoring cluster %s", clusterMap.ID(scaledDown[0]))
+	status := leaseMap.ClusterStatus(leaseID(clusterMap.ID(scaledDown[0])))
+	return restoreScaledDown(ctx, poolManager, recycler, scaledDown[0], status, clusterMap, req, services, k8sServiceName)
+}
+
+// restoreScaledDown restores the node pools of cluster, which comes from clusterMap, with
+// poolManager to the sizes recorded in status, and returns it. Since that takes minutes, the k8s service that holds the leases
+// is fetched afterwards and returned along with its parsed leases, in which the cluster is marked
+// restored.
+//
+// Returns errRestoringCluster if the node pools couldn't be restored
+// Returns errNoAvailableOrExpiredClustersFound if the cluster was leased while it was restored
+func restoreScaledDown(
+	ctx context.Context,
+	poolManager *PoolManager,
+	recycler *Recycler,
+	cluster *container.Cluster,
+	status leases.ClusterStatus,
+	clusterMap *Map,
+	req *api.CreateLeaseReq,
+	services k8s.ServiceGetterUpdater,
+	k8sServiceName string,
+) ([]*container.Cluster, *v1.Service, *leases.Map, error) {
+	clusterID := clusterMap.ID(cluster)
+	scope, _ := clusterMap.Scope(clusterID)
+	if err := poolManager.Restore(cluster, scope, status); err != nil {
+		return nil, nil, nil, errRestoringCluster{clusterName: clusterID, err: err}
+	}
+	svc, err := k8s.GetService(ctx, services, k8sServiceName)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	leaseMap, err := leases.ParseMapFromAnnotations(svc.Annotations)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	leaseMap.MarkRestored(leaseID(clusterID))
+	stillFree, err := searchForFreeClusters(clusterMap, leaseMap, req, recycler)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, freeCluster := range stillFree {
+		if freeCluster == cluster {
+			return []*container.Cluster{cluster}, svc, leaseMap, nil
+		}
 	}
+	return nil, nil, nil, errNoAvailableOrExpiredClustersFound{}
 }
 
+// getSvcsAndClusters gets the k8s service with the given name and lists the pool members in scopes
+// at the same time. It gives up when ctx is done or apiTimeout has passed, whichever comes first
 func getSvcsAndClusters(
+	ctx context.Context,
 	clusterLister ClusterLister,
 	services k8s.ServiceGetterUpdater,
-	gCloudProjID,
-	gCloudZone,
+	scopes []config.GKEScope,
+	membership config.PoolMembership,
 	k8sServiceName string,
 ) (*Map, *v1.Service, error) {
-
-	errCh := make(chan error)
-	clusterMapCh := make(chan *Map)
-	apiServiceCh := make(chan *v1.Service)
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
 	defer cancel()
+
+	// the channels are buffered, so that neither goroutine blocks once this func has returned
+	errCh := make(chan error, 2)
+	clusterMapCh := make(chan *Map, 1)
+	apiServiceCh := make(chan *v1.Service, 1)
 	go func() {
-		svc, err := services.Get(k8sServiceName)
+		svc, err := k8s.GetService(ctx, services, k8sServiceName)
 		if err != nil {
-			select {
-			case errCh <- err:
-			}
+			errCh <- err
 			return
 		}
-		select {
-		case apiServiceCh <- svc:
-		case <-ctx.Done():
-			errCh <- fmt.Errorf("Timeout exceeded while trying to fetch services from Kubernetes API")
-		}
+		apiServiceCh <- svc
 	}()
 	go func() {
-		clusterMap, err := ParseMapFromGKE(clusterLister, gCloudProjID, gCloudZone)
+		clusterMap, err := ParseMapFromGKE(ctx, clusterLister, scopes, membership)
 		if err != nil {
-			select {
-			case errCh <- err:
-			case <-ctx.Done():
-				errCh <- fmt.Errorf("Timeout exceeded while trying to fetch clusters from Google API")
-			}
+			errCh <- err
 			return
 		}
-		select {
-		case clusterMapCh <- clusterMap:
-		}
+		clusterMapCh <- clusterMap
 	}()
 
 	var clusterMapRet *Map
 	var apiServiceRet *v1.Service
-	for {
+	for clusterMapRet == nil || apiServiceRet == nil {
 		select {
 		case err := <-errCh:
 			return nil, nil, err
-		case cm := <-clusterMapCh:
-			clusterMapRet = cm
-		case svc := <-apiServiceCh:
-			apiServiceRet = svc
-		}
-		if clusterMapRet != nil && apiServiceRet != nil {
-			return clusterMapRet, apiServiceRet, nil
+		case clusterMapRet = <-clusterMapCh:
+		case apiServiceRet = <-apiServiceCh:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
 		}
 	}
+	return clusterMapRet, apiServiceRet, nil
 }
@@ -0,0 +1,37 @@
+package gke
+
+import (
+	container "google.golang.org/api/container/v1"
+)
+
+// GKEClusterCreator is a ClusterCreator implementation that uses the GKE Go SDK to create and
+// delete clusters on GKE
+type GKEClusterCreator struct {
+	svc *container.Service
+}
+
+// NewGKEClusterCreator creates a new GKEClusterCreator configured to use the given client.
+// See GetContainerService for how to create a new client.
+func NewGKEClusterCreator(svc *container.Service) *GKEClusterCreator {
+	return &GKEClusterCreator{svc: svc}
+}
+
+// Create is the ClusterCreator interface implementation
+func (g *GKEClusterCreator) Create(projectID, zone string, req *container.CreateClusterRequest) (*container.Operation, error) {
+	return g.svc.Projects.Zones.Clusters.Create(projectID, zone, req).Do()
+}
+
+// GetOperation is the ClusterCreator interface implementation
+func (g *GKEClusterCreator) GetOperation(projectID, zone, operationID string) (*container.Operation, error) {
+	return g.svc.Projects.Zones.Operations.Get(projectID, zone, operationID).Do()
+}
+
+// Get is the ClusterCreator interface implementation
+func (g *GKEClusterCreator) Get(projectID, zone, clusterID string) (*container.Cluster, error) {
+	return g.svc.Projects.Zones.Clusters.Get(projectID, zone, clusterID).Do()
+}
+
+// Delete is the ClusterCreator interface implementation
+func (g *GKEClusterCreator) Delete(projectID, zone, clusterID string) (*container.Operation, error) {
+	return g.svc.Projects.Zones.Clusters.Delete(projectID, zone, clusterID).Do()
+}
@@ -1,7 +1,12 @@
 package gke
 
 import (
+	"context"
+
 	container "google.golang.org/api/container/v1"
+	"google.golang.org/api/googleapi"
+
+	"github.com/deis/k8s-claimer/retry"
 )
 
 // GKEClusterLister is a ClusterLister implementation that uses the GKE Go SDK to list clusters
@@ -16,7 +21,22 @@ func NewGKEClusterLister(svc *container.Service) *GKEClusterLister {
 	return &GKEClusterLister{svc: svc}
 }
 
-// List is the ClusterLister interface implementation
-func (g *GKEClusterLister) List(projectID, zone string) (*container.ListClustersResponse, error) {
-	return g.svc.Projects.Zones.Clusters.List(projectID, zone).Do()
+// List is the ClusterLister interface implementation. Transient errors are retried
+func (g *GKEClusterLister) List(ctx context.Context, projectID, zone string) (*container.ListClustersResponse, error) {
+	var resp *container.ListClustersResponse
+	err := retry.Do(ctx, retry.DefaultBackoff, isTransientGKEError, func() error {
+		var err error
+		resp, err = g.svc.Projects.Zones.Clusters.List(projectID, zone).Context(ctx).Do()
+		return err
+	})
+	return resp, err
+}
+
+// isTransientGKEError returns true if err is a GKE API error that may go away if the call that
+// returned it is made again
+func isTransientGKEError(err error) bool {
+	if apiErr, ok := err.(*googleapi.Error); ok {
+		return retry.IsTransientStatus(apiErr.Code)
+	}
+	return retry.IsTransientNetError(err)
 }
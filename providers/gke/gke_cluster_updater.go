@@ -0,0 +1,28 @@
+package gke
+
+import (
+	container "google.golang.org/api/container/v1"
+)
+
+// GKEClusterUpdater is a ClusterUpdater implementation that uses the GKE Go SDK to update
+// clusters on GKE
+type GKEClusterUpdater struct {
+	svc *container.Service
+}
+
+// NewGKEClusterUpdater creates a new GKEClusterUpdater configured to use the given client.
+// See GetContainerService for how to create a new client.
+func NewGKEClusterUpdater(svc *container.Service) *GKEClusterUpdater {
+	return &GKEClusterUpdater{svc: svc}
+}
+
+// Update is the ClusterUpdater interface implementation
+func (g *GKEClusterUpdater) Update(projectID, zone, clusterID string, update *container.ClusterUpdate) (*container.Operation, error) {
+	req := &container.UpdateClusterRequest{Update: update}
+	return g.svc.Projects.Zones.Clusters.Update(projectID, zone, clusterID, req).Do()
+}
+
+// GetOperation is the ClusterUpdater interface implementation
+func (g *GKEClusterUpdater) GetOperation(projectID, zone, operationID string) (*container.Operation, error) {
+	return g.svc.Projects.Zones.Operations.Get(projectID, zone, operationID).Do()
+}
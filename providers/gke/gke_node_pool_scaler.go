@@ -0,0 +1,64 @@
+package gke
+
+import (
+	"fmt"
+	"strings"
+
+	compute "google.golang.org/api/compute/v1"
+	container "google.golang.org/api/container/v1"
+)
+
+// GKENodePoolScaler is a NodePoolScaler implementation that uses the GKE Go SDK to resize node
+// pools on GKE. The sizes of node pools are read from their Compute Engine instance groups
+type GKENodePoolScaler struct {
+	svc        *container.Service
+	computeSvc *compute.Service
+}
+
+// NewGKENodePoolScaler creates a new GKENodePoolScaler configured to use the given clients.
+// See NewContainerService and NewComputeService for how to create them.
+func NewGKENodePoolScaler(svc *container.Service, computeSvc *compute.Service) *GKENodePoolScaler {
+	return &GKENodePoolScaler{svc: svc, computeSvc: computeSvc}
+}
+
+// SetSize is the NodePoolScaler interface implementation
+func (g *GKENodePoolScaler) SetSize(projectID, zone, clusterID, nodePoolID string, nodeCount int64) (*container.Operation, error) {
+	req := &container.SetNodePoolSizeRequest{NodeCount: nodeCount}
+	return g.svc.Projects.Zones.Clusters.NodePools.SetSize(projectID, zone, clusterID, nodePoolID, req).Do()
+}
+
+// GetSize is the NodePoolScaler interface implementation. A node pool has one instance group in
+// each of its cluster's zones, and its size is the sum of their target sizes
+func (g *GKENodePoolScaler) GetSize(projectID, zone, clusterID string, nodePool *container.NodePool) (int64, error) {
+	if len(nodePool.InstanceGroupUrls) == 0 {
+		return 0, fmt.Errorf("node pool %s of cluster %s has no instance groups", nodePool.Name, clusterID)
+	}
+	var size int64
+	for _, url := range nodePool.InstanceGroupUrls {
+		groupProject, groupZone, groupName, err := parseInstanceGroupURL(url)
+		if err != nil {
+			return 0, err
+		}
+		group, err := g.computeSvc.InstanceGroupManagers.Get(groupProject, groupZone, groupName).Do()
+		if err != nil {
+			return 0, err
+		}
+		size += group.TargetSize
+	}
+	return size, nil
+}
+
+// GetOperation is the NodePoolScaler interface implementation
+func (g *GKENodePoolScaler) GetOperation(projectID, zone, operationID string) (*container.Operation, error) {
+	return g.svc.Projects.Zones.Operations.Get(projectID, zone, operationID).Do()
+}
+
+// parseInstanceGroupURL returns the project, zone and name of the instance group manager at url,
+// which ends in projects/<project>/zones/<zone>/instanceGroupManagers/<name>
+func parseInstanceGroupURL(url string) (string, string, string, error) {
+	parts := strings.Split(url, "/")
+	if len(parts) < 6 || parts[len(parts)-6] != "projects" || parts[len(parts)-4] != "zones" || parts[len(parts)-2] != "instanceGroupManagers" {
+		return "", "", "", fmt.Errorf("%s is not an instance group manager URL", url)
+	}
+	return parts[len(parts)-5], parts[len(parts)-3], parts[len(parts)-1], nil
+}
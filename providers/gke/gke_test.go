@@ -0,0 +1,133 @@
+package gke
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	container "google.golang.org/api/container/v1"
+	apierrors "k8s.io/client-go/pkg/api/errors"
+	"k8s.io/client-go/pkg/api/unversioned"
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/api"
+	"github.com/deis/k8s-claimer/auth"
+	"github.com/deis/k8s-claimer/config"
+	"github.com/deis/k8s-claimer/htp"
+	"github.com/deis/k8s-claimer/k8s"
+	"github.com/deis/k8s-claimer/leases"
+	"github.com/pborman/uuid"
+)
+
+// blockingClusterLister is a ClusterLister that blocks until ctx is done
+type blockingClusterLister struct{}
+
+func (blockingClusterLister) List(ctx context.Context, projectID, zone string) (*container.ListClustersResponse, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestGetSvcsAndClustersTimeout(t *testing.T) {
+	services := k8s.NewFakeServiceGetterUpdater(&v1.Service{ObjectMeta: v1.ObjectMeta{Name: "k8s-claimer"}}, nil, nil, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	scopes := []config.GKEScope{{ProjectID: "proj1", Location: "zone1"}}
+	_, _, err := getSvcsAndClusters(ctx, blockingClusterLister{}, services, scopes, config.PoolMembership{}, "k8s-claimer")
+	assert.Equal(t, err, context.DeadlineExceeded, "error")
+	assert.Equal(t, htp.UpstreamStatus(err), http.StatusGatewayTimeout, "status")
+}
+
+func TestLeaseRestoresScaledDownWhenNoneHealthy(t *testing.T) {
+	warm := poolCluster("warm", "1.7.8")
+	cold := poolCluster("cold", "1.7.8")
+	cold.Endpoint = "10.0.0.2"
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	leaseMap.MarkScaledDown(leaseID(scopedID("cold")), time.Now(), map[string]int64{"default-pool": 5})
+	services := poolServices(t, leaseMap)
+	scaler := NewFakeNodePoolScaler(nil)
+	lister := NewFakeClusterLister(&container.ListClustersResponse{Clusters: []*container.Cluster{warm, cold}}, nil)
+	manager := NewPoolManager(lister, scaler, services, "k8s-claimer", scopes, config.PoolMembership{}, poolConfig(1))
+	checker := k8s.NewFakeHealthChecker(map[string]error{"https://10.0.0.1": errors.New("node is not ready")})
+
+	res := httptest.NewRecorder()
+	req := &api.CreateLeaseReq{MaxTimeSec: 60, CloudProvider: "google"}
+	Lease(context.Background(), res, req, lister, services, nil, manager, nil, checker, time.Minute, nil, nil, "k8s-claimer", scopes, config.PoolMembership{})
+	assert.Equal(t, res.Code, http.StatusOK, "response code")
+	resp := new(api.CreateLeaseResp)
+	assert.NoErr(t, json.NewDecoder(res.Body).Decode(resp))
+	assert.Equal(t, resp.IP, "10.0.0.2", "leased cluster IP")
+	assert.Equal(t, scaler.Sizes, map[string]int64{"cold/default-pool": 5}, "node pool sizes")
+	saved := savedLeaseMap(t, services)
+	assert.False(t, saved.ClusterStatus(leaseID(scopedID("cold"))).IsScaledDown(), "cold is still marked scaled down")
+	assert.Equal(t, saved.ClusterStatus(leaseID(scopedID("warm"))).UnhealthyReason, "node is not ready", "unhealthy reason")
+}
+
+// racingServices is a ServiceGetterUpdater whose first update fails with a conflict, since another
+// request saved other first
+type racingServices struct {
+	*k8s.FakeServiceGetterUpdater
+	other *v1.Service
+}
+
+func (r *racingServices) Update(svc *v1.Service) (*v1.Service, error) {
+	if r.other != nil {
+		r.Svc, r.other = r.other, nil
+		return nil, apierrors.NewConflict(unversioned.GroupResource{Resource: "services"}, svc.Name, errors.New("the object has been modified"))
+	}
+	return r.FakeServiceGetterUpdater.Update(svc)
+}
+
+func TestLeaseRetriesConflicts(t *testing.T) {
+	lister := NewFakeClusterLister(&container.ListClustersResponse{Clusters: []*container.Cluster{poolCluster("c1", "1.7.8"), poolCluster("c2", "1.7.8")}}, nil)
+	ctx := auth.NewContext(context.Background(), auth.Identity{Name: "dev@example.com", Source: auth.SourceOIDC, Role: auth.RoleUser})
+	// the other request leases c2 for the same identity
+	otherMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	otherLease := leases.NewLease(scopedID("c2"), time.Now().Add(time.Hour))
+	otherLease.Provider = leases.ProviderGoogle
+	otherLease.CreatedBy = "oidc:dev@example.com"
+	assert.True(t, otherMap.CreateLease(uuid.NewRandom(), otherLease), "failed to create the other lease")
+	otherAnnos, err := otherMap.ToAnnotations()
+	assert.NoErr(t, err)
+
+	for _, limit := range []int{2, 1} {
+		leaseMap, err := leases.ParseMapFromAnnotations(nil)
+		assert.NoErr(t, err)
+		services := &racingServices{
+			FakeServiceGetterUpdater: poolServices(t, leaseMap),
+			other:                    &v1.Service{ObjectMeta: v1.ObjectMeta{Name: "k8s-claimer", Annotations: otherAnnos}},
+		}
+		var counted []int
+		admit := func(w http.ResponseWriter, leaseMap *leases.Map) bool {
+			count := leaseMap.CountCreatedBy("oidc:dev@example.com", time.Now())
+			counted = append(counted, count)
+			if count >= limit {
+				htp.Error(w, http.StatusForbidden, "too many leases")
+				return false
+			}
+			return true
+		}
+
+		res := httptest.NewRecorder()
+		req := &api.CreateLeaseReq{MaxTimeSec: 60, CloudProvider: "google"}
+		Lease(ctx, res, req, lister, services, nil, nil, nil, nil, time.Minute, nil, admit, "k8s-claimer", scopes, config.PoolMembership{})
+		// the request is checked again against the leases that the other request saved
+		assert.Equal(t, counted, []int{0, 1}, "counted leases")
+		saved := savedLeaseMap(t, services.FakeServiceGetterUpdater)
+		if limit == 1 {
+			assert.Equal(t, res.Code, http.StatusForbidden, "response code")
+			assert.Equal(t, saved.CountCreatedBy("oidc:dev@example.com", time.Now()), 1, "number of saved leases")
+			continue
+		}
+		assert.Equal(t, res.Code, http.StatusOK, "response code")
+		assert.Equal(t, saved.CountCreatedBy("oidc:dev@example.com", time.Now()), 2, "number of saved leases")
+		_, ok := saved.LeaseByClusterName(leaseID(scopedID("c1")))
+		assert.True(t, ok, "c1 wasn't leased")
+	}
+}
@@ -0,0 +1,37 @@
+package gke
+
+import (
+	"context"
+	"time"
+
+	container "google.golang.org/api/container/v1"
+
+	"github.com/deis/k8s-claimer/k8s"
+	"github.com/deis/k8s-claimer/leases"
+)
+
+// firstHealthyCluster returns the first of clusters that passes a probe by healthChecker, along
+// with its kubeconfig. clusters come from clusterMap. See k8s.FirstHealthyCluster for how clusters
+// are probed and the errors that are returned
+func firstHealthyCluster(
+	ctx context.Context,
+	clusterMap *Map,
+	clusters []*container.Cluster,
+	leaseMap *leases.Map,
+	healthChecker k8s.HealthChecker,
+	budget time.Duration,
+) (*container.Cluster, *k8s.KubeConfig, error) {
+	candidates := make([]k8s.HealthCandidate, len(clusters))
+	for i, cluster := range clusters {
+		cluster := cluster
+		candidates[i] = k8s.HealthCandidate{
+			ClusterID:  leaseID(clusterMap.ID(cluster)),
+			KubeConfig: func() (*k8s.KubeConfig, error) { return k8s.CreateKubeConfigFromCluster(cluster) },
+		}
+	}
+	i, kubeConfig, err := k8s.FirstHealthyCluster(ctx, candidates, leaseMap, healthChecker, budget)
+	if err != nil {
+		return nil, nil, err
+	}
+	return clusters[i], kubeConfig, nil
+}
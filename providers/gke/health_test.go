@@ -0,0 +1,68 @@
+package gke
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/k8s"
+	"github.com/deis/k8s-claimer/leases"
+	container "google.golang.org/api/container/v1"
+)
+
+func healthTestClusters() []*container.Cluster {
+	return []*container.Cluster{
+		&container.Cluster{Name: "upgrading", Endpoint: "10.0.0.1", MasterAuth: &container.MasterAuth{}},
+		&container.Cluster{Name: "healthy1", Endpoint: "10.0.0.2", MasterAuth: &container.MasterAuth{}},
+		&container.Cluster{Name: "healthy2", Endpoint: "10.0.0.3", MasterAuth: &container.MasterAuth{}},
+	}
+}
+
+func TestFirstHealthyClusterSkipsUnhealthy(t *testing.T) {
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	checker := k8s.NewFakeHealthChecker(map[string]error{"https://10.0.0.1": errors.New("master is upgrading")})
+	cluster, kubeConfig, err := firstHealthyCluster(context.Background(), newMap(), healthTestClusters(), leaseMap, checker, 10*time.Second)
+	assert.NoErr(t, err)
+	assert.Equal(t, cluster.Name, "healthy1", "healthy cluster name")
+	assert.Equal(t, kubeConfig.Clusters[0].Cluster.Server, "https://10.0.0.2", "kubeconfig server")
+	assert.Equal(t, checker.Checked, []string{"https://10.0.0.1", "https://10.0.0.2"}, "probed servers")
+	assert.Equal(t, leaseMap.ClusterStatus(leaseID("upgrading")).UnhealthyReason, "master is upgrading", "unhealthy reason")
+	assert.Equal(t, leaseMap.ClusterStatus(leaseID("healthy1")).UnhealthyReason, "", "unhealthy reason")
+}
+
+func TestFirstHealthyClusterNoneHealthy(t *testing.T) {
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	down := errors.New("down")
+	checker := k8s.NewFakeHealthChecker(map[string]error{
+		"https://10.0.0.1": down,
+		"https://10.0.0.2": down,
+		"https://10.0.0.3": down,
+	})
+	cluster, _, err := firstHealthyCluster(context.Background(), newMap(), healthTestClusters(), leaseMap, checker, 10*time.Second)
+	assert.Nil(t, cluster, "cluster")
+	assert.Err(t, k8s.ErrNoHealthyClusters{Tried: 3}, err)
+	for _, name := range []string{"upgrading", "healthy1", "healthy2"} {
+		assert.False(t, leaseMap.ClusterStatus(leaseID(name)).LastUnhealthyTime().IsZero(), "cluster %s wasn't marked unhealthy", name)
+	}
+}
+
+func TestFirstHealthyClusterBudget(t *testing.T) {
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	checker := k8s.NewFakeHealthChecker(nil)
+	_, _, err = firstHealthyCluster(context.Background(), newMap(), healthTestClusters(), leaseMap, checker, 0)
+	assert.Err(t, k8s.ErrNoHealthyClusters{Tried: 0}, err)
+	assert.Equal(t, len(checker.Checked), 0, "number of probes")
+}
+
+func TestFirstHealthyClusterNoChecker(t *testing.T) {
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	cluster, _, err := firstHealthyCluster(context.Background(), newMap(), healthTestClusters(), leaseMap, nil, 0)
+	assert.NoErr(t, err)
+	assert.Equal(t, cluster.Name, "upgrading", "cluster name")
+}
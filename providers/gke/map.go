@@ -1,12 +1,32 @@
 package gke
 
 import (
+	"context"
+	"sort"
+	"strings"
+
 	container "google.golang.org/api/container/v1"
+
+	"github.com/deis/k8s-claimer/api"
+	"github.com/deis/k8s-claimer/config"
+	"github.com/deis/k8s-claimer/leases"
+	"github.com/deis/k8s-claimer/semver"
 )
 
-// Map is a map from cluster name to GKE cluster
+// Map is a map from cluster ID to GKE cluster. A cluster's ID is always the qualified ID
+// project/location/name, so that it doesn't change when a cluster with the same name appears in
+// another project or location. Clusters that aren't in the pool are left out of the map, and only
+// reported by Excluded.
+//
+// Leases and statuses recorded before IDs were always qualified refer to clusters by their bare
+// name. Lookups by a bare name find the cluster with that name, as long as only one is listed
 type Map struct {
-	nameMap map[string]*container.Cluster
+	nameMap  map[string]*container.Cluster
+	scopeMap map[string]config.GKEScope
+	idMap    map[*container.Cluster]string
+	// mapping from bare cluster name to ID. names of clusters in more than one scope map to ""
+	legacyMap map[string]string
+	excluded  []api.ExcludedCluster
 }
 
 func clusterNamesToMap(c []*container.Cluster) map[string]*container.Cluster {
@@ -17,35 +37,150 @@ func clusterNamesToMap(c []*container.Cluster) map[string]*container.Cluster {
 	return ret
 }
 
-// ParseMapFromGKE calls the GKE API to get a list of clusters, then returns a Map representation
-// of those clusters. Returns nil and an appropriate error if any errors occurred along the way
-func ParseMapFromGKE(clusterLister ClusterLister, projID, zone string) (*Map, error) {
-	clustersResp, err := clusterLister.List(projID, zone)
-	if err != nil {
-		return nil, err
+// QualifiedClusterID returns the ID of the cluster with the given name in scope, in the
+// project/location/name format
+func QualifiedClusterID(scope config.GKEScope, name string) string {
+	return scope.String() + "/" + name
+}
+
+// leaseID returns the provider-qualified ID that leases and statuses of the cluster with the
+// given ID are recorded under
+func leaseID(clusterID string) string {
+	return leases.ClusterID(leases.ProviderGoogle, clusterID)
+}
+
+// clusterNameFromID returns the name of the cluster with the given ID, which is either a qualified
+// ID or, in leases and statuses recorded before IDs were always qualified, a bare name
+func clusterNameFromID(id string) string {
+	return id[strings.LastIndex(id, "/")+1:]
+}
+
+// ParseMapFromGKE calls the GKE API to get a list of clusters in each of scopes, then returns a
+// Map representation of all of those clusters that are members of the pool according to
+// membership. Clusters that are in more than one of scopes are only included once. Returns nil
+// and an appropriate error if any errors occurred along the way, or if ctx is done first
+func ParseMapFromGKE(ctx context.Context, clusterLister ClusterLister, scopes []config.GKEScope, membership config.PoolMembership) (*Map, error) {
+	m := newMap()
+	seen := make(map[string]bool)
+	for _, scope := range scopes {
+		clustersResp, err := clusterLister.List(ctx, scope.ProjectID, scope.Location)
+		if err != nil {
+			return nil, err
+		}
+		for _, cluster := range clustersResp.Clusters {
+			clusterScope := scope
+			if cluster.Zone != "" {
+				clusterScope.Location = cluster.Zone
+			}
+			// the ID is computed before membership is checked, so that excluded clusters are
+			// reported under the ID they'd have as members
+			id := QualifiedClusterID(clusterScope, cluster.Name)
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			if reason := membership.ExclusionReason(cluster.ResourceLabels, cluster.Name, id); reason != "" {
+				m.excluded = append(m.excluded, api.ExcludedCluster{
+					CloudProvider: leases.ProviderGoogle,
+					ClusterName:   cluster.Name,
+					ClusterID:     leaseID(id),
+					Reason:        reason,
+				})
+				continue
+			}
+			m.add(id, cluster, clusterScope)
+		}
+	}
+	return m, nil
+}
+
+func newMap() *Map {
+	return &Map{
+		nameMap:   make(map[string]*container.Cluster),
+		scopeMap:  make(map[string]config.GKEScope),
+		idMap:     make(map[*container.Cluster]string),
+		legacyMap: make(map[string]string),
+	}
+}
+
+func (m *Map) add(id string, cluster *container.Cluster, scope config.GKEScope) {
+	m.nameMap[id] = cluster
+	m.scopeMap[id] = scope
+	m.idMap[cluster] = id
+	if _, ambiguous := m.legacyMap[cluster.Name]; ambiguous {
+		m.legacyMap[cluster.Name] = ""
+	} else {
+		m.legacyMap[cluster.Name] = id
 	}
-	return &Map{nameMap: clusterNamesToMap(clustersResp.Clusters)}, nil
 }
 
-// ClusterByName returns the cluster of the given cluster name. Returns nil and false if no
-// cluster with the given name exists, non-nil and true otherwise
+// resolve returns the ID of the cluster with the given ID or bare name. Returns name if no
+// cluster has that ID, and no single cluster has that name
+func (m Map) resolve(name string) string {
+	if _, found := m.nameMap[name]; found {
+		return name
+	}
+	if id := m.legacyMap[name]; id != "" {
+		return id
+	}
+	return name
+}
+
+// ClusterByName returns the cluster of the given cluster ID, or of the given bare name if only
+// one cluster has that name. Returns nil and false if no such cluster exists, non-nil and true
+// otherwise
 func (m Map) ClusterByName(name string) (*container.Cluster, bool) {
-	cl, found := m.nameMap[name]
+	cl, found := m.nameMap[m.resolve(name)]
 	return cl, found
 }
 
-// ClusterNamesByVersion returns a slice of all cluster names which match a given cluster version
-func (m Map) ClusterNamesByVersion(matchingVersion string) []string {
-	var ret []string
+// ID returns the ID of cluster, which must have come from m. Returns the cluster's name if it
+// didn't
+func (m Map) ID(cluster *container.Cluster) string {
+	if id, ok := m.idMap[cluster]; ok {
+		return id
+	}
+	return cluster.Name
+}
+
+// Scope returns the project and location of the cluster with the given ID or bare name, which is
+// looked up like in ClusterByName. Returns false if no such cluster exists
+func (m Map) Scope(id string) (config.GKEScope, bool) {
+	scope, found := m.scopeMap[m.resolve(id)]
+	return scope, found
+}
+
+// Excluded returns the clusters that were listed but left out of m, because they aren't in the
+// pool
+func (m Map) Excluded() []api.ExcludedCluster {
+	return m.excluded
+}
+
+// ClusterNamesByVersion returns a slice of all cluster IDs whose version satisfies constraint,
+// ordered from the highest version to the lowest. source is either api.VersionSourceNode or
+// api.VersionSourceMaster, and selects which of the cluster's versions is matched
+func (m Map) ClusterNamesByVersion(constraint *semver.Constraint, source string) []string {
+	var matching semver.ByVersionDesc
 	for name, cluster := range m.nameMap {
-		if matchingVersion == cluster.CurrentNodeVersion {
-			ret = append(ret, name)
+		ver, err := semver.Parse(clusterVersion(cluster, source))
+		if err != nil || !constraint.Check(ver) {
+			continue
 		}
+		matching = append(matching, semver.Named{Name: name, Version: ver})
 	}
-	return ret
+	sort.Sort(matching)
+	return matching.Names()
+}
+
+// clusterVersion returns the master or node version of cluster, depending on source
+func clusterVersion(cluster *container.Cluster, source string) string {
+	if source == api.VersionSourceMaster {
+		return cluster.CurrentMasterVersion
+	}
+	return cluster.CurrentNodeVersion
 }
 
-// Names returns all cluster names in the map. The order of the returned slice is undefined
+// Names returns all cluster IDs in the map. The order of the returned slice is undefined
 func (m Map) Names() []string {
 	ret := make([]string, len(m.nameMap))
 	i := 0
@@ -1,10 +1,16 @@
 package gke
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"testing"
 
 	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/api"
+	"github.com/deis/k8s-claimer/config"
+	"github.com/deis/k8s-claimer/leases"
+	"github.com/deis/k8s-claimer/semver"
 	container "google.golang.org/api/container/v1"
 )
 
@@ -31,3 +37,126 @@ func TestNames(t *testing.T) {
 	retNames := m.Names()
 	assert.Equal(t, len(retNames), len(names), "length of names slice")
 }
+
+func TestClusterNamesByVersion(t *testing.T) {
+	nameMap := map[string]*container.Cluster{
+		"a": &container.Cluster{Name: "a", CurrentNodeVersion: "1.7.8-gke.0"},
+		"b": &container.Cluster{Name: "b", CurrentNodeVersion: "1.7.8-gke.1"},
+		"c": &container.Cluster{Name: "c", CurrentNodeVersion: "1.7.12"},
+		"d": &container.Cluster{Name: "d", CurrentNodeVersion: "1.6.11"},
+		"e": &container.Cluster{Name: "e", CurrentNodeVersion: "malformed"},
+	}
+	m := &Map{nameMap: nameMap}
+	constraint, err := semver.ParseConstraint("1.7")
+	assert.NoErr(t, err)
+	assert.Equal(t, m.ClusterNamesByVersion(constraint, api.VersionSourceNode), []string{"c", "b", "a"}, "matching cluster names")
+}
+
+func TestParseMapFromGKEQualifiesIDs(t *testing.T) {
+	lister := &FakeClusterLister{ScopedResps: map[string]*container.ListClustersResponse{
+		"proj1/-": &container.ListClustersResponse{Clusters: []*container.Cluster{
+			&container.Cluster{Name: "ci", Zone: "us-west1-a"},
+			&container.Cluster{Name: "staging", Zone: "us-central1"},
+		}},
+		"proj1/us-west1-a": &container.ListClustersResponse{Clusters: []*container.Cluster{
+			&container.Cluster{Name: "ci", Zone: "us-west1-a"},
+		}},
+		"proj2/us-east1-b": &container.ListClustersResponse{Clusters: []*container.Cluster{
+			&container.Cluster{Name: "ci"},
+		}},
+	}}
+	scopes := []config.GKEScope{
+		{ProjectID: "proj1", Location: "-"},
+		{ProjectID: "proj1", Location: "us-west1-a"},
+		{ProjectID: "proj2", Location: "us-east1-b"},
+	}
+	m, err := ParseMapFromGKE(context.Background(), lister, scopes, config.PoolMembership{})
+	assert.NoErr(t, err)
+	names := m.Names()
+	sort.Strings(names)
+	// clusters listed in more than one scope are only included once
+	assert.Equal(t, names, []string{"proj1/us-central1/staging", "proj1/us-west1-a/ci", "proj2/us-east1-b/ci"}, "cluster IDs")
+
+	cluster, found := m.ClusterByName("proj2/us-east1-b/ci")
+	assert.True(t, found, "qualified cluster not found")
+	assert.Equal(t, cluster.Name, "ci", "cluster name")
+	assert.Equal(t, m.ID(cluster), "proj2/us-east1-b/ci", "cluster ID")
+	scope, found := m.Scope("proj2/us-east1-b/ci")
+	assert.True(t, found, "scope not found")
+	assert.Equal(t, scope, config.GKEScope{ProjectID: "proj2", Location: "us-east1-b"}, "scope")
+	// regional clusters are in the scope of their region
+	scope, _ = m.Scope("proj1/us-central1/staging")
+	assert.Equal(t, scope, config.GKEScope{ProjectID: "proj1", Location: "us-central1"}, "regional scope")
+
+	// bare names, which older leases and statuses refer to clusters by, are found if they're
+	// unambiguous
+	cluster, found = m.ClusterByName("staging")
+	assert.True(t, found, "cluster not found by its bare name")
+	assert.Equal(t, m.ID(cluster), "proj1/us-central1/staging", "cluster ID")
+	_, found = m.ClusterByName("ci")
+	assert.False(t, found, "ambiguous bare name found a cluster")
+}
+
+func TestParseMapFromGKEExcludesNonMembers(t *testing.T) {
+	lister := &FakeClusterLister{ScopedResps: map[string]*container.ListClustersResponse{
+		"proj1/us-west1-a": &container.ListClustersResponse{Clusters: []*container.Cluster{
+			&container.Cluster{Name: "ci", ResourceLabels: map[string]string{"k8s-claimer": "true"}},
+			&container.Cluster{Name: "prod"},
+			&container.Cluster{Name: "staging", ResourceLabels: map[string]string{"k8s-claimer": "false"}},
+			&container.Cluster{Name: "pinned", ResourceLabels: map[string]string{"k8s-claimer": "true"}},
+		}},
+		"proj2/us-east1-b": &container.ListClustersResponse{Clusters: []*container.Cluster{
+			&container.Cluster{Name: "ci"},
+		}},
+	}}
+	scopes := []config.GKEScope{
+		{ProjectID: "proj1", Location: "us-west1-a"},
+		{ProjectID: "proj2", Location: "us-east1-b"},
+	}
+	membership := config.PoolMembership{Label: "k8s-claimer=true", Exclude: []string{"pinned"}}
+	m, err := ParseMapFromGKE(context.Background(), lister, scopes, membership)
+	assert.NoErr(t, err)
+	assert.Equal(t, m.Names(), []string{"proj1/us-west1-a/ci"}, "cluster IDs")
+
+	excluded := m.Excluded()
+	assert.Equal(t, len(excluded), 4, "number of excluded clusters")
+	reasons := make(map[string]string)
+	for _, cl := range excluded {
+		assert.Equal(t, cl.CloudProvider, "google", "cloud provider")
+		reasons[cl.ClusterID] = cl.Reason
+	}
+	assert.Equal(t, reasons, map[string]string{
+		"google/proj1/us-west1-a/prod":    "missing the k8s-claimer label",
+		"google/proj1/us-west1-a/staging": `the k8s-claimer label is "false", not "true"`,
+		"google/proj1/us-west1-a/pinned":  "pinned is in the exclude list",
+		"google/proj2/us-east1-b/ci":      "missing the k8s-claimer label",
+	}, "exclusion reasons")
+}
+
+func TestParseMapFromGKEExcludedClusterIDs(t *testing.T) {
+	lister := &FakeClusterLister{ScopedResps: map[string]*container.ListClustersResponse{
+		"proj1/-": &container.ListClustersResponse{Clusters: []*container.Cluster{
+			&container.Cluster{Name: "ci", Zone: "us-west1-a", ResourceLabels: map[string]string{"k8s-claimer": "true"}},
+			&container.Cluster{Name: "staging", Zone: "us-central1"},
+		}},
+		"proj2/us-east1-b": &container.ListClustersResponse{Clusters: []*container.Cluster{
+			&container.Cluster{Name: "ci"},
+		}},
+	}}
+	scopes := []config.GKEScope{
+		{ProjectID: "proj1", Location: "-"},
+		{ProjectID: "proj2", Location: "us-east1-b"},
+	}
+	members, err := ParseMapFromGKE(context.Background(), lister, scopes, config.PoolMembership{Label: "k8s-claimer=true"})
+	assert.NoErr(t, err)
+	all, err := ParseMapFromGKE(context.Background(), lister, scopes, config.PoolMembership{})
+	assert.NoErr(t, err)
+	assert.Equal(t, len(members.Excluded()), 2, "number of excluded clusters")
+	// excluded clusters are reported under the ID they have when they're members
+	for _, excluded := range members.Excluded() {
+		_, clusterID := leases.SplitClusterID(excluded.ClusterID)
+		cluster, found := all.ClusterByName(clusterID)
+		assert.True(t, found, "excluded cluster %s not found among all clusters", excluded.ClusterID)
+		assert.Equal(t, leaseID(all.ID(cluster)), excluded.ClusterID, "excluded cluster ID")
+	}
+}
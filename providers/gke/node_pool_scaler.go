@@ -0,0 +1,20 @@
+package gke
+
+import (
+	container "google.golang.org/api/container/v1"
+)
+
+// NodePoolScaler is an interface for resizing the node pools of GKE clusters. It has an adapter
+// for the standard *(google.golang.org/api/container/v1).Service as well as a fake
+// implementation, to be used in unit tests. Use this as a parameter in your funcs so that they
+// can be more easily unit tested
+type NodePoolScaler interface {
+	// SetSize starts resizing the given node pool to nodeCount nodes, and returns the operation
+	// that tracks the resize
+	SetSize(projectID, zone, clusterID, nodePoolID string, nodeCount int64) (*container.Operation, error)
+	// GetSize returns the number of nodes that nodePool, which is a node pool of the given
+	// cluster, is currently sized to. GKE only reports the initial size of node pools
+	GetSize(projectID, zone, clusterID string, nodePool *container.NodePool) (int64, error)
+	// GetOperation returns the current state of the operation with the given name
+	GetOperation(projectID, zone, operationID string) (*container.Operation, error)
+}
@@ -0,0 +1,46 @@
+package gke
+
+import (
+	"fmt"
+	"time"
+
+	container "google.golang.org/api/container/v1"
+)
+
+const (
+	operationDone = "DONE"
+)
+
+// operationGetter is implemented by ClusterCreator, NodePoolScaler and ClusterUpdater, which all
+// start operations that have to be followed until they're done
+type operationGetter interface {
+	GetOperation(projectID, zone, operationID string) (*container.Operation, error)
+}
+
+// waitForOperation polls op with ops every pollInterval until it's done or timeout has passed.
+// Returns an error if the operation didn't finish in time or finished with an error
+func waitForOperation(
+	ops operationGetter,
+	projID,
+	zone string,
+	op *container.Operation,
+	timeout,
+	pollInterval time.Duration,
+) error {
+	deadline := time.Now().Add(timeout)
+	for op.Status != operationDone {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("operation %s didn't finish within %s", op.Name, timeout)
+		}
+		time.Sleep(pollInterval)
+		var err error
+		op, err = ops.GetOperation(projID, zone, op.Name)
+		if err != nil {
+			return err
+		}
+	}
+	if op.StatusMessage != "" {
+		return fmt.Errorf("operation %s failed -- %s", op.Name, op.StatusMessage)
+	}
+	return nil
+}
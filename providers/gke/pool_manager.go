@@ -0,0 +1,418 @@
+package gke
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	container "google.golang.org/api/container/v1"
+
+	"github.com/deis/k8s-claimer/config"
+	"github.com/deis/k8s-claimer/inventory"
+	"github.com/deis/k8s-claimer/k8s"
+	"github.com/deis/k8s-claimer/leases"
+)
+
+const (
+	// PoolActionKeep means the pool manager left a free cluster as it was
+	PoolActionKeep = "keep"
+	// PoolActionScaleDown means the pool manager scaled a free cluster's node pools down to zero
+	PoolActionScaleDown = "scale-down"
+	// PoolActionRestore means the pool manager restored a free cluster's node pools
+	PoolActionRestore = "restore"
+)
+
+// PoolDecision is the json-encodable record of what the pool manager did with a free cluster,
+// and why
+type PoolDecision struct {
+	ClusterName string `json:"cluster_name"`
+	Version     string `json:"version"`
+	Action      string `json:"action"`
+	Reason      string `json:"reason"`
+	Error       string `json:"error,omitempty"`
+}
+
+// PoolStatus is the json-encodable result of the pool manager's last run
+type PoolStatus struct {
+	LastRun   string         `json:"last_run,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	Decisions []PoolDecision `json:"decisions"`
+}
+
+// PoolManager periodically scales the node pools of GKE clusters that have been free for longer
+// than the configured idle timeout down to zero nodes, while keeping the configured minimum
+// number of free clusters of each version running. It's safe for concurrent use
+type PoolManager struct {
+	clusterLister  ClusterLister
+	scaler         NodePoolScaler
+	services       k8s.ServiceGetterUpdater
+	k8sServiceName string
+	scopes         []config.GKEScope
+	membership     config.PoolMembership
+	conf           config.GKEPool
+
+	mut          sync.Mutex
+	status       PoolStatus
+	firstSeen    map[string]time.Time
+	clusterLocks map[string]*sync.Mutex
+}
+
+// NewPoolManager creates a new PoolManager that manages the clusters in scopes that are members of
+// the pool according to membership, and records its changes in the annotations of the k8s service
+// with the given name
+func NewPoolManager(
+	clusterLister ClusterLister,
+	scaler NodePoolScaler,
+	services k8s.ServiceGetterUpdater,
+	k8sServiceName string,
+	scopes []config.GKEScope,
+	membership config.PoolMembership,
+	conf config.GKEPool,
+) *PoolManager {
+	return &PoolManager{
+		clusterLister:  clusterLister,
+		scaler:         scaler,
+		services:       services,
+		k8sServiceName: k8sServiceName,
+		scopes:         scopes,
+		membership:     membership,
+		conf:           conf,
+		firstSeen:      make(map[string]time.Time),
+		clusterLocks:   make(map[string]*sync.Mutex),
+	}
+}
+
+// Run calls Reconcile immediately and then once every configured interval, until stop is closed
+func (p *PoolManager) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(p.conf.Interval)
+	defer ticker.Stop()
+	for {
+		p.Reconcile(time.Now())
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Status returns the result of the last call to Reconcile
+func (p *PoolManager) Status() PoolStatus {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	return p.status
+}
+
+// Reconcile decides what to do with each free cluster at time now, carries out the decisions and
+// returns them. The result is also returned by Status until the next call
+func (p *PoolManager) Reconcile(now time.Time) PoolStatus {
+	status := PoolStatus{LastRun: now.Format(leases.TimeFormat)}
+	decisions, err := p.reconcile(now)
+	status.Decisions = decisions
+	if err != nil {
+		log.Printf("Error managing the GKE cluster pool -- %s", err)
+		status.Error = err.Error()
+	}
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	p.status = status
+	return status
+}
+
+func (p *PoolManager) reconcile(now time.Time) ([]PoolDecision, error) {
+	clusterMap, svc, err := getSvcsAndClusters(context.Background(), p.clusterLister, p.services, p.scopes, p.membership, p.k8sServiceName)
+	if err != nil {
+		return nil, err
+	}
+	leaseMap, err := leases.ParseMapFromAnnotations(svc.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	decisions := p.decide(clusterMap, leaseMap, now)
+
+	// scale-downs are recorded before they start, so that Lease restores the clusters instead of
+	// handing them out while they're losing their nodes. The sizes they're restored to are the
+	// sizes their node pools have now, so clusters that can't be sized are left as they are
+	scaledDown := false
+	for i, decision := range decisions {
+		if decision.Action != PoolActionScaleDown {
+			continue
+		}
+		cluster, _ := clusterMap.ClusterByName(decision.ClusterName)
+		scope, _ := clusterMap.Scope(decision.ClusterName)
+		sizes, err := p.currentSizes(cluster, scope)
+		if err != nil {
+			log.Printf("Error getting the node pool sizes of cluster %s, not scaling it down -- %s", decision.ClusterName, err)
+			decisions[i].Action = PoolActionKeep
+			decisions[i].Error = err.Error()
+			continue
+		}
+		leaseMap.MarkScaledDown(leaseID(decision.ClusterName), now, sizes)
+		scaledDown = true
+	}
+	if scaledDown {
+		if err := k8s.SaveAnnotations(context.Background(), p.services, svc, leaseMap); err != nil {
+			return decisions, fmt.Errorf("error saving scale-downs to Kubernetes annotations, none were started -- %s", err)
+		}
+	}
+
+	var restored []string
+	for i, decision := range decisions {
+		clusterID := decision.ClusterName
+		cluster, _ := clusterMap.ClusterByName(clusterID)
+		scope, _ := clusterMap.Scope(clusterID)
+		var err error
+		switch decision.Action {
+		case PoolActionScaleDown:
+			log.Printf("Scaling down the node pools of cluster %s -- %s", clusterID, decision.Reason)
+			err = p.resize(cluster, scope, zeroSizes(cluster))
+		case PoolActionRestore:
+			log.Printf("Restoring the node pools of cluster %s -- %s", clusterID, decision.Reason)
+			if err = p.Restore(cluster, scope, leaseMap.ClusterStatus(leaseID(clusterID))); err == nil {
+				restored = append(restored, clusterID)
+			}
+		}
+		if err != nil {
+			log.Printf("Error resizing the node pools of cluster %s -- %s", clusterID, err)
+			decisions[i].Error = err.Error()
+		}
+	}
+	if len(restored) == 0 {
+		return decisions, nil
+	}
+
+	// restoring takes minutes, so the leases are fetched again before the restores are recorded
+	svc, err = p.services.Get(p.k8sServiceName)
+	if err != nil {
+		return decisions, err
+	}
+	leaseMap, err = leases.ParseMapFromAnnotations(svc.Annotations)
+	if err != nil {
+		return decisions, err
+	}
+	for _, clusterName := range restored {
+		leaseMap.MarkRestored(leaseID(clusterName))
+	}
+	if err := k8s.SaveAnnotations(context.Background(), p.services, svc, leaseMap); err != nil {
+		return decisions, fmt.Errorf("error saving restores to Kubernetes annotations -- %s", err)
+	}
+	return decisions, nil
+}
+
+// idleCluster is a free cluster, its ID and the time it became free
+type idleCluster struct {
+	id      string
+	cluster *container.Cluster
+	since   time.Time
+}
+
+type byIdleSince []idleCluster
+
+func (b byIdleSince) Len() int           { return len(b) }
+func (b byIdleSince) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byIdleSince) Less(i, j int) bool { return b[i].since.Before(b[j].since) }
+
+// decide returns what to do with each free cluster in clusterMap at time now. For each version,
+// free clusters that have been idle for longer than the idle timeout are scaled down, longest
+// idle first, as long as at least the configured minimum stay running. If fewer than that are
+// running, scaled down clusters of the version are restored to make up the difference
+func (p *PoolManager) decide(clusterMap *Map, leaseMap *leases.Map, now time.Time) []PoolDecision {
+	byVersion := make(map[string][]idleCluster)
+	var versions []string
+	clusterNames := clusterMap.Names()
+	sort.Strings(clusterNames)
+	for _, clusterName := range clusterNames {
+		since, free := p.idleSince(clusterName, leaseMap, now)
+		if !free {
+			continue
+		}
+		cluster, _ := clusterMap.ClusterByName(clusterName)
+		version := cluster.CurrentNodeVersion
+		if _, ok := byVersion[version]; !ok {
+			versions = append(versions, version)
+		}
+		byVersion[version] = append(byVersion[version], idleCluster{id: clusterName, cluster: cluster, since: since})
+	}
+	sort.Strings(versions)
+
+	var decisions []PoolDecision
+	for _, version := range versions {
+		var running, scaledDown []idleCluster
+		for _, idle := range byVersion[version] {
+			if leaseMap.ClusterStatus(leaseID(idle.id)).IsScaledDown() {
+				scaledDown = append(scaledDown, idle)
+			} else {
+				running = append(running, idle)
+			}
+		}
+		sort.Stable(byIdleSince(running))
+		sort.Stable(byIdleSince(scaledDown))
+		decide := func(idle idleCluster, action, reason string) {
+			decisions = append(decisions, PoolDecision{
+				ClusterName: idle.id,
+				Version:     version,
+				Action:      action,
+				Reason:      reason,
+			})
+		}
+
+		excess := len(running) - p.conf.MinFree
+		for _, idle := range running {
+			idleFor := now.Sub(idle.since)
+			switch {
+			case len(idle.cluster.NodePools) == 0:
+				decide(idle, PoolActionKeep, "it has no node pools")
+			case idleFor < p.conf.IdleTimeout:
+				decide(idle, PoolActionKeep, fmt.Sprintf("idle for %s, less than %s", idleFor, p.conf.IdleTimeout))
+			case excess <= 0:
+				decide(idle, PoolActionKeep, fmt.Sprintf("idle for %s, but %d free clusters of version %s must be running", idleFor, p.conf.MinFree, version))
+			default:
+				decide(idle, PoolActionScaleDown, fmt.Sprintf("idle for %s, more than %s", idleFor, p.conf.IdleTimeout))
+				excess--
+			}
+		}
+		missing := p.conf.MinFree - len(running)
+		for _, idle := range scaledDown {
+			scaledDownAt := leaseMap.ClusterStatus(leaseID(idle.id)).ScaledDownTime().Format(leases.TimeFormat)
+			if missing > 0 {
+				decide(idle, PoolActionRestore, fmt.Sprintf("%d free clusters of version %s are running, and %d must be", len(running), version, p.conf.MinFree))
+				missing--
+				continue
+			}
+			decide(idle, PoolActionKeep, "scaled down since "+scaledDownAt)
+		}
+	}
+	return decisions
+}
+
+// idleSince returns the time the given cluster became free, and true if it's free at time now.
+// That's the latest of the time its last lease was released or expired and the time the pool
+// manager first saw it, so that clusters aren't scaled down as soon as the server starts.
+// Clusters that are being recycled or upgraded aren't free
+func (p *PoolManager) idleSince(clusterName string, leaseMap *leases.Map, now time.Time) (time.Time, bool) {
+	if status := leaseMap.ClusterStatus(leaseID(clusterName)); status.IsRecycling() || status.IsUpgrading() {
+		return time.Time{}, false
+	}
+	p.mut.Lock()
+	since, seen := p.firstSeen[clusterName]
+	if !seen {
+		since = now
+		p.firstSeen[clusterName] = now
+	}
+	p.mut.Unlock()
+
+	if lease, leased := leaseMap.LeaseByClusterName(leaseID(clusterName)); leased {
+		exprTime, err := lease.ExpirationTime()
+		if err != nil || now.Before(exprTime) {
+			return time.Time{}, false
+		}
+		if exprTime.After(since) {
+			since = exprTime
+		}
+	}
+	if lastUsed := leaseMap.ClusterStatus(leaseID(clusterName)).LastUsedTime(); lastUsed.After(since) {
+		since = lastUsed
+	}
+	return since, true
+}
+
+// Restore resizes the node pools of cluster, which is in scope, back to the sizes recorded in
+// status when they were scaled down, and waits until that's done. Node pools without a recorded
+// size are resized to their initial node count. status isn't updated, callers have to mark the
+// cluster as restored
+func (p *PoolManager) Restore(cluster *container.Cluster, scope config.GKEScope, status leases.ClusterStatus) error {
+	sizes := nodePoolSizes(cluster)
+	for nodePool, size := range status.NodePoolSizes {
+		if _, ok := sizes[nodePool]; ok {
+			sizes[nodePool] = size
+		}
+	}
+	return p.resize(cluster, scope, sizes)
+}
+
+// resize resizes the node pools of cluster, which is in scope, to the given sizes, keyed by node
+// pool name, one at a time. Only one resize of a cluster runs at a time. The clusters that
+// p.clusterLister keeps in memory, if any, are invalidated afterward
+func (p *PoolManager) resize(cluster *container.Cluster, scope config.GKEScope, sizes map[string]int64) error {
+	lock := p.clusterLock(QualifiedClusterID(scope, cluster.Name))
+	lock.Lock()
+	defer lock.Unlock()
+	defer inventory.Invalidate(p.clusterLister)
+
+	nodePools := make([]string, 0, len(sizes))
+	for nodePool := range sizes {
+		nodePools = append(nodePools, nodePool)
+	}
+	sort.Strings(nodePools)
+	for _, nodePool := range nodePools {
+		op, err := p.scaler.SetSize(scope.ProjectID, scope.Location, cluster.Name, nodePool, sizes[nodePool])
+		if err != nil {
+			return err
+		}
+		if err := waitForOperation(p.scaler, scope.ProjectID, scope.Location, op, p.conf.OperationTimeout, p.conf.PollInterval); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *PoolManager) clusterLock(clusterName string) *sync.Mutex {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	lock, ok := p.clusterLocks[clusterName]
+	if !ok {
+		lock = new(sync.Mutex)
+		p.clusterLocks[clusterName] = lock
+	}
+	return lock
+}
+
+// currentSizes returns the number of nodes that each of cluster's node pools, by name, is
+// currently sized to. cluster is in scope
+func (p *PoolManager) currentSizes(cluster *container.Cluster, scope config.GKEScope) (map[string]int64, error) {
+	ret := make(map[string]int64)
+	for _, nodePool := range cluster.NodePools {
+		size, err := p.scaler.GetSize(scope.ProjectID, scope.Location, cluster.Name, nodePool)
+		if err != nil {
+			return nil, err
+		}
+		ret[nodePool.Name] = size
+	}
+	return ret, nil
+}
+
+// nodePoolSizes returns the initial node count of each of cluster's node pools, by name
+func nodePoolSizes(cluster *container.Cluster) map[string]int64 {
+	ret := make(map[string]int64)
+	for _, nodePool := range cluster.NodePools {
+		ret[nodePool.Name] = nodePool.InitialNodeCount
+	}
+	return ret
+}
+
+// zeroSizes returns a size of zero for each of cluster's node pools, by name
+func zeroSizes(cluster *container.Cluster) map[string]int64 {
+	ret := make(map[string]int64)
+	for _, nodePool := range cluster.NodePools {
+		ret[nodePool.Name] = 0
+	}
+	return ret
+}
+
+// splitScaledDown returns the clusters whose node pools are running and those whose node pools
+// are scaled down according to leaseMap, both in the order they're in clusters. clusters come
+// from clusterMap
+func splitScaledDown(clusterMap *Map, clusters []*container.Cluster, leaseMap *leases.Map) ([]*container.Cluster, []*container.Cluster) {
+	var running, scaledDown []*container.Cluster
+	for _, cluster := range clusters {
+		if leaseMap.ClusterStatus(leaseID(clusterMap.ID(cluster))).IsScaledDown() {
+			scaledDown = append(scaledDown, cluster)
+		} else {
+			running = append(running, cluster)
+		}
+	}
+	return running, scaledDown
+}
@@ -0,0 +1,209 @@
+package gke
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/api"
+	"github.com/deis/k8s-claimer/config"
+	"github.com/deis/k8s-claimer/k8s"
+	"github.com/deis/k8s-claimer/leases"
+	"github.com/pborman/uuid"
+	container "google.golang.org/api/container/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func poolConfig(minFree int) config.GKEPool {
+	return config.GKEPool{
+		Enabled:          true,
+		MinFree:          minFree,
+		IdleTimeout:      2 * time.Hour,
+		Interval:         time.Minute,
+		OperationTimeout: time.Minute,
+	}
+}
+
+func poolCluster(name, version string) *container.Cluster {
+	return &container.Cluster{
+		Name:               name,
+		CurrentNodeVersion: version,
+		Endpoint:           "10.0.0.1",
+		MasterAuth:         &container.MasterAuth{},
+		NodePools:          []*container.NodePool{&container.NodePool{Name: "default-pool", InitialNodeCount: 3}},
+	}
+}
+
+func poolServices(t *testing.T, leaseMap *leases.Map) *k8s.FakeServiceGetterUpdater {
+	annos, err := leaseMap.ToAnnotations()
+	assert.NoErr(t, err)
+	svc := &v1.Service{ObjectMeta: v1.ObjectMeta{Name: "k8s-claimer", Annotations: annos}}
+	return k8s.NewFakeServiceGetterUpdater(svc, nil, nil, nil)
+}
+
+func savedLeaseMap(t *testing.T, services *k8s.FakeServiceGetterUpdater) *leases.Map {
+	leaseMap, err := leases.ParseMapFromAnnotations(services.Svc.Annotations)
+	assert.NoErr(t, err)
+	return leaseMap
+}
+
+func decisionsByCluster(status PoolStatus) map[string]PoolDecision {
+	ret := make(map[string]PoolDecision)
+	for _, decision := range status.Decisions {
+		ret[clusterNameFromID(decision.ClusterName)] = decision
+	}
+	return ret
+}
+
+func TestPoolManagerScalesDownIdleClusters(t *testing.T) {
+	now := time.Now()
+	clusters := []*container.Cluster{
+		poolCluster("busy", "1.7.8"),
+		poolCluster("idle1", "1.7.8"),
+		poolCluster("idle2", "1.7.8"),
+		poolCluster("recent", "1.7.8"),
+		poolCluster("other", "1.8.1"),
+	}
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	leaseMap.CreateLease(uuid.NewUUID(), leases.NewLease(scopedID("busy"), now.Add(time.Hour)))
+	leaseMap.MarkReleased(leaseID(scopedID("idle1")), now.Add(-5*time.Hour))
+	leaseMap.MarkReleased(leaseID(scopedID("idle2")), now.Add(-4*time.Hour))
+	leaseMap.MarkReleased(leaseID(scopedID("recent")), now.Add(-30*time.Minute))
+	leaseMap.MarkReleased(leaseID(scopedID("other")), now.Add(-5*time.Hour))
+	services := poolServices(t, leaseMap)
+	scaler := NewFakeNodePoolScaler(nil)
+	// idle1 was resized by hand since it was created
+	scaler.Sizes["idle1/default-pool"] = 5
+	lister := NewFakeClusterLister(&container.ListClustersResponse{Clusters: clusters}, nil)
+	manager := NewPoolManager(lister, scaler, services, "k8s-claimer", scopes, config.PoolMembership{}, poolConfig(1))
+
+	// clusters aren't scaled down before they were seen for the idle timeout
+	status := manager.Reconcile(now.Add(-6 * time.Hour))
+	assert.Equal(t, status.Error, "", "reconcile error")
+	assert.Equal(t, len(scaler.Resized), 0, "number of resizes")
+
+	status = manager.Reconcile(now)
+	assert.Equal(t, status.Error, "", "reconcile error")
+	assert.Equal(t, manager.Status(), status, "reported status")
+	decisions := decisionsByCluster(status)
+	_, found := decisions["busy"]
+	assert.False(t, found, "a decision was made for a leased cluster")
+	assert.Equal(t, decisions["idle1"].Action, PoolActionScaleDown, "idle1 action")
+	assert.Equal(t, decisions["idle2"].Action, PoolActionScaleDown, "idle2 action")
+	assert.Equal(t, decisions["recent"].Action, PoolActionKeep, "recent action")
+	// the only free cluster of its version is kept running
+	assert.Equal(t, decisions["other"].Action, PoolActionKeep, "other action")
+	assert.Equal(t, scaler.Sizes, map[string]int64{"idle1/default-pool": 0, "idle2/default-pool": 0}, "node pool sizes")
+
+	saved := savedLeaseMap(t, services)
+	assert.True(t, saved.ClusterStatus(leaseID(scopedID("idle1"))).IsScaledDown(), "idle1 isn't marked scaled down")
+	assert.Equal(t, saved.ClusterStatus(leaseID(scopedID("idle1"))).NodePoolSizes, map[string]int64{"default-pool": 5}, "recorded node pool sizes")
+	assert.Equal(t, saved.ClusterStatus(leaseID(scopedID("idle2"))).NodePoolSizes, map[string]int64{"default-pool": 3}, "recorded node pool sizes")
+	assert.False(t, saved.ClusterStatus(leaseID(scopedID("recent"))).IsScaledDown(), "recent is marked scaled down")
+	_, found = saved.LeaseByClusterName(leaseID(scopedID("busy")))
+	assert.True(t, found, "lease on busy was lost")
+}
+
+func TestPoolManagerKeepsMinFree(t *testing.T) {
+	now := time.Now()
+	clusters := []*container.Cluster{poolCluster("idle1", "1.7.8"), poolCluster("idle2", "1.7.8")}
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	leaseMap.MarkReleased(leaseID(scopedID("idle1")), now.Add(-5*time.Hour))
+	leaseMap.MarkReleased(leaseID(scopedID("idle2")), now.Add(-4*time.Hour))
+	scaler := NewFakeNodePoolScaler(nil)
+	lister := NewFakeClusterLister(&container.ListClustersResponse{Clusters: clusters}, nil)
+	manager := NewPoolManager(lister, scaler, poolServices(t, leaseMap), "k8s-claimer", scopes, config.PoolMembership{}, poolConfig(2))
+	manager.Reconcile(now.Add(-6 * time.Hour))
+
+	decisions := decisionsByCluster(manager.Reconcile(now))
+	assert.Equal(t, decisions["idle1"].Action, PoolActionKeep, "idle1 action")
+	assert.Equal(t, decisions["idle2"].Action, PoolActionKeep, "idle2 action")
+	assert.Equal(t, len(scaler.Resized), 0, "number of resizes")
+}
+
+func TestPoolManagerRestoresToMinFree(t *testing.T) {
+	now := time.Now()
+	clusters := []*container.Cluster{poolCluster("cold1", "1.7.8"), poolCluster("cold2", "1.7.8")}
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	leaseMap.MarkReleased(leaseID(scopedID("cold1")), now.Add(-5*time.Hour))
+	leaseMap.MarkScaledDown(leaseID(scopedID("cold1")), now.Add(-3*time.Hour), map[string]int64{"default-pool": 5})
+	leaseMap.MarkReleased(leaseID(scopedID("cold2")), now.Add(-4*time.Hour))
+	leaseMap.MarkScaledDown(leaseID(scopedID("cold2")), now.Add(-2*time.Hour), map[string]int64{"default-pool": 5})
+	services := poolServices(t, leaseMap)
+	scaler := NewFakeNodePoolScaler(nil)
+	lister := NewFakeClusterLister(&container.ListClustersResponse{Clusters: clusters}, nil)
+	manager := NewPoolManager(lister, scaler, services, "k8s-claimer", scopes, config.PoolMembership{}, poolConfig(1))
+
+	decisions := decisionsByCluster(manager.Reconcile(now))
+	assert.Equal(t, decisions["cold1"].Action, PoolActionRestore, "cold1 action")
+	assert.Equal(t, decisions["cold2"].Action, PoolActionKeep, "cold2 action")
+	assert.Equal(t, scaler.Sizes, map[string]int64{"cold1/default-pool": 5}, "node pool sizes")
+	saved := savedLeaseMap(t, services)
+	assert.False(t, saved.ClusterStatus(leaseID(scopedID("cold1"))).IsScaledDown(), "cold1 is still marked scaled down")
+	assert.True(t, saved.ClusterStatus(leaseID(scopedID("cold2"))).IsScaledDown(), "cold2 isn't marked scaled down")
+}
+
+func TestPoolManagerResizeFailure(t *testing.T) {
+	now := time.Now()
+	clusters := []*container.Cluster{poolCluster("idle1", "1.7.8"), poolCluster("idle2", "1.7.8")}
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	leaseMap.MarkReleased(leaseID(scopedID("idle1")), now.Add(-5*time.Hour))
+	leaseMap.MarkReleased(leaseID(scopedID("idle2")), now.Add(-1*time.Hour))
+	scaler := NewFakeNodePoolScaler(errors.New("quota exceeded"))
+	lister := NewFakeClusterLister(&container.ListClustersResponse{Clusters: clusters}, nil)
+	manager := NewPoolManager(lister, scaler, poolServices(t, leaseMap), "k8s-claimer", scopes, config.PoolMembership{}, poolConfig(1))
+	manager.Reconcile(now.Add(-6 * time.Hour))
+
+	decisions := decisionsByCluster(manager.Reconcile(now))
+	assert.Equal(t, decisions["idle1"].Action, PoolActionScaleDown, "idle1 action")
+	assert.Equal(t, decisions["idle1"].Error, "quota exceeded", "idle1 error")
+}
+
+func TestRestoreIfScaledDown(t *testing.T) {
+	now := time.Now()
+	clusters := []*container.Cluster{poolCluster("cold", "1.7.8"), poolCluster("warm", "1.7.8")}
+	clusterMap := clusterMapWith(t, clusters)
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	leaseMap.MarkScaledDown(leaseID(scopedID("cold")), now, map[string]int64{"default-pool": 3})
+	services := poolServices(t, leaseMap)
+	scaler := NewFakeNodePoolScaler(nil)
+	manager := NewPoolManager(NewFakeClusterLister(nil, nil), scaler, services, "k8s-claimer", scopes, config.PoolMembership{}, poolConfig(1))
+
+	// running clusters are leased before scaled down ones
+	free, _, _, err := restoreIfScaledDown(context.Background(), manager, nil, clusters, clusterMap, leaseMap, services.Svc, &api.CreateLeaseReq{}, services, "k8s-claimer")
+	assert.NoErr(t, err)
+	assert.Equal(t, len(free), 1, "number of free clusters")
+	assert.Equal(t, free[0].Name, "warm", "free cluster name")
+	assert.Equal(t, len(scaler.Resized), 0, "number of resizes")
+
+	// if all are scaled down, the first is restored
+	free, _, restoredMap, err := restoreIfScaledDown(context.Background(), manager, nil, clusters[:1], clusterMap, leaseMap, services.Svc, &api.CreateLeaseReq{}, services, "k8s-claimer")
+	assert.NoErr(t, err)
+	assert.Equal(t, len(free), 1, "number of free clusters")
+	assert.Equal(t, free[0].Name, "cold", "free cluster name")
+	assert.Equal(t, scaler.Sizes, map[string]int64{"cold/default-pool": 3}, "node pool sizes")
+	assert.False(t, restoredMap.ClusterStatus(leaseID(scopedID("cold"))).IsScaledDown(), "cold is still marked scaled down")
+
+	// without a pool manager, nothing is restored
+	free, _, _, err = restoreIfScaledDown(context.Background(), nil, nil, clusters[:1], clusterMap, leaseMap, services.Svc, &api.CreateLeaseReq{}, services, "k8s-claimer")
+	assert.NoErr(t, err)
+	assert.Equal(t, len(free), 1, "number of free clusters")
+	assert.Equal(t, len(scaler.Resized), 1, "number of resizes")
+}
+
+func TestParseInstanceGroupURL(t *testing.T) {
+	project, zone, name, err := parseInstanceGroupURL("https://www.googleapis.com/compute/v1/projects/proj1/zones/us-west1-a/instanceGroupManagers/gke-ci-default-pool-grp")
+	assert.NoErr(t, err)
+	assert.Equal(t, project, "proj1", "project")
+	assert.Equal(t, zone, "us-west1-a", "zone")
+	assert.Equal(t, name, "gke-ci-default-pool-grp", "instance group name")
+	_, _, _, err = parseInstanceGroupURL("https://www.googleapis.com/compute/v1/projects/proj1")
+	assert.True(t, err != nil, "no error for a malformed URL")
+}
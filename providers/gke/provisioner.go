@@ -0,0 +1,197 @@
+package gke
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	container "google.golang.org/api/container/v1"
+	"k8s.io/client-go/pkg/labels"
+
+	"github.com/deis/k8s-claimer/api"
+	"github.com/deis/k8s-claimer/config"
+	"github.com/pborman/uuid"
+)
+
+const (
+	clusterRunning      = "RUNNING"
+	clusterProvisioning = "PROVISIONING"
+	clusterStopping     = "STOPPING"
+	// createdGrace is how long a created cluster is counted towards the cap if it never shows up
+	// in a cluster list, such as when it's deleted right away
+	createdGrace = time.Hour
+)
+
+type errClusterCapReached struct {
+	max int
+}
+
+func (e errClusterCapReached) Error() string {
+	return fmt.Sprintf("the pool already has the maximum of %d GKE clusters", e.max)
+}
+
+type errTemplateMismatch struct {
+	reason string
+}
+
+func (e errTemplateMismatch) Error() string {
+	return fmt.Sprintf("a new cluster wouldn't match the request (%s)", e.reason)
+}
+
+type errProvisioningFailed struct {
+	clusterName string
+	reason      string
+}
+
+func (e errProvisioningFailed) Error() string {
+	return fmt.Sprintf("creating cluster %s failed (%s)", e.clusterName, e.reason)
+}
+
+// Provisioner creates GKE clusters from the template in a config.GKEProvisioning when no free
+// cluster matches a lease request. It's safe for concurrent use
+type Provisioner struct {
+	creator ClusterCreator
+	conf    config.GKEProvisioning
+	projID  string
+	zone    string
+
+	mut sync.Mutex
+	// pending maps the names of the clusters that p is creating, or created but that weren't
+	// listed yet, to the time their creation finished. The time is zero while they're in flight
+	pending map[string]time.Time
+}
+
+// NewProvisioner creates a new Provisioner that creates clusters in the given project with
+// creator. leaseZone is the zone that clusters are leased from
+func NewProvisioner(creator ClusterCreator, conf config.GKEProvisioning, projID, leaseZone string) *Provisioner {
+	return &Provisioner{
+		creator: creator,
+		conf:    conf,
+		projID:  projID,
+		zone:    conf.ZoneFor(leaseZone),
+		pending: make(map[string]time.Time),
+	}
+}
+
+// Scope returns the project and zone that p creates clusters in
+func (p *Provisioner) Scope() config.GKEScope {
+	return config.GKEScope{ProjectID: p.projID, Location: p.zone}
+}
+
+// Provision creates a new cluster that matches the criteria in req, waits for it to be running
+// and returns it. clusterMap holds the clusters that already exist, and is used to enforce the
+// cap on the total number of clusters.
+//
+// Returns errTemplateMismatch if a cluster created from the template wouldn't match req
+// Returns errClusterCapReached if there are too many clusters to create another one
+// Returns errProvisioningFailed if the cluster couldn't be created or didn't start in time
+func (p *Provisioner) Provision(clusterMap *Map, req *api.CreateLeaseReq) (*container.Cluster, error) {
+	name := p.conf.NamePrefix + uuid.New()[:8]
+	if err := p.checkTemplate(name, req); err != nil {
+		return nil, err
+	}
+	if err := p.reserve(clusterMap, name); err != nil {
+		return nil, err
+	}
+	created := false
+	defer func() { p.release(name, created) }()
+
+	log.Printf("No free cluster matches the request, creating cluster %s in %s", name, p.zone)
+	op, err := p.creator.Create(p.projID, p.zone, &container.CreateClusterRequest{
+		Cluster: &container.Cluster{
+			Name:                  name,
+			InitialClusterVersion: p.conf.ClusterVersion,
+			InitialNodeCount:      p.conf.NodeCount,
+			NodeConfig:            &container.NodeConfig{MachineType: p.conf.MachineType},
+			ResourceLabels:        p.conf.Labels,
+		},
+	})
+	if err != nil {
+		return nil, errProvisioningFailed{clusterName: name, reason: err.Error()}
+	}
+	if err := waitForOperation(p.creator, p.projID, p.zone, op, p.conf.Timeout, p.conf.PollInterval); err != nil {
+		return nil, errProvisioningFailed{clusterName: name, reason: err.Error()}
+	}
+	cluster, err := p.creator.Get(p.projID, p.zone, name)
+	if err != nil {
+		return nil, errProvisioningFailed{clusterName: name, reason: err.Error()}
+	}
+	if cluster.Status != clusterRunning {
+		return nil, errProvisioningFailed{clusterName: name, reason: "cluster status is " + cluster.Status}
+	}
+	log.Printf("Created cluster %s", name)
+	created = true
+	return cluster, nil
+}
+
+// checkTemplate returns errTemplateMismatch if a cluster with the given name created from the
+// template wouldn't match the criteria in req
+func (p *Provisioner) checkTemplate(name string, req *api.CreateLeaseReq) error {
+	regex, err := req.ClusterNameRegexps()
+	if err != nil {
+		return err
+	}
+	if !regex.MatchString(name) {
+		return errTemplateMismatch{reason: fmt.Sprintf("name %s doesn't match %s", name, strings.Join(append([]string{req.ClusterRegex}, req.ClusterRegexes...), " and "))}
+	}
+	selector, err := req.LabelSelector()
+	if err != nil {
+		return err
+	}
+	if !selector.Matches(labels.Set(p.conf.Labels)) {
+		return errTemplateMismatch{reason: fmt.Sprintf("labels %v don't match %s", p.conf.Labels, req.ClusterSelector)}
+	}
+	constraint, err := req.VersionConstraint()
+	if err != nil {
+		return err
+	}
+	if constraint != nil && !constraint.CheckString(p.conf.ClusterVersion) {
+		return errTemplateMismatch{reason: fmt.Sprintf("version %q doesn't satisfy %s", p.conf.ClusterVersion, req.ClusterVersion)}
+	}
+	return nil
+}
+
+// reserve counts the new cluster with the given name towards the cap, given the clusters that
+// already exist in clusterMap. The clusters that p is creating or created are counted too, unless
+// they're in clusterMap, so that a clusterMap that was listed before they were created can't be
+// used to go over the cap. Returns errClusterCapReached if the cap doesn't allow another cluster
+func (p *Provisioner) reserve(clusterMap *Map, name string) error {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	listed := make(map[string]bool)
+	for _, id := range clusterMap.Names() {
+		if scope, _ := clusterMap.Scope(id); scope == p.Scope() {
+			listed[clusterNameFromID(id)] = true
+		}
+	}
+	existing := len(clusterMap.Names())
+	for pendingName, done := range p.pending {
+		switch {
+		case listed[pendingName] && !done.IsZero():
+			delete(p.pending, pendingName)
+		case !done.IsZero() && time.Since(done) > createdGrace:
+			delete(p.pending, pendingName)
+		case !listed[pendingName]:
+			existing++
+		}
+	}
+	if existing >= p.conf.MaxClusters {
+		return errClusterCapReached{max: p.conf.MaxClusters}
+	}
+	p.pending[name] = time.Time{}
+	return nil
+}
+
+// release stops counting the cluster with the given name as in flight. If it was created, it's
+// still counted until it shows up in a cluster list
+func (p *Provisioner) release(name string, created bool) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	if !created {
+		delete(p.pending, name)
+		return
+	}
+	p.pending[name] = time.Now()
+}
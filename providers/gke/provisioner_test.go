@@ -0,0 +1,123 @@
+package gke
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/api"
+	"github.com/deis/k8s-claimer/config"
+	"github.com/deis/k8s-claimer/testutil"
+	container "google.golang.org/api/container/v1"
+)
+
+func provisioningConfig() config.GKEProvisioning {
+	return config.GKEProvisioning{
+		Enabled:        true,
+		MaxClusters:    10,
+		NamePrefix:     "ci-",
+		ClusterVersion: "1.7.8-gke.0",
+		MachineType:    "n1-standard-2",
+		NodeCount:      3,
+		Labels:         map[string]string{"gpu": "false"},
+		Timeout:        time.Minute,
+	}
+}
+
+func clusterMapWith(t *testing.T, clusters []*container.Cluster) *Map {
+	clusterMap, err := ParseMapFromGKE(context.Background(), NewFakeClusterLister(&container.ListClustersResponse{Clusters: clusters}, nil), scopes, config.PoolMembership{})
+	assert.NoErr(t, err)
+	return clusterMap
+}
+
+func TestProvision(t *testing.T) {
+	creator := NewFakeClusterCreator(3, nil)
+	provisioner := NewProvisioner(creator, provisioningConfig(), projID, zone)
+	req := &api.CreateLeaseReq{ClusterRegex: "^ci-", ClusterVersion: "~1.7", ClusterSelector: "gpu=false"}
+	cluster, err := provisioner.Provision(clusterMapWith(t, testutil.GetGKEClusters()), req)
+	assert.NoErr(t, err)
+	assert.True(t, strings.HasPrefix(cluster.Name, "ci-"), "cluster name doesn't have the configured prefix")
+	assert.Equal(t, cluster.Status, clusterRunning, "cluster status")
+	assert.Equal(t, len(creator.Created), 1, "number of created clusters")
+	created := creator.Created[0].Cluster
+	assert.Equal(t, created.InitialClusterVersion, "1.7.8-gke.0", "cluster version")
+	assert.Equal(t, created.InitialNodeCount, int64(3), "node count")
+	assert.Equal(t, created.NodeConfig.MachineType, "n1-standard-2", "machine type")
+	assert.Equal(t, created.ResourceLabels, map[string]string{"gpu": "false"}, "labels")
+	assert.Equal(t, len(provisioner.pending), 1, "number of pending clusters")
+	assert.False(t, provisioner.pending[cluster.Name].IsZero(), "created cluster is still in flight")
+}
+
+func TestProvisionTemplateMismatch(t *testing.T) {
+	creator := NewFakeClusterCreator(1, nil)
+	provisioner := NewProvisioner(creator, provisioningConfig(), projID, zone)
+	for _, req := range []*api.CreateLeaseReq{
+		&api.CreateLeaseReq{ClusterRegex: "^staging-"},
+		&api.CreateLeaseReq{ClusterVersion: "1.8"},
+		&api.CreateLeaseReq{ClusterSelector: "gpu=true"},
+	} {
+		_, err := provisioner.Provision(clusterMapWith(t, nil), req)
+		if _, ok := err.(errTemplateMismatch); !ok {
+			t.Errorf("expected errTemplateMismatch for %+v, got %v", *req, err)
+		}
+	}
+	assert.Equal(t, len(creator.Created), 0, "number of created clusters")
+}
+
+func TestProvisionCap(t *testing.T) {
+	conf := provisioningConfig()
+	conf.MaxClusters = len(testutil.GetGKEClusters())
+	creator := NewFakeClusterCreator(1, nil)
+	provisioner := NewProvisioner(creator, conf, projID, zone)
+	_, err := provisioner.Provision(clusterMapWith(t, testutil.GetGKEClusters()), &api.CreateLeaseReq{})
+	assert.Err(t, errClusterCapReached{max: conf.MaxClusters}, err)
+	assert.Equal(t, len(creator.Created), 0, "number of created clusters")
+}
+
+func TestProvisionCapCountsUnlistedClusters(t *testing.T) {
+	conf := provisioningConfig()
+	conf.MaxClusters = len(testutil.GetGKEClusters()) + 1
+	creator := NewFakeClusterCreator(1, nil)
+	provisioner := NewProvisioner(creator, conf, projID, zone)
+	clusterMap := clusterMapWith(t, testutil.GetGKEClusters())
+	cluster, err := provisioner.Provision(clusterMap, &api.CreateLeaseReq{})
+	assert.NoErr(t, err)
+
+	// a cluster list from before the new cluster was created doesn't make room for another one
+	_, err = provisioner.Provision(clusterMap, &api.CreateLeaseReq{})
+	assert.Err(t, errClusterCapReached{max: conf.MaxClusters}, err)
+
+	// and once the new cluster is listed, it's only counted once
+	conf.MaxClusters++
+	provisioner.conf = conf
+	cluster.Zone = zone
+	_, err = provisioner.Provision(clusterMapWith(t, append(testutil.GetGKEClusters(), cluster)), &api.CreateLeaseReq{})
+	assert.NoErr(t, err)
+	assert.Equal(t, len(creator.Created), 2, "number of created clusters")
+}
+
+func TestProvisionFailures(t *testing.T) {
+	creator := NewFakeClusterCreator(1, errors.New("quota exceeded"))
+	_, err := NewProvisioner(creator, provisioningConfig(), projID, zone).Provision(clusterMapWith(t, nil), &api.CreateLeaseReq{})
+	if _, ok := err.(errProvisioningFailed); !ok {
+		t.Errorf("expected errProvisioningFailed when creation fails, got %v", err)
+	}
+
+	creator = NewFakeClusterCreator(2, nil)
+	creator.OperationError = "no capacity in zone"
+	_, err = NewProvisioner(creator, provisioningConfig(), projID, zone).Provision(clusterMapWith(t, nil), &api.CreateLeaseReq{})
+	if _, ok := err.(errProvisioningFailed); !ok {
+		t.Errorf("expected errProvisioningFailed when the operation fails, got %v", err)
+	}
+
+	conf := provisioningConfig()
+	conf.Timeout = 0
+	creator = NewFakeClusterCreator(100, nil)
+	_, err = NewProvisioner(creator, conf, projID, zone).Provision(clusterMapWith(t, nil), &api.CreateLeaseReq{})
+	if _, ok := err.(errProvisioningFailed); !ok {
+		t.Errorf("expected errProvisioningFailed when the operation times out, got %v", err)
+	}
+}
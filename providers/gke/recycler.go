@@ -0,0 +1,433 @@
+package gke
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	container "google.golang.org/api/container/v1"
+	"google.golang.org/api/googleapi"
+
+	"github.com/deis/k8s-claimer/config"
+	"github.com/deis/k8s-claimer/k8s"
+	"github.com/deis/k8s-claimer/leases"
+)
+
+type errRecycling struct {
+	clusterName string
+	step        string
+	err         error
+}
+
+func (e errRecycling) Error() string {
+	return fmt.Sprintf("error %s cluster %s -- %s", e.step, e.clusterName, e.err)
+}
+
+// Recycler deletes released GKE clusters whose names match the configured regex and recreates
+// them with the same name and spec, so that every lease gets a fresh cluster. The recycle phase
+// of each cluster is saved in its status in the k8s annotations, and the cluster can't be leased
+// until it's running again. Recycles that the server didn't finish, such as those it was
+// interrupted in by a restart, are resumed by Reconcile
+type Recycler struct {
+	creator        ClusterCreator
+	clusterLister  ClusterLister
+	services       k8s.ServiceGetterUpdater
+	k8sServiceName string
+	scopes         []config.GKEScope
+	conf           config.GKERecycling
+	regex          *regexp.Regexp
+
+	mut sync.Mutex
+	// the IDs of the clusters that are being recycled by this server
+	running map[string]bool
+	wg      sync.WaitGroup
+}
+
+// NewRecycler creates a new Recycler that recycles clusters with creator, and saves their
+// progress in the annotations of the k8s service with the given name. Clusters whose status
+// doesn't record their project and location are looked for in scopes with clusterLister. Returns
+// an error if conf.ClusterRegex isn't a valid regular expression
+func NewRecycler(
+	creator ClusterCreator,
+	clusterLister ClusterLister,
+	services k8s.ServiceGetterUpdater,
+	k8sServiceName string,
+	scopes []config.GKEScope,
+	conf config.GKERecycling,
+) (*Recycler, error) {
+	regex, err := regexp.Compile(conf.ClusterRegex)
+	if err != nil {
+		return nil, err
+	}
+	return &Recycler{
+		creator:        creator,
+		clusterLister:  clusterLister,
+		services:       services,
+		k8sServiceName: k8sServiceName,
+		scopes:         scopes,
+		conf:           conf,
+		regex:          regex,
+		running:        make(map[string]bool),
+	}, nil
+}
+
+// Matches returns true if the cluster with the given name is recycled after its lease is released
+func (r *Recycler) Matches(clusterName string) bool {
+	return r.regex.MatchString(clusterName)
+}
+
+// recyclesLease returns true if r is not nil and recycles the cluster of lease after it's
+// released or reclaimed
+func (r *Recycler) recyclesLease(lease *leases.Lease) bool {
+	return r != nil && lease.Provider == leases.ProviderGoogle && r.Matches(clusterNameFromID(lease.ClusterName))
+}
+
+// Run calls Reconcile every r.conf.Interval until stop is closed. Pass a nil stop channel to run
+// forever
+func (r *Recycler) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(r.conf.Interval)
+	defer ticker.Stop()
+	for {
+		if err := r.Reconcile(); err != nil {
+			log.Printf("Error looking for GKE clusters to recycle -- %s", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Reconcile reclaims the expired leases of clusters that r recycles and marks those clusters as
+// deleting, then starts recycling every cluster that is marked as deleting or creating, unless
+// this server is already recycling it. Clusters whose leases expire are recycled this way, and so
+// are those whose recycle was interrupted. The recycles run one after another in the background,
+// and only errors finding the clusters to recycle are returned
+func (r *Recycler) Reconcile() error {
+	if err := r.saveProgress(r.reclaimExpiredLeases); err != nil {
+		return err
+	}
+	svc, err := r.services.Get(r.k8sServiceName)
+	if err != nil {
+		return err
+	}
+	leaseMap, err := leases.ParseMapFromAnnotations(svc.Annotations)
+	if err != nil {
+		return err
+	}
+	var clusterMap *Map
+	var resumed []resumedRecycle
+	for _, id := range leaseMap.RecyclingClusterIDs() {
+		provider, clusterID := leases.SplitClusterID(id)
+		if provider != "" && provider != leases.ProviderGoogle {
+			continue
+		}
+		scope, name, qualified := splitQualifiedClusterID(clusterID)
+		if !qualified {
+			// statuses recorded before GKE cluster IDs were always qualified only have the name
+			if clusterMap == nil {
+				ctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+				clusterMap, err = ParseMapFromGKE(ctx, r.clusterLister, r.scopes, config.PoolMembership{})
+				cancel()
+				if err != nil {
+					return err
+				}
+			}
+			scope, qualified = clusterMap.Scope(clusterID)
+		}
+		if !qualified {
+			r.markFailed(clusterID, errRecycling{clusterName: clusterID, step: "resuming the recycle of", err: errNoSuchCluster{name: clusterID}})
+			continue
+		}
+		if !r.start(clusterID) {
+			continue
+		}
+		resumed = append(resumed, resumedRecycle{clusterID: clusterID, name: name, scope: scope, phase: leaseMap.ClusterStatus(id).Recycling})
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for _, rr := range resumed {
+			r.resume(rr.clusterID, rr.name, rr.scope, rr.phase)
+			r.finish(rr.clusterID)
+		}
+	}()
+	return nil
+}
+
+// resumedRecycle is a recycle that Reconcile resumes
+type resumedRecycle struct {
+	clusterID string
+	name      string
+	scope     config.GKEScope
+	phase     string
+}
+
+// reclaimExpiredLeases deletes the expired leases in leaseMap of the clusters that r recycles,
+// and marks the clusters as deleting
+func (r *Recycler) reclaimExpiredLeases(leaseMap *leases.Map) {
+	expired, err := findExpiredLeases(leaseMap)
+	if err != nil {
+		return
+	}
+	for _, expiredLease := range expired {
+		if !r.recyclesLease(expiredLease.Lease) {
+			continue
+		}
+		leaseMap.DeleteLease(expiredLease.UUID)
+		if exprTime, err := expiredLease.Lease.ExpirationTime(); err == nil {
+			leaseMap.MarkReleased(expiredLease.Lease.ClusterID(), exprTime)
+		}
+		leaseMap.MarkRecycling(expiredLease.Lease.ClusterID(), leases.RecycleDeleting, time.Now())
+	}
+}
+
+// start records that this server started recycling the cluster with the given ID. Returns false
+// if it already is
+func (r *Recycler) start(clusterID string) bool {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if r.running[clusterID] {
+		return false
+	}
+	r.running[clusterID] = true
+	return true
+}
+
+// finish records that this server stopped recycling the cluster with the given ID
+func (r *Recycler) finish(clusterID string) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	delete(r.running, clusterID)
+}
+
+// wait waits until the recycles that Reconcile started are done
+func (r *Recycler) wait() {
+	r.wg.Wait()
+}
+
+// Recycle deletes cluster, which has the given ID and is in scope, recreates it with the same
+// name and spec and waits until it's running. Each phase is saved to the cluster's status as
+// it's entered, and the status is cleared once the cluster is running. If anything fails, the
+// cluster is marked as failed instead, and stays unleasable. Callers should mark the cluster as
+// deleting when they release its lease, so that it can't be leased again before Recycle starts,
+// and Reconcile picks it up if this server stops before it's done. Does nothing if this server is
+// already recycling the cluster
+func (r *Recycler) Recycle(clusterID string, scope config.GKEScope, cluster *container.Cluster) error {
+	if !r.start(clusterID) {
+		return nil
+	}
+	defer r.finish(clusterID)
+	return r.done(clusterID, r.recycle(clusterID, scope, cluster))
+}
+
+// done logs the result err of recycling the cluster with the given ID, and marks it as failed if
+// err isn't nil. Returns err
+func (r *Recycler) done(clusterID string, err error) error {
+	if err != nil {
+		r.markFailed(clusterID, err)
+		return err
+	}
+	log.Printf("Recycled cluster %s", clusterID)
+	return nil
+}
+
+func (r *Recycler) markFailed(clusterID string, err error) {
+	log.Printf("Error recycling cluster %s -- %s", clusterID, err)
+	if saveErr := r.saveProgress(func(leaseMap *leases.Map) {
+		leaseMap.MarkRecycleFailed(leaseID(clusterID), time.Now(), err.Error())
+	}); saveErr != nil {
+		log.Printf("Error saving the recycle failure of cluster %s to Kubernetes annotations -- %s", clusterID, saveErr)
+	}
+}
+
+// resume continues recycling the cluster with the given ID and name in scope, which is in the
+// given recycle phase according to its status, from where it was left off. The cluster is fetched
+// to find out how far the recycle got. Deleted clusters whose recreation never started can't be
+// recreated, since their spec was lost with them, and are marked as failed
+func (r *Recycler) resume(clusterID, name string, scope config.GKEScope, phase string) error {
+	log.Printf("Resuming the recycle of cluster %s, which was %s", clusterID, phase)
+	cluster, err := r.creator.Get(scope.ProjectID, scope.Location, name)
+	if isNotFound(err) {
+		return r.done(clusterID, errRecycling{clusterName: clusterID, step: "resuming the recycle of", err: fmt.Errorf("the cluster was deleted before it was recreated, and its spec was lost")})
+	}
+	if err != nil {
+		return r.done(clusterID, errRecycling{clusterName: clusterID, step: "resuming the recycle of", err: err})
+	}
+	switch {
+	case phase == leases.RecycleCreating && cluster.Status == clusterRunning:
+		return r.done(clusterID, r.markRecycled(clusterID))
+	case phase == leases.RecycleCreating && cluster.Status == clusterProvisioning:
+		return r.done(clusterID, r.waitUntilRecreated(clusterID, scope, name))
+	case phase == leases.RecycleDeleting && cluster.Status == clusterStopping:
+		if err := r.waitUntilDeleted(clusterID, scope, name); err != nil {
+			return r.done(clusterID, err)
+		}
+		return r.done(clusterID, r.recreate(clusterID, scope, cluster))
+	case phase == leases.RecycleDeleting && cluster.Status == clusterRunning:
+		return r.done(clusterID, r.recycle(clusterID, scope, cluster))
+	default:
+		return r.done(clusterID, errRecycling{clusterName: clusterID, step: "resuming the recycle of", err: fmt.Errorf("cluster status is %s", cluster.Status)})
+	}
+}
+
+func (r *Recycler) recycle(clusterID string, scope config.GKEScope, cluster *container.Cluster) error {
+	projID, zone := scope.ProjectID, scope.Location
+
+	log.Printf("Recycling cluster %s, deleting it", clusterID)
+	if err := r.saveProgress(func(leaseMap *leases.Map) {
+		leaseMap.MarkRecycling(leaseID(clusterID), leases.RecycleDeleting, time.Now())
+	}); err != nil {
+		return errRecycling{clusterName: clusterID, step: "saving the progress of", err: err}
+	}
+	op, err := r.creator.Delete(projID, zone, cluster.Name)
+	if err != nil {
+		return errRecycling{clusterName: clusterID, step: "deleting", err: err}
+	}
+	if err := waitForOperation(r.creator, projID, zone, op, r.conf.Timeout, r.conf.PollInterval); err != nil {
+		return errRecycling{clusterName: clusterID, step: "deleting", err: err}
+	}
+	return r.recreate(clusterID, scope, cluster)
+}
+
+// recreate creates a cluster with the same name and spec as cluster, which was deleted, and
+// waits until it's running
+func (r *Recycler) recreate(clusterID string, scope config.GKEScope, cluster *container.Cluster) error {
+	projID, zone := scope.ProjectID, scope.Location
+	log.Printf("Recycling cluster %s, recreating it", clusterID)
+	if err := r.saveProgress(func(leaseMap *leases.Map) {
+		leaseMap.MarkRecycling(leaseID(clusterID), leases.RecycleCreating, time.Now())
+	}); err != nil {
+		return errRecycling{clusterName: clusterID, step: "saving the progress of", err: err}
+	}
+	op, err := r.creator.Create(projID, zone, recreateRequest(cluster))
+	if err != nil {
+		return errRecycling{clusterName: clusterID, step: "recreating", err: err}
+	}
+	if err := waitForOperation(r.creator, projID, zone, op, r.conf.Timeout, r.conf.PollInterval); err != nil {
+		return errRecycling{clusterName: clusterID, step: "recreating", err: err}
+	}
+	recreated, err := r.creator.Get(projID, zone, cluster.Name)
+	if err != nil {
+		return errRecycling{clusterName: clusterID, step: "recreating", err: err}
+	}
+	if recreated.Status != clusterRunning {
+		return errRecycling{clusterName: clusterID, step: "recreating", err: fmt.Errorf("cluster status is %s", recreated.Status)}
+	}
+	return r.markRecycled(clusterID)
+}
+
+// waitUntilDeleted polls the cluster with the given name in scope every r.conf.PollInterval
+// until it doesn't exist anymore, or r.conf.Timeout has passed
+func (r *Recycler) waitUntilDeleted(clusterID string, scope config.GKEScope, name string) error {
+	deadline := time.Now().Add(r.conf.Timeout)
+	for {
+		_, err := r.creator.Get(scope.ProjectID, scope.Location, name)
+		if isNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return errRecycling{clusterName: clusterID, step: "deleting", err: err}
+		}
+		if time.Now().After(deadline) {
+			return errRecycling{clusterName: clusterID, step: "deleting", err: fmt.Errorf("cluster wasn't deleted within %s", r.conf.Timeout)}
+		}
+		time.Sleep(r.conf.PollInterval)
+	}
+}
+
+// waitUntilRecreated polls the cluster with the given name in scope every r.conf.PollInterval
+// until it's running, or r.conf.Timeout has passed, and marks it as recycled once it is
+func (r *Recycler) waitUntilRecreated(clusterID string, scope config.GKEScope, name string) error {
+	deadline := time.Now().Add(r.conf.Timeout)
+	for {
+		cluster, err := r.creator.Get(scope.ProjectID, scope.Location, name)
+		if err != nil {
+			return errRecycling{clusterName: clusterID, step: "recreating", err: err}
+		}
+		switch {
+		case cluster.Status == clusterRunning:
+			return r.markRecycled(clusterID)
+		case cluster.Status != clusterProvisioning:
+			return errRecycling{clusterName: clusterID, step: "recreating", err: fmt.Errorf("cluster status is %s", cluster.Status)}
+		case time.Now().After(deadline):
+			return errRecycling{clusterName: clusterID, step: "recreating", err: fmt.Errorf("cluster wasn't running within %s", r.conf.Timeout)}
+		}
+		time.Sleep(r.conf.PollInterval)
+	}
+}
+
+// markRecycled clears the recycle phase of the cluster with the given ID, and records that its
+// namespaces are clean
+func (r *Recycler) markRecycled(clusterID string) error {
+	if err := r.saveProgress(func(leaseMap *leases.Map) {
+		leaseMap.MarkRecycled(leaseID(clusterID))
+		leaseMap.MarkCleaned(leaseID(clusterID), time.Now())
+	}); err != nil {
+		return errRecycling{clusterName: clusterID, step: "saving the progress of", err: err}
+	}
+	return nil
+}
+
+func (r *Recycler) saveProgress(fn func(*leases.Map)) error {
+	return k8s.UpdateLeaseMap(context.Background(), r.services, r.k8sServiceName, fn)
+}
+
+// isNotFound returns true if err is a GKE API error that means the requested object doesn't exist
+func isNotFound(err error) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	return ok && apiErr.Code == http.StatusNotFound
+}
+
+// splitQualifiedClusterID splits id into the scope and name of its cluster. Returns false if id
+// isn't a qualified ID, but a bare cluster name
+func splitQualifiedClusterID(id string) (config.GKEScope, string, bool) {
+	parts := strings.Split(id, "/")
+	if len(parts) != 3 {
+		return config.GKEScope{}, id, false
+	}
+	return config.GKEScope{ProjectID: parts[0], Location: parts[1]}, parts[2], true
+}
+
+// recreateRequest returns a request that creates a cluster with the same name and spec as
+// cluster. Its nodes run the version that its master currently runs
+func recreateRequest(cluster *container.Cluster) *container.CreateClusterRequest {
+	spec := &container.Cluster{
+		Name:                  cluster.Name,
+		Description:           cluster.Description,
+		InitialClusterVersion: cluster.CurrentMasterVersion,
+		Network:               cluster.Network,
+		Subnetwork:            cluster.Subnetwork,
+		ClusterIpv4Cidr:       cluster.ClusterIpv4Cidr,
+		Locations:             cluster.Locations,
+		LoggingService:        cluster.LoggingService,
+		MonitoringService:     cluster.MonitoringService,
+		AddonsConfig:          cluster.AddonsConfig,
+		ResourceLabels:        cluster.ResourceLabels,
+	}
+	if cluster.MasterAuth != nil {
+		spec.MasterAuth = &container.MasterAuth{
+			Username: cluster.MasterAuth.Username,
+			Password: cluster.MasterAuth.Password,
+		}
+	}
+	for _, nodePool := range cluster.NodePools {
+		spec.NodePools = append(spec.NodePools, &container.NodePool{
+			Name:             nodePool.Name,
+			Config:           nodePool.Config,
+			InitialNodeCount: nodePool.InitialNodeCount,
+			Autoscaling:      nodePool.Autoscaling,
+		})
+	}
+	if len(spec.NodePools) == 0 {
+		spec.InitialNodeCount = cluster.InitialNodeCount
+		spec.NodeConfig = cluster.NodeConfig
+	}
+	return &container.CreateClusterRequest{Cluster: spec}
+}
@@ -0,0 +1,193 @@
+package gke
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/api"
+	"github.com/deis/k8s-claimer/config"
+	"github.com/deis/k8s-claimer/leases"
+	"github.com/pborman/uuid"
+	container "google.golang.org/api/container/v1"
+)
+
+func recycledCluster() *container.Cluster {
+	return &container.Cluster{
+		Name:                 "ci-recycled",
+		Zone:                 "us-west1-a",
+		CurrentMasterVersion: "1.7.8-gke.0",
+		CurrentNodeVersion:   "1.7.6-gke.1",
+		Status:               clusterRunning,
+		ResourceLabels:       map[string]string{"gpu": "false"},
+		MasterAuth:           &container.MasterAuth{Username: "admin", Password: "secret", ClientKey: "key"},
+		NodePools: []*container.NodePool{&container.NodePool{
+			Name:             "default-pool",
+			InitialNodeCount: 3,
+			Config:           &container.NodeConfig{MachineType: "n1-standard-4"},
+			Status:           "RUNNING",
+		}},
+	}
+}
+
+var (
+	recycledScope = config.GKEScope{ProjectID: projID, Location: "us-west1-a"}
+)
+
+func recyclingConfig() config.GKERecycling {
+	return config.GKERecycling{ClusterRegex: "^ci-", Timeout: time.Minute}
+}
+
+func TestRecyclerMatches(t *testing.T) {
+	recycler, err := NewRecycler(NewFakeClusterCreator(1, nil), nil, nil, "k8s-claimer", scopes, recyclingConfig())
+	assert.NoErr(t, err)
+	assert.True(t, recycler.Matches("ci-recycled"), "ci-recycled doesn't match")
+	assert.False(t, recycler.Matches("staging"), "staging matches")
+
+	_, err = NewRecycler(NewFakeClusterCreator(1, nil), nil, nil, "k8s-claimer", scopes, config.GKERecycling{ClusterRegex: "("})
+	assert.True(t, err != nil, "no error for an invalid regex")
+}
+
+func TestRecycle(t *testing.T) {
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	leaseMap.MarkRecycling(leaseID("ci-recycled"), leases.RecycleDeleting, time.Now())
+	services := poolServices(t, leaseMap)
+	creator := NewFakeClusterCreator(2, nil)
+	recycler, err := NewRecycler(creator, nil, services, "k8s-claimer", scopes, recyclingConfig())
+	assert.NoErr(t, err)
+
+	assert.NoErr(t, recycler.Recycle("ci-recycled", recycledScope, recycledCluster()))
+	assert.Equal(t, creator.Deleted, []string{"ci-recycled"}, "deleted clusters")
+	assert.Equal(t, len(creator.Created), 1, "number of created clusters")
+	recreated := creator.Created[0].Cluster
+	assert.Equal(t, recreated.Name, "ci-recycled", "recreated cluster name")
+	assert.Equal(t, recreated.InitialClusterVersion, "1.7.8-gke.0", "recreated cluster version")
+	assert.Equal(t, recreated.ResourceLabels, map[string]string{"gpu": "false"}, "recreated cluster labels")
+	assert.Equal(t, *recreated.MasterAuth, container.MasterAuth{Username: "admin", Password: "secret"}, "recreated master auth")
+	assert.Equal(t, len(recreated.NodePools), 1, "number of recreated node pools")
+	assert.Equal(t, recreated.NodePools[0].InitialNodeCount, int64(3), "recreated node count")
+	assert.Equal(t, recreated.NodePools[0].Config.MachineType, "n1-standard-4", "recreated machine type")
+	assert.Equal(t, recreated.NodePools[0].Status, "", "recreated node pool status")
+
+	status := savedLeaseMap(t, services).ClusterStatus(leaseID("ci-recycled"))
+	assert.False(t, status.IsRecycling(), "cluster is still recycling")
+	assert.False(t, status.LastCleanedTime().IsZero(), "cluster wasn't marked cleaned")
+}
+
+func TestRecycleFailure(t *testing.T) {
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	services := poolServices(t, leaseMap)
+	creator := NewFakeClusterCreator(1, errors.New("quota exceeded"))
+	recycler, err := NewRecycler(creator, nil, services, "k8s-claimer", scopes, recyclingConfig())
+	assert.NoErr(t, err)
+
+	err = recycler.Recycle("ci-recycled", recycledScope, recycledCluster())
+	assert.Err(t, errRecycling{clusterName: "ci-recycled", step: "recreating", err: creator.CreateErr}, err)
+	status := savedLeaseMap(t, services).ClusterStatus(leaseID("ci-recycled"))
+	assert.Equal(t, status.Recycling, leases.RecycleFailed, "recycle phase")
+	assert.True(t, strings.Contains(status.RecycleError, "quota exceeded"), "recycle error doesn't mention the cause")
+
+	creator = NewFakeClusterCreator(1, nil)
+	creator.OperationError = "cluster is being upgraded"
+	recycler, err = NewRecycler(creator, nil, services, "k8s-claimer", scopes, recyclingConfig())
+	assert.NoErr(t, err)
+	assert.True(t, recycler.Recycle("ci-recycled", recycledScope, recycledCluster()) != nil, "no error when the deletion fails")
+	assert.Equal(t, len(creator.Created), 0, "number of created clusters")
+	assert.Equal(t, savedLeaseMap(t, services).ClusterStatus(leaseID("ci-recycled")).Recycling, leases.RecycleFailed, "recycle phase")
+}
+
+func recycledClusterNamed(name string) *container.Cluster {
+	cluster := recycledCluster()
+	cluster.Name = name
+	return cluster
+}
+
+func TestRecyclerResumesInterruptedRecycles(t *testing.T) {
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	for name, phase := range map[string]string{
+		"ci-deleting": leases.RecycleDeleting,
+		"ci-creating": leases.RecycleCreating,
+		"ci-lost":     leases.RecycleDeleting,
+	} {
+		leaseMap.MarkRecycling(leaseID(QualifiedClusterID(recycledScope, name)), phase, time.Now())
+	}
+	services := poolServices(t, leaseMap)
+	creator := NewFakeClusterCreator(1, nil)
+	// ci-deleting was never deleted, and ci-creating was recreated before the server stopped
+	creator.Add(recycledClusterNamed("ci-deleting"))
+	creator.Add(recycledClusterNamed("ci-creating"))
+	recycler, err := NewRecycler(creator, nil, services, "k8s-claimer", scopes, recyclingConfig())
+	assert.NoErr(t, err)
+
+	assert.NoErr(t, recycler.Reconcile())
+	recycler.wait()
+	assert.Equal(t, creator.Deleted, []string{"ci-deleting"}, "deleted clusters")
+	assert.Equal(t, len(creator.Created), 1, "number of created clusters")
+	saved := savedLeaseMap(t, services)
+	for _, name := range []string{"ci-deleting", "ci-creating"} {
+		status := saved.ClusterStatus(leaseID(QualifiedClusterID(recycledScope, name)))
+		assert.False(t, status.IsRecycling(), "%s is still recycling", name)
+		assert.False(t, status.LastCleanedTime().IsZero(), "%s wasn't marked cleaned", name)
+	}
+	// ci-lost was deleted, but its spec was lost before it was recreated
+	status := saved.ClusterStatus(leaseID(QualifiedClusterID(recycledScope, "ci-lost")))
+	assert.Equal(t, status.Recycling, leases.RecycleFailed, "ci-lost recycle phase")
+	assert.Equal(t, len(saved.RecyclingClusterIDs()), 0, "number of recycling clusters")
+}
+
+func TestRecyclerReclaimsExpiredLeases(t *testing.T) {
+	clusterID := QualifiedClusterID(recycledScope, "ci-recycled")
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	expired := leases.NewLease(clusterID, time.Now().Add(-time.Minute))
+	expired.Provider = leases.ProviderGoogle
+	leaseMap.CreateLease(uuid.NewRandom(), expired)
+	staging := leases.NewLease(QualifiedClusterID(recycledScope, "staging"), time.Now().Add(-time.Minute))
+	staging.Provider = leases.ProviderGoogle
+	leaseMap.CreateLease(uuid.NewRandom(), staging)
+	services := poolServices(t, leaseMap)
+	creator := NewFakeClusterCreator(1, nil)
+	creator.Add(recycledCluster())
+	recycler, err := NewRecycler(creator, nil, services, "k8s-claimer", scopes, recyclingConfig())
+	assert.NoErr(t, err)
+
+	assert.NoErr(t, recycler.Reconcile())
+	recycler.wait()
+	assert.Equal(t, creator.Deleted, []string{"ci-recycled"}, "deleted clusters")
+	saved := savedLeaseMap(t, services)
+	_, leased := saved.LeaseByClusterName(leaseID(clusterID))
+	assert.False(t, leased, "the expired lease of ci-recycled wasn't reclaimed")
+	assert.False(t, saved.ClusterStatus(leaseID(clusterID)).IsRecycling(), "ci-recycled is still recycling")
+	// clusters that aren't recycled are left for lease requests to reclaim
+	_, leased = saved.LeaseByClusterName(leaseID(QualifiedClusterID(recycledScope, "staging")))
+	assert.True(t, leased, "the expired lease of staging was reclaimed")
+}
+
+func TestSearchForFreeClustersRecyclesExpiredLeases(t *testing.T) {
+	clusters := []*container.Cluster{recycledCluster(), recycledClusterNamed("staging")}
+	lister := NewFakeClusterLister(&container.ListClustersResponse{Clusters: clusters}, nil)
+	clusterMap, err := ParseMapFromGKE(context.Background(), lister, []config.GKEScope{recycledScope}, config.PoolMembership{})
+	assert.NoErr(t, err)
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	for _, cluster := range clusters {
+		expired := leases.NewLease(clusterMap.ID(cluster), time.Now().Add(-time.Minute))
+		expired.Provider = leases.ProviderGoogle
+		leaseMap.CreateLease(uuid.NewRandom(), expired)
+	}
+	recycler, err := NewRecycler(NewFakeClusterCreator(1, nil), nil, nil, "k8s-claimer", scopes, recyclingConfig())
+	assert.NoErr(t, err)
+
+	free, err := searchForFreeClusters(clusterMap, leaseMap, &api.CreateLeaseReq{}, recycler)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(free), 1, "number of free clusters")
+	assert.Equal(t, free[0].Name, "staging", "free cluster")
+	status := leaseMap.ClusterStatus(leaseID(QualifiedClusterID(recycledScope, "ci-recycled")))
+	assert.Equal(t, status.Recycling, leases.RecycleDeleting, "recycle phase of the reclaimed cluster")
+}
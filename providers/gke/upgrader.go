@@ -0,0 +1,344 @@
+package gke
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	container "google.golang.org/api/container/v1"
+
+	"github.com/deis/k8s-claimer/config"
+	"github.com/deis/k8s-claimer/inventory"
+	"github.com/deis/k8s-claimer/k8s"
+	"github.com/deis/k8s-claimer/leases"
+	"github.com/deis/k8s-claimer/semver"
+)
+
+const (
+	// UpgradeStateUpToDate means the cluster's master and nodes run its target version or a
+	// higher one
+	UpgradeStateUpToDate = "up-to-date"
+	// UpgradeStatePending means the cluster will be upgraded once no other cluster is
+	UpgradeStatePending = "pending"
+	// UpgradeStateLeased means the cluster needs an upgrade, but it's leased
+	UpgradeStateLeased = "leased"
+	// UpgradeStateBusy means the cluster needs an upgrade, but it's being recycled or is scaled
+	// down
+	UpgradeStateBusy = "busy"
+	// UpgradeStateUpgrading means the cluster is being upgraded
+	UpgradeStateUpgrading = "upgrading"
+	// UpgradeStateFailed means the cluster's last upgrade to its target version failed. It isn't
+	// retried until the target version changes
+	UpgradeStateFailed = "failed"
+)
+
+// UpgradeProgress is the json-encodable record of the upgrade that's running
+type UpgradeProgress struct {
+	ClusterName   string `json:"cluster_name"`
+	TargetVersion string `json:"target_version"`
+	Started       string `json:"started"`
+	Step          string `json:"step"`
+}
+
+// ClusterUpgradeStatus is the json-encodable record of a cluster that has a target version
+type ClusterUpgradeStatus struct {
+	ClusterName   string `json:"cluster_name"`
+	MasterVersion string `json:"master_version"`
+	NodeVersion   string `json:"node_version"`
+	TargetVersion string `json:"target_version"`
+	State         string `json:"state"`
+	Error         string `json:"error,omitempty"`
+}
+
+// UpgradeStatus is the json-encodable state of the upgrader
+type UpgradeStatus struct {
+	LastRun   string                 `json:"last_run,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+	Upgrading *UpgradeProgress       `json:"upgrading,omitempty"`
+	Clusters  []ClusterUpgradeStatus `json:"clusters"`
+}
+
+// Upgrader periodically upgrades the masters and node pools of GKE clusters that aren't leased
+// to the versions configured for them, one cluster at a time. A cluster is marked as upgrading in
+// its status in the k8s annotations before its upgrade starts, so that it can't be leased until
+// the upgrade is done. Clusters that have a lease, even an expired one, are never touched.
+// It's safe for concurrent use
+type Upgrader struct {
+	clusterLister  ClusterLister
+	updater        ClusterUpdater
+	services       k8s.ServiceGetterUpdater
+	k8sServiceName string
+	scopes         []config.GKEScope
+	membership     config.PoolMembership
+	conf           config.GKEUpgrades
+	targets        []config.UpgradeTarget
+
+	mut    sync.Mutex
+	status UpgradeStatus
+}
+
+// NewUpgrader creates a new Upgrader that upgrades the clusters in scopes that are members of the
+// pool according to membership with updater, and records its progress in the annotations of the
+// k8s service with the given name. Returns an error if any of the targets in conf is malformed
+func NewUpgrader(
+	clusterLister ClusterLister,
+	updater ClusterUpdater,
+	services k8s.ServiceGetterUpdater,
+	k8sServiceName string,
+	scopes []config.GKEScope,
+	membership config.PoolMembership,
+	conf config.GKEUpgrades,
+) (*Upgrader, error) {
+	targets, err := conf.ParseTargets()
+	if err != nil {
+		return nil, err
+	}
+	return &Upgrader{
+		clusterLister:  clusterLister,
+		updater:        updater,
+		services:       services,
+		k8sServiceName: k8sServiceName,
+		scopes:         scopes,
+		membership:     membership,
+		conf:           conf,
+		targets:        targets,
+	}, nil
+}
+
+// Run calls Reconcile immediately and then once every configured interval, until stop is closed
+func (u *Upgrader) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(u.conf.Interval)
+	defer ticker.Stop()
+	for {
+		u.Reconcile(time.Now())
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Status returns the state of the upgrader, including the progress of the running upgrade
+func (u *Upgrader) Status() UpgradeStatus {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	ret := u.status
+	if ret.Upgrading != nil {
+		progress := *ret.Upgrading
+		ret.Upgrading = &progress
+	}
+	ret.Clusters = append([]ClusterUpgradeStatus(nil), u.status.Clusters...)
+	return ret
+}
+
+// Reconcile finds the clusters whose versions are lower than their target versions at time now,
+// and upgrades one of them, waiting until that's done. An upgrade that was interrupted, i.e. by
+// a restart, is resumed before any other is started. Returns the resulting state, which is also
+// returned by Status until the next call
+func (u *Upgrader) Reconcile(now time.Time) UpgradeStatus {
+	status := UpgradeStatus{LastRun: now.Format(leases.TimeFormat)}
+	clusterMap, svc, err := getSvcsAndClusters(context.Background(), u.clusterLister, u.services, u.scopes, u.membership, u.k8sServiceName)
+	if err != nil {
+		return u.finish(status, err)
+	}
+	leaseMap, err := leases.ParseMapFromAnnotations(svc.Annotations)
+	if err != nil {
+		return u.finish(status, err)
+	}
+	status.Clusters = u.plan(clusterMap, leaseMap)
+
+	next := -1
+	for i, cluster := range status.Clusters {
+		if cluster.State == UpgradeStateUpgrading {
+			next = i
+			break
+		}
+		if cluster.State == UpgradeStatePending && next < 0 {
+			next = i
+		}
+	}
+	if next < 0 {
+		return u.finish(status, nil)
+	}
+
+	target := &status.Clusters[next]
+	clusterID := target.ClusterName
+	cluster, _ := clusterMap.ClusterByName(clusterID)
+	scope, _ := clusterMap.Scope(clusterID)
+	if leaseMap.ClusterStatus(leaseID(clusterID)).Upgrading != target.TargetVersion {
+		// the upgrade is recorded before it starts, so that the cluster isn't leased meanwhile.
+		// Interrupted upgrades to a version that's no longer the target are recorded again
+		leaseMap.MarkUpgrading(leaseID(clusterID), target.TargetVersion, now)
+		if err := k8s.SaveAnnotations(context.Background(), u.services, svc, leaseMap); err != nil {
+			return u.finish(status, fmt.Errorf("error saving the upgrade of cluster %s to Kubernetes annotations, it wasn't started -- %s", clusterID, err))
+		}
+	}
+	target.State = UpgradeStateUpgrading
+	started := leaseMap.ClusterStatus(leaseID(clusterID)).UpgradeStarted
+	u.setStatus(status, &UpgradeProgress{ClusterName: clusterID, TargetVersion: target.TargetVersion, Started: started})
+
+	log.Printf("Upgrading cluster %s to version %s", clusterID, target.TargetVersion)
+	upgradeErr := u.upgrade(cluster, scope, target.TargetVersion)
+	saveErr := k8s.UpdateLeaseMap(context.Background(), u.services, u.k8sServiceName, func(leaseMap *leases.Map) {
+		if upgradeErr != nil {
+			leaseMap.MarkUpgradeFailed(leaseID(clusterID), target.TargetVersion, upgradeErr.Error())
+		} else {
+			leaseMap.MarkUpgraded(leaseID(clusterID))
+		}
+	})
+	if upgradeErr != nil {
+		log.Printf("Error upgrading cluster %s to version %s -- %s", clusterID, target.TargetVersion, upgradeErr)
+		target.State = UpgradeStateFailed
+		target.Error = upgradeErr.Error()
+	} else {
+		log.Printf("Upgraded cluster %s to version %s", clusterID, target.TargetVersion)
+		target.State = UpgradeStateUpToDate
+		target.MasterVersion = target.TargetVersion
+		target.NodeVersion = target.TargetVersion
+	}
+	if saveErr != nil {
+		return u.finish(status, fmt.Errorf("error saving the result of the upgrade of cluster %s to Kubernetes annotations -- %s", clusterID, saveErr))
+	}
+	return u.finish(status, nil)
+}
+
+func (u *Upgrader) finish(status UpgradeStatus, err error) UpgradeStatus {
+	if err != nil {
+		log.Printf("Error upgrading GKE clusters -- %s", err)
+		status.Error = err.Error()
+	}
+	u.setStatus(status, nil)
+	return status
+}
+
+func (u *Upgrader) setStatus(status UpgradeStatus, progress *UpgradeProgress) {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	status.Upgrading = progress
+	status.Clusters = append([]ClusterUpgradeStatus(nil), status.Clusters...)
+	u.status = status
+}
+
+func (u *Upgrader) setStep(step string) {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	if u.status.Upgrading != nil {
+		u.status.Upgrading.Step = step
+	}
+}
+
+// plan returns the state of each cluster in clusterMap that has a target version, sorted by name
+func (u *Upgrader) plan(clusterMap *Map, leaseMap *leases.Map) []ClusterUpgradeStatus {
+	var ret []ClusterUpgradeStatus
+	clusterNames := clusterMap.Names()
+	sort.Strings(clusterNames)
+	for _, clusterName := range clusterNames {
+		cluster, _ := clusterMap.ClusterByName(clusterName)
+		version, ok := u.targetVersion(cluster.Name)
+		if !ok {
+			continue
+		}
+		status := leaseMap.ClusterStatus(leaseID(clusterName))
+		_, leased := leaseMap.LeaseByClusterName(leaseID(clusterName))
+		clusterStatus := ClusterUpgradeStatus{
+			ClusterName:   clusterName,
+			MasterVersion: cluster.CurrentMasterVersion,
+			NodeVersion:   cluster.CurrentNodeVersion,
+			TargetVersion: version,
+		}
+		switch {
+		case leased:
+			clusterStatus.State = UpgradeStateLeased
+			if !needsUpgrade(cluster, version) {
+				clusterStatus.State = UpgradeStateUpToDate
+			}
+		case status.IsUpgrading():
+			clusterStatus.State = UpgradeStateUpgrading
+		case !needsUpgrade(cluster, version):
+			clusterStatus.State = UpgradeStateUpToDate
+		case status.IsRecycling() || status.IsScaledDown():
+			clusterStatus.State = UpgradeStateBusy
+		case status.UpgradeFailed == version:
+			clusterStatus.State = UpgradeStateFailed
+			clusterStatus.Error = status.UpgradeError
+		default:
+			clusterStatus.State = UpgradeStatePending
+		}
+		ret = append(ret, clusterStatus)
+	}
+	return ret
+}
+
+// targetVersion returns the version of the first target that matches the given cluster name, and
+// false if none does. Targets are matched against cluster names, not IDs
+func (u *Upgrader) targetVersion(clusterName string) (string, bool) {
+	for _, target := range u.targets {
+		if target.ClusterRegex.MatchString(clusterName) {
+			return target.Version, true
+		}
+	}
+	return "", false
+}
+
+// upgrade upgrades the master of cluster, which is in scope, to version, then each of its node
+// pools, and waits until each step is done. Steps that aren't needed are skipped, so that an
+// interrupted upgrade can be resumed. The clusters that u.clusterLister keeps in memory, if any,
+// are invalidated afterward
+func (u *Upgrader) upgrade(cluster *container.Cluster, scope config.GKEScope, version string) error {
+	defer inventory.Invalidate(u.clusterLister)
+	if olderThan(cluster.CurrentMasterVersion, version) {
+		u.setStep("master")
+		update := &container.ClusterUpdate{DesiredMasterVersion: version}
+		if err := u.update(cluster.Name, scope, update); err != nil {
+			return fmt.Errorf("error upgrading the master -- %s", err)
+		}
+	}
+	for _, nodePool := range cluster.NodePools {
+		if !olderThan(nodePool.Version, version) {
+			continue
+		}
+		u.setStep("node pool " + nodePool.Name)
+		update := &container.ClusterUpdate{DesiredNodePoolId: nodePool.Name, DesiredNodeVersion: version}
+		if err := u.update(cluster.Name, scope, update); err != nil {
+			return fmt.Errorf("error upgrading node pool %s -- %s", nodePool.Name, err)
+		}
+	}
+	return nil
+}
+
+func (u *Upgrader) update(clusterName string, scope config.GKEScope, update *container.ClusterUpdate) error {
+	op, err := u.updater.Update(scope.ProjectID, scope.Location, clusterName, update)
+	if err != nil {
+		return err
+	}
+	return waitForOperation(u.updater, scope.ProjectID, scope.Location, op, u.conf.Timeout, u.conf.PollInterval)
+}
+
+// needsUpgrade returns true if the master or any node pool of cluster runs a version lower than
+// version
+func needsUpgrade(cluster *container.Cluster, version string) bool {
+	if olderThan(cluster.CurrentMasterVersion, version) {
+		return true
+	}
+	for _, nodePool := range cluster.NodePools {
+		if olderThan(nodePool.Version, version) {
+			return true
+		}
+	}
+	return len(cluster.NodePools) == 0 && olderThan(cluster.CurrentNodeVersion, version)
+}
+
+// olderThan returns true if current is a lower version than target. Versions that can't be
+// parsed are only compared for equality
+func olderThan(current, target string) bool {
+	currentVer, currentErr := semver.Parse(current)
+	targetVer, targetErr := semver.Parse(target)
+	if currentErr != nil || targetErr != nil {
+		return current != target
+	}
+	return currentVer.Compare(targetVer) < 0
+}
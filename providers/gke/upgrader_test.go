@@ -0,0 +1,126 @@
+package gke
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/config"
+	"github.com/deis/k8s-claimer/leases"
+	"github.com/pborman/uuid"
+	container "google.golang.org/api/container/v1"
+)
+
+func upgradeConfig(targets ...string) config.GKEUpgrades {
+	return config.GKEUpgrades{Targets: targets, Interval: time.Minute, Timeout: time.Minute}
+}
+
+func upgradeCluster(name, version string) *container.Cluster {
+	cluster := poolCluster(name, version)
+	cluster.CurrentMasterVersion = version
+	cluster.NodePools[0].Version = version
+	return cluster
+}
+
+func upgradesByCluster(status UpgradeStatus) map[string]ClusterUpgradeStatus {
+	ret := make(map[string]ClusterUpgradeStatus)
+	for _, cluster := range status.Clusters {
+		ret[clusterNameFromID(cluster.ClusterName)] = cluster
+	}
+	return ret
+}
+
+func TestUpgraderUpgradesOneIdleCluster(t *testing.T) {
+	clusters := []*container.Cluster{
+		upgradeCluster("ci-a", "1.7.8-gke.0"),
+		upgradeCluster("ci-b", "1.7.8-gke.0"),
+		upgradeCluster("ci-leased", "1.7.8-gke.0"),
+		upgradeCluster("ci-new", "1.8.1-gke.0"),
+		upgradeCluster("staging", "1.7.8-gke.0"),
+	}
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	leaseMap.CreateLease(uuid.NewUUID(), leases.NewLease(scopedID("ci-leased"), time.Now().Add(-time.Hour)))
+	services := poolServices(t, leaseMap)
+	updater := NewFakeClusterUpdater(clusters, nil)
+	lister := NewFakeClusterLister(&container.ListClustersResponse{Clusters: clusters}, nil)
+	upgrader, err := NewUpgrader(lister, updater, services, "k8s-claimer", scopes, config.PoolMembership{}, upgradeConfig("^ci-=1.8.1-gke.0"))
+	assert.NoErr(t, err)
+
+	status := upgrader.Reconcile(time.Now())
+	assert.Equal(t, status.Error, "", "upgrade error")
+	assert.Equal(t, upgrader.Status(), status, "reported status")
+	upgrades := upgradesByCluster(status)
+	assert.Equal(t, len(upgrades), 4, "number of clusters with a target version")
+	assert.Equal(t, upgrades["ci-a"].State, UpgradeStateUpToDate, "ci-a state")
+	assert.Equal(t, upgrades["ci-b"].State, UpgradeStatePending, "ci-b state")
+	// clusters with a lease aren't touched, even if it expired
+	assert.Equal(t, upgrades["ci-leased"].State, UpgradeStateLeased, "ci-leased state")
+	assert.Equal(t, upgrades["ci-new"].State, UpgradeStateUpToDate, "ci-new state")
+
+	// the master is upgraded before the node pools
+	assert.Equal(t, updater.Updated, []string{"ci-a", "ci-a"}, "updated clusters")
+	assert.Equal(t, updater.Updates[0].DesiredMasterVersion, "1.8.1-gke.0", "master version")
+	assert.Equal(t, updater.Updates[1].DesiredNodePoolId, "default-pool", "node pool")
+	assert.Equal(t, updater.Updates[1].DesiredNodeVersion, "1.8.1-gke.0", "node version")
+	assert.Equal(t, clusters[0].CurrentMasterVersion, "1.8.1-gke.0", "ci-a master version")
+	assert.False(t, savedLeaseMap(t, services).ClusterStatus(leaseID(scopedID("ci-a"))).IsUpgrading(), "ci-a is still marked upgrading")
+
+	upgrades = upgradesByCluster(upgrader.Reconcile(time.Now()))
+	assert.Equal(t, upgrades["ci-b"].State, UpgradeStateUpToDate, "ci-b state")
+	assert.Equal(t, len(updater.Updated), 4, "number of updates")
+	upgrader.Reconcile(time.Now())
+	assert.Equal(t, len(updater.Updated), 4, "number of updates")
+}
+
+func TestUpgraderResumesInterruptedUpgrade(t *testing.T) {
+	clusters := []*container.Cluster{upgradeCluster("ci-a", "1.7.8-gke.0"), upgradeCluster("ci-b", "1.7.8-gke.0")}
+	clusters[1].CurrentMasterVersion = "1.8.1-gke.0"
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	leaseMap.MarkUpgrading(leaseID(scopedID("ci-b")), "1.8.1-gke.0", time.Now().Add(-time.Hour))
+	services := poolServices(t, leaseMap)
+	updater := NewFakeClusterUpdater(clusters, nil)
+	lister := NewFakeClusterLister(&container.ListClustersResponse{Clusters: clusters}, nil)
+	upgrader, err := NewUpgrader(lister, updater, services, "k8s-claimer", scopes, config.PoolMembership{}, upgradeConfig("^ci-=1.8.1-gke.0"))
+	assert.NoErr(t, err)
+
+	upgrades := upgradesByCluster(upgrader.Reconcile(time.Now()))
+	assert.Equal(t, upgrades["ci-b"].State, UpgradeStateUpToDate, "ci-b state")
+	assert.Equal(t, upgrades["ci-a"].State, UpgradeStatePending, "ci-a state")
+	// the master was already upgraded, so only the node pool is
+	assert.Equal(t, updater.Updated, []string{"ci-b"}, "updated clusters")
+	assert.Equal(t, updater.Updates[0].DesiredNodePoolId, "default-pool", "node pool")
+}
+
+func TestUpgraderFailure(t *testing.T) {
+	clusters := []*container.Cluster{upgradeCluster("ci-a", "1.7.8-gke.0")}
+	leaseMap, err := leases.ParseMapFromAnnotations(nil)
+	assert.NoErr(t, err)
+	services := poolServices(t, leaseMap)
+	updater := NewFakeClusterUpdater(clusters, errors.New("version not supported"))
+	lister := NewFakeClusterLister(&container.ListClustersResponse{Clusters: clusters}, nil)
+	upgrader, err := NewUpgrader(lister, updater, services, "k8s-claimer", scopes, config.PoolMembership{}, upgradeConfig("^ci-=1.8.1-gke.0"))
+	assert.NoErr(t, err)
+
+	upgrades := upgradesByCluster(upgrader.Reconcile(time.Now()))
+	assert.Equal(t, upgrades["ci-a"].State, UpgradeStateFailed, "ci-a state")
+	saved := savedLeaseMap(t, services).ClusterStatus(leaseID(scopedID("ci-a")))
+	assert.False(t, saved.IsUpgrading(), "ci-a is still marked upgrading")
+	assert.Equal(t, saved.UpgradeFailed, "1.8.1-gke.0", "failed upgrade version")
+
+	// failed upgrades aren't retried until the target version changes
+	upgrades = upgradesByCluster(upgrader.Reconcile(time.Now()))
+	assert.Equal(t, upgrades["ci-a"].State, UpgradeStateFailed, "ci-a state")
+	assert.Equal(t, upgrades["ci-a"].Error, "error upgrading the master -- version not supported", "ci-a error")
+	assert.Equal(t, len(updater.Updated), 1, "number of updates")
+}
+
+func TestOlderThan(t *testing.T) {
+	assert.True(t, olderThan("1.7.8-gke.0", "1.8.1-gke.0"), "1.7.8-gke.0 isn't older than 1.8.1-gke.0")
+	assert.True(t, olderThan("1.8.1-gke.0", "1.8.1-gke.1"), "1.8.1-gke.0 isn't older than 1.8.1-gke.1")
+	assert.False(t, olderThan("1.8.1-gke.0", "1.8.1-gke.0"), "1.8.1-gke.0 is older than itself")
+	assert.False(t, olderThan("1.9.0", "1.8.1-gke.0"), "1.9.0 is older than 1.8.1-gke.0")
+	assert.True(t, olderThan("", "1.8.1-gke.0"), "an empty version isn't older than 1.8.1-gke.0")
+}
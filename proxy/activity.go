@@ -0,0 +1,119 @@
+// Package proxy forwards requests that are made with the kubeconfigs of leases to the masters
+// of the leased clusters, and records how active each lease is
+package proxy
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LeaseActivity is what Activity reports about the requests that were forwarded for a lease
+type LeaseActivity struct {
+	Token       string
+	ClusterID   string
+	Requests    int64
+	LastRequest time.Time
+}
+
+type leaseActivity struct {
+	LeaseActivity
+	inFlight map[int]context.CancelFunc
+}
+
+// Activity counts the requests that the API proxy forwards for each lease, and keeps track of the
+// ones in flight, so that they can be cut off when the lease is released. It's safe for
+// concurrent use, and a nil Activity records nothing
+type Activity struct {
+	mut    sync.Mutex
+	leases map[string]*leaseActivity
+	nextID int
+}
+
+// NewActivity creates a new Activity that hasn't recorded any requests
+func NewActivity() *Activity {
+	return &Activity{leases: make(map[string]*leaseActivity)}
+}
+
+// Begin records a request for the lease with the given token, on the cluster with the given ID.
+// cancel is called if the lease is cut off while the request is in flight. The returned func must
+// be called when the request is done
+func (a *Activity) Begin(leaseToken, clusterID string, cancel context.CancelFunc) func() {
+	if a == nil {
+		return func() {}
+	}
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	lease, ok := a.leases[leaseToken]
+	if !ok {
+		lease = &leaseActivity{
+			LeaseActivity: LeaseActivity{Token: leaseToken},
+			inFlight:      make(map[int]context.CancelFunc),
+		}
+		a.leases[leaseToken] = lease
+	}
+	lease.ClusterID = clusterID
+	lease.Requests++
+	lease.LastRequest = time.Now()
+	id := a.nextID
+	a.nextID++
+	lease.inFlight[id] = cancel
+	return func() {
+		a.mut.Lock()
+		defer a.mut.Unlock()
+		delete(lease.inFlight, id)
+	}
+}
+
+// Cut cancels the requests in flight for the lease with the given token, and forgets it
+func (a *Activity) Cut(leaseToken string) {
+	if a == nil {
+		return
+	}
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	lease, ok := a.leases[leaseToken]
+	if !ok {
+		return
+	}
+	for _, cancel := range lease.inFlight {
+		cancel()
+	}
+	delete(a.leases, leaseToken)
+}
+
+// Retain forgets the leases whose tokens keep returns false for, such as leases that expired
+func (a *Activity) Retain(keep func(leaseToken string) bool) {
+	if a == nil {
+		return
+	}
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	for token := range a.leases {
+		if !keep(token) {
+			delete(a.leases, token)
+		}
+	}
+}
+
+// Leases returns what was recorded for each lease, ordered by token
+func (a *Activity) Leases() []LeaseActivity {
+	if a == nil {
+		return nil
+	}
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	ret := make([]LeaseActivity, 0, len(a.leases))
+	for _, lease := range a.leases {
+		ret = append(ret, lease.LeaseActivity)
+	}
+	sort.Sort(byToken(ret))
+	return ret
+}
+
+type byToken []LeaseActivity
+
+func (b byToken) Len() int           { return len(b) }
+func (b byToken) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byToken) Less(i, j int) bool { return b[i].Token < b[j].Token }
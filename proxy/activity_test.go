@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+func TestActivity(t *testing.T) {
+	activity := NewActivity()
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	done1 := activity.Begin("abc", "google/cluster1", cancel1)
+	done1()
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	activity.Begin("abc", "google/cluster1", cancel2)
+	_, cancel3 := context.WithCancel(context.Background())
+	activity.Begin("def", "azure/cluster2", cancel3)
+
+	leases := activity.Leases()
+	assert.Equal(t, len(leases), 2, "number of leases")
+	assert.Equal(t, leases[0].Token, "abc", "token")
+	assert.Equal(t, leases[0].ClusterID, "google/cluster1", "cluster ID")
+	assert.Equal(t, leases[0].Requests, int64(2), "number of requests")
+	assert.False(t, leases[0].LastRequest.IsZero(), "last request wasn't recorded")
+
+	activity.Cut("abc")
+	assert.Nil(t, ctx1.Err(), "a finished request was canceled")
+	assert.Equal(t, ctx2.Err(), context.Canceled, "in flight request error")
+	leases = activity.Leases()
+	assert.Equal(t, len(leases), 1, "number of leases")
+	assert.Equal(t, leases[0].Token, "def", "token")
+
+	activity.Retain(func(token string) bool { return token != "def" })
+	assert.Equal(t, len(activity.Leases()), 0, "number of leases")
+}
+
+func TestNilActivity(t *testing.T) {
+	var activity *Activity
+	activity.Begin("abc", "google/cluster1", func() {})()
+	activity.Cut("abc")
+	activity.Retain(func(string) bool { return false })
+	assert.Equal(t, len(activity.Leases()), 0, "number of leases")
+}
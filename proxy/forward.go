@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	impersonateHeaderPrefix = "Impersonate-"
+	impersonateUserHeader   = "Impersonate-User"
+)
+
+// Forward forwards r to the master at server with transport, and writes the master's response to
+// w. path is the path of the request on the master. The Authorization and impersonation headers
+// of r are dropped, since they were meant for the proxy. If user isn't empty, the master is asked
+// to impersonate it, so that the request has the user's permissions instead of the ones of the
+// transport's credentials. Responses are flushed to w every flushInterval, so that watches are
+// streamed. ReverseProxy can't carry the connection upgrades of exec, attach and port-forward, so
+// those should be refused with Upgrade before r is forwarded
+func Forward(
+	w http.ResponseWriter,
+	r *http.Request,
+	server *url.URL,
+	transport http.RoundTripper,
+	path string,
+	user string,
+	flushInterval time.Duration,
+) {
+	director := func(req *http.Request) {
+		req.URL.Scheme = server.Scheme
+		req.URL.Host = server.Host
+		req.URL.Path = strings.TrimSuffix(server.Path, "/") + "/" + strings.TrimPrefix(path, "/")
+		req.URL.RawPath = ""
+		req.Host = server.Host
+		req.Header.Del("Authorization")
+		for key := range req.Header {
+			if strings.HasPrefix(key, impersonateHeaderPrefix) {
+				req.Header.Del(key)
+			}
+		}
+		if user != "" {
+			req.Header.Set(impersonateUserHeader, user)
+		}
+	}
+	rp := &httputil.ReverseProxy{Director: director, Transport: transport, FlushInterval: flushInterval}
+	rp.ServeHTTP(w, r)
+}
+
+// Upgrade returns true if r asks to upgrade its connection to another protocol, like the SPDY and
+// websocket streams of exec, attach and port-forward do
+func Upgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") != "" {
+		return true
+	}
+	for _, value := range r.Header["Connection"] {
+		for _, option := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(option), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
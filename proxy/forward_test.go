@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+)
+
+func TestForward(t *testing.T) {
+	var upstreamReq *http.Request
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamReq = r
+		w.Write([]byte("pods"))
+	}))
+	defer master.Close()
+	server, err := url.Parse(master.URL)
+	assert.NoErr(t, err)
+
+	req, err := http.NewRequest("GET", "/proxy/abc/api/v1/pods?watch=true", nil)
+	assert.NoErr(t, err)
+	req.Header.Set("Authorization", "Bearer proxytoken")
+	req.Header.Set("Impersonate-Group", "system:masters")
+	req.Header.Set("Accept", "application/json")
+	res := httptest.NewRecorder()
+	Forward(res, req, server, http.DefaultTransport, "/api/v1/pods", "system:serviceaccount:kube-system:lease", 10*time.Millisecond)
+
+	assert.Equal(t, res.Code, http.StatusOK, "response code")
+	body, err := ioutil.ReadAll(res.Body)
+	assert.NoErr(t, err)
+	assert.Equal(t, string(body), "pods", "response body")
+	assert.Equal(t, upstreamReq.URL.Path, "/api/v1/pods", "forwarded path")
+	assert.Equal(t, upstreamReq.URL.RawQuery, "watch=true", "forwarded query")
+	assert.Equal(t, upstreamReq.Header.Get("Authorization"), "", "forwarded authorization header")
+	assert.Equal(t, upstreamReq.Header.Get("Impersonate-Group"), "", "forwarded impersonation header")
+	assert.Equal(t, upstreamReq.Header.Get("Impersonate-User"), "system:serviceaccount:kube-system:lease", "impersonated user")
+	assert.Equal(t, upstreamReq.Header.Get("Accept"), "application/json", "forwarded accept header")
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/deis/k8s-claimer/k8s"
+	"github.com/deis/k8s-claimer/leases"
+)
+
+const (
+	// maxCachedLeases is the number of leases whose Targets a Transports keeps. The least recently
+	// used one is dropped to make room for another
+	maxCachedLeases = 256
+	// maxTargetAge is how long a cached Target is used before its lease and cluster are looked up
+	// again, so that changes the server didn't make itself, such as rotated cluster credentials,
+	// are picked up
+	maxTargetAge = time.Minute
+)
+
+// Target is where the API proxy forwards the requests of a lease: the master of the leased
+// cluster, and a transport that authenticates to it with the cluster's credentials. Lease is the
+// lease as it was when the Target was created
+type Target struct {
+	Lease     leases.Lease
+	Server    *url.URL
+	Transport http.RoundTripper
+}
+
+type cachedTarget struct {
+	*Target
+	created time.Time
+	used    time.Time
+}
+
+// Transports caches the Target of each lease that uses the API proxy, so that its requests don't
+// look up the lease and its cluster again, and reuse the connections to the cluster's master.
+// Targets are dropped when their lease is released, and are created again after maxTargetAge.
+// At most maxCachedLeases are kept. It's safe for concurrent use, and a nil Transports caches
+// nothing
+type Transports struct {
+	mut          sync.Mutex
+	byToken      map[string]*cachedTarget
+	dropped      map[string]time.Time
+	newTransport func(*k8s.KubeConfig) (*url.URL, http.RoundTripper, error)
+	now          func() time.Time
+}
+
+// NewTransports creates a new, empty Transports
+func NewTransports() *Transports {
+	return &Transports{
+		byToken:      make(map[string]*cachedTarget),
+		dropped:      make(map[string]time.Time),
+		newTransport: k8s.NewTransport,
+		now:          time.Now,
+	}
+}
+
+// Get returns the cached Target of the lease with the given token. Returns nil and false if there
+// is none, or if it's older than maxTargetAge
+func (t *Transports) Get(leaseToken string) (*Target, bool) {
+	if t == nil {
+		return nil, false
+	}
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	cached, ok := t.byToken[leaseToken]
+	if !ok {
+		return nil, false
+	}
+	now := t.now()
+	if now.Sub(cached.created) > maxTargetAge {
+		delete(t.byToken, leaseToken)
+		return nil, false
+	}
+	cached.used = now
+	return cached.Target, true
+}
+
+// Put creates the Target of lease, whose token is leaseToken, from conf, the admin kubeconfig of
+// the leased cluster, and caches it. It isn't cached if the lease was dropped while it was being
+// looked up
+func (t *Transports) Put(leaseToken string, lease *leases.Lease, conf *k8s.KubeConfig) (*Target, error) {
+	newTransport := k8s.NewTransport
+	if t != nil {
+		newTransport = t.newTransport
+	}
+	server, rt, err := newTransport(conf)
+	if err != nil {
+		return nil, err
+	}
+	target := &Target{Lease: *lease, Server: server, Transport: rt}
+	if t == nil {
+		return target, nil
+	}
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	now := t.now()
+	if droppedAt, ok := t.dropped[leaseToken]; ok && now.Sub(droppedAt) <= maxTargetAge {
+		return target, nil
+	}
+	if _, ok := t.byToken[leaseToken]; !ok && len(t.byToken) >= maxCachedLeases {
+		t.evict()
+	}
+	t.byToken[leaseToken] = &cachedTarget{Target: target, created: now, used: now}
+	return target, nil
+}
+
+// Drop drops the cached Target of the lease with the given token, such as when the lease is
+// released. Targets of the lease that are put within maxTargetAge aren't cached either, since
+// they were looked up before it was dropped
+func (t *Transports) Drop(leaseToken string) {
+	if t == nil {
+		return
+	}
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	now := t.now()
+	delete(t.byToken, leaseToken)
+	for token, droppedAt := range t.dropped {
+		if now.Sub(droppedAt) > maxTargetAge {
+			delete(t.dropped, token)
+		}
+	}
+	t.dropped[leaseToken] = now
+}
+
+// evict drops the least recently used Target. t.mut must be held
+func (t *Transports) evict() {
+	var oldestToken string
+	var oldest time.Time
+	for token, cached := range t.byToken {
+		if oldestToken == "" || cached.used.Before(oldest) {
+			oldestToken, oldest = token, cached.used
+		}
+	}
+	delete(t.byToken, oldestToken)
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/k8s"
+	"github.com/deis/k8s-claimer/leases"
+)
+
+func newTestTransports(now *time.Time) (*Transports, *int) {
+	created := 0
+	transports := NewTransports()
+	transports.newTransport = func(conf *k8s.KubeConfig) (*url.URL, http.RoundTripper, error) {
+		created++
+		server, err := url.Parse(conf.Clusters[0].Cluster.Server)
+		return server, http.DefaultTransport, err
+	}
+	transports.now = func() time.Time { return *now }
+	return transports, &created
+}
+
+func TestTransports(t *testing.T) {
+	now := time.Now()
+	transports, created := newTestTransports(&now)
+	conf := &k8s.KubeConfig{
+		Clusters:  []k8s.NamedCluster{{Name: "cluster1", Cluster: k8s.Cluster{Server: "https://1.2.3.4"}}},
+		AuthInfos: []k8s.NamedAuthInfo{{Name: "cluster1", AuthInfo: k8s.AuthInfo{Username: "admin", Password: "pass"}}},
+	}
+	lease := leases.NewLease("cluster1", now.Add(time.Hour))
+
+	_, ok := transports.Get("lease1")
+	assert.False(t, ok, "a target was cached before it was put")
+	target, err := transports.Put("lease1", lease, conf)
+	assert.NoErr(t, err)
+	assert.Equal(t, target.Server.Host, "1.2.3.4", "server host")
+	assert.Equal(t, target.Lease.ClusterName, "cluster1", "cluster name")
+	cached, ok := transports.Get("lease1")
+	assert.True(t, ok, "the target wasn't cached")
+	assert.True(t, cached == target, "a different target was cached")
+	assert.Equal(t, *created, 1, "number of transports created")
+
+	// old targets are looked up again
+	now = now.Add(maxTargetAge + time.Second)
+	_, ok = transports.Get("lease1")
+	assert.False(t, ok, "an old target was returned")
+
+	// targets aren't cached again right after they're dropped, since they may have been looked up
+	// before the lease was released
+	_, err = transports.Put("lease1", lease, conf)
+	assert.NoErr(t, err)
+	transports.Drop("lease1")
+	_, ok = transports.Get("lease1")
+	assert.False(t, ok, "a dropped target was returned")
+	_, err = transports.Put("lease1", lease, conf)
+	assert.NoErr(t, err)
+	_, ok = transports.Get("lease1")
+	assert.False(t, ok, "a target was cached right after it was dropped")
+	now = now.Add(maxTargetAge + time.Second)
+	_, err = transports.Put("lease1", lease, conf)
+	assert.NoErr(t, err)
+	_, ok = transports.Get("lease1")
+	assert.True(t, ok, "a target wasn't cached long after it was dropped")
+}
+
+func TestTransportsEvict(t *testing.T) {
+	now := time.Now()
+	transports, _ := newTestTransports(&now)
+	conf := &k8s.KubeConfig{Clusters: []k8s.NamedCluster{{Name: "cluster1", Cluster: k8s.Cluster{Server: "https://1.2.3.4"}}}}
+	lease := leases.NewLease("cluster1", now.Add(time.Hour))
+	for i := 0; i < maxCachedLeases; i++ {
+		_, err := transports.Put(fmt.Sprintf("lease%d", i), lease, conf)
+		assert.NoErr(t, err)
+		now = now.Add(time.Millisecond)
+	}
+	// lease0 was used last, so lease1 is the least recently used
+	_, ok := transports.Get("lease0")
+	assert.True(t, ok, "lease0 wasn't cached")
+	_, err := transports.Put("another", lease, conf)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(transports.byToken), maxCachedLeases, "number of cached targets")
+	_, ok = transports.Get("lease1")
+	assert.False(t, ok, "the least recently used target wasn't evicted")
+	_, ok = transports.Get("lease0")
+	assert.True(t, ok, "a recently used target was evicted")
+}
+
+func TestTransportsNil(t *testing.T) {
+	var transports *Transports
+	conf := &k8s.KubeConfig{
+		Clusters:  []k8s.NamedCluster{{Name: "cluster1", Cluster: k8s.Cluster{Server: "https://1.2.3.4"}}},
+		AuthInfos: []k8s.NamedAuthInfo{{Name: "cluster1", AuthInfo: k8s.AuthInfo{Username: "admin", Password: "pass"}}},
+	}
+	_, err := transports.Put("lease1", leases.NewLease("cluster1", time.Now().Add(time.Hour)), conf)
+	assert.NoErr(t, err)
+	_, ok := transports.Get("lease1")
+	assert.False(t, ok, "a nil Transports cached a target")
+	transports.Drop("lease1")
+}
@@ -0,0 +1,118 @@
+// Package quota budgets how much cluster time each identity may lease per day and per week,
+// according to the usage ledgers that are saved next to the leases
+package quota
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/deis/k8s-claimer/api"
+	"github.com/deis/k8s-claimer/leases"
+)
+
+const (
+	// WindowDay is the name of the window that starts at midnight UTC every day
+	WindowDay = "day"
+	// WindowWeek is the name of the window that starts at midnight UTC every Monday
+	WindowWeek = "week"
+)
+
+// Budget is how much cluster time each identity may lease in each window. A window whose budget
+// is 0 is unlimited
+type Budget struct {
+	Daily  time.Duration
+	Weekly time.Duration
+}
+
+// Enabled returns true if b limits any window
+func (b Budget) Enabled() bool {
+	return b.Daily > 0 || b.Weekly > 0
+}
+
+// ErrExceeded is the error returned when leasing a cluster would take an identity over its budget
+// for a window. Reset is the time the window ends, when the identity's usage starts over
+type ErrExceeded struct {
+	Identity  string
+	Window    string
+	Used      time.Duration
+	Requested time.Duration
+	Budget    time.Duration
+	Reset     time.Time
+}
+
+// Error is the error interface implementation
+func (e ErrExceeded) Error() string {
+	return fmt.Sprintf(
+		"%s used %s of its %s budget for this %s, so it can't lease a cluster for %s until the budget resets at %s",
+		e.Identity,
+		e.Used,
+		e.Budget,
+		e.Window,
+		e.Requested,
+		e.Reset.Format(leases.TimeFormat),
+	)
+}
+
+type window struct {
+	name   string
+	budget time.Duration
+	start  time.Time
+	reset  time.Time
+}
+
+// windows returns the windows that b limits and that now is in
+func (b Budget) windows(now time.Time) []window {
+	now = now.UTC()
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	// Weekday counts from Sunday, and weeks start on Monday
+	weekStart := dayStart.AddDate(0, 0, -((int(now.Weekday()) + 6) % 7))
+	var ret []window
+	if b.Daily > 0 {
+		ret = append(ret, window{name: WindowDay, budget: b.Daily, start: dayStart, reset: dayStart.AddDate(0, 0, 1)})
+	}
+	if b.Weekly > 0 {
+		ret = append(ret, window{name: WindowWeek, budget: b.Weekly, start: weekStart, reset: weekStart.AddDate(0, 0, 7)})
+	}
+	return ret
+}
+
+// Check returns an ErrExceeded if leasing a cluster for requested at now would take the identity
+// whose ledger is usage over its budget for any window. Leases count against the window they
+// start in, for the whole time they're requested for until they're released
+func (b Budget) Check(usage leases.Usage, requested time.Duration, now time.Time) error {
+	for _, w := range b.windows(now) {
+		used := usage.Used(w.start, w.reset)
+		if used+requested > w.budget {
+			return ErrExceeded{
+				Identity:  usage.Identity,
+				Window:    w.name,
+				Used:      used,
+				Requested: requested,
+				Budget:    w.budget,
+				Reset:     w.reset,
+			}
+		}
+	}
+	return nil
+}
+
+// Report returns the budget, usage and reset time of each window that b limits for the identity
+// whose ledger is usage, at now
+func (b Budget) Report(usage leases.Usage, now time.Time) api.Quota {
+	q := api.Quota{Identity: usage.Identity, Windows: []api.QuotaWindow{}}
+	for _, w := range b.windows(now) {
+		used := usage.Used(w.start, w.reset)
+		remaining := w.budget - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		q.Windows = append(q.Windows, api.QuotaWindow{
+			Window:         w.name,
+			BudgetHours:    w.budget.Hours(),
+			UsedHours:      used.Hours(),
+			RemainingHours: remaining.Hours(),
+			Reset:          w.reset.Format(leases.TimeFormat),
+		})
+	}
+	return q
+}
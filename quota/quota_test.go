@@ -0,0 +1,85 @@
+package quota
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/leases"
+)
+
+// wednesday is a Wednesday afternoon, so that the day and the week start at different times
+var wednesday = time.Date(2017, 11, 8, 15, 0, 0, 0, time.UTC)
+
+func testUsage(entries ...[2]time.Time) leases.Usage {
+	usage := leases.Usage{Identity: "dev@example.com"}
+	for _, entry := range entries {
+		usage.Leases = append(usage.Leases, leases.UsageEntry{
+			Start: entry[0].Format(leases.TimeFormat),
+			End:   entry[1].Format(leases.TimeFormat),
+		})
+	}
+	return usage
+}
+
+func TestWindows(t *testing.T) {
+	windows := Budget{Daily: 8 * time.Hour, Weekly: 20 * time.Hour}.windows(wednesday)
+	assert.Equal(t, len(windows), 2, "number of windows")
+	assert.Equal(t, windows[0].start, time.Date(2017, 11, 8, 0, 0, 0, 0, time.UTC), "start of the day")
+	assert.Equal(t, windows[0].reset, time.Date(2017, 11, 9, 0, 0, 0, 0, time.UTC), "end of the day")
+	assert.Equal(t, windows[1].start, time.Date(2017, 11, 6, 0, 0, 0, 0, time.UTC), "start of the week")
+	assert.Equal(t, windows[1].reset, time.Date(2017, 11, 13, 0, 0, 0, 0, time.UTC), "end of the week")
+
+	// Sundays are the last day of the week
+	sunday := time.Date(2017, 11, 12, 23, 0, 0, 0, time.UTC)
+	windows = Budget{Weekly: 20 * time.Hour}.windows(sunday)
+	assert.Equal(t, len(windows), 1, "number of windows")
+	assert.Equal(t, windows[0].start, time.Date(2017, 11, 6, 0, 0, 0, 0, time.UTC), "start of the week")
+	assert.Equal(t, len(Budget{}.windows(sunday)), 0, "number of unlimited windows")
+}
+
+func TestCheck(t *testing.T) {
+	budget := Budget{Daily: 8 * time.Hour, Weekly: 20 * time.Hour}
+	monday := wednesday.Add(-48 * time.Hour)
+	usage := testUsage(
+		[2]time.Time{monday, monday.Add(10 * time.Hour)},
+		[2]time.Time{wednesday.Add(-2 * time.Hour), wednesday.Add(4 * time.Hour)},
+	)
+	assert.NoErr(t, budget.Check(usage, 2*time.Hour, wednesday))
+
+	err := budget.Check(usage, 3*time.Hour, wednesday)
+	assert.Err(t, ErrExceeded{
+		Identity:  "dev@example.com",
+		Window:    WindowDay,
+		Used:      6 * time.Hour,
+		Requested: 3 * time.Hour,
+		Budget:    8 * time.Hour,
+		Reset:     time.Date(2017, 11, 9, 0, 0, 0, 0, time.UTC),
+	}, err)
+
+	// a day later, the daily usage started over, but the weekly usage didn't
+	err = budget.Check(usage, 5*time.Hour, wednesday.Add(24*time.Hour))
+	assert.Err(t, ErrExceeded{
+		Identity:  "dev@example.com",
+		Window:    WindowWeek,
+		Used:      16 * time.Hour,
+		Requested: 5 * time.Hour,
+		Budget:    20 * time.Hour,
+		Reset:     time.Date(2017, 11, 13, 0, 0, 0, 0, time.UTC),
+	}, err)
+
+	assert.NoErr(t, Budget{}.Check(usage, 100*time.Hour, wednesday))
+}
+
+func TestReport(t *testing.T) {
+	budget := Budget{Daily: 8 * time.Hour}
+	usage := testUsage([2]time.Time{wednesday, wednesday.Add(10 * time.Hour)})
+	q := budget.Report(usage, wednesday)
+	assert.Equal(t, q.Identity, "dev@example.com", "identity")
+	assert.Equal(t, len(q.Windows), 1, "number of windows")
+	assert.Equal(t, q.Windows[0].Window, WindowDay, "window")
+	assert.Equal(t, q.Windows[0].BudgetHours, 8.0, "budget hours")
+	assert.Equal(t, q.Windows[0].UsedHours, 10.0, "used hours")
+	assert.Equal(t, q.Windows[0].RemainingHours, 0.0, "remaining hours")
+	assert.Equal(t, q.Windows[0].Reset, "2017-11-09T00:00:00Z", "reset time")
+}
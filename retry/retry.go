@@ -0,0 +1,68 @@
+// Package retry retries calls to remote APIs, such as the cloud providers' and the k8s API
+// server's, that fail with transient errors
+package retry
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Backoff describes how a failed call is retried. The first retry waits Initial, and each retry
+// after it waits Factor times as long as the one before, up to Max. Attempts is the maximum
+// number of calls, including the first one
+type Backoff struct {
+	Attempts int
+	Initial  time.Duration
+	Max      time.Duration
+	Factor   float64
+}
+
+// DefaultBackoff is the Backoff that calls to remote APIs are retried with
+var DefaultBackoff = Backoff{Attempts: 4, Initial: 250 * time.Millisecond, Max: 2 * time.Second, Factor: 2}
+
+// Do calls fn until it succeeds, it fails with an error that isTransient returns false for, or
+// b.Attempts calls have been made, and returns the last error fn returned. If ctx is done while
+// Do waits to retry, it returns ctx.Err() instead
+func Do(ctx context.Context, b Backoff, isTransient func(error) bool, fn func() error) error {
+	wait := b.Initial
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= b.Attempts || !isTransient(err) {
+			return err
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		wait = time.Duration(float64(wait) * b.Factor)
+		if wait > b.Max {
+			wait = b.Max
+		}
+	}
+}
+
+// IsTransientStatus returns true if an API that responded with the given HTTP status code may
+// succeed if it's called again
+func IsTransientStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsTransientNetError returns true if err is a network error that timed out or is temporary
+func IsTransientNetError(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && (netErr.Timeout() || netErr.Temporary())
+}
@@ -0,0 +1,70 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+)
+
+var (
+	errTransient = errors.New("transient")
+	errPermanent = errors.New("permanent")
+	testBackoff  = Backoff{Attempts: 3, Initial: time.Millisecond, Max: time.Millisecond, Factor: 2}
+)
+
+func isTransient(err error) bool {
+	return err == errTransient
+}
+
+func TestDo(t *testing.T) {
+	calls := 0
+	err := Do(context.Background(), testBackoff, isTransient, func() error {
+		calls++
+		if calls < 2 {
+			return errTransient
+		}
+		return nil
+	})
+	assert.NoErr(t, err)
+	assert.Equal(t, calls, 2, "number of calls")
+
+	// permanent errors aren't retried
+	calls = 0
+	err = Do(context.Background(), testBackoff, isTransient, func() error {
+		calls++
+		return errPermanent
+	})
+	assert.Equal(t, err, errPermanent, "error")
+	assert.Equal(t, calls, 1, "number of calls")
+
+	// transient errors are retried until the attempts run out
+	calls = 0
+	err = Do(context.Background(), testBackoff, isTransient, func() error {
+		calls++
+		return errTransient
+	})
+	assert.Equal(t, err, errTransient, "error")
+	assert.Equal(t, calls, testBackoff.Attempts, "number of calls")
+}
+
+func TestDoContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := Do(ctx, Backoff{Attempts: 3, Initial: time.Hour, Max: time.Hour, Factor: 2}, isTransient, func() error {
+		calls++
+		cancel()
+		return errTransient
+	})
+	assert.Equal(t, err, context.Canceled, "error")
+	assert.Equal(t, calls, 1, "number of calls")
+}
+
+func TestIsTransientStatus(t *testing.T) {
+	assert.True(t, IsTransientStatus(http.StatusServiceUnavailable), "503 is not transient")
+	assert.True(t, IsTransientStatus(http.StatusTooManyRequests), "429 is not transient")
+	assert.False(t, IsTransientStatus(http.StatusNotFound), "404 is transient")
+}
@@ -0,0 +1,81 @@
+package selection
+
+import (
+	"sort"
+)
+
+// Hints are soft preferences from a lease request. They never exclude a cluster, they only
+// change the order in which a strategy's choices are tried
+type Hints struct {
+	// PreferredCluster is the name of a cluster that should be tried first, even before clusters
+	// with a matching affinity key
+	PreferredCluster string
+	// AffinityKey, if not empty, moves clusters whose last lease had the same affinity key to the
+	// front
+	AffinityKey string
+	// Avoid holds the names of clusters that should only be leased if nothing else is free. This
+	// takes precedence over PreferredCluster and AffinityKey
+	Avoid []string
+}
+
+const (
+	rankPreferred = iota
+	rankAffinity
+	rankNeutral
+	rankAvoided
+)
+
+// Apply reorders ordered, which holds names of candidates in the order a strategy chose, so that
+// the preferred cluster comes first, followed by clusters with a matching affinity key, and
+// avoided clusters come last. The strategy's order is kept otherwise
+func (h Hints) Apply(ordered []string, candidates []Candidate) []string {
+	byName := make(map[string]Candidate, len(candidates))
+	for _, c := range candidates {
+		byName[c.Name] = c
+	}
+	avoid := make(map[string]struct{}, len(h.Avoid))
+	for _, name := range h.Avoid {
+		avoid[name] = struct{}{}
+	}
+	ranked := make(byRank, len(ordered))
+	for i, name := range ordered {
+		ranked[i] = rankedName{name: name, rank: rankNeutral}
+		if _, avoided := avoid[name]; avoided {
+			ranked[i].rank = rankAvoided
+			continue
+		}
+		if h.PreferredCluster != "" && name == h.PreferredCluster {
+			ranked[i].rank = rankPreferred
+			continue
+		}
+		if h.AffinityKey != "" && byName[name].Status.AffinityKey == h.AffinityKey {
+			ranked[i].rank = rankAffinity
+		}
+	}
+	sort.Stable(ranked)
+	ret := make([]string, len(ranked))
+	for i, r := range ranked {
+		ret[i] = r.name
+	}
+	return ret
+}
+
+type rankedName struct {
+	name string
+	rank int
+}
+
+// byRank is a sort.Interface implementation that orders names by their rank, lowest first
+type byRank []rankedName
+
+func (b byRank) Len() int {
+	return len(b)
+}
+
+func (b byRank) Less(i, j int) bool {
+	return b[i].rank < b[j].rank
+}
+
+func (b byRank) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
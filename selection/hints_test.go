@@ -0,0 +1,37 @@
+package selection
+
+import (
+	"testing"
+
+	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/leases"
+)
+
+func TestHintsApply(t *testing.T) {
+	candidates := []Candidate{
+		candidate("a", "1.7.8", false, leases.ClusterStatus{}),
+		candidate("b", "1.7.8", false, leases.ClusterStatus{AffinityKey: "pipeline-1"}),
+		candidate("c", "1.7.8", false, leases.ClusterStatus{}),
+		candidate("d", "1.7.8", false, leases.ClusterStatus{AffinityKey: "pipeline-1"}),
+	}
+	ordered := []string{"a", "b", "c", "d"}
+
+	assert.Equal(t, Hints{}.Apply(ordered, candidates), ordered, "order without hints")
+	assert.Equal(t,
+		Hints{AffinityKey: "pipeline-1"}.Apply(ordered, candidates),
+		[]string{"b", "d", "a", "c"},
+		"order with an affinity key",
+	)
+	assert.Equal(t,
+		Hints{PreferredCluster: "c", AffinityKey: "pipeline-1"}.Apply(ordered, candidates),
+		[]string{"c", "b", "d", "a"},
+		"order with a preferred cluster and an affinity key",
+	)
+	assert.Equal(t,
+		Hints{PreferredCluster: "c", AffinityKey: "pipeline-1", Avoid: []string{"b", "c"}}.Apply(ordered, candidates),
+		[]string{"d", "a", "b", "c"},
+		"order with avoided clusters",
+	)
+	// a preferred cluster that isn't free isn't added
+	assert.Equal(t, Hints{PreferredCluster: "e"}.Apply(ordered, candidates), ordered, "order with a leased preferred cluster")
+}
@@ -0,0 +1,243 @@
+package selection
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/deis/k8s-claimer/leases"
+	"github.com/deis/k8s-claimer/semver"
+)
+
+const (
+	// Random picks a random free cluster
+	Random = "random"
+	// LeastRecentlyUsed picks the free cluster that was leased or released the longest time ago
+	LeastRecentlyUsed = "least-recently-used"
+	// MostRecentlyCleaned picks the free cluster whose namespaces were deleted most recently
+	MostRecentlyCleaned = "most-recently-cleaned"
+	// BinPack picks a free cluster of the version that has the fewest free clusters left, so that
+	// versions with many free clusters stay available for later requests
+	BinPack = "bin-pack"
+)
+
+// Names holds the names of all strategies, in the order they should be listed to users
+var Names = []string{Random, LeastRecentlyUsed, MostRecentlyCleaned, BinPack}
+
+// ErrUnknownStrategy is returned from ByName when the strategy name isn't known
+type ErrUnknownStrategy struct {
+	name string
+}
+
+// Error is the error interface implementation
+func (e ErrUnknownStrategy) Error() string {
+	return fmt.Sprintf("unknown selection strategy %s", e.name)
+}
+
+// Candidate is a cluster that is eligible for a lease
+type Candidate struct {
+	Name string
+	// Version is the cluster's version. It's only meaningful if HasVersion is true
+	Version    semver.Version
+	HasVersion bool
+	Status     leases.ClusterStatus
+	Leased     bool
+}
+
+// Strategy decides which cluster to lease out of a set of eligible clusters
+type Strategy interface {
+	// Order returns the names of all candidates that aren't leased, the most preferred first.
+	// If preferHighestVersion is true, candidates that the strategy considers equal are ordered
+	// from the highest version to the lowest
+	Order(candidates []Candidate, preferHighestVersion bool) []string
+}
+
+// ByName returns the strategy with the given name. Returns nil and ErrUnknownStrategy if there is
+// no such strategy
+func ByName(name string) (Strategy, error) {
+	switch name {
+	case Random:
+		return NewRandomStrategy(rand.NewSource(time.Now().UnixNano())), nil
+	case LeastRecentlyUsed:
+		return leastRecentlyUsed{}, nil
+	case MostRecentlyCleaned:
+		return mostRecentlyCleaned{}, nil
+	case BinPack:
+		return binPack{}, nil
+	}
+	return nil, ErrUnknownStrategy{name: name}
+}
+
+// free returns all candidates that aren't leased
+func free(candidates []Candidate) []Candidate {
+	var ret []Candidate
+	for _, c := range candidates {
+		if !c.Leased {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+func names(candidates []Candidate) []string {
+	ret := make([]string, len(candidates))
+	for i, c := range candidates {
+		ret[i] = c.Name
+	}
+	return ret
+}
+
+// compareVersions returns a negative number if a should be ordered before b because it has the
+// higher version, a positive one if b should be, and 0 if they're equal. Candidates without
+// versions are ordered last
+func compareVersions(a, b Candidate) int {
+	switch {
+	case a.HasVersion && b.HasVersion:
+		return b.Version.Compare(a.Version)
+	case a.HasVersion:
+		return -1
+	case b.HasVersion:
+		return 1
+	}
+	return 0
+}
+
+// candidateSorter sorts candidates by less, then by version if preferHighestVersion is set,
+// then by name
+type candidateSorter struct {
+	candidates           []Candidate
+	less                 func(a, b Candidate) int
+	preferHighestVersion bool
+}
+
+func (c candidateSorter) Len() int {
+	return len(c.candidates)
+}
+
+func (c candidateSorter) Less(i, j int) bool {
+	a, b := c.candidates[i], c.candidates[j]
+	if cmp := c.less(a, b); cmp != 0 {
+		return cmp < 0
+	}
+	if c.preferHighestVersion {
+		if cmp := compareVersions(a, b); cmp != 0 {
+			return cmp < 0
+		}
+	}
+	return a.Name < b.Name
+}
+
+func (c candidateSorter) Swap(i, j int) {
+	c.candidates[i], c.candidates[j] = c.candidates[j], c.candidates[i]
+}
+
+func compareTimesAsc(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+type randomStrategy struct {
+	rnd *rand.Rand
+}
+
+// NewRandomStrategy returns the Random strategy, using src as its source of randomness
+func NewRandomStrategy(src rand.Source) Strategy {
+	return &randomStrategy{rnd: rand.New(src)}
+}
+
+// Order is the Strategy interface implementation. It shuffles the free candidates
+func (r *randomStrategy) Order(candidates []Candidate, preferHighestVersion bool) []string {
+	freeCandidates := free(candidates)
+	shuffled := make([]Candidate, len(freeCandidates))
+	for i, j := range r.rnd.Perm(len(freeCandidates)) {
+		shuffled[i] = freeCandidates[j]
+	}
+	if preferHighestVersion {
+		sort.Stable(byVersion(shuffled))
+	}
+	return names(shuffled)
+}
+
+// byVersion is a sort.Interface implementation that orders candidates from the highest version
+// to the lowest
+type byVersion []Candidate
+
+func (b byVersion) Len() int {
+	return len(b)
+}
+
+func (b byVersion) Less(i, j int) bool {
+	return compareVersions(b[i], b[j]) < 0
+}
+
+func (b byVersion) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+
+type leastRecentlyUsed struct{}
+
+// Order is the Strategy interface implementation. Clusters that were never used come first
+func (leastRecentlyUsed) Order(candidates []Candidate, preferHighestVersion bool) []string {
+	freeCandidates := free(candidates)
+	sort.Sort(candidateSorter{
+		candidates: freeCandidates,
+		less: func(a, b Candidate) int {
+			return compareTimesAsc(a.Status.LastUsedTime(), b.Status.LastUsedTime())
+		},
+		preferHighestVersion: preferHighestVersion,
+	})
+	return names(freeCandidates)
+}
+
+type mostRecentlyCleaned struct{}
+
+// Order is the Strategy interface implementation. Clusters that were never cleaned come last
+func (mostRecentlyCleaned) Order(candidates []Candidate, preferHighestVersion bool) []string {
+	freeCandidates := free(candidates)
+	sort.Sort(candidateSorter{
+		candidates: freeCandidates,
+		less: func(a, b Candidate) int {
+			return compareTimesAsc(b.Status.LastCleanedTime(), a.Status.LastCleanedTime())
+		},
+		preferHighestVersion: preferHighestVersion,
+	})
+	return names(freeCandidates)
+}
+
+type binPack struct{}
+
+// Order is the Strategy interface implementation. Candidates are grouped by version, and the
+// groups are ordered by the number of free clusters in them, fewest first. Groups with equal
+// numbers of free clusters are ordered from the highest version to the lowest
+func (binPack) Order(candidates []Candidate, preferHighestVersion bool) []string {
+	freeCandidates := free(candidates)
+	freeCounts := make(map[string]int)
+	for _, c := range freeCandidates {
+		freeCounts[versionKey(c)]++
+	}
+	sort.Sort(candidateSorter{
+		candidates: freeCandidates,
+		less: func(a, b Candidate) int {
+			if diff := freeCounts[versionKey(a)] - freeCounts[versionKey(b)]; diff != 0 {
+				return diff
+			}
+			return compareVersions(a, b)
+		},
+		preferHighestVersion: preferHighestVersion,
+	})
+	return names(freeCandidates)
+}
+
+// versionKey returns the key that groups c with all other candidates of the same version
+func versionKey(c Candidate) string {
+	if !c.HasVersion {
+		return ""
+	}
+	return c.Version.String()
+}
@@ -0,0 +1,97 @@
+package selection
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/deis/k8s-claimer/leases"
+	"github.com/deis/k8s-claimer/semver"
+)
+
+func candidate(name, ver string, leased bool, status leases.ClusterStatus) Candidate {
+	v, err := semver.Parse(ver)
+	return Candidate{Name: name, Version: v, HasVersion: err == nil, Status: status, Leased: leased}
+}
+
+func hoursAgo(h int) string {
+	return time.Now().Add(-time.Duration(h) * time.Hour).Format(leases.TimeFormat)
+}
+
+func TestByName(t *testing.T) {
+	for _, name := range Names {
+		s, err := ByName(name)
+		assert.NoErr(t, err)
+		assert.NotNil(t, s, "strategy "+name)
+	}
+	s, err := ByName("first-fit")
+	assert.Nil(t, s, "unknown strategy")
+	assert.Err(t, ErrUnknownStrategy{name: "first-fit"}, err)
+}
+
+func TestRandomIsExhaustive(t *testing.T) {
+	// a big, mostly leased pool. every free cluster must be returned
+	var candidates []Candidate
+	for i := 0; i < 100; i++ {
+		candidates = append(candidates, candidate(string(rune('a'+i%26))+string(rune('a'+i/26)), "1.7.8", i != 42 && i != 97, leases.ClusterStatus{}))
+	}
+	ordered := NewRandomStrategy(rand.NewSource(1)).Order(candidates, false)
+	sort.Strings(ordered)
+	assert.Equal(t, ordered, []string{candidates[42].Name, candidates[97].Name}, "free clusters")
+}
+
+func TestRandomPrefersHighestVersion(t *testing.T) {
+	candidates := []Candidate{
+		candidate("old", "1.6.11", false, leases.ClusterStatus{}),
+		candidate("new", "1.7.8", false, leases.ClusterStatus{}),
+		candidate("unknown", "", false, leases.ClusterStatus{}),
+	}
+	for seed := int64(0); seed < 10; seed++ {
+		ordered := NewRandomStrategy(rand.NewSource(seed)).Order(candidates, true)
+		assert.Equal(t, ordered, []string{"new", "old", "unknown"}, "ordered clusters")
+	}
+}
+
+func TestLeastRecentlyUsed(t *testing.T) {
+	candidates := []Candidate{
+		candidate("recent", "1.7.8", false, leases.ClusterStatus{LastLeased: hoursAgo(3), LastReleased: hoursAgo(1)}),
+		candidate("stale", "1.7.8", false, leases.ClusterStatus{LastLeased: hoursAgo(10), LastReleased: hoursAgo(9)}),
+		candidate("never", "1.7.8", false, leases.ClusterStatus{}),
+		candidate("leased", "1.7.8", true, leases.ClusterStatus{LastLeased: hoursAgo(20)}),
+	}
+	s, err := ByName(LeastRecentlyUsed)
+	assert.NoErr(t, err)
+	assert.Equal(t, s.Order(candidates, false), []string{"never", "stale", "recent"}, "ordered clusters")
+}
+
+func TestMostRecentlyCleaned(t *testing.T) {
+	candidates := []Candidate{
+		candidate("never", "1.7.8", false, leases.ClusterStatus{}),
+		candidate("old", "1.7.8", false, leases.ClusterStatus{LastCleaned: hoursAgo(5)}),
+		candidate("fresh", "1.7.8", false, leases.ClusterStatus{LastCleaned: hoursAgo(1)}),
+	}
+	s, err := ByName(MostRecentlyCleaned)
+	assert.NoErr(t, err)
+	assert.Equal(t, s.Order(candidates, false), []string{"fresh", "old", "never"}, "ordered clusters")
+}
+
+func TestBinPack(t *testing.T) {
+	candidates := []Candidate{
+		candidate("a-1.7", "1.7.8", false, leases.ClusterStatus{}),
+		candidate("b-1.7", "1.7.8", false, leases.ClusterStatus{}),
+		candidate("c-1.7", "1.7.8", false, leases.ClusterStatus{}),
+		candidate("a-1.6", "1.6.11", false, leases.ClusterStatus{}),
+		candidate("b-1.6", "1.6.11", true, leases.ClusterStatus{}),
+		candidate("a-1.8", "1.8.1", false, leases.ClusterStatus{}),
+		candidate("b-1.8", "1.8.1", false, leases.ClusterStatus{}),
+	}
+	s, err := ByName(BinPack)
+	assert.NoErr(t, err)
+	assert.Equal(t,
+		s.Order(candidates, false),
+		[]string{"a-1.6", "a-1.8", "b-1.8", "a-1.7", "b-1.7", "c-1.7"},
+		"ordered clusters",
+	)
+}
@@ -0,0 +1,251 @@
+package semver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Constraint is a parsed version range, such as ~1.7, >=1.6 <1.8 or 1.7.x. A constraint is a set
+// of alternatives separated by "||", each of which is a set of terms separated by spaces or
+// commas that all must match. Each term is an optional operator (=, !=, >, >=, <, <=, ~ or ^)
+// followed by a version that may be partial (1.7) or contain wildcards (1.7.x, 1.*).
+// A bare version without an operator matches every version it is a prefix of, so 1.7 matches
+// 1.7.8-gke.0. Version suffixes are only compared if the term has one itself
+type Constraint struct {
+	str          string
+	alternatives [][]matcher
+}
+
+type matcher func(Version) bool
+
+// ErrMalformedConstraint is returned whenever a constraint string couldn't be parsed
+type ErrMalformedConstraint struct {
+	constraint string
+	reason     string
+}
+
+// Error is the error interface implementation
+func (e ErrMalformedConstraint) Error() string {
+	return fmt.Sprintf("malformed version constraint %s (%s)", e.constraint, e.reason)
+}
+
+var operators = []string{">=", "<=", "!=", ">", "<", "=", "~", "^"}
+
+// ParseConstraint parses str into a Constraint. Returns nil and an ErrMalformedConstraint if
+// str isn't a valid constraint
+func ParseConstraint(str string) (*Constraint, error) {
+	c := &Constraint{str: str}
+	for _, alt := range strings.Split(str, "||") {
+		terms, err := splitTerms(alt)
+		if err != nil {
+			return nil, ErrMalformedConstraint{constraint: str, reason: err.Error()}
+		}
+		var matchers []matcher
+		for _, term := range terms {
+			m, err := parseTerm(term)
+			if err != nil {
+				return nil, ErrMalformedConstraint{constraint: str, reason: err.Error()}
+			}
+			matchers = append(matchers, m)
+		}
+		c.alternatives = append(c.alternatives, matchers)
+	}
+	return c, nil
+}
+
+// String is the fmt.Stringer interface implementation
+func (c *Constraint) String() string {
+	return c.str
+}
+
+// Check returns true if v satisfies c
+func (c *Constraint) Check(v Version) bool {
+	for _, alt := range c.alternatives {
+		matched := true
+		for _, m := range alt {
+			if !m(v) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckString parses ver and returns true if it satisfies c. Returns false if ver is malformed
+func (c *Constraint) CheckString(ver string) bool {
+	v, err := Parse(ver)
+	if err != nil {
+		return false
+	}
+	return c.Check(v)
+}
+
+// splitTerms splits an alternative into its terms, rejoining operators that were separated from
+// their version by a space (i.e. ">= 1.6")
+func splitTerms(alt string) ([]string, error) {
+	fields := strings.Fields(strings.Replace(alt, ",", " ", -1))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty range")
+	}
+	var terms []string
+	for i := 0; i < len(fields); i++ {
+		if isOperator(fields[i]) {
+			if i+1 >= len(fields) {
+				return nil, fmt.Errorf("operator %s has no version", fields[i])
+			}
+			terms = append(terms, fields[i]+fields[i+1])
+			i++
+			continue
+		}
+		terms = append(terms, fields[i])
+	}
+	return terms, nil
+}
+
+func isOperator(s string) bool {
+	for _, op := range operators {
+		if s == op {
+			return true
+		}
+	}
+	return false
+}
+
+// partial is a version whose trailing components may be unspecified. n is the number of
+// specified components, which are held in v. The unspecified ones are 0 in v
+type partial struct {
+	v Version
+	n int
+}
+
+// bump returns the lowest version that is higher than every version p is a prefix of, looking
+// only at the first n components
+func (p partial) bump(n int) Version {
+	switch n {
+	case 1:
+		return Version{Major: p.v.Major + 1}
+	case 2:
+		return Version{Major: p.v.Major, Minor: p.v.Minor + 1}
+	default:
+		return Version{Major: p.v.Major, Minor: p.v.Minor, Patch: p.v.Patch + 1}
+	}
+}
+
+func parsePartial(str string) (partial, error) {
+	nums, suffix := splitSuffix(strings.TrimPrefix(str, "v"))
+	parts := strings.Split(nums, ".")
+	if len(parts) > 3 {
+		return partial{}, fmt.Errorf("version %s has too many components", str)
+	}
+	var ints [3]int
+	n := 0
+	for _, part := range parts {
+		if part == "x" || part == "X" || part == "*" {
+			break
+		}
+		i, err := strconv.Atoi(part)
+		if err != nil || i < 0 {
+			return partial{}, fmt.Errorf("invalid version component %q in %s", part, str)
+		}
+		ints[n] = i
+		n++
+	}
+	if suffix != "" && n < 3 {
+		return partial{}, fmt.Errorf("version %s has a suffix but no patch number", str)
+	}
+	return partial{v: Version{Major: ints[0], Minor: ints[1], Patch: ints[2], Suffix: suffix}, n: n}, nil
+}
+
+func parseTerm(term string) (matcher, error) {
+	op := ""
+	for _, candidate := range operators {
+		if strings.HasPrefix(term, candidate) {
+			op = candidate
+			break
+		}
+	}
+	p, err := parsePartial(term[len(op):])
+	if err != nil {
+		return nil, err
+	}
+	cmp := func(v, o Version) int { return v.compareNumbers(o) }
+	if p.v.Suffix != "" {
+		cmp = func(v, o Version) int { return v.Compare(o) }
+	}
+	lower := p.v
+	matchAll := func(Version) bool { return true }
+	inRange := func(low, high Version) matcher {
+		return func(v Version) bool { return cmp(v, low) >= 0 && cmp(v, high) < 0 }
+	}
+
+	switch op {
+	case "", "=":
+		if p.n == 0 {
+			return matchAll, nil
+		}
+		if p.n == 3 {
+			return func(v Version) bool { return cmp(v, lower) == 0 }, nil
+		}
+		return inRange(lower, p.bump(p.n)), nil
+	case "!=":
+		if p.n == 0 {
+			return func(Version) bool { return false }, nil
+		}
+		if p.n == 3 {
+			return func(v Version) bool { return cmp(v, lower) != 0 }, nil
+		}
+		excluded := inRange(lower, p.bump(p.n))
+		return func(v Version) bool { return !excluded(v) }, nil
+	case ">":
+		if p.n == 0 {
+			return func(Version) bool { return false }, nil
+		}
+		if p.n == 3 {
+			return func(v Version) bool { return cmp(v, lower) > 0 }, nil
+		}
+		high := p.bump(p.n)
+		return func(v Version) bool { return cmp(v, high) >= 0 }, nil
+	case ">=":
+		return func(v Version) bool { return cmp(v, lower) >= 0 }, nil
+	case "<":
+		if p.n == 0 {
+			return func(Version) bool { return false }, nil
+		}
+		return func(v Version) bool { return cmp(v, lower) < 0 }, nil
+	case "<=":
+		if p.n == 0 {
+			return matchAll, nil
+		}
+		if p.n == 3 {
+			return func(v Version) bool { return cmp(v, lower) <= 0 }, nil
+		}
+		high := p.bump(p.n)
+		return func(v Version) bool { return cmp(v, high) < 0 }, nil
+	case "~":
+		switch p.n {
+		case 0:
+			return matchAll, nil
+		case 1:
+			return inRange(lower, p.bump(1)), nil
+		default:
+			return inRange(lower, p.bump(2)), nil
+		}
+	case "^":
+		switch {
+		case p.n == 0:
+			return matchAll, nil
+		case p.v.Major > 0 || p.n == 1:
+			return inRange(lower, p.bump(1)), nil
+		case p.v.Minor > 0 || p.n == 2:
+			return inRange(lower, p.bump(2)), nil
+		default:
+			return inRange(lower, p.bump(3)), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown operator in %s", term)
+}
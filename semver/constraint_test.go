@@ -0,0 +1,61 @@
+package semver
+
+import (
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+type constraintTestCase struct {
+	constraint string
+	version    string
+	matches    bool
+}
+
+func TestConstraintCheck(t *testing.T) {
+	testCases := []constraintTestCase{
+		{constraint: "1.7", version: "1.7.8-gke.0", matches: true},
+		{constraint: "1.7", version: "1.8.0", matches: false},
+		{constraint: "1.7.x", version: "1.7.0", matches: true},
+		{constraint: "1.*", version: "1.9.2", matches: true},
+		{constraint: "1.7.8", version: "1.7.8-gke.0", matches: true},
+		{constraint: "1.7.8-gke.0", version: "1.7.8-gke.1", matches: false},
+		{constraint: "1.7.8-gke.1", version: "1.7.8-gke.1", matches: true},
+		{constraint: "~1.7", version: "1.7.12", matches: true},
+		{constraint: "~1.7.3", version: "1.7.2", matches: false},
+		{constraint: "~1.7.3", version: "1.8.0", matches: false},
+		{constraint: "^1.6", version: "1.9.0", matches: true},
+		{constraint: "^1.6", version: "2.0.0", matches: false},
+		{constraint: ">=1.6 <1.8", version: "1.6.0", matches: true},
+		{constraint: ">=1.6 <1.8", version: "1.7.8-gke.0", matches: true},
+		{constraint: ">=1.6 <1.8", version: "1.8.0-gke.0", matches: false},
+		{constraint: ">= 1.6, < 1.8", version: "1.5.7", matches: false},
+		{constraint: ">1.6", version: "1.6.4", matches: false},
+		{constraint: ">1.6", version: "1.7.0", matches: true},
+		{constraint: "<=1.7", version: "1.7.9", matches: true},
+		{constraint: "!=1.7", version: "1.7.9", matches: false},
+		{constraint: "!=1.7", version: "1.6.9", matches: true},
+		{constraint: "1.5 || 1.7", version: "1.7.2", matches: true},
+		{constraint: "1.5 || 1.7", version: "1.6.2", matches: false},
+		{constraint: "*", version: "1.6.2", matches: true},
+		{constraint: "1.7", version: "v1.7.2", matches: true},
+		{constraint: "1.7", version: "not a version", matches: false},
+	}
+	for _, testCase := range testCases {
+		c, err := ParseConstraint(testCase.constraint)
+		assert.NoErr(t, err)
+		assert.Equal(t,
+			c.CheckString(testCase.version),
+			testCase.matches,
+			testCase.constraint+" matching "+testCase.version,
+		)
+	}
+}
+
+func TestParseConstraintMalformed(t *testing.T) {
+	for _, str := range []string{"", ">=", "1.a", "1.2.3.4", "1.7-gke.0", ">=1.6 ||"} {
+		c, err := ParseConstraint(str)
+		assert.Nil(t, c, "constraint for "+str)
+		assert.True(t, err != nil, "no error returned for malformed constraint %s", str)
+	}
+}
@@ -0,0 +1,38 @@
+package semver
+
+// Named pairs a version with a name, such as the name of the cluster that runs it
+type Named struct {
+	Name    string
+	Version Version
+}
+
+// ByVersionDesc is a sort.Interface implementation that orders Named values from the highest
+// version to the lowest. Equal versions are ordered by name, so that the order is stable
+type ByVersionDesc []Named
+
+// Len is the sort.Interface implementation
+func (b ByVersionDesc) Len() int {
+	return len(b)
+}
+
+// Less is the sort.Interface implementation
+func (b ByVersionDesc) Less(i, j int) bool {
+	if c := b[i].Version.Compare(b[j].Version); c != 0 {
+		return c > 0
+	}
+	return b[i].Name < b[j].Name
+}
+
+// Swap is the sort.Interface implementation
+func (b ByVersionDesc) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+
+// Names returns the names in b, in order
+func (b ByVersionDesc) Names() []string {
+	ret := make([]string, len(b))
+	for i, named := range b {
+		ret[i] = named.Name
+	}
+	return ret
+}
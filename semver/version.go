@@ -0,0 +1,113 @@
+package semver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a parsed Kubernetes version. Kubernetes providers append their own suffixes to
+// versions (i.e. GKE reports 1.7.8-gke.0), so everything after the patch number is kept in
+// Suffix and ignored when versions are matched against ranges
+type Version struct {
+	Major  int
+	Minor  int
+	Patch  int
+	Suffix string
+}
+
+// ErrMalformedVersion is returned whenever a version string couldn't be parsed
+type ErrMalformedVersion struct {
+	ver string
+}
+
+// Error is the error interface implementation
+func (e ErrMalformedVersion) Error() string {
+	return fmt.Sprintf("malformed version %s", e.ver)
+}
+
+// Parse parses a full version string such as 1.7.8, v1.6.6 or 1.7.8-gke.0. Returns an
+// ErrMalformedVersion if ver doesn't have major, minor and patch numbers
+func Parse(ver string) (Version, error) {
+	nums, suffix := splitSuffix(strings.TrimPrefix(strings.TrimSpace(ver), "v"))
+	parts := strings.Split(nums, ".")
+	if len(parts) != 3 {
+		return Version{}, ErrMalformedVersion{ver: ver}
+	}
+	var ints [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return Version{}, ErrMalformedVersion{ver: ver}
+		}
+		ints[i] = n
+	}
+	return Version{Major: ints[0], Minor: ints[1], Patch: ints[2], Suffix: suffix}, nil
+}
+
+// String is the fmt.Stringer interface implementation
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d%s", v.Major, v.Minor, v.Patch, v.Suffix)
+}
+
+// Compare returns -1, 0 or 1 if v is lower than, equal to or higher than o. Suffixes are
+// compared last, so that 1.7.8-gke.1 is higher than 1.7.8-gke.0
+func (v Version) Compare(o Version) int {
+	if c := compareInts(v.Major, o.Major); c != 0 {
+		return c
+	}
+	if c := compareInts(v.Minor, o.Minor); c != 0 {
+		return c
+	}
+	if c := compareInts(v.Patch, o.Patch); c != 0 {
+		return c
+	}
+	return compareSuffixes(v.Suffix, o.Suffix)
+}
+
+// compareNumbers compares only the major, minor and patch numbers of v and o
+func (v Version) compareNumbers(o Version) int {
+	return Version{Major: v.Major, Minor: v.Minor, Patch: v.Patch}.Compare(Version{Major: o.Major, Minor: o.Minor, Patch: o.Patch})
+}
+
+// splitSuffix splits ver at the first '-' or '+' character
+func splitSuffix(ver string) (string, string) {
+	if i := strings.IndexAny(ver, "-+"); i >= 0 {
+		return ver[:i], ver[i:]
+	}
+	return ver, ""
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareSuffixes compares the '.' separated identifiers of a and b one by one, numerically if
+// both are numbers and lexically otherwise
+func compareSuffixes(a, b string) int {
+	if a == b {
+		return 0
+	}
+	aIDs := strings.Split(strings.TrimLeft(a, "-+"), ".")
+	bIDs := strings.Split(strings.TrimLeft(b, "-+"), ".")
+	for i := 0; i < len(aIDs) && i < len(bIDs); i++ {
+		aNum, aErr := strconv.Atoi(aIDs[i])
+		bNum, bErr := strconv.Atoi(bIDs[i])
+		if aErr == nil && bErr == nil {
+			if c := compareInts(aNum, bNum); c != 0 {
+				return c
+			}
+			continue
+		}
+		if c := strings.Compare(aIDs[i], bIDs[i]); c != 0 {
+			return c
+		}
+	}
+	return compareInts(len(aIDs), len(bIDs))
+}
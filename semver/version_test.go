@@ -0,0 +1,30 @@
+package semver
+
+import (
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+func TestParse(t *testing.T) {
+	v, err := Parse("v1.7.8-gke.0")
+	assert.NoErr(t, err)
+	assert.Equal(t, v, Version{Major: 1, Minor: 7, Patch: 8, Suffix: "-gke.0"}, "parsed version")
+	assert.Equal(t, v.String(), "1.7.8-gke.0", "version string")
+
+	_, err = Parse("1.7")
+	assert.Err(t, ErrMalformedVersion{ver: "1.7"}, err)
+}
+
+func TestCompare(t *testing.T) {
+	ordered := []string{"1.6.13", "1.7.8", "1.7.8-gke.0", "1.7.8-gke.1", "1.7.8-gke.10", "1.8.0"}
+	for i := 1; i < len(ordered); i++ {
+		lower, err := Parse(ordered[i-1])
+		assert.NoErr(t, err)
+		higher, err := Parse(ordered[i])
+		assert.NoErr(t, err)
+		assert.Equal(t, lower.Compare(higher), -1, ordered[i-1]+" compared to "+ordered[i])
+		assert.Equal(t, higher.Compare(lower), 1, ordered[i]+" compared to "+ordered[i-1])
+		assert.Equal(t, higher.Compare(higher), 0, ordered[i]+" compared to itself")
+	}
+}